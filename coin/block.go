@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"firstcoin/repository"
 	"firstcoin/utils"
 	"firstcoin/wallet"
@@ -12,6 +13,10 @@ import (
 	"time"
 )
 
+// ErrBlockTimestamp is a block timestamp that is not after the previous block's or too far in the future. A node with its
+// clock off makes such blocks too, so they are no proof the node that relayed them is misbehaving.
+var ErrBlockTimestamp = errors.New("invalid block timestamp")
+
 type Block struct {
 	Index           int                      `json:"index"`
 	PreviousHash    []byte                   `json:"previousHash"`
@@ -23,10 +28,13 @@ type Block struct {
 }
 
 func calculateBlockHash(index int, previousHash []byte, timestamp int, transactions []repository.Transaction, difficultyLevel int) ([]byte, error) {
+	// TODO: Does POW hash calculation contain transactions??
+	return calculateBlockHashFromTxs(index, previousHash, timestamp, concatTransactionIDs(transactions), difficultyLevel)
+}
+
+func calculateBlockHashFromTxs(index int, previousHash []byte, timestamp int, concatenatedTransactionIDs []byte, difficultyLevel int) ([]byte, error) {
 	msgHash := sha256.New()
 
-	// TODO: Does POW hash calculation contain transactions??
-	concatenatedTransactionIDs := concatTransactionIDs(transactions)
 	_, err := msgHash.Write([]byte(fmt.Sprintf("%d%s%d%s%d", index, string(previousHash), timestamp, concatenatedTransactionIDs, difficultyLevel)))
 	if err != nil {
 		return nil, err
@@ -71,7 +79,28 @@ func (b *Block) IsGenesisBlock() error {
 	return nil
 }
 
-func (b *Block) IsValidBlock(previousBlock Block) error {
+// CheckProofOfWork checks that the block hashes to its hash and that the hash meets its difficulty level, which is all
+// that can be checked of a block without its parent
+func (b *Block) CheckProofOfWork() error {
+	hash, err := calculateBlockHash(b.Index, b.PreviousHash, b.Timestamp, b.Transactions, b.DifficultyLevel)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(hash, b.Hash) {
+		return fmt.Errorf("Invalid block: %s", "invalid block hash")
+	}
+
+	if !ValidateProofOfWork(b.Hash, b.Nonce, b.DifficultyLevel) {
+		return fmt.Errorf("Invalid block: %s", "invalid pow")
+	}
+
+	return nil
+}
+
+// IsValidBlock validates the block on top of previousBlock under params, with its transactions spending from uTxOSet,
+// which is left untouched
+func (b *Block) IsValidBlock(previousBlock Block, uTxOSet repository.UTxOSetType, params ChainParams) error {
 	if previousBlock.Index+1 != b.Index {
 		return fmt.Errorf("Invalid block: %s", "invalid index")
 	}
@@ -97,17 +126,25 @@ func (b *Block) IsValidBlock(previousBlock Block) error {
 	}
 
 	if b.Timestamp <= previousBlock.Timestamp {
-		return fmt.Errorf("Invalid block: %s", "invalid timestamps")
+		return fmt.Errorf("Invalid block: %w, not after the previous block", ErrBlockTimestamp)
+	}
+
+	if err := params.CheckBlockLimits(*b); err != nil {
+		return fmt.Errorf("Invalid block: %s. error: %s", "exceeds limits", err.Error())
 	}
 
-	if err := wallet.AreValidTransactions(b.Transactions); err != nil {
+	if err := wallet.AreValidTransactions(b.Transactions, uTxOSet, params.ScriptFlags(b.Index)); err != nil {
 		return fmt.Errorf("Invalid block: %s. error: %s", "invalid transactions", err.Error())
 	}
 
+	if err := wallet.AreTransactionsFinal(b.Transactions, uTxOSet, b.Index, b.Timestamp); err != nil {
+		return fmt.Errorf("Invalid block: %s. error: %s", "non-final transactions", err.Error())
+	}
+
 	// validate that the current block's timestamp isnt more than 10s in the future - we allow a certain error in time registration
 	// need to be careful with this value and time to mine a block
 	if b.Timestamp > int(time.Now().UnixNano())+10*NANO_SECONDS {
-		return fmt.Errorf("Invalid block: %s", "invalid block timestamp")
+		return fmt.Errorf("Invalid block: %w, too far in the future", ErrBlockTimestamp)
 	}
 
 	return nil
@@ -179,17 +216,30 @@ func hashBytes(blockString []byte) string {
 
 // a SHA version of a transaction is a concatenation of all transaction IDs and all transaction input signatures
 func concatTransactionIDs(transactions []repository.Transaction) []byte {
-	concatTransaction := []byte{}
-
+	txCommitments := make([][]byte, 0, len(transactions))
 	for _, transaction := range transactions {
-		concatTxInSignatures := []byte{}
-		for _, txIn := range transaction.TxIns {
-			concatTxInSignatures = append(concatTxInSignatures, txIn.ScriptSignature...)
-		}
+		txCommitments = append(txCommitments, txCommitment(transaction))
+	}
+
+	return hashTxCommitments(txCommitments)
+}
 
-		concatTransaction = append(concatTransaction, transaction.ID...)
-		concatTransaction = append(concatTransaction, concatTxInSignatures...)
+// the part of the block hash contributed by a single transaction: its ID followed by its input signatures
+func txCommitment(transaction repository.Transaction) []byte {
+	concatTransaction := append([]byte{}, transaction.ID...)
+	for _, txIn := range transaction.TxIns {
+		concatTransaction = append(concatTransaction, txIn.ScriptSignature...)
 	}
+
+	return concatTransaction
+}
+
+func hashTxCommitments(txCommitments [][]byte) []byte {
+	concatTransaction := []byte{}
+	for _, commitment := range txCommitments {
+		concatTransaction = append(concatTransaction, commitment...)
+	}
+
 	msgHash := sha256.New()
 	_, err := msgHash.Write(concatTransaction)
 	if err != nil {
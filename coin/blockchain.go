@@ -1,8 +1,12 @@
 package coin
 
 import (
+	"bytes"
+	"encoding/json"
 	"firstcoin/repository"
+	"firstcoin/wallet"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -10,62 +14,146 @@ const (
 	BLOCK_GENERATION_INTERVAL      = 20         //seconds
 	DIFFICULTY_ADJUSTMENT_INTERVAL = 10         //seconds
 	NANO_SECONDS                   = 1000000000 //number of nanoseconds in 1 second
+	MIN_DIFFICULTY_LEVEL           = 1          //difficulty is never adjusted below this level
 )
 
+// Blockchain is safe for concurrent use. Its blocks are only reached through its methods, which return copies of the
+// block list. Its params are set when it is created and never change.
 type Blockchain struct {
-	Blocks []Block `json:"blocks"`
+	mu     sync.RWMutex
+	blocks []Block
+	params ChainParams
 }
 
-func NewBlockchain(b []Block) *Blockchain {
+func NewBlockchain(b []Block, params ChainParams) *Blockchain {
 	return &Blockchain{
-		Blocks: b,
+		blocks: b,
+		params: params,
 	}
 }
 
+// Params are the consensus params the blocks of the chain are validated with
+func (b *Blockchain) Params() ChainParams {
+	return b.params
+}
+
+// blockchainJSON is how a blockchain is sent between peers
+type blockchainJSON struct {
+	Blocks []Block `json:"blocks"`
+}
+
+func (b *Blockchain) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blockchainJSON{Blocks: b.GetBlocks()})
+}
+
+func (b *Blockchain) UnmarshalJSON(data []byte) error {
+	bc := blockchainJSON{}
+	if err := json.Unmarshal(data, &bc); err != nil {
+		return err
+	}
+
+	b.SetBlockchain(bc.Blocks)
+	return nil
+}
+
 func (b *Blockchain) AddBlock(bl Block) {
-	b.Blocks = append(b.Blocks, bl)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocks = append(b.blocks, bl)
 }
 
 func (b *Blockchain) GetLastBlock() Block {
-	return b.Blocks[len(b.Blocks)-1]
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.blocks[len(b.blocks)-1]
+}
+
+// GetBlocks returns a copy of the block list
+func (b *Blockchain) GetBlocks() []Block {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return append([]Block{}, b.blocks...)
+}
+
+// GetBlockByHash returns the block of the chain with hash
+func (b *Blockchain) GetBlockByHash(hash []byte) (Block, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for i := len(b.blocks) - 1; i >= 0; i-- {
+		if bytes.Equal(b.blocks[i].Hash, hash) {
+			return b.blocks[i], true
+		}
+	}
+
+	return Block{}, false
+}
+
+func (b *Blockchain) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.blocks)
 }
 
 func (b *Blockchain) SetBlockchain(blocks []Block) {
-	b.Blocks = blocks
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocks = blocks
 }
 
 func (b *Blockchain) GenerateNextBlock(transactionPool *[]repository.Transaction) (Block, error) {
-	previousBlock := b.GetLastBlock()
-	currentDifficultyLevel := b.getDifficultyLevel()
+	blocks := b.GetBlocks()
+	previousBlock := blocks[len(blocks)-1]
+	currentDifficultyLevel := getDifficultyLevel(blocks)
 	now := int(time.Now().UnixNano())
 	hash, err := calculateBlockHash(previousBlock.Index+1, previousBlock.Hash, now, *transactionPool, currentDifficultyLevel)
 	if err != nil {
 		return Block{}, err
 	}
-	nonce := ProofOfWork(hash, currentDifficultyLevel)
 
-	return Block{
+	block := Block{
 		Index:           previousBlock.Index + 1,
 		PreviousHash:    previousBlock.Hash,
 		Transactions:    *transactionPool,
 		Timestamp:       now,
 		Hash:            hash,
-		Nonce:           nonce,
 		DifficultyLevel: currentDifficultyLevel,
-	}, nil
+	}
+
+	// no point in mining a block that breaks the limits
+	if err := b.params.CheckBlockLimits(block); err != nil {
+		return Block{}, err
+	}
+	block.Nonce = ProofOfWork(hash, currentDifficultyLevel)
+
+	return block, nil
 }
 
-// Always favour the chain with the most work - it is sufficient to check the DifficultyLevel attribute on the block because this is validated in the IsValidBlock method
-func (b *Blockchain) ReplaceBlockchain(bc Blockchain) {
-	if bc.cumulativeDifficulty() > b.cumulativeDifficulty() {
-		b.SetBlockchain(bc.Blocks)
+// Always favour the chain with the most work - it is sufficient to check the DifficultyLevel attribute on the block because this is validated in the IsValidBlock method.
+// It returns whether the chain was replaced.
+func (b *Blockchain) ReplaceBlockchain(bc *Blockchain) bool {
+	blocks := bc.GetBlocks()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if CumulativeDifficulty(blocks) > CumulativeDifficulty(b.blocks) {
+		b.blocks = blocks
+		return true
 	}
+
+	return false
 }
 
-// calculate the difficulty of the block chain
-func (b *Blockchain) cumulativeDifficulty() int {
+// CumulativeDifficulty is the work of a chain of blocks, the sum of their difficulty levels
+func CumulativeDifficulty(blocks []Block) int {
 	cumulativeDifficulty := 0
-	for _, block := range b.Blocks {
+	for _, block := range blocks {
 		cumulativeDifficulty += block.DifficultyLevel
 	}
 
@@ -74,29 +162,47 @@ func (b *Blockchain) cumulativeDifficulty() int {
 
 // Difficulty level is decreased by 1 if time between last 10 blocks > 200s (twice DIFFICULTY_ADJUSTMENT_INTERVAL * BLOCK_GENERATION_INTERVAL),
 // and increased by 1 if time < 50s (half DIFFICULTY_ADJUSTMENT_INTERVAL * BLOCK_GENERATION_INTERVAL). This keeps it roughly 100s for 10 blocks
-func (b *Blockchain) getDifficultyLevel() int {
-	if b.GetLastBlock().Index%DIFFICULTY_ADJUSTMENT_INTERVAL == 0 && b.GetLastBlock().Index != 0 {
-		fmt.Println((b.GetLastBlock().Timestamp - b.Blocks[len(b.Blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) / NANO_SECONDS)
-		if (b.GetLastBlock().Timestamp - b.Blocks[len(b.Blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) >= 2*DIFFICULTY_ADJUSTMENT_INTERVAL*BLOCK_GENERATION_INTERVAL*NANO_SECONDS {
-			return b.GetLastBlock().DifficultyLevel - 1
+func getDifficultyLevel(blocks []Block) int {
+	lastBlock := blocks[len(blocks)-1]
+	if lastBlock.Index%DIFFICULTY_ADJUSTMENT_INTERVAL == 0 && lastBlock.Index != 0 {
+		fmt.Println((lastBlock.Timestamp - blocks[len(blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) / NANO_SECONDS)
+		if (lastBlock.Timestamp-blocks[len(blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) >= 2*DIFFICULTY_ADJUSTMENT_INTERVAL*BLOCK_GENERATION_INTERVAL*NANO_SECONDS && lastBlock.DifficultyLevel > MIN_DIFFICULTY_LEVEL {
+			return lastBlock.DifficultyLevel - 1
 		}
-		if (b.GetLastBlock().Timestamp - b.Blocks[len(b.Blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) <= 0.5*DIFFICULTY_ADJUSTMENT_INTERVAL*BLOCK_GENERATION_INTERVAL*NANO_SECONDS {
-			return b.GetLastBlock().DifficultyLevel + 1
+		if (lastBlock.Timestamp - blocks[len(blocks)-DIFFICULTY_ADJUSTMENT_INTERVAL].Timestamp) <= 0.5*DIFFICULTY_ADJUSTMENT_INTERVAL*BLOCK_GENERATION_INTERVAL*NANO_SECONDS {
+			return lastBlock.DifficultyLevel + 1
 		}
 	}
-	return b.GetLastBlock().DifficultyLevel
+	return lastBlock.DifficultyLevel
 }
 
+// IsValidBlockchain validates every block on top of the one before it, with the transactions of the chain replayed on
+// an empty uTxO set
 func (b *Blockchain) IsValidBlockchain() error {
-	if err := b.Blocks[0].IsGenesisBlock(); err != nil {
+	blocks := b.GetBlocks()
+	if len(blocks) == 0 {
+		return fmt.Errorf("Invalid blockchain: %s", "no blocks")
+	}
+
+	if err := blocks[0].IsGenesisBlock(); err != nil {
 		return fmt.Errorf("Invalid blockchain: %s. error: %s", "invalid genesis block", err.Error())
 	}
 
-	for i := 1; i < len(b.Blocks); i++ {
-		if err := b.Blocks[i].IsValidBlock(b.Blocks[i-1]); err != nil {
+	uTxOSet := make(repository.UTxOSetType)
+	applyBlockTransactions(blocks[0], uTxOSet)
+
+	for i := 1; i < len(blocks); i++ {
+		if err := blocks[i].IsValidBlock(blocks[i-1], uTxOSet, b.params); err != nil {
 			return err
 		}
+		applyBlockTransactions(blocks[i], uTxOSet)
 	}
 
 	return nil
 }
+
+func applyBlockTransactions(block Block, uTxOSet repository.UTxOSetType) {
+	for _, tx := range block.Transactions {
+		wallet.ApplyTransactionCopy(tx, uTxOSet, block.Index, block.Timestamp)
+	}
+}
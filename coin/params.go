@@ -0,0 +1,98 @@
+package coin
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"fmt"
+)
+
+const (
+	MAX_BLOCK_SIZE = 1000000 //bytes of a serialized block, header and txs
+	MAX_TX_SIZE    = 100000  //bytes of a serialized tx
+	MAX_BLOCK_TXS  = 10000   //txs in a block, coinbase included
+
+	CHAIN_ID = "firstcoin-main" //peers with other params refuse to connect
+
+	LEGACY_SIGNATURES_UNTIL = 0 //block index from which md5 signatures no longer verify, none on the main chain
+)
+
+// ChainParams are the consensus limits every block and tx must keep to. Blocks below LegacySignaturesUntil may carry
+// md5 signatures, letting a network migrate to SignatureVersionSHA256; from it on only sha256 signatures verify.
+type ChainParams struct {
+	ID                    string
+	MaxBlockSize          int
+	MaxTxSize             int
+	MaxBlockTxs           int
+	LegacySignaturesUntil int
+}
+
+// DefaultChainParams are the params of the main chain
+func DefaultChainParams() ChainParams {
+	return ChainParams{
+		ID:                    CHAIN_ID,
+		MaxBlockSize:          MAX_BLOCK_SIZE,
+		MaxTxSize:             MAX_TX_SIZE,
+		MaxBlockTxs:           MAX_BLOCK_TXS,
+		LegacySignaturesUntil: LEGACY_SIGNATURES_UNTIL,
+	}
+}
+
+// ScriptFlags are the flags the scripts of txs in the block at blockIndex are verified with
+func (p ChainParams) ScriptFlags(blockIndex int) wallet.ScriptFlags {
+	flags := wallet.SCRIPT_VERIFY_NONE
+	if blockIndex < p.LegacySignaturesUntil {
+		flags |= wallet.SCRIPT_VERIFY_LEGACY_SIGNATURES
+	}
+
+	return flags
+}
+
+// CheckTxSize is an error when tx serializes to more than the max tx size
+func (p ChainParams) CheckTxSize(tx repository.Transaction) error {
+	if size := wallet.SerializedSize(tx); size > p.MaxTxSize {
+		return fmt.Errorf("tx %x is %d bytes, more than the max of %d", tx.ID, size, p.MaxTxSize)
+	}
+
+	return nil
+}
+
+// CheckBlockLimits is an error when the block has too many txs, a tx that is too large or serializes to more than the
+// max block size
+func (p ChainParams) CheckBlockLimits(b Block) error {
+	if len(b.Transactions) > p.MaxBlockTxs {
+		return fmt.Errorf("block has %d txs, more than the max of %d", len(b.Transactions), p.MaxBlockTxs)
+	}
+
+	for _, tx := range b.Transactions {
+		if err := p.CheckTxSize(tx); err != nil {
+			return err
+		}
+	}
+
+	if size := b.SerializedSize(); size > p.MaxBlockSize {
+		return fmt.Errorf("block is %d bytes, more than the max of %d", size, p.MaxBlockSize)
+	}
+
+	return nil
+}
+
+// MaxBlockTxsSize is how many bytes of txs fit in a block after its header
+func (p ChainParams) MaxBlockTxsSize(previousHash []byte) int {
+	return p.MaxBlockSize - blockHeaderSize(previousHash)
+}
+
+// SerializedSize is the size of the block header and its txs serialized. The header is the index, timestamp, difficulty
+// level and nonce as 8 bytes each, the previous hash and hash prefixed with their length and the tx count.
+func (b *Block) SerializedSize() int {
+	size := blockHeaderSize(b.PreviousHash)
+	for _, tx := range b.Transactions {
+		size += wallet.SerializedSize(tx)
+	}
+
+	return size
+}
+
+// blockHeaderSize is the serialized size of a header with a sha256 hash of its own
+func blockHeaderSize(previousHash []byte) int {
+	return 4*8 + 4 + len(previousHash) + 4 + 32 + 4
+}
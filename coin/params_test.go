@@ -0,0 +1,90 @@
+package coin_test
+
+import (
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestChainParams(test *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+	dataTx := repository.Transaction{
+		TxOuts: []repository.TxO{{ScriptPubKey: wallet.NewDataCarrierLockingScript(make([]byte, 80)).Encode()}},
+	}
+	dataTx.ID = wallet.GenerateTransactionID(dataTx)
+
+	block, err := coin.GenesisBlock(1, []repository.Transaction{coinbaseTx, dataTx})
+	if err != nil {
+		test.Fatalf("unexpected error: %+v", err)
+	}
+
+	test.Run("accepts a block within the limits", func(t *testing.T) {
+		if err := coin.DefaultChainParams().CheckBlockLimits(block); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+	})
+
+	test.Run("rejects too many txs", func(t *testing.T) {
+		params := coin.DefaultChainParams()
+		params.MaxBlockTxs = 1
+
+		if err := params.CheckBlockLimits(block); err == nil {
+			t.Fatalf("expected an error for a block with 2 txs")
+		}
+	})
+
+	test.Run("rejects a tx that is too large", func(t *testing.T) {
+		params := coin.DefaultChainParams()
+		params.MaxTxSize = wallet.SerializedSize(dataTx) - 1
+
+		if err := params.CheckTxSize(dataTx); err == nil {
+			t.Fatalf("expected an error for a tx over the max tx size")
+		}
+		if err := params.CheckBlockLimits(block); err == nil {
+			t.Fatalf("expected an error for a block with a tx over the max tx size")
+		}
+	})
+
+	test.Run("rejects a block that is too large", func(t *testing.T) {
+		params := coin.DefaultChainParams()
+		params.MaxBlockSize = block.SerializedSize() - 1
+
+		if err := params.CheckBlockLimits(block); err == nil {
+			t.Fatalf("expected an error for a block over the max block size")
+		}
+
+		params.MaxBlockSize = block.SerializedSize()
+		if err := params.CheckBlockLimits(block); err != nil {
+			t.Fatalf("expected a block of exactly the max block size to be valid: %+v", err)
+		}
+	})
+
+	test.Run("does not mine a block over the limits", func(t *testing.T) {
+		params := coin.DefaultChainParams()
+		params.MaxBlockTxs = 1
+
+		blockchain := coin.NewBlockchain([]coin.Block{block}, params)
+		if _, err := blockchain.GenerateNextBlock(&[]repository.Transaction{coinbaseTx, dataTx}); err == nil {
+			t.Fatalf("expected an error generating a block over the limits")
+		}
+	})
+
+	test.Run("verifies legacy signatures only below their activation height", func(t *testing.T) {
+		params := coin.DefaultChainParams()
+		if params.ScriptFlags(1) != wallet.SCRIPT_VERIFY_NONE {
+			t.Fatalf("expected the default params to refuse legacy signatures")
+		}
+
+		params.LegacySignaturesUntil = 10
+		if params.ScriptFlags(9)&wallet.SCRIPT_VERIFY_LEGACY_SIGNATURES == 0 {
+			t.Fatalf("expected legacy signatures to verify below the activation height")
+		}
+		if params.ScriptFlags(10) != wallet.SCRIPT_VERIFY_NONE {
+			t.Fatalf("incorrect script flags. Got: %d. Want: %d", params.ScriptFlags(10), wallet.SCRIPT_VERIFY_NONE)
+		}
+	})
+}
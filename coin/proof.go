@@ -0,0 +1,115 @@
+package coin
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"fmt"
+)
+
+// InclusionProof shows that a transaction is part of a block without the rest of the block's transactions. A block hash
+// commits to every transaction through the hash of their concatenated IDs and input signatures, so the proof carries
+// those per-transaction commitments together with the block header they hash into.
+type InclusionProof struct {
+	BlockIndex      int                    `json:"blockIndex"`
+	PreviousHash    []byte                 `json:"previousHash"`
+	Timestamp       int                    `json:"timestamp"`
+	DifficultyLevel int                    `json:"difficultyLevel"`
+	Nonce           int                    `json:"nonce"`
+	BlockHash       []byte                 `json:"blockHash"`
+	TxCommitments   [][]byte               `json:"txCommitments"`
+	TxIndex         int                    `json:"txIndex"`
+	Tx              repository.Transaction `json:"tx"`
+}
+
+// ProveTransactionInclusion builds the inclusion proof of the transaction with txID
+func (b *Blockchain) ProveTransactionInclusion(txID []byte) (InclusionProof, error) {
+	for _, block := range b.GetBlocks() {
+		for index, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txID) {
+				return newInclusionProof(block, index), nil
+			}
+		}
+	}
+
+	return InclusionProof{}, fmt.Errorf("tx %x is not in the blockchain", txID)
+}
+
+// ProveDataCommitment builds the inclusion proof of the first transaction whose data carrier output anchors data
+func (b *Blockchain) ProveDataCommitment(data []byte) (InclusionProof, error) {
+	for _, block := range b.GetBlocks() {
+		for index, tx := range block.Transactions {
+			for _, txO := range tx.TxOuts {
+				if payload, ok := wallet.DataCarrierPayload(txO.ScriptPubKey); ok && bytes.Equal(payload, data) {
+					return newInclusionProof(block, index), nil
+				}
+			}
+		}
+	}
+
+	return InclusionProof{}, fmt.Errorf("data %x is not committed in the blockchain", data)
+}
+
+func newInclusionProof(block Block, txIndex int) InclusionProof {
+	txCommitments := make([][]byte, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		txCommitments = append(txCommitments, txCommitment(tx))
+	}
+
+	return InclusionProof{
+		BlockIndex:      block.Index,
+		PreviousHash:    block.PreviousHash,
+		Timestamp:       block.Timestamp,
+		DifficultyLevel: block.DifficultyLevel,
+		Nonce:           block.Nonce,
+		BlockHash:       block.Hash,
+		TxCommitments:   txCommitments,
+		TxIndex:         txIndex,
+		Tx:              block.Transactions[txIndex],
+	}
+}
+
+// Verify checks that the proof's transaction hashes into the proof's block hash and that the block has valid proof of
+// work. It is up to the verifier to check that BlockHash is on the chain it trusts, eg. with VerifyInclusionProof.
+func (p InclusionProof) Verify() error {
+	if p.TxIndex < 0 || p.TxIndex >= len(p.TxCommitments) {
+		return fmt.Errorf("invalid proof: tx index %d out of range", p.TxIndex)
+	}
+
+	if !bytes.Equal(wallet.GenerateTransactionID(p.Tx), p.Tx.ID) {
+		return fmt.Errorf("invalid proof: tx id does not match the tx")
+	}
+
+	if !bytes.Equal(txCommitment(p.Tx), p.TxCommitments[p.TxIndex]) {
+		return fmt.Errorf("invalid proof: tx is not at index %d", p.TxIndex)
+	}
+
+	hash, err := calculateBlockHashFromTxs(p.BlockIndex, p.PreviousHash, p.Timestamp, hashTxCommitments(p.TxCommitments), p.DifficultyLevel)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hash, p.BlockHash) {
+		return fmt.Errorf("invalid proof: tx commitments do not hash to the block hash")
+	}
+
+	if !ValidateProofOfWork(p.BlockHash, p.Nonce, p.DifficultyLevel) {
+		return fmt.Errorf("invalid proof: invalid pow")
+	}
+
+	return nil
+}
+
+// VerifyInclusionProof verifies the proof and that its block is part of this blockchain
+func (b *Blockchain) VerifyInclusionProof(p InclusionProof) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+
+	blocks := b.GetBlocks()
+	if p.BlockIndex < 0 || p.BlockIndex >= len(blocks) || !bytes.Equal(blocks[p.BlockIndex].Hash, p.BlockHash) {
+		return fmt.Errorf("invalid proof: block %x is not in the blockchain", p.BlockHash)
+	}
+
+	return nil
+}
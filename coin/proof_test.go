@@ -0,0 +1,58 @@
+package coin_test
+
+import (
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestInclusionProof(test *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+	data := wallet.CommitmentHash([]byte("my document"))
+	dataTx := repository.Transaction{
+		TxOuts: []repository.TxO{{ScriptPubKey: wallet.NewDataCarrierLockingScript(data).Encode()}},
+	}
+	dataTx.ID = wallet.GenerateTransactionID(dataTx)
+
+	block, err := coin.GenesisBlock(1, []repository.Transaction{coinbaseTx, dataTx})
+	if err != nil {
+		test.Fatalf("unexpected error: %+v", err)
+	}
+	blockchain := coin.NewBlockchain([]coin.Block{block}, coin.DefaultChainParams())
+
+	test.Run("commitment proof verifies", func(t *testing.T) {
+		proof, err := blockchain.ProveDataCommitment(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if proof.TxIndex != 1 {
+			t.Fatalf("incorrect tx index. Got: %d. Want: %d", proof.TxIndex, 1)
+		}
+
+		if err := blockchain.VerifyInclusionProof(proof); err != nil {
+			t.Fatalf("expected valid proof: %+v", err)
+		}
+	})
+
+	test.Run("unknown commitment", func(t *testing.T) {
+		if _, err := blockchain.ProveDataCommitment([]byte("other")); err == nil {
+			t.Fatalf("expected error for data that was never published")
+		}
+	})
+
+	test.Run("tampered proof is rejected", func(t *testing.T) {
+		proof, _ := blockchain.ProveTransactionInclusion(dataTx.ID)
+
+		proof.Tx.TxOuts[0].ScriptPubKey = wallet.NewDataCarrierLockingScript([]byte("forged")).Encode()
+		proof.Tx.ID = wallet.GenerateTransactionID(proof.Tx)
+
+		if err := proof.Verify(); err == nil {
+			t.Fatalf("expected error for a forged tx")
+		}
+	})
+}
@@ -2,10 +2,10 @@ module firstcoin
 
 go 1.17
 
-require golang.org/x/crypto v0.0.0-20220214200702-86341886e292
-
 require (
-	github.com/btcsuite/btcd v0.20.1-beta // indirect
-	github.com/btcsuite/btcutil v1.0.2 // indirect
-	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
+	github.com/btcsuite/btcutil v1.0.2
+	github.com/cenkalti/backoff/v4 v4.1.3
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
+
+require github.com/btcsuite/btcd v0.20.1-beta // indirect
@@ -9,10 +9,153 @@ import (
 	"firstcoin/wallet"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const seedHost = "firstcoin-node1:8080"
 
+// seedHostsFromEnv reads the comma separated seed hosts from SEED_HOSTS, by default seedHost
+func seedHostsFromEnv() []string {
+	seeds := make([]string, 0)
+	for _, seed := range strings.Split(os.Getenv("SEED_HOSTS"), ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	if len(seeds) == 0 {
+		return []string{seedHost}
+	}
+
+	return seeds
+}
+
+// peersFileFromEnv reads the file the peer addresses are saved to from PEERS_FILE, by default peers-<port>.json
+func peersFileFromEnv(port string) string {
+	if path := os.Getenv("PEERS_FILE"); path != "" {
+		return path
+	}
+
+	return fmt.Sprintf("peers-%s.json", port)
+}
+
+// bansFileFromEnv reads the file the ban list is saved to from BANS_FILE, by default bans-<port>.json
+func bansFileFromEnv(port string) string {
+	if path := os.Getenv("BANS_FILE"); path != "" {
+		return path
+	}
+
+	return fmt.Sprintf("bans-%s.json", port)
+}
+
+// rateLimitConfigFromEnv reads the rate limit of each endpoint class from RATE_LIMIT_<CLASS>_RATE in requests per
+// second and RATE_LIMIT_<CLASS>_BURST, eg RATE_LIMIT_GOSSIP_RATE. A rate of 0 turns the limit off. Unset limits keep
+// those of config.
+func rateLimitConfigFromEnv(config peer.RateLimitConfig) peer.RateLimitConfig {
+	for _, class := range []peer.EndpointClass{peer.CLASS_CONTROL, peer.CLASS_GOSSIP, peer.CLASS_QUERY} {
+		limit := config[class]
+		prefix := "RATE_LIMIT_" + strings.ToUpper(string(class))
+
+		if rate, err := strconv.ParseFloat(os.Getenv(prefix+"_RATE"), 64); err == nil {
+			limit.Rate = rate
+		}
+
+		if burst, err := strconv.Atoi(os.Getenv(prefix + "_BURST")); err == nil {
+			limit.Burst = burst
+		}
+
+		config[class] = limit
+	}
+
+	return config
+}
+
+// controlAddressFromEnv reads the address of the control API from CONTROL_ADDRESS, by default localhost on the port
+// plus peer.CONTROL_PORT_OFFSET
+func controlAddressFromEnv(port string) string {
+	if address := os.Getenv("CONTROL_ADDRESS"); address != "" {
+		return address
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		utils.PanicError(err)
+	}
+
+	return peer.ControlAddress(p)
+}
+
+// controlTokensFromEnv reads the role:token pairs of the control API from CONTROL_TOKENS. Without any, an admin token is
+// generated and written to CONTROL_TOKEN_FILE, by default control-<port>.token.
+func controlTokensFromEnv(port string) map[string]peer.Role {
+	tokens, err := peer.ParseControlTokens(os.Getenv("CONTROL_TOKENS"))
+	if err != nil {
+		utils.PanicError(err)
+	}
+	if len(tokens) > 0 {
+		return tokens
+	}
+
+	path := os.Getenv("CONTROL_TOKEN_FILE")
+	if path == "" {
+		path = fmt.Sprintf("control-%s.token", port)
+	}
+
+	token, err := peer.GenerateControlToken(path)
+	if err != nil {
+		utils.PanicError(err)
+	}
+	fmt.Printf("Admin token of the control API written to %s\n", path)
+
+	return map[string]peer.Role{token: peer.ROLE_ADMIN}
+}
+
+// tlsConfigFromEnv reads if the peer and control listeners use TLS from PEER_TLS and CONTROL_TLS. Setting the key
+// fingerprints of the nodes allowed to connect in PEER_TLS_ALLOWED_KEYS turns on peer TLS with mutual auth. The node
+// identity is kept in NODE_KEY_FILE and NODE_CERT_FILE, and the keys pinned for peers in PEER_PINS_FILE, by default
+// node-<port>.key, node-<port>.crt and pins-<port>.json. It returns nil if neither listener uses TLS.
+func tlsConfigFromEnv(port string) *peer.TLSConfig {
+	peerTLS, _ := strconv.ParseBool(os.Getenv("PEER_TLS"))
+	controlTLS, _ := strconv.ParseBool(os.Getenv("CONTROL_TLS"))
+	allowedKeys := peer.ParseAllowedKeys(os.Getenv("PEER_TLS_ALLOWED_KEYS"))
+	if len(allowedKeys) > 0 {
+		peerTLS = true
+	}
+	if !peerTLS && !controlTLS {
+		return nil
+	}
+
+	identity, err := peer.LoadOrCreateIdentity(fileFromEnv("NODE_KEY_FILE", "node-%s.key", port), fileFromEnv("NODE_CERT_FILE", "node-%s.crt", port))
+	if err != nil {
+		utils.PanicError(err)
+	}
+	fmt.Printf("Key fingerprint of this node: %s\n", identity.Fingerprint)
+
+	pins := peer.NewPinStore(fileFromEnv("PEER_PINS_FILE", "pins-%s.json", port))
+	if err := pins.Load(); err != nil {
+		utils.ErrorLogger.Printf("Could not load pinned peer keys: %s", err)
+	}
+
+	return &peer.TLSConfig{
+		Identity:    identity,
+		Pins:        pins,
+		AllowedKeys: allowedKeys,
+		Peer:        peerTLS,
+		Control:     controlTLS,
+	}
+}
+
+// fileFromEnv reads a file path from env, by default format of the port
+func fileFromEnv(env string, format string, port string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+
+	return fmt.Sprintf(format, port)
+}
+
 // For now seed host is identified as being on port 8080
 func isSeedHost(port string) bool {
 	if port == "8080" {
@@ -22,14 +165,26 @@ func isSeedHost(port string) bool {
 	return false
 }
 
+// txPoolConfigFromEnv reads the tx pool limits from TX_POOL_MAX_SIZE in bytes and TX_POOL_EXPIRY as a duration, eg
+// 72h. Unset limits keep those of config.
+func txPoolConfigFromEnv(config service.TxPoolConfig) service.TxPoolConfig {
+	if maxSize, err := strconv.Atoi(os.Getenv("TX_POOL_MAX_SIZE")); err == nil {
+		config.MaxSize = maxSize
+	}
+
+	if expiry, err := time.ParseDuration(os.Getenv("TX_POOL_EXPIRY")); err == nil {
+		config.Expiry = expiry
+	}
+
+	return config
+}
+
 func main() {
 	args := os.Args[1:]
 	port := args[0]
 
-	var client *peer.Client
-
 	blocks := make([]coin.Block, 0)
-	blockchain := coin.NewBlockchain(blocks)
+	blockchain := coin.NewBlockchain(blocks, coin.DefaultChainParams())
 	hostname := os.Getenv("HOST_NAME")
 	thisPeer := fmt.Sprintf("%s:%s", hostname, port)
 	fmt.Printf("This peer: %s\n", thisPeer)
@@ -46,51 +201,91 @@ func main() {
 	fmt.Printf("Address of this node: %s\n", string(string(crypt.FirstcoinAddress)))
 	fmt.Printf("Address of this node: %s\n", string(repository.Base64Encode(crypt.FirstcoinAddress)))
 
-	userWallet := wallet.NewWallet(*crypt)
+	userWallet := wallet.NewWallet(*crypt, repository.NewUTxOSet(), repository.NewTxPool())
+
+	blockchainService := service.NewBlockchainService(blockchain, userWallet)
+	blockchainService.SetTxPoolConfig(txPoolConfigFromEnv(blockchainService.GetTxPoolConfig()))
+
+	// the chain is saved to CHAIN_FILE, by default chain-<port>.json, and a restarted node carries on from its saved tip
+	if err := blockchainService.SetChainStore(service.NewChainStore(fileFromEnv("CHAIN_FILE", "chain-%s.json", port))); err != nil {
+		utils.ErrorLogger.Printf("Could not save the chain: %s", err)
+	}
+	loadedChain, err := blockchainService.LoadChain()
+	if err != nil {
+		utils.ErrorLogger.Printf("Could not load the chain: %s", err)
+	}
+
+	addresses := peer.NewAddrManager(peersFileFromEnv(port))
+	if err := addresses.Load(); err != nil {
+		utils.ErrorLogger.Printf("Could not load peer addresses: %s", err)
+	}
+
+	client := peer.NewClient(peers, blockchainService, thisPeer, addresses)
+	if tlsConfig := tlsConfigFromEnv(port); tlsConfig != nil {
+		client.SetTLSConfig(tlsConfig)
+	}
 
 	if isSeedHost(port) {
-		var err error
-		*blockchain, _, err = service.CreateGenesisBlockchain(*crypt, *blockchain)
-		if err != nil {
+		if loadedChain {
+			utils.InfoLogger.Printf("Loaded the chain up to block %d", blockchainService.Blockchain.GetLastBlock().Index)
+		} else if _, err := blockchainService.CreateGenesisBlockchain(*crypt); err != nil {
 			utils.PanicError(err)
 		}
-		client = peer.NewClient(peers, blockchain, thisPeer)
 	} else {
 		if len(args) > 1 {
 			specificPeerToConnectTo := args[1]
-			peers.Hostnames[specificPeerToConnectTo] = specificPeerToConnectTo
-
-			client = peer.NewClient(peers, blockchain, thisPeer)
-		} else {
-			client = peer.NewClient(peers, blockchain, thisPeer)
-			newPeers, err := client.GetPeers(seedHost)
-			if err != nil {
-				utils.ErrorLogger.Printf("Could not get peers: %s", err)
+			peers.AddHostname(specificPeerToConnectTo)
+		} else if addresses.Len() == 0 {
+			// a node that saved no addresses asks the seeds for their peers, otherwise it dials the saved ones
+			for _, seed := range seedHostsFromEnv() {
+				newPeers, err := client.GetPeers(seed)
+				if err != nil {
+					utils.ErrorLogger.Printf("Could not get peers from seed %s: %s", seed, err)
+					continue
+				}
+				peers.SetHostnames(newPeers)
+				break
 			}
-			peers.Hostnames = newPeers
 		}
 
-		err := client.QueryPeersForBlockchain(client.Peers.Hostnames)
+		err := client.QueryPeersForBlockchain(client.Peers.Hostnames())
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		err = client.QueryNetworkForUnconfirmedTxPool(client.Peers.Hostnames)
+		// without peers yet the tx pool fills as txs are announced
+		err = client.QueryNetworkForUnconfirmedTxPool(client.Peers.Hostnames())
 		if err != nil {
-			return
+			utils.ErrorLogger.Println(err)
 		}
 
-		utils.InfoLogger.Println(client.Peers.Hostnames)
+		utils.InfoLogger.Println(client.Peers.Hostnames())
 		client.BroadcastOnline(thisPeer)
 	}
 
 	// peers.AddHostname(thisPeer)
 
-	service := service.NewBlockchainService(blockchain, userWallet)
-	coinServerHandler := peer.NewCoinServerHandler(service, client, peers)
+	go client.RelayInventory()
 
-	server := peer.NewServer(*coinServerHandler)
+	bans := peer.NewBanManager(bansFileFromEnv(port))
+	if err := bans.Load(); err != nil {
+		utils.ErrorLogger.Printf("Could not load bans: %s", err)
+	}
+
+	rateLimiter := peer.NewRateLimiter(rateLimitConfigFromEnv(peer.DefaultRateLimitConfig()))
+	coinServerHandler := peer.NewCoinServerHandler(blockchainService, client, peers, bans, rateLimiter)
+	go coinServerHandler.MaintainPeerConnections()
+
+	controlAuth := peer.NewControlAuth(controlTokensFromEnv(port))
+	server := peer.NewServer(*coinServerHandler, rateLimiter, controlAuth)
+
+	controlAddress := controlAddressFromEnv(port)
+	controlScheme := "http"
+	if client.TLS != nil && client.TLS.Control {
+		controlScheme = "https"
+	}
+	fmt.Printf("Control API of this node: %s://%s\n", controlScheme, controlAddress)
 
-	server.HandleServer(args[0], port == "8080")
+	server.HandleServer(args[0], controlAddress, port == "8080")
 }
@@ -0,0 +1,326 @@
+package peer
+
+import (
+	"encoding/json"
+	"firstcoin/utils"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MAX_NEW_ADDRESSES and MAX_TRIED_ADDRESSES bound the addresses only heard of and those connected to before. The
+	// worst address of a full bucket is dropped for a new one.
+	MAX_NEW_ADDRESSES   = 1000
+	MAX_TRIED_ADDRESSES = 256
+
+	// MAX_NEW_FAILURES is how many attempts in a row an address never connected to can fail before it is dropped.
+	// MAX_TRIED_FAILURES is the same for an address connected to before, which is also kept for TRIED_RETENTION after its
+	// last success.
+	MAX_NEW_FAILURES   = 3
+	MAX_TRIED_FAILURES = 10
+	TRIED_RETENTION    = 7 * 24 * time.Hour
+
+	// RETRY_INTERVAL is how long after a failed attempt an address is dialed again, doubled for every failure in a row
+	// up to MAX_RETRY_INTERVAL
+	RETRY_INTERVAL     = 30 * time.Second
+	MAX_RETRY_INTERVAL = time.Hour
+
+	// ADDRESS_HORIZON is how long ago an address may last have been seen to be shared with peers
+	ADDRESS_HORIZON = 30 * 24 * time.Hour
+
+	// MAX_ADDR_PER_MESSAGE is the most addresses shared in one addr message
+	MAX_ADDR_PER_MESSAGE = 1000
+)
+
+// KnownAddress is what a node knows of the address of a peer. Times are unix seconds, zero for never.
+type KnownAddress struct {
+	Hostname    string `json:"hostname"`
+	Source      string `json:"source"`
+	LastSeen    int64  `json:"lastSeen"`
+	LastAttempt int64  `json:"lastAttempt"`
+	LastSuccess int64  `json:"lastSuccess"`
+	Failures    int    `json:"failures"`
+	Tried       bool   `json:"tried"`
+}
+
+// retryAt is the time the address may be dialed again after its failures in a row
+func (ka *KnownAddress) retryAt() int64 {
+	if ka.Failures == 0 {
+		return ka.LastAttempt
+	}
+
+	backoff := RETRY_INTERVAL
+	for i := 1; i < ka.Failures && backoff < MAX_RETRY_INTERVAL; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_RETRY_INTERVAL {
+		backoff = MAX_RETRY_INTERVAL
+	}
+
+	return ka.LastAttempt + int64(backoff/time.Second)
+}
+
+// isBad reports if the address failed too often to keep
+func (ka *KnownAddress) isBad(now int64) bool {
+	if !ka.Tried {
+		return ka.Failures >= MAX_NEW_FAILURES
+	}
+
+	return ka.Failures >= MAX_TRIED_FAILURES && now-ka.LastSuccess > int64(TRIED_RETENTION/time.Second)
+}
+
+// worse orders the addresses to drop first: those with more failures, then those seen least recently
+func (ka *KnownAddress) worse(other *KnownAddress) bool {
+	if ka.Failures != other.Failures {
+		return ka.Failures > other.Failures
+	}
+
+	return ka.LastSeen < other.LastSeen
+}
+
+// AddrManager keeps the addresses of the peers a node knows, in a new bucket for those only heard of and a tried bucket
+// for those it connected to. It is saved to path as JSON. It is safe for concurrent use.
+type AddrManager struct {
+	mu    sync.Mutex
+	addrs map[string]*KnownAddress
+	path  string
+}
+
+func NewAddrManager(path string) *AddrManager {
+	return &AddrManager{
+		addrs: make(map[string]*KnownAddress),
+		path:  path,
+	}
+}
+
+// Load reads the addresses saved at the path of the manager. A missing file is no addresses.
+func (a *AddrManager) Load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	j, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]*KnownAddress, 0)
+	if err := json.Unmarshal(j, &addrs); err != nil {
+		return err
+	}
+
+	for _, ka := range addrs {
+		if ka.Hostname != "" {
+			a.addrs[ka.Hostname] = ka
+		}
+	}
+
+	return nil
+}
+
+// Save writes the addresses to the path of the manager
+func (a *AddrManager) Save() error {
+	a.mu.Lock()
+	addrs := make([]KnownAddress, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		addrs = append(addrs, *ka)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Hostname < addrs[j].Hostname })
+
+	return utils.WriteJSONFile(a.path, addrs)
+}
+
+// AddAddresses records hostnames heard of from source in the new bucket. Known addresses are marked as seen.
+func (a *AddrManager) AddAddresses(source string, hostnames ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, hostname := range hostnames {
+		if hostname == "" {
+			continue
+		}
+
+		if ka, ok := a.addrs[hostname]; ok {
+			ka.LastSeen = now
+			continue
+		}
+
+		a.addrs[hostname] = &KnownAddress{Hostname: hostname, Source: source, LastSeen: now}
+		a.limitBucket(false)
+	}
+}
+
+// Attempt records that the address is being dialed
+func (a *AddrManager) Attempt(hostname string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ka, ok := a.addrs[hostname]; ok {
+		ka.LastAttempt = time.Now().Unix()
+	}
+}
+
+// Good records a connection to the address, which moves it to the tried bucket
+func (a *AddrManager) Good(hostname string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().Unix()
+	ka, ok := a.addrs[hostname]
+	if !ok {
+		ka = &KnownAddress{Hostname: hostname, Source: hostname}
+		a.addrs[hostname] = ka
+	}
+
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Failures = 0
+	if !ka.Tried {
+		ka.Tried = true
+		a.limitBucket(true)
+	}
+}
+
+// Failed records a failed attempt to reach the address, which is dropped once it is bad
+func (a *AddrManager) Failed(hostname string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[hostname]
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	ka.Failures++
+	ka.LastAttempt = now
+	if ka.isBad(now) {
+		delete(a.addrs, hostname)
+	}
+}
+
+// Select returns up to count addresses to dial, that are not in exclude and are not waiting to be retried. Tried and
+// new addresses are picked alternately, so a node keeps to the peers it knows but still finds new ones.
+func (a *AddrManager) Select(count int, exclude map[string]bool) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().Unix()
+	tried := make([]string, 0)
+	fresh := make([]string, 0)
+	for hostname, ka := range a.addrs {
+		if exclude[hostname] || ka.Failures > 0 && ka.retryAt() > now {
+			continue
+		}
+
+		if ka.Tried {
+			tried = append(tried, hostname)
+		} else {
+			fresh = append(fresh, hostname)
+		}
+	}
+
+	rand.Shuffle(len(tried), func(i, j int) { tried[i], tried[j] = tried[j], tried[i] })
+	rand.Shuffle(len(fresh), func(i, j int) { fresh[i], fresh[j] = fresh[j], fresh[i] })
+
+	selected := make([]string, 0, count)
+	for len(selected) < count && len(tried)+len(fresh) > 0 {
+		if len(tried) > 0 && (len(selected)%2 == 0 || len(fresh) == 0) {
+			selected = append(selected, tried[0])
+			tried = tried[1:]
+			continue
+		}
+
+		selected = append(selected, fresh[0])
+		fresh = fresh[1:]
+	}
+
+	return selected
+}
+
+// Addresses returns up to MAX_ADDR_PER_MESSAGE addresses seen within ADDRESS_HORIZON that have not failed, to share
+// with peers
+func (a *AddrManager) Addresses() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().Unix()
+	hostnames := make([]string, 0)
+	for hostname, ka := range a.addrs {
+		if ka.Failures == 0 && now-ka.LastSeen <= int64(ADDRESS_HORIZON/time.Second) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	rand.Shuffle(len(hostnames), func(i, j int) { hostnames[i], hostnames[j] = hostnames[j], hostnames[i] })
+	if len(hostnames) > MAX_ADDR_PER_MESSAGE {
+		hostnames = hostnames[:MAX_ADDR_PER_MESSAGE]
+	}
+
+	return hostnames
+}
+
+func (a *AddrManager) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.addrs)
+}
+
+// KnownAddresses returns a copy of the addresses, for operators
+func (a *AddrManager) KnownAddresses() []KnownAddress {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addrs := make([]KnownAddress, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		addrs = append(addrs, *ka)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Hostname < addrs[j].Hostname })
+
+	return addrs
+}
+
+// limitBucket drops the worst addresses of the tried or new bucket while it holds more than its max. A tried address
+// is moved back to the new bucket rather than dropped.
+func (a *AddrManager) limitBucket(tried bool) {
+	max := MAX_NEW_ADDRESSES
+	if tried {
+		max = MAX_TRIED_ADDRESSES
+	}
+
+	for {
+		var worst *KnownAddress
+		count := 0
+		for _, ka := range a.addrs {
+			if ka.Tried != tried {
+				continue
+			}
+
+			count++
+			if worst == nil || ka.worse(worst) {
+				worst = ka
+			}
+		}
+
+		if count <= max {
+			return
+		}
+
+		if tried {
+			worst.Tried = false
+			a.limitBucket(false)
+			continue
+		}
+		delete(a.addrs, worst.Hostname)
+	}
+}
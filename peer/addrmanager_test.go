@@ -0,0 +1,115 @@
+package peer_test
+
+import (
+	"firstcoin/peer"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddrManager(t *testing.T) {
+	newAddrManager := func(t *testing.T) *peer.AddrManager {
+		return peer.NewAddrManager(filepath.Join(t.TempDir(), "peers.json"))
+	}
+
+	find := func(a *peer.AddrManager, hostname string) (peer.KnownAddress, bool) {
+		for _, ka := range a.KnownAddresses() {
+			if ka.Hostname == hostname {
+				return ka, true
+			}
+		}
+
+		return peer.KnownAddress{}, false
+	}
+
+	t.Run("moves an address connected to into the tried bucket", func(t *testing.T) {
+		a := newAddrManager(t)
+		a.AddAddresses("seed:8080", "node:8081")
+
+		if ka, _ := find(a, "node:8081"); ka.Tried || ka.Source != "seed:8080" {
+			t.Fatalf("expected a new address heard of from the seed, got: %+v", ka)
+		}
+
+		a.Attempt("node:8081")
+		a.Failed("node:8081")
+		a.Good("node:8081")
+
+		ka, _ := find(a, "node:8081")
+		if !ka.Tried || ka.Failures != 0 || ka.LastSuccess == 0 {
+			t.Errorf("expected a tried address without failures, got: %+v", ka)
+		}
+	})
+
+	t.Run("does not select an address waiting to be retried", func(t *testing.T) {
+		a := newAddrManager(t)
+		a.AddAddresses("seed:8080", "node:8081", "node:8082")
+		a.Failed("node:8081")
+
+		selected := a.Select(2, map[string]bool{})
+		if len(selected) != 1 || selected[0] != "node:8082" {
+			t.Errorf("incorrect addresses selected. Got: %v. Want: [node:8082]", selected)
+		}
+
+		if selected := a.Select(2, map[string]bool{"node:8082": true}); len(selected) != 0 {
+			t.Errorf("expected excluded addresses not to be selected, got: %v", selected)
+		}
+	})
+
+	t.Run("drops a new address that keeps failing and keeps a tried one", func(t *testing.T) {
+		a := newAddrManager(t)
+		a.AddAddresses("seed:8080", "new:8081", "tried:8082")
+		a.Good("tried:8082")
+
+		for i := 0; i < peer.MAX_NEW_FAILURES; i++ {
+			a.Failed("new:8081")
+			a.Failed("tried:8082")
+		}
+
+		if _, ok := find(a, "new:8081"); ok {
+			t.Errorf("expected the new address to be dropped")
+		}
+		if ka, ok := find(a, "tried:8082"); !ok || ka.Failures != peer.MAX_NEW_FAILURES {
+			t.Errorf("expected the tried address to be kept through a network blip")
+		}
+	})
+
+	t.Run("keeps at most MAX_NEW_ADDRESSES new addresses", func(t *testing.T) {
+		a := newAddrManager(t)
+		for i := 0; i <= peer.MAX_NEW_ADDRESSES; i++ {
+			a.AddAddresses("seed:8080", fmt.Sprintf("node:%d", 10000+i))
+		}
+
+		if a.Len() != peer.MAX_NEW_ADDRESSES {
+			t.Errorf("incorrect number of addresses. Got: %d. Want: %d", a.Len(), peer.MAX_NEW_ADDRESSES)
+		}
+	})
+
+	t.Run("loads the addresses it saved", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "peers.json")
+		a := peer.NewAddrManager(path)
+		a.AddAddresses("seed:8080", "node:8081", "node:8082")
+		a.Good("node:8082")
+		if err := a.Save(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		loaded := peer.NewAddrManager(path)
+		if err := loaded.Load(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if loaded.Len() != 2 {
+			t.Fatalf("incorrect number of addresses. Got: %d. Want: %d", loaded.Len(), 2)
+		}
+		if ka, _ := find(loaded, "node:8082"); !ka.Tried {
+			t.Errorf("expected the tried bucket to be saved")
+		}
+	})
+
+	t.Run("loads no addresses without a saved file", func(t *testing.T) {
+		a := newAddrManager(t)
+		if err := a.Load(); err != nil || a.Len() != 0 {
+			t.Errorf("expected no addresses and no error, got %d addresses and %v", a.Len(), err)
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package peer
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Role is what a control API token is allowed to do
+type Role string
+
+const (
+	// ROLE_READ reads the chain, the pool and the state of the node, ROLE_SPEND also creates and signs txs and ROLE_MINE
+	// also creates blocks. ROLE_ADMIN can do all of it and manage the bans of the node.
+	ROLE_READ  Role = "read"
+	ROLE_SPEND Role = "spend"
+	ROLE_MINE  Role = "mine"
+	ROLE_ADMIN Role = "admin"
+
+	// CONTROL_PORT_OFFSET is added to the HTTP port of a node for the port of its control API
+	CONTROL_PORT_OFFSET = 2000
+
+	// CONTROL_COOKIE is the cookie a browser authenticates to the control API with, set by /login
+	CONTROL_COOKIE = "firstcoin_token"
+
+	// CONTROL_TOKEN_SIZE is the bytes of a generated token
+	CONTROL_TOKEN_SIZE = 32
+)
+
+// allows reports if the role grants the permissions of required
+func (role Role) allows(required Role) bool {
+	switch role {
+	case ROLE_ADMIN:
+		return true
+	case ROLE_SPEND, ROLE_MINE:
+		return required == role || required == ROLE_READ
+	case ROLE_READ:
+		return required == ROLE_READ
+	}
+
+	return false
+}
+
+func validRole(role Role) bool {
+	switch role {
+	case ROLE_READ, ROLE_SPEND, ROLE_MINE, ROLE_ADMIN:
+		return true
+	}
+
+	return false
+}
+
+// ControlAuth authenticates requests to the control API by the bearer token in the Authorization header, or the token
+// in the CONTROL_COOKIE cookie, and checks the role of the token allows the endpoint
+type ControlAuth struct {
+	tokens map[string]Role
+}
+
+func NewControlAuth(tokens map[string]Role) *ControlAuth {
+	return &ControlAuth{tokens: tokens}
+}
+
+// ParseControlTokens parses comma separated role:token pairs, eg read:abc,spend:def
+func ParseControlTokens(s string) (map[string]Role, error) {
+	tokens := make(map[string]Role)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("control token %q is not of the form role:token", pair)
+		}
+
+		role := Role(parts[0])
+		if !validRole(role) {
+			return nil, fmt.Errorf("unknown control role %q", role)
+		}
+		tokens[parts[1]] = role
+	}
+
+	return tokens, nil
+}
+
+// GenerateControlToken returns a random token and writes it to path, readable by its owner only
+func GenerateControlToken(path string) (string, error) {
+	b := make([]byte, CONTROL_TOKEN_SIZE)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ControlAddress is the default address of the control API of the node listening on port, only reachable locally
+func ControlAddress(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", port+CONTROL_PORT_OFFSET)
+}
+
+// ControlHostname is the host and port of the control API of the node with hostname, which the node must expose beyond
+// localhost to be reached from another host
+func ControlHostname(hostname string) (string, error) {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %s. error: %s", hostname, err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p+CONTROL_PORT_OFFSET)), nil
+}
+
+// requestToken is the bearer token of the request, or the token of its CONTROL_COOKIE
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := r.Cookie(CONTROL_COOKIE); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// role is the role of token
+func (a *ControlAuth) role(token string) (Role, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	// every token is compared so the time taken does not tell how much of one matched
+	found := Role("")
+	for t, role := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = role
+		}
+	}
+
+	return found, found != ""
+}
+
+// Authorize serves requests carrying a token with a role that allows required, responding 401 without a known token
+// and 403 for a role that does not allow it
+func (a *ControlAuth) Authorize(required Role, handler ServiceHandler) ServiceHandler {
+	return func(r *http.Request) (*HTTPResponse, *HTTPError) {
+		role, ok := a.role(requestToken(r))
+		if !ok {
+			return nil, NewHTTPError(http.StatusUnauthorized, "a control token is required")
+		}
+		if !role.allows(required) {
+			return nil, NewHTTPError(http.StatusForbidden, "the %s role is not allowed to %s", role, r.URL.Path)
+		}
+
+		return handler(r)
+	}
+}
+
+// ControlLogin is the token a browser logs in to the control API with
+type ControlLogin struct {
+	Token string `json:"token"`
+}
+
+// login sets the CONTROL_COOKIE of a known token, so the web UI served by the control API can call it. The token is
+// only taken from the body of a POST, a token in a URL would end up in the browser history and logs.
+func (a *ControlAuth) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	login := ControlLogin{}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_SIZE)
+	if err := readBody(r, &login); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	role, ok := a.role(login.Token)
+	if !ok {
+		http.Error(w, "unknown control token", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CONTROL_COOKIE,
+		Value:    login.Token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	fmt.Fprintf(w, "logged in with the %s role\n", role)
+}
+
+// logout clears the CONTROL_COOKIE
+func (a *ControlAuth) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CONTROL_COOKIE,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package peer_test
+
+import (
+	"firstcoin/peer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlAuth(t *testing.T) {
+	auth := peer.NewControlAuth(map[string]peer.Role{
+		"read-token":  peer.ROLE_READ,
+		"spend-token": peer.ROLE_SPEND,
+		"mine-token":  peer.ROLE_MINE,
+		"admin-token": peer.ROLE_ADMIN,
+	})
+
+	ok := func(r *http.Request) (*peer.HTTPResponse, *peer.HTTPError) {
+		return &peer.HTTPResponse{StatusCode: http.StatusOK}, nil
+	}
+
+	call := func(required peer.Role, token string) int {
+		request := httptest.NewRequest("GET", "/endpoint", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		response, err := auth.Authorize(required, ok)(request)
+		if err != nil {
+			return err.Code
+		}
+
+		return response.StatusCode
+	}
+
+	t.Run("refuses a request without a known token", func(t *testing.T) {
+		for _, token := range []string{"", "unknown-token"} {
+			if code := call(peer.ROLE_READ, token); code != http.StatusUnauthorized {
+				t.Errorf("incorrect code for token %q. Got: %d. Want: %d", token, code, http.StatusUnauthorized)
+			}
+		}
+	})
+
+	t.Run("allows the endpoints of each role", func(t *testing.T) {
+		tests := []struct {
+			required peer.Role
+			token    string
+			code     int
+		}{
+			{peer.ROLE_READ, "read-token", http.StatusOK},
+			{peer.ROLE_SPEND, "read-token", http.StatusForbidden},
+			{peer.ROLE_READ, "spend-token", http.StatusOK},
+			{peer.ROLE_SPEND, "spend-token", http.StatusOK},
+			{peer.ROLE_MINE, "spend-token", http.StatusForbidden},
+			{peer.ROLE_MINE, "mine-token", http.StatusOK},
+			{peer.ROLE_SPEND, "mine-token", http.StatusForbidden},
+			{peer.ROLE_ADMIN, "mine-token", http.StatusForbidden},
+			{peer.ROLE_ADMIN, "admin-token", http.StatusOK},
+			{peer.ROLE_SPEND, "admin-token", http.StatusOK},
+		}
+
+		for _, test := range tests {
+			if code := call(test.required, test.token); code != test.code {
+				t.Errorf("incorrect code for %s with %s. Got: %d. Want: %d", test.required, test.token, code, test.code)
+			}
+		}
+	})
+
+	t.Run("takes the token from the control cookie", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/endpoint", nil)
+		request.AddCookie(&http.Cookie{Name: peer.CONTROL_COOKIE, Value: "spend-token"})
+
+		if _, err := auth.Authorize(peer.ROLE_SPEND, ok)(request); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestParseControlTokens(t *testing.T) {
+	t.Run("parses role:token pairs", func(t *testing.T) {
+		tokens, err := peer.ParseControlTokens("read:abc, spend:def,")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(tokens) != 2 || tokens["abc"] != peer.ROLE_READ || tokens["def"] != peer.ROLE_SPEND {
+			t.Errorf("incorrect tokens. Got: %v", tokens)
+		}
+	})
+
+	t.Run("refuses an unknown role or a missing token", func(t *testing.T) {
+		for _, s := range []string{"root:abc", "spend:", "abc"} {
+			if _, err := peer.ParseControlTokens(s); err == nil {
+				t.Errorf("expected an error parsing %q", s)
+			}
+		}
+	})
+}
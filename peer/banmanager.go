@@ -0,0 +1,239 @@
+package peer
+
+import (
+	"encoding/json"
+	"firstcoin/utils"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// BAN_THRESHOLD is the ban score at which a peer is disconnected and banned for DEFAULT_BAN_DURATION
+	BAN_THRESHOLD        = 100
+	DEFAULT_BAN_DURATION = 24 * time.Hour
+
+	// the ban score of each protocol violation. A peer relaying a block that breaks the consensus rules is banned at
+	// once, the other violations can be honest mistakes, races or clocks that are off and take repeating.
+	SCORE_INVALID_BLOCK     = 100
+	SCORE_BLOCK_TIMESTAMP   = 10
+	SCORE_INVALID_TX        = 10
+	SCORE_OVERSIZED_MESSAGE = 20
+	SCORE_MALFORMED_MESSAGE = 10
+	SCORE_FAKE_HOSTNAME     = 20
+
+	// SCORE_DECAY_INTERVAL is how often a ban score loses a point, so that violations spread out over time do not add
+	// up to a ban
+	SCORE_DECAY_INTERVAL = time.Minute
+)
+
+// Ban is a peer address that is refused until BannedUntil, in unix seconds
+type Ban struct {
+	Address     string `json:"address"`
+	Reason      string `json:"reason"`
+	BannedAt    int64  `json:"bannedAt"`
+	BannedUntil int64  `json:"bannedUntil"`
+}
+
+// BanManager keeps the ban score of each peer address and the bans of the addresses that reached BAN_THRESHOLD or were
+// banned by an operator. Peers are scored and banned by IP address, as the hostname a peer names itself by is up to the
+// peer. The bans are saved to path as JSON on every change. It is safe for concurrent use.
+type BanManager struct {
+	mu     sync.Mutex
+	scores map[string]*banScore
+	bans   map[string]Ban
+	path   string
+}
+
+func NewBanManager(path string) *BanManager {
+	return &BanManager{
+		scores: make(map[string]*banScore),
+		bans:   make(map[string]Ban),
+		path:   path,
+	}
+}
+
+// BanAddress is the IP address bans apply to for address, an IP with or without a port
+func BanAddress(address string) (string, error) {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", address)
+	}
+
+	return ip.String(), nil
+}
+
+// Load reads the bans saved at the path of the manager, dropping the expired ones. A missing file is no bans.
+func (b *BanManager) Load() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	j, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bans := make([]Ban, 0)
+	if err := json.Unmarshal(j, &bans); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, ban := range bans {
+		if ban.BannedUntil > now {
+			b.bans[ban.Address] = ban
+		}
+	}
+
+	return nil
+}
+
+// Misbehaving adds score to the ban score of the peer at address, and bans it once the score reaches BAN_THRESHOLD. It
+// reports if the peer is banned.
+func (b *BanManager) Misbehaving(address string, score int, reason string) (bool, error) {
+	address, err := BanAddress(address)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	now := time.Now().Unix()
+	b.decayScores(now)
+	if _, ok := b.scores[address]; !ok {
+		b.scores[address] = &banScore{decayedAt: now}
+	}
+	b.scores[address].score += score
+	reached := b.scores[address].score >= BAN_THRESHOLD
+	b.mu.Unlock()
+
+	if !reached {
+		return false, nil
+	}
+
+	return true, b.Ban(address, DEFAULT_BAN_DURATION, reason)
+}
+
+// Score is the ban score of the peer at address
+func (b *BanManager) Score(address string) int {
+	address, err := BanAddress(address)
+	if err != nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.decayScores(time.Now().Unix())
+	if score, ok := b.scores[address]; ok {
+		return score.score
+	}
+
+	return 0
+}
+
+// decayScores decays the ban scores up to now, dropping those down to zero
+func (b *BanManager) decayScores(now int64) {
+	for address, score := range b.scores {
+		if score.decay(now); score.score == 0 {
+			delete(b.scores, address)
+		}
+	}
+}
+
+// Ban refuses the peer at address for duration, and saves the bans
+func (b *BanManager) Ban(address string, duration time.Duration, reason string) error {
+	address, err := BanAddress(address)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	now := time.Now().Unix()
+	b.bans[address] = Ban{
+		Address:     address,
+		Reason:      reason,
+		BannedAt:    now,
+		BannedUntil: now + int64(duration/time.Second),
+	}
+	delete(b.scores, address)
+	b.mu.Unlock()
+
+	return b.Save()
+}
+
+// Unban lifts the ban of the peer at address, and saves the bans. It reports if the peer was banned.
+func (b *BanManager) Unban(address string) (bool, error) {
+	address, err := BanAddress(address)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	_, banned := b.bans[address]
+	delete(b.bans, address)
+	delete(b.scores, address)
+	b.mu.Unlock()
+
+	if !banned {
+		return false, nil
+	}
+
+	return true, b.Save()
+}
+
+// IsBanned reports if the peer at address is banned. An expired ban is lifted.
+func (b *BanManager) IsBanned(address string) bool {
+	address, err := BanAddress(address)
+	if err != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, ok := b.bans[address]
+	if !ok {
+		return false
+	}
+
+	if ban.BannedUntil <= time.Now().Unix() {
+		delete(b.bans, address)
+		return false
+	}
+
+	return true
+}
+
+// Bans returns the bans that have not expired
+func (b *BanManager) Bans() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if ban.BannedUntil > now {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Address < bans[j].Address })
+
+	return bans
+}
+
+// Save writes the bans to the path of the manager
+func (b *BanManager) Save() error {
+	return utils.WriteJSONFile(b.path, b.Bans())
+}
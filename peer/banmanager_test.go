@@ -0,0 +1,106 @@
+package peer_test
+
+import (
+	"firstcoin/peer"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanManager(t *testing.T) {
+	newBanManager := func(t *testing.T) *peer.BanManager {
+		return peer.NewBanManager(filepath.Join(t.TempDir(), "bans.json"))
+	}
+
+	t.Run("bans a peer once its score reaches the threshold", func(t *testing.T) {
+		b := newBanManager(t)
+
+		for i := 0; i < peer.BAN_THRESHOLD/peer.SCORE_INVALID_TX-1; i++ {
+			banned, err := b.Misbehaving("10.0.0.1:8081", peer.SCORE_INVALID_TX, "invalid tx")
+			if err != nil || banned {
+				t.Fatalf("expected the peer not to be banned yet, got banned %t and error %v", banned, err)
+			}
+		}
+		if b.IsBanned("10.0.0.1") {
+			t.Fatalf("expected the peer not to be banned below the threshold")
+		}
+
+		banned, err := b.Misbehaving("10.0.0.1:8082", peer.SCORE_INVALID_TX, "invalid tx")
+		if err != nil || !banned {
+			t.Fatalf("expected the peer to be banned, got banned %t and error %v", banned, err)
+		}
+		if !b.IsBanned("10.0.0.1:9999") {
+			t.Errorf("expected the ban to apply to any port of the address")
+		}
+		if b.IsBanned("10.0.0.2") {
+			t.Errorf("expected other addresses not to be banned")
+		}
+	})
+
+	t.Run("bans a peer relaying an invalid block at once", func(t *testing.T) {
+		b := newBanManager(t)
+
+		if banned, _ := b.Misbehaving("10.0.0.1:8081", peer.SCORE_INVALID_BLOCK, "invalid block"); !banned {
+			t.Errorf("expected the peer to be banned")
+		}
+	})
+
+	t.Run("refuses an address that is not an IP", func(t *testing.T) {
+		b := newBanManager(t)
+
+		if err := b.Ban("localhost:8081", time.Hour, "test"); err == nil {
+			t.Errorf("expected an error banning a hostname")
+		}
+	})
+
+	t.Run("lifts a ban", func(t *testing.T) {
+		b := newBanManager(t)
+		if err := b.Ban("10.0.0.1", time.Hour, "test"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		unbanned, err := b.Unban("10.0.0.1")
+		if err != nil || !unbanned {
+			t.Fatalf("expected the peer to be unbanned, got %t and error %v", unbanned, err)
+		}
+		if b.IsBanned("10.0.0.1") || len(b.Bans()) != 0 {
+			t.Errorf("expected no bans")
+		}
+
+		if unbanned, _ := b.Unban("10.0.0.1"); unbanned {
+			t.Errorf("expected an address that is not banned not to be unbanned")
+		}
+	})
+
+	t.Run("does not keep an expired ban", func(t *testing.T) {
+		b := newBanManager(t)
+		if err := b.Ban("10.0.0.1", 0, "test"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if b.IsBanned("10.0.0.1") || len(b.Bans()) != 0 {
+			t.Errorf("expected the expired ban to be lifted")
+		}
+	})
+
+	t.Run("loads the bans it saved", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bans.json")
+		b := peer.NewBanManager(path)
+		if err := b.Ban("10.0.0.1", time.Hour, "invalid block"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		loaded := peer.NewBanManager(path)
+		if err := loaded.Load(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		bans := loaded.Bans()
+		if len(bans) != 1 || bans[0].Address != "10.0.0.1" || bans[0].Reason != "invalid block" {
+			t.Errorf("incorrect bans loaded. Got: %+v", bans)
+		}
+		if !loaded.IsBanned("10.0.0.1") {
+			t.Errorf("expected the loaded ban to apply")
+		}
+	})
+}
@@ -0,0 +1,24 @@
+package peer
+
+import "time"
+
+// banScore is the ban score of a peer as of decayedAt, in unix seconds
+type banScore struct {
+	score     int
+	decayedAt int64
+}
+
+// decay takes a point off the score for every SCORE_DECAY_INTERVAL since it last decayed
+func (s *banScore) decay(now int64) {
+	interval := int64(SCORE_DECAY_INTERVAL / time.Second)
+	intervals := (now - s.decayedAt) / interval
+	if intervals <= 0 {
+		return
+	}
+
+	s.score -= int(intervals)
+	if s.score < 0 {
+		s.score = 0
+	}
+	s.decayedAt += intervals * interval
+}
@@ -0,0 +1,58 @@
+package peer
+
+import (
+	"firstcoin/coin"
+	"firstcoin/service"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBanScore(t *testing.T) {
+	interval := int64(SCORE_DECAY_INTERVAL / time.Second)
+
+	t.Run("loses a point every decay interval", func(t *testing.T) {
+		s := &banScore{score: 10, decayedAt: 1000}
+
+		s.decay(1000 + interval - 1)
+		if s.score != 10 {
+			t.Fatalf("expected no decay within an interval, got: %d", s.score)
+		}
+
+		s.decay(1000 + 3*interval + 1)
+		if s.score != 7 || s.decayedAt != 1000+3*interval {
+			t.Fatalf("incorrect decay. Got score %d as of %d", s.score, s.decayedAt)
+		}
+
+		s.decay(1000 + 100*interval)
+		if s.score != 0 {
+			t.Errorf("expected the score to stop at zero, got: %d", s.score)
+		}
+	})
+
+	t.Run("forgets the scores that decayed to zero", func(t *testing.T) {
+		b := NewBanManager("")
+		b.scores["10.0.0.1"] = &banScore{score: 2, decayedAt: 1000}
+		b.scores["10.0.0.2"] = &banScore{score: 50, decayedAt: 1000}
+
+		b.decayScores(1000 + 2*interval)
+		if _, ok := b.scores["10.0.0.1"]; ok {
+			t.Errorf("expected the decayed score to be dropped")
+		}
+		if b.scores["10.0.0.2"].score != 48 {
+			t.Errorf("incorrect score. Got: %d. Want: %d", b.scores["10.0.0.2"].score, 48)
+		}
+	})
+
+	t.Run("scores a block with its timestamp off below a ban", func(t *testing.T) {
+		skewed := &service.InvalidBlockError{Err: fmt.Errorf("Invalid block: %w, too far in the future", coin.ErrBlockTimestamp)}
+		if score := invalidBlockScore(skewed); score >= BAN_THRESHOLD {
+			t.Errorf("expected a skewed timestamp not to ban at once, got score %d", score)
+		}
+
+		invalid := &service.InvalidBlockError{Err: fmt.Errorf("Invalid block: invalid pow")}
+		if score := invalidBlockScore(invalid); score != SCORE_INVALID_BLOCK {
+			t.Errorf("incorrect score. Got: %d. Want: %d", score, SCORE_INVALID_BLOCK)
+		}
+	})
+}
@@ -16,35 +16,70 @@ import (
 	"github.com/cenkalti/backoff/v4"
 )
 
+// PEER_HOST_HEADER names the peer a message is sent from, so that the receiver can request the data it announces and the
+// ancestors it is missing back from it
+const PEER_HOST_HEADER = "X-Firstcoin-Peer"
+
 type Client struct {
-	Peers      *Peers
-	Blockchain *coin.Blockchain
-	ThisPeer   string
+	Peers             *Peers
+	BlockchainService *service.BlockchainService
+	ThisPeer          string
+	Addresses         *AddrManager
+	TLS               *TLSConfig
+	inventory         *inventory
+	conns             *connSet
+	nonce             uint64
+	httpClient        *http.Client
 }
 
-func NewClient(p *Peers, b *coin.Blockchain, t string) *Client {
+func NewClient(p *Peers, s *service.BlockchainService, t string, a *AddrManager) *Client {
 	return &Client{
-		Peers:      p,
-		Blockchain: b,
-		ThisPeer:   t,
+		Peers:             p,
+		BlockchainService: s,
+		ThisPeer:          t,
+		Addresses:         a,
+		inventory:         newInventory(),
+		conns:             newConnSet(),
+		nonce:             randomNonce(),
+		httpClient:        http.DefaultClient,
 	}
 }
 
+// SetTLSConfig makes the client reach peers over TLS if t secures the peer listeners, and the control API of peers if
+// t secures the control listeners
+func (c *Client) SetTLSConfig(t *TLSConfig) {
+	c.TLS = t
+	c.httpClient = t.HTTPClient()
+}
+
+// peerURL is the URL of path on the peer API of the node with hostname
+func (c *Client) peerURL(hostname string, path string) string {
+	if c.TLS != nil && c.TLS.Peer {
+		return fmt.Sprintf("https://%s%s", hostname, path)
+	}
+
+	return fmt.Sprintf("http://%s%s", hostname, path)
+}
+
+// controlURL is the URL of path on the control API at controlHostname
+func (c *Client) controlURL(controlHostname string, path string) string {
+	if c.TLS != nil && c.TLS.Control {
+		return fmt.Sprintf("https://%s%s", controlHostname, path)
+	}
+
+	return fmt.Sprintf("http://%s%s", controlHostname, path)
+}
+
+// BroadcastBlock announces block to the peers that do not have it yet. Blocks are announced right away, the peers
+// request the ones they lack with getdata.
 func (c *Client) BroadcastBlock(block coin.Block) (coin.Block, error) {
-	for _, peer := range c.Peers.Hostnames {
-		if peer != c.ThisPeer {
-			resp, err := httpPostWithBackoff(fmt.Sprintf("http://%s/block", peer), block)
-			if err != nil {
-				utils.ErrorLogger.Println(fmt.Sprintf("error when posting block %s", err))
-
-				// Remove host if error for now
-				c.Peers.RemoveHostname(peer)
-				continue
-			}
-			if resp.StatusCode >= 400 {
-				utils.ErrorLogger.Println(fmt.Sprintf("error from peer when broadcasting block %s", readResponseBody(resp.Body)))
-			}
+	for _, peer := range c.Peers.Hostnames() {
+		if peer == c.ThisPeer {
+			continue
+		}
 
+		if items := c.inventory.unknown(peer, []InvItem{blockInvItem(block)}); len(items) > 0 {
+			c.sendInv(peer, items)
 		}
 	}
 
@@ -52,7 +87,7 @@ func (c *Client) BroadcastBlock(block coin.Block) (coin.Block, error) {
 }
 
 func (c *Client) getBlockchain(address string) (*coin.Blockchain, error) {
-	resp, err := httpGetWithBackoff(fmt.Sprintf("http://%s/block-chain", address))
+	resp, err := c.httpGetWithBackoff(c.peerURL(address, "/block-chain"))
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +109,7 @@ func (c *Client) getBlockchain(address string) (*coin.Blockchain, error) {
 }
 
 func (c *Client) GetLatestBlockFromPeer(peer string) (*coin.Block, error) {
-	resp, err := httpGetWithBackoff(fmt.Sprintf("http://%s/latest-block", peer))
+	resp, err := c.httpGetWithBackoff(c.peerURL(peer, "/latest-block"))
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +125,66 @@ func (c *Client) GetLatestBlockFromPeer(peer string) (*coin.Block, error) {
 	return &block, nil
 }
 
+// GetBlockFromPeer requests the block with hash, in the peer's chain or orphan pool. It is not retried, a peer that does
+// not have the block will not have it later either.
+func (c *Client) GetBlockFromPeer(peer string, hash []byte) (*coin.Block, error) {
+	if conn, ok := c.conns.get(peer); ok {
+		var block coin.Block
+		if err := requestOne(conn, InvItem{Type: INV_BLOCK, Hash: hash}, &block); err != nil {
+			return nil, err
+		}
+
+		return &block, nil
+	}
+
+	resp, err := c.httpClient.Get(c.peerURL(peer, fmt.Sprintf("/block?hash=%x", hash)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s does not have block %x. error: %s", peer, hash, readResponseBody(resp.Body))
+	}
+
+	var block coin.Block
+	if err := json.NewDecoder(resp.Body).Decode(&block); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+// GetTransactionFromPeer requests the tx with txID, in the peer's tx pool or orphan tx pool. Like GetBlockFromPeer it is
+// not retried.
+func (c *Client) GetTransactionFromPeer(peer string, txID []byte) (*repository.Transaction, error) {
+	if conn, ok := c.conns.get(peer); ok {
+		var tx repository.Transaction
+		if err := requestOne(conn, InvItem{Type: INV_TX, Hash: txID}, &tx); err != nil {
+			return nil, err
+		}
+
+		return &tx, nil
+	}
+
+	resp, err := c.httpClient.Get(c.peerURL(peer, fmt.Sprintf("/transaction?id=%x", txID)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s does not have tx %x. error: %s", peer, txID, readResponseBody(resp.Body))
+	}
+
+	var tx repository.Transaction
+	if err := json.NewDecoder(resp.Body).Decode(&tx); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
 func (c *Client) SpendCoin(spendCoinRelay SpendCoinRelay) (*http.Response, error) {
 
 	ct := CreateTransactionControl{
@@ -102,18 +197,25 @@ func (c *Client) SpendCoin(spendCoinRelay SpendCoinRelay) (*http.Response, error
 		return nil, err
 	}
 
-	b := bytes.NewReader(j)
+	controlHostname, err := ControlHostname(spendCoinRelay.Host)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s/spend-coin", spendCoinRelay.Host), "application/json", b)
+	req, err := http.NewRequest("POST", c.controlURL(controlHostname, "/spend-coin"), bytes.NewReader(j))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if spendCoinRelay.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+spendCoinRelay.Token)
+	}
 
-	return resp, nil
+	return c.httpClient.Do(req)
 }
 
 func (c *Client) GetTxPoolFromPeer(peer string) (map[repository.TxIDType]repository.Transaction, error) {
-	resp, err := httpGetWithBackoff(fmt.Sprintf("http://%s/txpool", peer))
+	resp, err := c.httpGetWithBackoff(c.peerURL(peer, "/txpool"))
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +232,10 @@ func (c *Client) GetTxPoolFromPeer(peer string) (map[repository.TxIDType]reposit
 }
 
 func (c *Client) GetPeers(hostName string) (map[string]string, error) {
-	resp, err := httpGetWithBackoff(fmt.Sprintf("http://%s/peers", hostName))
+	resp, err := c.httpGetWithBackoff(c.peerURL(hostName, "/peers"))
+	if err != nil {
+		return nil, err
+	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	var peers map[string]string
 
@@ -142,8 +247,12 @@ func (c *Client) GetPeers(hostName string) (map[string]string, error) {
 	return peers, nil
 }
 
-func (c *Client) GetHosts(hostName string, excludedHosts map[string]Details) ([]Details, error) {
-	resp, err := httpPostWithBackoff(fmt.Sprintf("http://%s/hosts", hostName), excludedHosts)
+// GetHosts asks the peer at hostName for its details followed by the hostnames of its peers
+func (c *Client) GetHosts(hostName string) ([]Details, error) {
+	resp, err := c.httpGetWithBackoff(c.peerURL(hostName, "/hosts"))
+	if err != nil {
+		return nil, err
+	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	var peers []Details
 
@@ -157,6 +266,8 @@ func (c *Client) GetHosts(hostName string, excludedHosts map[string]Details) ([]
 
 // TODO: This will not work - cant simply take the longest chain - malice could have one block longer - should take the one that is 2 or 3 blocks longer
 func (c *Client) QueryPeersForBlockchain(peers map[string]string) error {
+	blockchain := c.BlockchainService.Blockchain
+
 	for address, _ := range peers {
 		if address == c.ThisPeer {
 			continue
@@ -167,39 +278,19 @@ func (c *Client) QueryPeersForBlockchain(peers map[string]string) error {
 			return err
 		}
 
-		if len(c.Blockchain.Blocks) == 0 {
-			bc, err := c.getBlockchain(address)
-			if err != nil {
-				return err
-			}
-
-			forkChain := coin.NewBlockchain(bc.Blocks)
-
-			c.Blockchain.ReplaceBlockchain(*forkChain)
-			// if err := bc.IsValidBlockchain(); err == nil {
-			// } else {
-			// 	return err
-			// }
-
+		if blockchain.Len() > 0 && block.Index <= blockchain.GetLastBlock().Index {
+			continue
 		}
 
-		if len(c.Blockchain.Blocks) > 0 && block.Index > c.Blockchain.GetLastBlock().Index {
-			forkChain, err := c.getBlockchain(address)
-			if err != nil {
-				return err
-			}
-
-			if err := forkChain.IsValidBlockchain(); err != nil {
-				return err
-			}
-			c.Blockchain.ReplaceBlockchain(*forkChain)
+		forkChain, err := c.getBlockchain(address)
+		if err != nil {
+			return err
 		}
-	}
 
-	err := replayBlockChainTransactions(*c.Blockchain)
-	if err != nil {
-		utils.ErrorLogger.Println(err)
-		repository.ClearUTxOSet()
+		// every block of the peer's chain is connected on a fresh uTxO set, the node keeps its own chain if any fails
+		if err := c.BlockchainService.SyncBlockchain(forkChain.GetBlocks()); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -213,7 +304,7 @@ func (c *Client) QueryNetworkForUnconfirmedTxPool(peers map[string]string) error
 			continue
 		}
 
-		repository.SetTxPool(txPool)
+		c.BlockchainService.SetTxPool(txPool)
 		return nil
 	}
 
@@ -226,27 +317,23 @@ func (c *Client) BroadcastOnline(thisHostname string) {
 
 	fmt.Println("Notifying these hosts: ", h)
 
-	for _, hostname := range c.Peers.Hostnames {
-		_, err := httpPostWithBackoff(fmt.Sprintf("http://%s/notify", hostname), h)
+	for _, hostname := range c.Peers.Hostnames() {
+		_, err := c.httpPostWithBackoff(c.peerURL(hostname, "/notify"), h)
 		if err != nil {
 			utils.ErrorLogger.Println(err)
 		}
 	}
 }
 
+// BroadcastTransaction queues tx to be announced to the peers that do not have it yet, by RelayInventory
 func (c *Client) BroadcastTransaction(tx repository.Transaction) error {
-	for _, peer := range c.Peers.Hostnames {
-		if peer != c.ThisPeer {
-			resp, err := httpPostWithBackoff(fmt.Sprintf("http://%s/transaction", peer), tx)
-			if err != nil {
-				utils.ErrorLogger.Println(fmt.Sprintf("peer %s rejected transaction. error: %s", peer, err))
-				continue
-			}
-
-			if resp.StatusCode >= 400 {
-				utils.ErrorLogger.Println(fmt.Sprintf("peer %s rejected transaction. error: %s", peer, readResponseBody(resp.Body)))
-			}
+	for _, peer := range c.Peers.Hostnames() {
+		if peer == c.ThisPeer {
+			continue
+		}
 
+		if items := c.inventory.unknown(peer, []InvItem{txInvItem(tx)}); len(items) > 0 {
+			c.inventory.queue(peer, items)
 		}
 	}
 
@@ -264,26 +351,6 @@ func readResponseBody(body io.ReadCloser) string {
 	return buf.String()
 }
 
-func replayBlockChainTransactions(bc coin.Blockchain) error {
-	if err := bc.Blocks[0].IsGenesisBlock(); err != nil {
-		return fmt.Errorf("Invalid firstcoin: %s. error: %s", "invalid genesis block", err.Error())
-	}
-
-	err := service.CommitBlockTransactions(bc.Blocks[0])
-	if err != nil {
-		return err
-	}
-
-	for _, block := range bc.Blocks[1:] {
-		err := service.CommitBlockTransactions(block)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 var (
 	DefaultInitialInterval     = 500 * time.Millisecond
 	DefaultRandomizationFactor = 0.5
@@ -306,7 +373,12 @@ func NewExponentialBackOff() *backoff.ExponentialBackOff {
 	return b
 }
 
-func httpPostWithBackoff(url string, body interface{}) (*http.Response, error) {
+func (c *Client) httpPostWithBackoff(url string, body interface{}) (*http.Response, error) {
+	return c.httpPostWithBackoffFrom(url, body, "")
+}
+
+// httpPostWithBackoffFrom posts body naming from as the sender in the PEER_HOST_HEADER
+func (c *Client) httpPostWithBackoffFrom(url string, body interface{}, from string) (*http.Response, error) {
 	var resp *http.Response
 	var err error
 
@@ -315,10 +387,17 @@ func httpPostWithBackoff(url string, body interface{}) (*http.Response, error) {
 		return nil, err
 	}
 
-	b := bytes.NewReader(j)
-
 	op := func() error {
-		resp, err = http.Post(url, "application/json", b)
+		req, err := http.NewRequest("POST", url, bytes.NewReader(j))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if from != "" {
+			req.Header.Set(PEER_HOST_HEADER, from)
+		}
+
+		resp, err = c.httpClient.Do(req)
 		if err != nil {
 			utils.ErrorLogger.Printf("%s", err)
 			return err
@@ -341,12 +420,29 @@ func httpPostWithBackoff(url string, body interface{}) (*http.Response, error) {
 	return resp, nil
 }
 
-func httpGetWithBackoff(url string) (*http.Response, error) {
+// httpPostFrom posts body once, naming from as the sender in the PEER_HOST_HEADER
+func (c *Client) httpPostFrom(url string, body interface{}, from string) (*http.Response, error) {
+	j, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(PEER_HOST_HEADER, from)
+
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) httpGetWithBackoff(url string) (*http.Response, error) {
 	var resp *http.Response
 	var err error
 
 	op := func() error {
-		resp, err = http.Get(url)
+		resp, err = c.httpClient.Get(url)
 		if err != nil {
 			utils.ErrorLogger.Printf("%s", err)
 
@@ -0,0 +1,462 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"firstcoin/coin"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// HANDSHAKE_TIMEOUT is how long a new connection has to complete the version/verack handshake
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// PING_INTERVAL is how often a connection is pinged. A peer that has not answered the previous ping by the next one
+	// is disconnected, as is a connection that stays silent for IDLE_TIMEOUT.
+	PING_INTERVAL = 30 * time.Second
+	IDLE_TIMEOUT  = 3 * PING_INTERVAL
+
+	// WRITE_TIMEOUT is how long a message has to be written before the connection is dropped
+	WRITE_TIMEOUT = 30 * time.Second
+
+	// REQUEST_TIMEOUT is how long a getdata sent over a connection waits for its blocks and txs
+	REQUEST_TIMEOUT = 30 * time.Second
+
+	// MAX_QUEUED_MESSAGES is how many messages of a connection wait to be handled before it stops reading
+	MAX_QUEUED_MESSAGES = 100
+)
+
+var ErrConnClosed = errors.New("peer connection closed")
+
+// Conn is a long-lived connection to a peer that completed the handshake. Messages are written whole under a lock, so
+// any goroutine can send. Blocks, txs and notfound messages answering a request are handed to the waiting requester.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	// Version is the version message of the peer, with ProtocolVersion lowered to the version both sides speak
+	Version VersionMessage
+	Inbound bool
+
+	mu          sync.Mutex
+	pending     map[string]chan Message
+	pingNonce   uint64
+	pingSentAt  time.Time
+	pingTime    time.Duration
+	connectedAt time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ConnInfo describes a peer connection to operators
+type ConnInfo struct {
+	Hostname        string  `json:"hostname"`
+	Address         string  `json:"address"`
+	Inbound         bool    `json:"inbound"`
+	ProtocolVersion int     `json:"protocolVersion"`
+	BestHeight      int     `json:"bestHeight"`
+	Services        uint64  `json:"services"`
+	PingTime        float64 `json:"pingTime"`
+	ConnectedAt     int64   `json:"connectedAt"`
+}
+
+// Handshake exchanges version messages with the peer over conn and acknowledges each other's. It refuses a peer on
+// another chain, below MIN_PROTOCOL_VERSION or with the nonce of local, which is a connection to itself. It returns the
+// version of the peer with ProtocolVersion lowered to the version both sides speak.
+func Handshake(conn net.Conn, local VersionMessage) (VersionMessage, error) {
+	return handshake(conn, bufio.NewReader(conn), local)
+}
+
+func handshake(conn net.Conn, reader *bufio.Reader, local VersionMessage) (VersionMessage, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	// messages are written concurrently with reading, an unbuffered conn would otherwise block both sides on a write
+	versionWritten := make(chan error, 1)
+	go func() {
+		versionWritten <- WriteMessage(conn, CMD_VERSION, local)
+	}()
+	verackWritten := make(chan error, 1)
+
+	var remote *VersionMessage
+	acknowledged := false
+	for remote == nil || !acknowledged {
+		msg, err := ReadMessage(reader)
+		if err != nil {
+			return VersionMessage{}, err
+		}
+
+		switch {
+		case msg.Command == CMD_VERSION && remote == nil:
+			var version VersionMessage
+			if err := msg.Decode(&version); err != nil {
+				return VersionMessage{}, err
+			}
+			if err := checkVersion(version, local); err != nil {
+				return VersionMessage{}, err
+			}
+			remote = &version
+
+			go func() {
+				if err := <-versionWritten; err != nil {
+					verackWritten <- err
+					return
+				}
+				verackWritten <- WriteMessage(conn, CMD_VERACK, nil)
+			}()
+
+		case msg.Command == CMD_VERACK && remote != nil:
+			acknowledged = true
+
+		default:
+			return VersionMessage{}, fmt.Errorf("unexpected %s message during handshake", msg.Command)
+		}
+	}
+
+	if err := <-verackWritten; err != nil {
+		return VersionMessage{}, err
+	}
+
+	if remote.ProtocolVersion > local.ProtocolVersion {
+		remote.ProtocolVersion = local.ProtocolVersion
+	}
+
+	return *remote, nil
+}
+
+func checkVersion(remote VersionMessage, local VersionMessage) error {
+	if remote.ProtocolVersion < MIN_PROTOCOL_VERSION {
+		return fmt.Errorf("peer protocol version %d is below the min of %d", remote.ProtocolVersion, MIN_PROTOCOL_VERSION)
+	}
+	if remote.ChainID != local.ChainID {
+		return fmt.Errorf("peer is on chain %q, not %q", remote.ChainID, local.ChainID)
+	}
+	if remote.Nonce == local.Nonce {
+		return fmt.Errorf("connected to self")
+	}
+	if remote.Hostname == "" {
+		return fmt.Errorf("peer did not send its hostname")
+	}
+
+	return nil
+}
+
+// newConn completes the handshake over conn
+func newConn(conn net.Conn, local VersionMessage, inbound bool) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	remote, err := handshake(conn, reader, local)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn:        conn,
+		reader:      reader,
+		Version:     remote,
+		Inbound:     inbound,
+		pending:     make(map[string]chan Message),
+		connectedAt: time.Now(),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// Send writes a message to the peer. A failed write closes the connection.
+func (c *Conn) Send(command string, payload interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if err := WriteMessage(c.conn, command, payload); err != nil {
+		c.Close()
+		return err
+	}
+
+	return nil
+}
+
+// RemoteAddr is the IP and port the connection is from
+func (c *Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// request sends a getdata for items and waits for the peer to send each of them, or notfound. It returns the messages
+// that arrived before REQUEST_TIMEOUT.
+func (c *Conn) request(items []InvItem) ([]Message, error) {
+	responses := make(chan Message, len(items))
+
+	c.mu.Lock()
+	for _, item := range items {
+		c.pending[item.key()] = responses
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		for _, item := range items {
+			if c.pending[item.key()] == responses {
+				delete(c.pending, item.key())
+			}
+		}
+		c.mu.Unlock()
+	}()
+
+	if err := c.Send(CMD_GETDATA, Inv{Items: items}); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(items))
+	timeout := time.After(REQUEST_TIMEOUT)
+	for len(messages) < len(items) {
+		select {
+		case msg := <-responses:
+			messages = append(messages, msg)
+		case <-timeout:
+			return messages, fmt.Errorf("peer %s did not answer getdata in %s", c.Version.Hostname, REQUEST_TIMEOUT)
+		case <-c.closed:
+			return messages, ErrConnClosed
+		}
+	}
+
+	return messages, nil
+}
+
+// deliver hands msg to the request waiting for item, and reports if there was one
+func (c *Conn) deliver(item InvItem, msg Message) bool {
+	c.mu.Lock()
+	responses, ok := c.pending[item.key()]
+	delete(c.pending, item.key())
+	c.mu.Unlock()
+
+	if ok {
+		responses <- msg
+	}
+
+	return ok
+}
+
+// readLoop reads messages until the connection fails. Pings are answered and answers to requests delivered here, the
+// other messages are queued for handle, which handles them in order on a single goroutine, so handling one can wait on a
+// request. With MAX_QUEUED_MESSAGES waiting it stops reading until handle catches up. A ping or a queued message that
+// allow refuses by its command is dropped.
+func (c *Conn) readLoop(allow func(command string) bool, handle func(*Conn, Message)) error {
+	queue := make(chan Message, MAX_QUEUED_MESSAGES)
+	defer close(queue)
+	go c.handleLoop(queue, handle)
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		msg, err := ReadMessage(c.reader)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Command {
+		case CMD_PING:
+			var ping PingMessage
+			if err := msg.Decode(&ping); err != nil {
+				return err
+			}
+			if !allow(msg.Command) {
+				continue
+			}
+			if err := c.Send(CMD_PONG, ping); err != nil {
+				return err
+			}
+			continue
+
+		case CMD_PONG:
+			var pong PingMessage
+			if err := msg.Decode(&pong); err != nil {
+				return err
+			}
+			c.receivePong(pong)
+			continue
+
+		case CMD_VERSION, CMD_VERACK:
+			return fmt.Errorf("unexpected %s message after handshake", msg.Command)
+		}
+
+		if c.deliverResponse(msg) || !allow(msg.Command) {
+			continue
+		}
+
+		select {
+		case queue <- msg:
+		case <-c.closed:
+			return ErrConnClosed
+		}
+	}
+}
+
+// handleLoop passes the messages of queue to handle until the queue or the connection closes
+func (c *Conn) handleLoop(queue <-chan Message, handle func(*Conn, Message)) {
+	for msg := range queue {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		handle(c, msg)
+	}
+}
+
+// deliverResponse hands a block, tx or notfound message to the requests waiting for it
+func (c *Conn) deliverResponse(msg Message) bool {
+	switch msg.Command {
+	case CMD_BLOCK:
+		var block coin.Block
+		if err := msg.Decode(&block); err == nil {
+			return c.deliver(blockInvItem(block), msg)
+		}
+
+	case CMD_TX:
+		var item struct {
+			ID []byte `json:"txid"`
+		}
+		if err := msg.Decode(&item); err == nil {
+			return c.deliver(InvItem{Type: INV_TX, Hash: item.ID}, msg)
+		}
+
+	case CMD_NOTFOUND:
+		var inv Inv
+		if err := msg.Decode(&inv); err != nil {
+			return false
+		}
+
+		delivered := false
+		for _, item := range inv.Items {
+			if c.deliver(item, Message{Command: CMD_NOTFOUND}) {
+				delivered = true
+			}
+		}
+		return delivered
+	}
+
+	return false
+}
+
+// pingLoop pings the peer every PING_INTERVAL until the connection closes, and closes it when a ping goes unanswered
+func (c *Conn) pingLoop(nonce func() uint64) {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		c.mu.Lock()
+		unanswered := c.pingNonce != 0
+		ping := PingMessage{Nonce: nonce()}
+		c.pingNonce = ping.Nonce
+		c.pingSentAt = time.Now()
+		c.mu.Unlock()
+
+		if unanswered {
+			c.Close()
+			return
+		}
+
+		if err := c.Send(CMD_PING, ping); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) receivePong(pong PingMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pong.Nonce != c.pingNonce || c.pingNonce == 0 {
+		return
+	}
+
+	c.pingTime = time.Since(c.pingSentAt)
+	c.pingNonce = 0
+}
+
+// Info describes the connection to operators
+func (c *Conn) Info() ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ConnInfo{
+		Hostname:        c.Version.Hostname,
+		Address:         c.conn.RemoteAddr().String(),
+		Inbound:         c.Inbound,
+		ProtocolVersion: c.Version.ProtocolVersion,
+		BestHeight:      c.Version.BestHeight,
+		Services:        c.Version.Services,
+		PingTime:        c.pingTime.Seconds(),
+		ConnectedAt:     c.connectedAt.Unix(),
+	}
+}
+
+// connSet is the connections of a node by the hostname of the peer, safe for concurrent use
+type connSet struct {
+	mu    sync.RWMutex
+	conns map[string]*Conn
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[string]*Conn)}
+}
+
+func (s *connSet) get(hostname string) (*Conn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conn, ok := s.conns[hostname]
+	return conn, ok
+}
+
+// add keeps conn unless the peer is already connected, which it reports
+func (s *connSet) add(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.conns[conn.Version.Hostname]; ok {
+		return false
+	}
+
+	s.conns[conn.Version.Hostname] = conn
+	return true
+}
+
+func (s *connSet) remove(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns[conn.Version.Hostname] == conn {
+		delete(s.conns, conn.Version.Hostname)
+	}
+}
+
+func (s *connSet) all() []*Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
@@ -0,0 +1,231 @@
+package peer
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConns completes a handshake over a pipe, returning the connection of each side
+func testConns(t *testing.T) (*Conn, *Conn) {
+	version := func(hostname string, nonce uint64) VersionMessage {
+		return VersionMessage{
+			ProtocolVersion: PROTOCOL_VERSION,
+			ChainID:         "firstcoin-test",
+			Services:        SERVICE_NODE_NETWORK,
+			Hostname:        hostname,
+			Nonce:           nonce,
+		}
+	}
+
+	pipeA, pipeB := net.Pipe()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := newConn(pipeB, version("localhost:8081", 2), true)
+		done <- result{conn, err}
+	}()
+
+	connA, err := newConn(pipeA, version("localhost:8080", 1), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resultB := <-done
+	if resultB.err != nil {
+		t.Fatalf("unexpected error: %s", resultB.err)
+	}
+
+	t.Cleanup(func() {
+		connA.Close()
+		resultB.conn.Close()
+	})
+
+	return connA, resultB.conn
+}
+
+func TestConn(t *testing.T) {
+	allowAll := func(string) bool { return true }
+	ignore := func(*Conn, Message) {}
+
+	t.Run("answers a ping with its nonce", func(t *testing.T) {
+		local, remote := testConns(t)
+		go local.readLoop(allowAll, ignore)
+
+		if err := remote.Send(CMD_PING, PingMessage{Nonce: 42}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		msg, err := ReadMessage(remote.reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var pong PingMessage
+		if err := msg.Decode(&pong); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if msg.Command != CMD_PONG || pong.Nonce != 42 {
+			t.Errorf("incorrect answer. Got: %s %d. Want: %s %d", msg.Command, pong.Nonce, CMD_PONG, 42)
+		}
+	})
+
+	t.Run("records the round trip of the pong to its ping only", func(t *testing.T) {
+		local, _ := testConns(t)
+		local.pingNonce = 42
+		local.pingSentAt = time.Now().Add(-time.Second)
+
+		local.receivePong(PingMessage{Nonce: 7})
+		if local.pingNonce != 42 {
+			t.Fatalf("expected a pong with another nonce to be ignored")
+		}
+
+		local.receivePong(PingMessage{Nonce: 42})
+		if local.pingNonce != 0 || local.pingTime < time.Second {
+			t.Errorf("expected the ping to be answered. Got nonce %d, ping time %s", local.pingNonce, local.pingTime)
+		}
+	})
+
+	t.Run("delivers the txs and notfound answering a getdata", func(t *testing.T) {
+		local, remote := testConns(t)
+		go local.readLoop(allowAll, ignore)
+
+		found := InvItem{Type: INV_TX, Hash: []byte("found")}
+		missing := InvItem{Type: INV_TX, Hash: []byte("missing")}
+
+		// the remote side has the found tx only
+		go func() {
+			for {
+				msg, err := ReadMessage(remote.reader)
+				if err != nil {
+					return
+				}
+				var inv Inv
+				if msg.Command != CMD_GETDATA || msg.Decode(&inv) != nil {
+					continue
+				}
+
+				notFound := make([]InvItem, 0)
+				for _, item := range inv.Items {
+					if item.key() == found.key() {
+						remote.Send(CMD_TX, repository.Transaction{ID: found.Hash})
+					} else {
+						notFound = append(notFound, item)
+					}
+				}
+				if len(notFound) > 0 {
+					remote.Send(CMD_NOTFOUND, Inv{Items: notFound})
+				}
+			}
+		}()
+
+		data, err := requestData(local, []InvItem{found, missing})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(data.Transactions) != 1 || !bytes.Equal(data.Transactions[0].ID, found.Hash) {
+			t.Errorf("incorrect txs. Got: %v", data.Transactions)
+		}
+
+		if err := requestOne(local, missing, &repository.Transaction{}); err == nil {
+			t.Errorf("expected an error for a tx the peer did not send")
+		}
+	})
+
+	t.Run("handles the other messages in order", func(t *testing.T) {
+		local, remote := testConns(t)
+
+		var mu sync.Mutex
+		handled := make([]uint64, 0)
+		done := make(chan struct{})
+		go local.readLoop(allowAll, func(conn *Conn, msg Message) {
+			var ping PingMessage
+			msg.Decode(&ping)
+
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, ping.Nonce)
+			if len(handled) == 10 {
+				close(done)
+			}
+		})
+
+		for i := uint64(0); i < 10; i++ {
+			if err := remote.Send("test", PingMessage{Nonce: i}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("messages were not handled")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for i, nonce := range handled {
+			if nonce != uint64(i) {
+				t.Fatalf("incorrect order. Got: %v", handled)
+			}
+		}
+	})
+
+	t.Run("drops the messages past the rate limit of the peer", func(t *testing.T) {
+		local, remote := testConns(t)
+		handler := &CoinServerHandler{RateLimiter: NewRateLimiter(RateLimitConfig{CLASS_GOSSIP: {Rate: 0.001, Burst: 2}})}
+
+		handled := make(chan Message, 5)
+		go local.readLoop(handler.allowMessage(local), func(conn *Conn, msg Message) {
+			handled <- msg
+		})
+
+		for i := 0; i < 5; i++ {
+			if err := remote.Send(CMD_INV, Inv{}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		// the ping is in another class, its pong comes after the invs were read
+		remote.Send(CMD_PING, PingMessage{Nonce: 42})
+		if msg, err := ReadMessage(remote.reader); err != nil || msg.Command != CMD_PONG {
+			t.Fatalf("expected a pong, got: %v, %v", msg.Command, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-handled:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %d messages to be handled", i+1)
+			}
+		}
+		select {
+		case <-handled:
+			t.Errorf("expected the messages past the burst to be dropped")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if rejected := handler.RateLimiter.Metrics().Rejected[CLASS_GOSSIP]; rejected != 3 {
+			t.Errorf("incorrect rejected messages. Got: %d. Want: %d", rejected, 3)
+		}
+	})
+
+	t.Run("refuses a version message after the handshake", func(t *testing.T) {
+		local, remote := testConns(t)
+		result := make(chan error)
+		go func() {
+			result <- local.readLoop(allowAll, ignore)
+		}()
+
+		remote.Send(CMD_VERSION, VersionMessage{})
+		if err := <-result; err == nil || !strings.Contains(err.Error(), "after handshake") {
+			t.Errorf("expected the connection to fail, got: %v", err)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package peer
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"firstcoin/coin"
 	"firstcoin/repository"
 	"firstcoin/service"
@@ -9,28 +11,34 @@ import (
 	"firstcoin/wallet"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
+	"time"
 )
 
 type CoinServerHandler struct {
 	Peers             *Peers
 	Client            *Client
-	BlockchainService service.BlockchainService
+	BlockchainService *service.BlockchainService
+	Bans              *BanManager
+	RateLimiter       *RateLimiter
 }
 
-func NewCoinServerHandler(s service.BlockchainService, c *Client, p *Peers) *CoinServerHandler {
+func NewCoinServerHandler(s *service.BlockchainService, c *Client, p *Peers, b *BanManager, l *RateLimiter) *CoinServerHandler {
 	return &CoinServerHandler{
 		Peers:             p,
 		Client:            c,
 		BlockchainService: s,
+		Bans:              b,
+		RateLimiter:       l,
 	}
 }
 
 func (c *CoinServerHandler) latestBlock(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "GET":
-		latestBlock := c.BlockchainService.Blockchain.Blocks[len(c.BlockchainService.Blockchain.Blocks)-1]
+		latestBlock := c.BlockchainService.Blockchain.GetLastBlock()
 
 		return &HTTPResponse{
 			StatusCode: http.StatusCreated,
@@ -45,10 +53,8 @@ func (c *CoinServerHandler) latestBlock(r *http.Request) (*HTTPResponse, *HTTPEr
 
 func (c *CoinServerHandler) receiveTransaction(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
-	case "POST":
-		tx := repository.Transaction{}
-
-		err := readBody(r, &tx)
+	case "GET":
+		txID, err := hex.DecodeString(r.URL.Query().Get("id"))
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -56,47 +62,160 @@ func (c *CoinServerHandler) receiveTransaction(r *http.Request) (*HTTPResponse,
 			}
 		}
 
-		_, ok := repository.GetTxFromTxPool(tx.ID)
-		if ok {
-			return &HTTPResponse{
-				StatusCode: http.StatusNotModified,
-				Body:       tx,
-			}, nil
+		tx, ok := c.BlockchainService.GetTransaction(txID)
+		if !ok {
+			return nil, &HTTPError{
+				Code:    http.StatusNotFound,
+				Message: fmt.Sprintf("tx %x not found", txID),
+			}
 		}
 
-		err = wallet.IsValidTransaction(tx)
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       tx,
+		}, nil
+
+	case "POST":
+		tx := repository.Transaction{}
+
+		err := readBody(r, &tx)
 		if err != nil {
-			utils.ErrorLogger.Println(fmt.Sprintf("received tx is invalid. error: %s", err.Error()))
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
 				Message: err.Error(),
 			}
 		}
 
-		_, err = service.ValidateTxPoolDryRun(&tx)
-		if err != nil {
-			utils.ErrorLogger.Println(fmt.Sprintf("txPool is invalid. error: %s", err.Error()))
-			return nil, &HTTPError{
-				Code:    http.StatusBadRequest,
-				Message: fmt.Sprintf("txPool is invalid. error: %s", err.Error()),
-			}
+		return c.acceptTransaction(tx, c.senderPeer(r), r.RemoteAddr)
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// acceptTransaction processes a tx sent by peer from addr, and relays the txs that entered the tx pool. The txs it spends
+// from are requested from the peer in the background if they are missing. An invalid tx adds to the ban score of the peer.
+func (c *CoinServerHandler) acceptTransaction(tx repository.Transaction, peer string, addr string) (*HTTPResponse, *HTTPError) {
+	c.Client.MarkKnown(peer, txInvItem(tx))
+
+	_, ok := c.BlockchainService.TxPool.Get(tx.ID)
+	if ok {
+		return &HTTPResponse{
+			StatusCode: http.StatusNotModified,
+			Body:       tx,
+		}, nil
+	}
+
+	// the tx is validated on top of the tx pool, as it can spend the outputs of unconfirmed txs or replace pool txs
+	nextBlockIndex := c.BlockchainService.Blockchain.GetLastBlock().Index + 1
+	source, _ := BanAddress(addr)
+	accepted, evicted, err := c.BlockchainService.ProcessTransactionFrom(tx, nextBlockIndex, source)
+
+	// a tx can be relayed before the txs it spends from, the peer that relayed it has them
+	var missingInputs *service.MissingInputsError
+	if errors.As(err, &missingInputs) {
+		utils.InfoLogger.Println(err)
+		c.requestMissingTxsInBackground(peer, addr, missingInputs.Missing, nextBlockIndex)
+
+		return &HTTPResponse{
+			StatusCode: http.StatusAccepted,
+			Body:       tx,
+		}, nil
+	} else if err != nil {
+		utils.ErrorLogger.Println(err.Error())
+
+		var invalidTx *service.InvalidTxError
+		if errors.As(err, &invalidTx) {
+			c.misbehaving(addr, SCORE_INVALID_TX, err.Error())
 		}
 
-		ok = c.BlockchainService.AddTxToTxPool(tx)
-		if ok {
-			utils.InfoLogger.Println("Received new Tx and added to pool. Relaying tx pool")
-			c.Client.BroadcastTransaction(tx)
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
 		}
+	}
+	c.relayAcceptedTxs(accepted, evicted)
 
+	if _, ok := c.BlockchainService.TxPool.Get(tx.ID); !ok {
 		return &HTTPResponse{
-			StatusCode: http.StatusCreated,
+			StatusCode: http.StatusAccepted,
 			Body:       tx,
 		}, nil
 	}
 
-	return nil, &HTTPError{
-		Code: http.StatusMethodNotAllowed,
+	return &HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       tx,
+	}, nil
+}
+
+// relayAcceptedTxs relays the txs that entered the tx pool, and updates the pending txs of the wallet if txs left it
+func (c *CoinServerHandler) relayAcceptedTxs(accepted []repository.Transaction, evicted []repository.Transaction) {
+	if len(evicted) > 0 {
+		utils.InfoLogger.Printf("Received tx replaced %d txs in the pool\n", len(evicted))
+		c.BlockchainService.SyncPendingTxs()
+	}
+
+	utils.InfoLogger.Printf("Received new Tx, %d txs added to pool. Relaying them\n", len(accepted))
+	for _, acceptedTx := range accepted {
+		c.Client.BroadcastTransaction(acceptedTx)
+	}
+}
+
+// requestMissingTxsInBackground runs requestMissingTxs as one of the getdata requests in flight and relays the txs that
+// entered the tx pool, so the handler does not wait for the peer. With MAX_GETDATA_IN_FLIGHT requests running the txs
+// are not requested, the orphan tx waits in the orphan pool for its parents to be relayed.
+func (c *CoinServerHandler) requestMissingTxsInBackground(peer string, addr string, missing [][]byte, nextBlockIndex int) {
+	if peer == "" || !c.Client.inventory.startFetch() {
+		return
+	}
+
+	go func() {
+		defer c.Client.inventory.endFetch()
+		c.relayAcceptedTxs(c.requestMissingTxs(peer, addr, missing, nextBlockIndex))
+	}()
+}
+
+// requestMissingTxs requests the txs an orphan tx spends from the peer that relayed it, and the txs they spend from in
+// turn, until the orphan can enter the tx pool or MAX_ORPHAN_TXS txs were requested. It returns the txs that entered the
+// pool and those that left it.
+func (c *CoinServerHandler) requestMissingTxs(peer string, addr string, missing [][]byte, nextBlockIndex int) ([]repository.Transaction, []repository.Transaction) {
+	accepted := make([]repository.Transaction, 0)
+	evicted := make([]repository.Transaction, 0)
+	if peer == "" {
+		return accepted, evicted
+	}
+	source, _ := BanAddress(addr)
+
+	for requested := 0; len(missing) > 0 && requested < service.MAX_ORPHAN_TXS; requested++ {
+		txID := missing[0]
+		missing = missing[1:]
+
+		tx, err := c.Client.GetTransactionFromPeer(peer, txID)
+		if err != nil {
+			utils.ErrorLogger.Println(err)
+			continue
+		}
+		c.Client.MarkKnown(peer, txInvItem(*tx))
+
+		txAccepted, txEvicted, err := c.BlockchainService.ProcessTransactionFrom(*tx, nextBlockIndex, source)
+		accepted = append(accepted, txAccepted...)
+		evicted = append(evicted, txEvicted...)
+
+		var missingInputs *service.MissingInputsError
+		var invalidTx *service.InvalidTxError
+		if errors.As(err, &missingInputs) {
+			missing = append(missing, missingInputs.Missing...)
+		} else if errors.As(err, &invalidTx) {
+			utils.ErrorLogger.Println(err)
+			c.misbehaving(addr, SCORE_INVALID_TX, err.Error())
+		} else if err != nil {
+			utils.ErrorLogger.Println(err)
+		}
 	}
+
+	return accepted, evicted
 }
 
 func (c *CoinServerHandler) spendCoinRelay(r *http.Request) (*HTTPResponse, *HTTPError) {
@@ -111,6 +230,14 @@ func (c *CoinServerHandler) spendCoinRelay(r *http.Request) (*HTTPResponse, *HTT
 			}
 		}
 
+		// a relay is only sent to a node of the network, and only carries the token of the caller back to this node
+		if _, ok := c.Peers.Hostnames()[scr.Host]; !ok && scr.Host != c.Client.ThisPeer {
+			return nil, NewHTTPError(http.StatusBadRequest, "%s is not a peer of this node", scr.Host)
+		}
+		if scr.Host == c.Client.ThisPeer && scr.Token == "" {
+			scr.Token = requestToken(r)
+		}
+
 		resp, err := c.Client.SpendCoin(scr)
 		if err != nil {
 			return nil, &HTTPError{
@@ -126,6 +253,7 @@ func (c *CoinServerHandler) spendCoinRelay(r *http.Request) (*HTTPResponse, *HTT
 			}
 		}
 
+		scr.Token = ""
 		return &HTTPResponse{
 			StatusCode: http.StatusCreated,
 			Body:       scr,
@@ -150,23 +278,16 @@ func (c *CoinServerHandler) createTransaction(r *http.Request) (*HTTPResponse, *
 			}
 		}
 
-		tx, err := c.BlockchainService.CreateTx(cc.Address, cc.Amount)
-		if err != nil {
-			return nil, &HTTPError{
-				Code:    http.StatusBadRequest,
-				Message: err.Error(),
-			}
+		payments := cc.Payments
+		if len(payments) == 0 {
+			payments = []wallet.Payment{{Address: cc.Address, Amount: cc.Amount}}
 		}
 
-		tID := wallet.GenerateTransactionID(*tx)
-		if !reflect.DeepEqual(tID, tx.ID) {
-			return nil, &HTTPError{
-				Code:    http.StatusBadRequest,
-				Message: "unequal tx ids",
-			}
+		if cc.Batch {
+			return c.queuePayments(cc, payments)
 		}
 
-		err = wallet.IsValidTransaction(*tx)
+		coinSelection, err := wallet.CoinSelectionStrategyByName(cc.CoinSelection)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -174,18 +295,14 @@ func (c *CoinServerHandler) createTransaction(r *http.Request) (*HTTPResponse, *
 			}
 		}
 
-		_, err = service.ValidateTxPoolDryRun(tx)
-		if err != nil {
-			utils.ErrorLogger.Println(fmt.Sprintf("txPool is invalid. error: %s", err.Error()))
-			return nil, &HTTPError{
-				Code:    http.StatusBadRequest,
-				Message: fmt.Sprintf("txPool is invalid. error: %s", err.Error()),
-			}
-		}
-
-		repository.AddTxToTxPool(*tx)
-
-		err = c.Client.BroadcastTransaction(*tx)
+		tx, err := c.BlockchainService.CreateTx(payments, wallet.TxOptions{
+			Locktime:      cc.Locktime,
+			Sequence:      cc.Sequence,
+			LockUntil:     cc.LockUntil,
+			FeeRate:       cc.FeeRate,
+			CoinSelection: coinSelection,
+			Replaceable:   cc.Replaceable,
+		})
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -193,11 +310,7 @@ func (c *CoinServerHandler) createTransaction(r *http.Request) (*HTTPResponse, *
 			}
 		}
 
-		return &HTTPResponse{
-			StatusCode: http.StatusCreated,
-			Body:       tx,
-		}, nil
-
+		return c.submitTransaction(tx)
 	}
 
 	return nil, &HTTPError{
@@ -205,31 +318,53 @@ func (c *CoinServerHandler) createTransaction(r *http.Request) (*HTTPResponse, *
 	}
 }
 
-func (c *CoinServerHandler) getTxPool(r *http.Request) (*HTTPResponse, *HTTPError) {
-	switch r.Method {
-	case "GET":
-
-		return &HTTPResponse{
-			StatusCode: http.StatusOK,
-			Body:       repository.GetTxPool(),
-		}, nil
-
+func (c *CoinServerHandler) queuePayments(cc CreateTransactionControl, payments []wallet.Payment) (*HTTPResponse, *HTTPError) {
+	if cc.Locktime != 0 || cc.Sequence != 0 || cc.LockUntil != 0 {
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: "timelocks cannot be set on batched payments",
+		}
 	}
 
-	return nil, &HTTPError{
-		Code: http.StatusMethodNotAllowed,
+	if err := c.BlockchainService.QueuePayments(payments); err != nil {
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
 	}
+
+	return &HTTPResponse{
+		StatusCode: http.StatusAccepted,
+		Body:       c.BlockchainService.QueuedPayments(),
+	}, nil
 }
 
-func (c *CoinServerHandler) getTxSet(r *http.Request) (*HTTPResponse, *HTTPError) {
+// GET lists the queued payments, POST sends them all in one tx
+func (c *CoinServerHandler) paymentBatch(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "GET":
-
 		return &HTTPResponse{
 			StatusCode: http.StatusOK,
-			Body:       repository.GetEntireUTxOSet(),
+			Body:       c.BlockchainService.QueuedPayments(),
 		}, nil
+	case "POST":
+		tx, payments, err := c.BlockchainService.FlushPayments()
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		resp, httpErr := c.submitTransaction(tx)
+		if httpErr != nil {
+			if err := c.BlockchainService.QueuePayments(payments); err != nil {
+				utils.ErrorLogger.Printf("could not queue payments again after failed flush: %s\n", err)
+			}
+			return nil, httpErr
+		}
 
+		return resp, nil
 	}
 
 	return nil, &HTTPError{
@@ -237,72 +372,87 @@ func (c *CoinServerHandler) getTxSet(r *http.Request) (*HTTPResponse, *HTTPError
 	}
 }
 
-func (c *CoinServerHandler) getBlockchain(r *http.Request) (*HTTPResponse, *HTTPError) {
-	switch r.Method {
-	case "GET":
-
-		return &HTTPResponse{
-			StatusCode: http.StatusOK,
-			Body:       c.BlockchainService.Blockchain.Blocks,
-		}, nil
-
+// submitTransaction validates a transaction created on this node, adds it to the pool and broadcasts it. A tx that
+// does not make it into the pool gives back the uTxOs reserved for it.
+func (c *CoinServerHandler) submitTransaction(tx *repository.Transaction) (*HTTPResponse, *HTTPError) {
+	tID := wallet.GenerateTransactionID(*tx)
+	if !reflect.DeepEqual(tID, tx.ID) {
+		c.BlockchainService.ReleaseTx(tx.ID)
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: "unequal tx ids",
+		}
 	}
 
-	return nil, &HTTPError{
-		Code: http.StatusMethodNotAllowed,
+	// the tx is validated on top of the tx pool, as it can spend the change of this node's unconfirmed txs or replace
+	// them with a higher fee
+	evicted, err := c.BlockchainService.AcceptToTxPool(*tx, c.BlockchainService.Blockchain.GetLastBlock().Index+1)
+	if err != nil {
+		utils.ErrorLogger.Println(err.Error())
+		c.BlockchainService.ReleaseTx(tx.ID)
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
 	}
-}
-
-func convertHostnamesToArray(hosts map[string]Details) []Details {
-	hostnames := make([]Details, 0)
+	if len(evicted) > 0 {
+		c.BlockchainService.SyncPendingTxs()
+	}
+	c.BlockchainService.TrackPendingTx(*tx)
 
-	for _, details := range hosts {
-		hostnames = append(hostnames, details)
+	err = c.Client.BroadcastTransaction(*tx)
+	if err != nil {
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
 	}
 
-	return hostnames
+	return &HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       tx,
+	}, nil
 }
 
-func (c *CoinServerHandler) getHostsRecursive(r *http.Request) (*HTTPResponse, *HTTPError) {
+func (c *CoinServerHandler) multisig(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "POST":
-		excludedHosts := make(map[string]Details, 0)
-
-		err := readBody(r, &excludedHosts)
+		mc := MultisigControl{}
+		err := readBody(r, &mc)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
 				Message: err.Error(),
 			}
 		}
-		address := c.BlockchainService.Wallet.Crypt.FirstcoinAddress
-		excludedHosts[c.Client.ThisPeer] = Details{
-			Address:     address,
-			TotalAmount: wallet.GetTotalAmount(address),
-			HostName:    c.Client.ThisPeer,
-		}
 
-		for hostname, _ := range c.Peers.Hostnames {
-			if excludedHosts[hostname].HostName != "" {
-				continue
+		multisig, err := c.BlockchainService.CreateMultisig(mc.M, mc.PublicKeys)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
 			}
+		}
 
-			peersHostNames, err := c.Client.GetHosts(hostname, excludedHosts)
-			if err != nil {
-				utils.ErrorLogger.Println(err)
-			}
+		return &HTTPResponse{
+			StatusCode: http.StatusCreated,
+			Body:       multisig,
+		}, nil
 
-			for _, hostDetails := range peersHostNames {
-				excludedHosts[hostDetails.HostName] = hostDetails
-			}
+	case "GET":
+		multisigs := make([]MultisigDetails, 0)
+		uTxOSet := c.BlockchainService.UTxOSet.Copy()
+		for _, multisig := range c.BlockchainService.Multisigs() {
+			multisigs = append(multisigs, MultisigDetails{
+				Multisig:    multisig,
+				TotalAmount: wallet.GetTotalAmount(multisig.ScriptPubKey(), uTxOSet),
+			})
 		}
 
-		hostnames := convertHostnamesToArray(excludedHosts)
 		return &HTTPResponse{
 			StatusCode: http.StatusOK,
-			Body:       hostnames,
+			Body:       multisigs,
 		}, nil
-
 	}
 
 	return nil, &HTTPError{
@@ -310,22 +460,30 @@ func (c *CoinServerHandler) getHostsRecursive(r *http.Request) (*HTTPResponse, *
 	}
 }
 
-// This gets this host's publicKey, and total amount.
-func (c *CoinServerHandler) getHostDetails(r *http.Request) (*HTTPResponse, *HTTPError) {
-	address := c.BlockchainService.Wallet.Crypt.FirstcoinAddress
+func (c *CoinServerHandler) spendMultisig(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		sm := SpendMultisigControl{}
+		err := readBody(r, &sm)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
 
-	totalAmount := wallet.GetTotalAmount(address)
+		pst, err := c.BlockchainService.CreateMultisigTx(sm.MultisigAddress, sm.Address, sm.Amount, sm.FeeRate)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
 
-	switch r.Method {
-	case "GET":
 		return &HTTPResponse{
-			StatusCode: http.StatusOK,
-			Body: Details{
-				Address:     address,
-				TotalAmount: totalAmount,
-			},
+			StatusCode: http.StatusCreated,
+			Body:       pst,
 		}, nil
-
 	}
 
 	return nil, &HTTPError{
@@ -333,18 +491,12 @@ func (c *CoinServerHandler) getHostDetails(r *http.Request) (*HTTPResponse, *HTT
 	}
 }
 
-type Details struct {
-	Address     []byte `json:"address"`
-	TotalAmount int    `json:"totalAmount"`
-	HostName    string `json:"hostname"`
-}
-
-func (c *CoinServerHandler) peers(r *http.Request) (*HTTPResponse, *HTTPError) {
+// POST replaces a pending replaceable tx of this node by one paying a higher fee rate
+func (c *CoinServerHandler) bumpFee(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "POST":
-		t := HostName{}
-
-		err := readBody(r, &t)
+		cb := BumpFeeControl{}
+		err := readBody(r, &cb)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -352,21 +504,15 @@ func (c *CoinServerHandler) peers(r *http.Request) (*HTTPResponse, *HTTPError) {
 			}
 		}
 
-		fmt.Printf("Adding hostname to list of peers %+v\n", t)
-
-		c.Peers.AddHostname(t.Hostname)
-
-		fmt.Printf("current hostNames %+v", c.Peers.Hostnames)
-
-		return &HTTPResponse{
-			StatusCode: http.StatusOK,
-		}, nil
+		tx, err := c.BlockchainService.BumpFee(cb.TxID, cb.FeeRate)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
 
-	case "GET":
-		return &HTTPResponse{
-			StatusCode: http.StatusOK,
-			Body:       c.Peers.Hostnames,
-		}, nil
+		return c.submitTransaction(tx)
 	}
 
 	return nil, &HTTPError{
@@ -374,13 +520,33 @@ func (c *CoinServerHandler) peers(r *http.Request) (*HTTPResponse, *HTTPError) {
 	}
 }
 
-func (c *CoinServerHandler) blockChain(r *http.Request) (*HTTPResponse, *HTTPError) {
+// GET lists the vesting outputs this node can claim, POST claims one once its locktime is reached
+func (c *CoinServerHandler) vesting(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "GET":
 		return &HTTPResponse{
 			StatusCode: http.StatusOK,
-			Body:       c.BlockchainService.Blockchain,
+			Body:       c.BlockchainService.GetVestingUTxOs(),
 		}, nil
+	case "POST":
+		cv := ClaimVestingControl{}
+		err := readBody(r, &cv)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		tx, err := c.BlockchainService.ClaimVestingTx(cv.TxID, cv.TxOIndex, cv.Address)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return c.submitTransaction(tx)
 	}
 
 	return nil, &HTTPError{
@@ -388,11 +554,12 @@ func (c *CoinServerHandler) blockChain(r *http.Request) (*HTTPResponse, *HTTPErr
 	}
 }
 
-func (c *CoinServerHandler) mineBlock(r *http.Request) (*HTTPResponse, *HTTPError) {
+// fund an htlc refundable to this node. The response carries the redeem script the counterparty needs to audit and claim it
+func (c *CoinServerHandler) fundHTLC(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "POST":
-		block := coin.Block{}
-		err := readBody(r, &block)
+		fc := FundHTLCControl{}
+		err := readBody(r, &fc)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -400,35 +567,26 @@ func (c *CoinServerHandler) mineBlock(r *http.Request) (*HTTPResponse, *HTTPErro
 			}
 		}
 
-		if block.Index == c.BlockchainService.Blockchain.GetLastBlock().Index {
-			utils.InfoLogger.Println("Block already exists in blockchain")
-			return &HTTPResponse{
-				StatusCode: http.StatusAlreadyReported,
-				Body:       c.BlockchainService.Blockchain,
-			}, nil
-		}
-
-		if err := block.IsValidBlock(c.BlockchainService.Blockchain.GetLastBlock()); err != nil {
-			utils.ErrorLogger.Println(err)
+		htlc, tx, err := c.BlockchainService.FundHTLC(fc.SecretHash, fc.Address, fc.Locktime, fc.Amount)
+		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
-				Message: fmt.Sprintf("Could not update blockchain. error: %s", err.Error()),
+				Message: err.Error(),
 			}
 		}
 
-		// TODO: This needs to be added to a fork (need to implement forks first). It is not a given that the block should be accepted
-		//just because it has valid POW, and "fits" on to the chain.
-		c.BlockchainService.Blockchain.AddBlock(block)
-		service.CommitBlockTransactions(block)
-
-		// this is relaying an accepted block to the network. Right now it simply sends to all the peers. The node that originally sent
-		// the block only adds it block to its own chain if it receives it back from the network.
-		c.Client.BroadcastBlock(block)
+		resp, httpErr := c.submitTransaction(tx)
+		if httpErr != nil {
+			return nil, httpErr
+		}
 
-		return &HTTPResponse{
-			StatusCode: http.StatusCreated,
-			Body:       c.BlockchainService.Blockchain,
-		}, nil
+		resp.Body = HTLCDetails{
+			HTLC:         htlc,
+			RedeemScript: htlc.RedeemScript(),
+			Address:      htlc.Address(),
+			Tx:           tx,
+		}
+		return resp, nil
 	}
 
 	return nil, &HTTPError{
@@ -436,11 +594,11 @@ func (c *CoinServerHandler) mineBlock(r *http.Request) (*HTTPResponse, *HTTPErro
 	}
 }
 
-func (c *CoinServerHandler) createBlock(r *http.Request) (*HTTPResponse, *HTTPError) {
+func (c *CoinServerHandler) claimHTLC(r *http.Request) (*HTTPResponse, *HTTPError) {
 	switch r.Method {
 	case "POST":
-		data := BlockDataControl{}
-		err := readBody(r, &data)
+		sc := SpendHTLCControl{}
+		err := readBody(r, &sc)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
@@ -448,27 +606,15 @@ func (c *CoinServerHandler) createBlock(r *http.Request) (*HTTPResponse, *HTTPEr
 			}
 		}
 
-		block, blockchain, err := c.BlockchainService.CreateNextBlock()
+		tx, err := c.BlockchainService.ClaimHTLC(sc.RedeemScript, sc.TxID, sc.TxOIndex, sc.Secret, sc.Address)
 		if err != nil {
 			return nil, &HTTPError{
 				Code:    http.StatusBadRequest,
 				Message: err.Error(),
 			}
 		}
-		c.Client.BroadcastBlock(*block)
-
-		payload := struct {
-			Blocks              []coin.Block                                   `json:"blocks"`
-			UnspentTransactions map[repository.TxIDType]repository.Transaction `json:"unspentTransactions"`
-		}{
-			Blocks:              blockchain.Blocks,
-			UnspentTransactions: repository.GetEntireUTxOSet(),
-		}
 
-		return &HTTPResponse{
-			StatusCode: http.StatusCreated,
-			Body:       payload,
-		}, nil
+		return c.submitTransaction(tx)
 	}
 
 	return nil, &HTTPError{
@@ -476,11 +622,1027 @@ func (c *CoinServerHandler) createBlock(r *http.Request) (*HTTPResponse, *HTTPEr
 	}
 }
 
-func readBody(request *http.Request, params interface{}) error {
-	reqBody, err := ioutil.ReadAll(request.Body)
-	if err != nil {
-		return fmt.Errorf("cant read body %s. error: %s", request.Body, err.Error())
-	}
+func (c *CoinServerHandler) refundHTLC(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		sc := SpendHTLCControl{}
+		err := readBody(r, &sc)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		tx, err := c.BlockchainService.RefundHTLC(sc.RedeemScript, sc.TxID, sc.TxOIndex, sc.Address)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return c.submitTransaction(tx)
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// publish a data or document commitment in a data carrier tx
+func (c *CoinServerHandler) publishCommitment(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		cc := CommitmentControl{}
+		err := readBody(r, &cc)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		tx, err := c.BlockchainService.PublishData(cc.commitment())
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		resp, httpErr := c.submitTransaction(tx)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+
+		resp.Body = CommitmentDetails{
+			Data: cc.commitment(),
+			Tx:   tx,
+		}
+		return resp, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// POST with a commitment returns the proof that it was included in the chain, PUT with a proof verifies it against this node's chain
+func (c *CoinServerHandler) commitmentProof(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		cc := CommitmentControl{}
+		err := readBody(r, &cc)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		proof, err := c.BlockchainService.ProveData(cc.commitment())
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusNotFound,
+				Message: err.Error(),
+			}
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       proof,
+		}, nil
+	case "PUT":
+		proof := coin.InclusionProof{}
+		err := readBody(r, &proof)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		if err := c.BlockchainService.Blockchain.VerifyInclusionProof(proof); err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       proof,
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) signPartialTx(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		pst := wallet.PartiallySignedTransaction{}
+		err := readBody(r, &pst)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		signed, err := c.BlockchainService.SignPartialTx(pst)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       signed,
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// takes the copies of the partially signed tx returned by each cosigner, combines them and submits the final tx
+func (c *CoinServerHandler) submitPartialTxs(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		psts := make([]wallet.PartiallySignedTransaction, 0)
+		err := readBody(r, &psts)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		tx, err := c.BlockchainService.FinalizePartialTxs(psts)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return c.submitTransaction(tx)
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) getTxPool(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.BlockchainService.TxPool.Map(),
+		}, nil
+
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) getTxPoolInfo(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.BlockchainService.GetTxPoolInfo(),
+		}, nil
+
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) getTxSet(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.BlockchainService.UTxOSet.Copy(),
+		}, nil
+
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) getBlockchain(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.BlockchainService.Blockchain.GetBlocks(),
+		}, nil
+
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// connections lists the peer connections of this node
+func (c *CoinServerHandler) connections(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Client.Connections(),
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// addresses lists the peer addresses this node knows, with their connection history
+func (c *CoinServerHandler) addresses(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Client.Addresses.KnownAddresses(),
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// BanControl bans Address, an IP, for Duration seconds, DEFAULT_BAN_DURATION when zero
+type BanControl struct {
+	Address  string `json:"address"`
+	Duration int64  `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+func (c *CoinServerHandler) bans(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Bans.Bans(),
+		}, nil
+
+	case "POST":
+		ban := BanControl{}
+		if err := readBody(r, &ban); err != nil {
+			return nil, NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if ban.Duration < 0 {
+			return nil, NewHTTPError(http.StatusBadRequest, "duration must not be negative")
+		}
+		duration := DEFAULT_BAN_DURATION
+		if ban.Duration > 0 {
+			duration = time.Duration(ban.Duration) * time.Second
+		}
+		if ban.Reason == "" {
+			ban.Reason = "banned by operator"
+		}
+
+		address, err := BanAddress(ban.Address)
+		if err != nil {
+			return nil, NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := c.Bans.Ban(address, duration, ban.Reason); err != nil {
+			utils.ErrorLogger.Printf("could not save bans. error: %s", err)
+		}
+		c.disconnect(address)
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Bans.Bans(),
+		}, nil
+
+	case "DELETE":
+		address := r.URL.Query().Get("address")
+		banned, err := c.Bans.Unban(address)
+		if !banned && err != nil {
+			return nil, NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if !banned {
+			return nil, NewHTTPError(http.StatusNotFound, "%s is not banned", address)
+		}
+		if err != nil {
+			utils.ErrorLogger.Printf("could not save bans. error: %s", err)
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Bans.Bans(),
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// misbehaving adds score to the ban score of the peer at addr, and disconnects it once it is banned
+func (c *CoinServerHandler) misbehaving(addr string, score int, reason string) {
+	banned, err := c.Bans.Misbehaving(addr, score, reason)
+	if err != nil {
+		utils.ErrorLogger.Printf("could not score peer %s. error: %s", addr, err)
+	}
+	if !banned {
+		return
+	}
+
+	utils.InfoLogger.Printf("banned peer %s. reason: %s\n", addr, reason)
+	c.disconnect(addr)
+}
+
+// disconnect closes the connections to the peer at addr and drops it from the peers messages are sent to
+func (c *CoinServerHandler) disconnect(addr string) {
+	address, err := BanAddress(addr)
+	if err != nil {
+		return
+	}
+
+	for _, conn := range c.Client.conns.all() {
+		if remote, err := BanAddress(conn.RemoteAddr()); err == nil && remote == address {
+			c.Peers.RemoveHostname(conn.Version.Hostname)
+			conn.Close()
+		}
+	}
+}
+
+// peerEndpoint refuses requests from banned peers, and scores peers sending a body larger than the endpoint allows
+func (c *CoinServerHandler) peerEndpoint(handler ServiceHandler) ServiceHandler {
+	return func(r *http.Request) (*HTTPResponse, *HTTPError) {
+		if c.Bans.IsBanned(r.RemoteAddr) {
+			return nil, NewHTTPError(http.StatusForbidden, "%s is banned", r.RemoteAddr)
+		}
+
+		response, err := handler(r)
+		if body, ok := r.Body.(*limitedBody); ok && body.exceeded {
+			c.misbehaving(r.RemoteAddr, SCORE_OVERSIZED_MESSAGE, "oversized request body")
+		}
+
+		return response, err
+	}
+}
+
+// senderPeer is the hostname the sender of r names in the PEER_HOST_HEADER, or empty if it names none. Data is requested
+// back from that hostname, so a hostname that does not resolve to the address of the sender is scored and not used.
+func (c *CoinServerHandler) senderPeer(r *http.Request) string {
+	peer := r.Header.Get(PEER_HOST_HEADER)
+	if peer == "" {
+		return ""
+	}
+
+	if !resolvesTo(peer, r.RemoteAddr) {
+		c.misbehaving(r.RemoteAddr, SCORE_FAKE_HOSTNAME, fmt.Sprintf("named peer %q", peer))
+		return ""
+	}
+
+	return peer
+}
+
+// resolvesTo reports if hostname names the host at addr, so a peer cannot announce a hostname that is not its own
+func resolvesTo(hostname string, addr string) bool {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return false
+	}
+	remote, err := BanAddress(addr)
+	if err != nil {
+		return false
+	}
+
+	// a node without HOST_NAME is dialed on the local machine, like net.Dial does with an empty host
+	if host == "" {
+		host = "localhost"
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if resolved, err := BanAddress(ip); err == nil && resolved == remote {
+			return true
+		}
+	}
+
+	return false
+}
+
+func convertHostnamesToArray(hosts map[string]Details) []Details {
+	hostnames := make([]Details, 0)
+
+	for _, details := range hosts {
+		hostnames = append(hostnames, details)
+	}
+
+	return hostnames
+}
+
+// MAX_CRAWLED_HOSTS is the most hosts the control API asks for their details and peers when it crawls the network
+const MAX_CRAWLED_HOSTS = 100
+
+// hosts answers a peer with the details of this node followed by the hostnames of its peers. It asks no other node, so
+// a peer cannot make it fan out to the network.
+func (c *CoinServerHandler) hosts(r *http.Request) (*HTTPResponse, *HTTPError) {
+	if r.Method != "GET" {
+		return nil, &HTTPError{
+			Code: http.StatusMethodNotAllowed,
+		}
+	}
+
+	hosts := []Details{c.hostDetails()}
+	for hostname := range c.Peers.Hostnames() {
+		hosts = append(hosts, Details{HostName: hostname})
+	}
+
+	return &HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       hosts,
+	}, nil
+}
+
+// getHostsRecursive crawls the network for the control API. It asks the peers of this node, and the peers they name in
+// turn, for their details, up to MAX_CRAWLED_HOSTS hosts. The hosts in the body are known already and not asked.
+func (c *CoinServerHandler) getHostsRecursive(r *http.Request) (*HTTPResponse, *HTTPError) {
+	if r.Method != "POST" {
+		return nil, &HTTPError{
+			Code: http.StatusMethodNotAllowed,
+		}
+	}
+
+	knownHosts := make(map[string]Details, 0)
+	if err := readBody(r, &knownHosts); err != nil {
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	knownHosts[c.Client.ThisPeer] = c.hostDetails()
+
+	queue := make([]string, 0)
+	for hostname := range c.Peers.Hostnames() {
+		queue = append(queue, hostname)
+	}
+
+	for asked := 0; len(queue) > 0 && asked < MAX_CRAWLED_HOSTS; {
+		hostname := queue[0]
+		queue = queue[1:]
+		if _, ok := knownHosts[hostname]; ok {
+			continue
+		}
+		asked++
+
+		// the first host is the one asked, the others its peers
+		hosts, err := c.Client.GetHosts(hostname)
+		if err != nil || len(hosts) == 0 {
+			utils.ErrorLogger.Printf("could not get the hosts of %s. error: %v", hostname, err)
+			continue
+		}
+		hosts[0].HostName = hostname
+		knownHosts[hostname] = hosts[0]
+
+		for _, peer := range hosts[1:] {
+			if _, ok := knownHosts[peer.HostName]; !ok && peer.HostName != "" {
+				queue = append(queue, peer.HostName)
+			}
+		}
+	}
+
+	return &HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       convertHostnamesToArray(knownHosts),
+	}, nil
+}
+
+// hostDetails are the details of this node's wallet, as shared with peers
+func (c *CoinServerHandler) hostDetails() Details {
+	crypt := c.BlockchainService.Wallet.Crypt
+
+	return Details{
+		Address:     crypt.FirstcoinAddress,
+		TotalAmount: wallet.GetTotalAmount(crypt.ScriptPubKey, c.BlockchainService.UTxOSet.Copy()),
+		HostName:    c.Client.ThisPeer,
+	}
+}
+
+// This gets this host's publicKey, and total amount.
+func (c *CoinServerHandler) getHostDetails(r *http.Request) (*HTTPResponse, *HTTPError) {
+	address := c.BlockchainService.Wallet.Crypt.FirstcoinAddress
+
+	switch r.Method {
+	case "GET":
+		balances := c.BlockchainService.GetBalances()
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body: Details{
+				Address:     address,
+				PublicKey:   c.BlockchainService.Wallet.Crypt.PublicKey,
+				TotalAmount: balances.Confirmed + balances.Pending,
+				Balances:    &balances,
+			},
+		}, nil
+
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// Details describes a node's wallet. TotalAmount is what the wallet can spend, confirmed or pending, and Balances
+// breaks it down.
+type Details struct {
+	Address     []byte           `json:"address"`
+	PublicKey   []byte           `json:"publicKey,omitempty"`
+	TotalAmount int              `json:"totalAmount"`
+	Balances    *wallet.Balances `json:"balances,omitempty"`
+	HostName    string           `json:"hostname"`
+}
+
+type MultisigDetails struct {
+	wallet.Multisig
+	TotalAmount int `json:"totalAmount"`
+}
+
+func (c *CoinServerHandler) peers(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		t := HostName{}
+
+		err := readBody(r, &t)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		if !resolvesTo(t.Hostname, r.RemoteAddr) {
+			c.misbehaving(r.RemoteAddr, SCORE_FAKE_HOSTNAME, fmt.Sprintf("announced hostname %q", t.Hostname))
+			return nil, NewHTTPError(http.StatusBadRequest, "hostname %q does not resolve to %s", t.Hostname, r.RemoteAddr)
+		}
+
+		fmt.Printf("Adding hostname to list of peers %+v\n", t)
+
+		c.Peers.AddHostname(t.Hostname)
+		c.Client.Addresses.AddAddresses(t.Hostname, t.Hostname)
+
+		fmt.Printf("current hostNames %+v", c.Peers.Hostnames())
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+		}, nil
+
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.Peers.Hostnames(),
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) blockChain(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       c.BlockchainService.Blockchain,
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) mineBlock(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		hash, err := hex.DecodeString(r.URL.Query().Get("hash"))
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		block, ok := c.BlockchainService.GetBlock(hash)
+		if !ok {
+			return nil, &HTTPError{
+				Code:    http.StatusNotFound,
+				Message: fmt.Sprintf("block %x not found", hash),
+			}
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       block,
+		}, nil
+
+	case "POST":
+		block := coin.Block{}
+		err := readBody(r, &block)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		return c.acceptBlock(block, c.senderPeer(r), r.RemoteAddr)
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// acceptBlock processes a block sent by peer from addr, and announces the blocks that were connected. Its missing
+// ancestors are requested from the peer in the background. A block breaking the consensus rules gets the peer banned.
+func (c *CoinServerHandler) acceptBlock(block coin.Block, peer string, addr string) (*HTTPResponse, *HTTPError) {
+	c.Client.MarkKnown(peer, blockInvItem(block))
+
+	source, _ := BanAddress(addr)
+	connected, err := c.BlockchainService.ProcessBlockFrom(block, source)
+
+	// gossip delivers blocks out of order, the peer that sent the block has the ancestors we are missing
+	var missingParent *service.MissingParentError
+	if errors.As(err, &missingParent) {
+		c.requestMissingBlocksInBackground(peer, addr, missingParent.Missing)
+	}
+
+	switch {
+	case errors.Is(err, service.ErrKnownBlock):
+		utils.InfoLogger.Println("Block already exists in blockchain")
+		return &HTTPResponse{
+			StatusCode: http.StatusAlreadyReported,
+			Body:       c.BlockchainService.Blockchain,
+		}, nil
+
+	case errors.As(err, &missingParent):
+		utils.InfoLogger.Println(err)
+		return &HTTPResponse{
+			StatusCode: http.StatusAccepted,
+			Body:       err.Error(),
+		}, nil
+
+	case err != nil:
+		c.rejectBlock(addr, err)
+
+		return nil, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Could not update blockchain. error: %s", err.Error()),
+		}
+	}
+	c.announceConnectedBlocks(connected)
+
+	return &HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       c.BlockchainService.Blockchain,
+	}, nil
+}
+
+// invalidBlockScore is the ban score of relaying the invalid block of err. A block with its timestamp off may come from
+// an honest node whose clock is off, so it is scored like the other honest mistakes.
+func invalidBlockScore(err *service.InvalidBlockError) int {
+	if errors.Is(err, coin.ErrBlockTimestamp) {
+		return SCORE_BLOCK_TIMESTAMP
+	}
+
+	return SCORE_INVALID_BLOCK
+}
+
+// rejectBlock logs the error of a block relayed from addr, banning the peer if the block breaks the consensus rules
+func (c *CoinServerHandler) rejectBlock(addr string, err error) {
+	utils.ErrorLogger.Println(err)
+
+	var invalidBlock *service.InvalidBlockError
+	if errors.As(err, &invalidBlock) {
+		c.misbehaving(addr, invalidBlockScore(invalidBlock), err.Error())
+	}
+}
+
+// announceConnectedBlocks announces the connected blocks to the peers that do not have them, including the sender's own
+// ancestors, and updates the pending txs of the wallet
+func (c *CoinServerHandler) announceConnectedBlocks(connected []coin.Block) {
+	c.BlockchainService.SyncPendingTxs()
+
+	for _, connectedBlock := range connected {
+		c.Client.BroadcastBlock(connectedBlock)
+	}
+}
+
+// requestMissingBlocksInBackground runs requestMissingBlocks as one of the getdata requests in flight and announces the
+// blocks that were connected, so the handler does not wait for the peer. With MAX_GETDATA_IN_FLIGHT requests running the
+// blocks are not requested, the orphan waits for the next sync with the peer.
+func (c *CoinServerHandler) requestMissingBlocksInBackground(peer string, addr string, missing []byte) {
+	if peer == "" || !c.Client.inventory.startFetch() {
+		return
+	}
+	source, _ := BanAddress(addr)
+
+	go func() {
+		defer c.Client.inventory.endFetch()
+
+		connected, err := c.requestMissingBlocks(peer, source, missing)
+		var missingParent *service.MissingParentError
+		if errors.As(err, &missingParent) || errors.Is(err, service.ErrKnownBlock) {
+			utils.InfoLogger.Println(err)
+		} else if err != nil {
+			c.rejectBlock(addr, err)
+			return
+		}
+
+		if len(connected) > 0 {
+			c.announceConnectedBlocks(connected)
+		}
+	}()
+}
+
+// requestMissingBlocks requests the ancestors of an orphan block from the peer that sent it from source, one at a time
+// back from the missing hash, until its branch reaches the chain. It returns the blocks that were connected on the way.
+// A branch longer than the orphans kept from one source is left to the next sync with the peer.
+func (c *CoinServerHandler) requestMissingBlocks(peer string, source string, missing []byte) ([]coin.Block, error) {
+	if peer == "" {
+		return nil, &service.MissingParentError{Missing: missing}
+	}
+
+	for i := 0; i < service.MAX_ORPHAN_BLOCKS_PER_SOURCE; i++ {
+		block, err := c.Client.GetBlockFromPeer(peer, missing)
+		if err != nil {
+			utils.ErrorLogger.Println(err)
+			break
+		}
+		c.Client.MarkKnown(peer, blockInvItem(*block))
+
+		connected, err := c.BlockchainService.ProcessBlockFrom(*block, source)
+
+		var missingParent *service.MissingParentError
+		if !errors.As(err, &missingParent) {
+			return connected, err
+		}
+		missing = missingParent.Missing
+	}
+
+	return nil, &service.MissingParentError{Missing: missing}
+}
+
+// inv receives the blocks and txs a peer announces, and requests the ones this node lacks from it with getdata
+func (c *CoinServerHandler) inv(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		inv := Inv{}
+		err := readBody(r, &inv)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		peer := c.senderPeer(r)
+		if peer == "" {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("missing %s header or it does not name the sender", PEER_HOST_HEADER),
+			}
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusAccepted,
+			Body:       Inv{Items: c.receiveInv(peer, r.RemoteAddr, inv.Items)},
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+// receiveInv records the items peer announced from addr as known to it, and requests the ones this node lacks, which it
+// returns
+func (c *CoinServerHandler) receiveInv(peer string, addr string, items []InvItem) []InvItem {
+	if len(items) > MAX_INV_ITEMS {
+		items = items[:MAX_INV_ITEMS]
+	}
+	c.Client.MarkKnown(peer, items...)
+
+	missing := make([]InvItem, 0)
+	for _, item := range items {
+		if !c.hasInventory(item) {
+			missing = append(missing, item)
+		}
+	}
+
+	// the peer waits for the inv to be received before it announces more, so the data is requested after that. With
+	// MAX_GETDATA_IN_FLIGHT requests running the items are not requested, a later announcement requests them.
+	if len(missing) > 0 && c.Client.inventory.startFetch() {
+		go func() {
+			defer c.Client.inventory.endFetch()
+			c.getDataFromPeer(peer, addr, missing)
+		}()
+	}
+
+	return missing
+}
+
+// getDataFromPeer requests the items from the peer that announced them, skipping those already requested from another
+// peer, and processes the blocks and txs it sends as if the peer had posted them
+func (c *CoinServerHandler) getDataFromPeer(peer string, addr string, items []InvItem) {
+	items = c.Client.inventory.request(items, time.Now())
+	if len(items) == 0 {
+		return
+	}
+	defer c.Client.inventory.received(items)
+
+	data, err := c.Client.GetDataFromPeer(peer, items)
+	if err != nil {
+		utils.ErrorLogger.Println(err)
+		return
+	}
+
+	for _, block := range data.Blocks {
+		if _, err := c.acceptBlock(block, peer, addr); err != nil {
+			utils.ErrorLogger.Printf("block %x from peer %s rejected. error: %s", block.Hash, peer, err)
+		}
+	}
+	for _, tx := range data.Transactions {
+		if _, err := c.acceptTransaction(tx, peer, addr); err != nil {
+			utils.ErrorLogger.Printf("tx %x from peer %s rejected. error: %s", tx.ID, peer, err)
+		}
+	}
+}
+
+// hasInventory reports whether the block or tx of item is in the chain, the tx pool, the uTxO set or an orphan pool
+func (c *CoinServerHandler) hasInventory(item InvItem) bool {
+	switch item.Type {
+	case INV_BLOCK:
+		_, ok := c.BlockchainService.GetBlock(item.Hash)
+		return ok
+	case INV_TX:
+		if _, ok := c.BlockchainService.GetTransaction(item.Hash); ok {
+			return true
+		}
+		_, ok := c.BlockchainService.UTxOSet.Get(item.Hash)
+		return ok
+	}
+
+	// unknown types are never requested
+	return true
+}
+
+// findData looks up the blocks and txs of items in the chain, the tx pool and the orphan pools
+func (c *CoinServerHandler) findData(items []InvItem) InvData {
+	data := InvData{
+		Blocks:       make([]coin.Block, 0),
+		Transactions: make([]repository.Transaction, 0),
+		NotFound:     make([]InvItem, 0),
+	}
+	for _, item := range items {
+		switch item.Type {
+		case INV_BLOCK:
+			if block, ok := c.BlockchainService.GetBlock(item.Hash); ok {
+				data.Blocks = append(data.Blocks, block)
+				continue
+			}
+		case INV_TX:
+			if tx, ok := c.BlockchainService.GetTransaction(item.Hash); ok {
+				data.Transactions = append(data.Transactions, tx)
+				continue
+			}
+		}
+
+		data.NotFound = append(data.NotFound, item)
+	}
+
+	return data
+}
+
+// getData sends the blocks and txs a peer requests after they were announced to it
+func (c *CoinServerHandler) getData(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		inv := Inv{}
+		err := readBody(r, &inv)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		if len(inv.Items) > MAX_INV_ITEMS {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("getdata of %d items, more than the max of %d", len(inv.Items), MAX_INV_ITEMS),
+			}
+		}
+
+		data := c.findData(inv.Items)
+		c.Client.MarkKnown(c.senderPeer(r), inv.Items...)
+
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body:       data,
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func (c *CoinServerHandler) createBlock(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "POST":
+		data := BlockDataControl{}
+		err := readBody(r, &data)
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+
+		if data.Data != "" {
+			tx, err := c.BlockchainService.PublishData([]byte(data.Data))
+			if err != nil {
+				return nil, &HTTPError{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				}
+			}
+
+			if _, httpErr := c.submitTransaction(tx); httpErr != nil {
+				return nil, httpErr
+			}
+		}
+
+		block, blockchain, err := c.BlockchainService.CreateNextBlock()
+		if err != nil {
+			return nil, &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			}
+		}
+		c.Client.BroadcastBlock(*block)
+
+		payload := struct {
+			Blocks              []coin.Block                                   `json:"blocks"`
+			UnspentTransactions map[repository.TxIDType]repository.Transaction `json:"unspentTransactions"`
+		}{
+			Blocks:              blockchain.GetBlocks(),
+			UnspentTransactions: c.BlockchainService.UTxOSet.Copy(),
+		}
+
+		return &HTTPResponse{
+			StatusCode: http.StatusCreated,
+			Body:       payload,
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
+}
+
+func readBody(request *http.Request, params interface{}) error {
+	reqBody, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return fmt.Errorf("cant read body %s. error: %s", request.Body, err.Error())
+	}
 
 	unmarshalErr := json.Unmarshal(reqBody, params)
 	if unmarshalErr != nil {
@@ -490,21 +1652,101 @@ func readBody(request *http.Request, params interface{}) error {
 	return nil
 }
 
+// Data, if set, is anchored in the new block by a data carrier tx
 type BlockDataControl struct {
 	Data string `json:"data"`
 }
 
+// CommitmentControl names the data to publish or prove. If Document is set its commitment hash is used as the data.
+type CommitmentControl struct {
+	Data     []byte `json:"data,omitempty"`
+	Document []byte `json:"document,omitempty"`
+}
+
+func (cc CommitmentControl) commitment() []byte {
+	if len(cc.Document) != 0 {
+		return wallet.CommitmentHash(cc.Document)
+	}
+
+	return cc.Data
+}
+
+type CommitmentDetails struct {
+	Data []byte                  `json:"data"`
+	Tx   *repository.Transaction `json:"tx"`
+}
+
 type HostName struct {
 	Hostname string `json:"hostName"`
 }
 
+// Payments is the list form to pay several receivers in one tx, otherwise Address and Amount are the single receiver.
+// With Batch set the payments are queued until the payment batch is flushed. FeeRate is in coins per 1000 bytes and
+// CoinSelection names one of wallet.CoinSelectionStrategies(). A Replaceable tx can have its fee bumped while it is pending.
 type CreateTransactionControl struct {
-	Address []byte `json:"address"`
-	Amount  int    `json:"amount"`
+	Address       []byte           `json:"address"`
+	Amount        int              `json:"amount"`
+	Payments      []wallet.Payment `json:"payments,omitempty"`
+	Batch         bool             `json:"batch,omitempty"`
+	Locktime      int              `json:"locktime,omitempty"`
+	Sequence      int              `json:"sequence,omitempty"`
+	LockUntil     int              `json:"lockUntil,omitempty"`
+	FeeRate       int              `json:"feeRate,omitempty"`
+	CoinSelection string           `json:"coinSelection,omitempty"`
+	Replaceable   bool             `json:"replaceable,omitempty"`
+}
+
+// BumpFeeControl replaces the pending tx with TxID by one paying FeeRate coins per 1000 bytes
+type BumpFeeControl struct {
+	TxID    []byte `json:"txid"`
+	FeeRate int    `json:"feeRate,omitempty"`
 }
 
+type ClaimVestingControl struct {
+	TxID     []byte `json:"txid"`
+	TxOIndex int    `json:"vout"`
+	Address  []byte `json:"address,omitempty"`
+}
+
+// SpendCoinRelay spends from the node with Host, which must be this node or a peer, through its control API with Token
 type SpendCoinRelay struct {
 	Host    string `json:"host"`
 	Address []byte `json:"address"`
 	Amount  int    `json:"amount"`
+	Token   string `json:"token,omitempty"`
+}
+
+type MultisigControl struct {
+	M          int      `json:"m"`
+	PublicKeys [][]byte `json:"publicKeys"`
+}
+
+type FundHTLCControl struct {
+	SecretHash []byte `json:"secretHash"`
+	Address    []byte `json:"address"`
+	Locktime   int    `json:"locktime"`
+	Amount     int    `json:"amount"`
+}
+
+type SpendHTLCControl struct {
+	RedeemScript []byte `json:"redeemScript"`
+	TxID         []byte `json:"txid"`
+	TxOIndex     int    `json:"vout"`
+	Secret       []byte `json:"secret,omitempty"`
+	Address      []byte `json:"address,omitempty"`
+}
+
+type HTLCDetails struct {
+	wallet.HTLC
+	RedeemScript []byte                  `json:"redeemScript"`
+	Address      []byte                  `json:"address"`
+	Tx           *repository.Transaction `json:"tx"`
+}
+
+// SpendMultisigControl pays Amount from the multisig address to Address at FeeRate coins per 1000 bytes
+type SpendMultisigControl struct {
+	MultisigAddress []byte `json:"multisigAddress"`
+	Address         []byte `json:"address"`
+	Amount          int    `json:"amount"`
+	FeeRate         int    `json:"feeRate,omitempty"`
 }
@@ -0,0 +1,302 @@
+package peer
+
+import (
+	"encoding/json"
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/utils"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	INV_BLOCK = "block"
+	INV_TX    = "tx"
+
+	// MAX_INV_ITEMS is the most items of an inv or getdata message. The items of a larger message are dropped.
+	MAX_INV_ITEMS = 1000
+
+	// MAX_KNOWN_INVENTORY is the most items remembered as known to a peer. The oldest are forgotten first.
+	MAX_KNOWN_INVENTORY = 10000
+
+	// TX_TRICKLE_INTERVAL is how often the txs queued for a peer are announced to it, in one inv message of at most
+	// MAX_INV_ITEMS. Blocks are announced right away.
+	TX_TRICKLE_INTERVAL = 2 * time.Second
+
+	// MAX_QUEUED_INV is the most announcements queued for a peer. The oldest are dropped first.
+	MAX_QUEUED_INV = 10 * MAX_INV_ITEMS
+
+	// MAX_GETDATA_IN_FLIGHT is the most getdata requests this node waits on at once
+	MAX_GETDATA_IN_FLIGHT = 16
+
+	// GETDATA_TIMEOUT is how long an item requested from one peer is not requested from others announcing it
+	GETDATA_TIMEOUT = 30 * time.Second
+)
+
+// InvItem names a block by its hash or a tx by its id
+type InvItem struct {
+	Type string `json:"type"`
+	Hash []byte `json:"hash"`
+}
+
+func (i InvItem) key() string {
+	return fmt.Sprintf("%s:%x", i.Type, i.Hash)
+}
+
+// Inv is the body of an inv message, announcing items to a peer, and of a getdata message, requesting them
+type Inv struct {
+	Items []InvItem `json:"items"`
+}
+
+// InvData is the response to a getdata message, with the requested items the peer has
+type InvData struct {
+	Blocks       []coin.Block             `json:"blocks"`
+	Transactions []repository.Transaction `json:"transactions"`
+	NotFound     []InvItem                `json:"notFound"`
+}
+
+// knownInventory is the set of items a peer has, bounded to MAX_KNOWN_INVENTORY
+type knownInventory struct {
+	items map[string]bool
+	order []string
+}
+
+func (k *knownInventory) add(key string) {
+	if k.items[key] {
+		return
+	}
+
+	k.items[key] = true
+	k.order = append(k.order, key)
+	if len(k.order) > MAX_KNOWN_INVENTORY {
+		delete(k.items, k.order[0])
+		k.order = k.order[1:]
+	}
+}
+
+// inventory is the relay state of a node: what each peer is known to have, the txs queued to announce to each peer and
+// the items requested from peers
+type inventory struct {
+	mu        sync.Mutex
+	known     map[string]*knownInventory
+	queued    map[string][]InvItem
+	requested map[string]time.Time
+	fetches   chan struct{}
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		known:     make(map[string]*knownInventory),
+		queued:    make(map[string][]InvItem),
+		requested: make(map[string]time.Time),
+		fetches:   make(chan struct{}, MAX_GETDATA_IN_FLIGHT),
+	}
+}
+
+// markKnown records that peer has the items, so they are not announced to it
+func (inv *inventory) markKnown(peer string, items ...InvItem) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	known, ok := inv.known[peer]
+	if !ok {
+		known = &knownInventory{items: make(map[string]bool)}
+		inv.known[peer] = known
+	}
+
+	for _, item := range items {
+		known.add(item.key())
+	}
+}
+
+// unknown returns the items that are not known to peer, and marks them as known as they are about to be announced
+func (inv *inventory) unknown(peer string, items []InvItem) []InvItem {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	known, ok := inv.known[peer]
+	if !ok {
+		known = &knownInventory{items: make(map[string]bool)}
+		inv.known[peer] = known
+	}
+
+	unknown := make([]InvItem, 0, len(items))
+	for _, item := range items {
+		if !known.items[item.key()] {
+			known.add(item.key())
+			unknown = append(unknown, item)
+		}
+	}
+
+	return unknown
+}
+
+// queue adds items to the announcements for peer, dropping the oldest past MAX_QUEUED_INV
+func (inv *inventory) queue(peer string, items []InvItem) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	queued := append(inv.queued[peer], items...)
+	if len(queued) > MAX_QUEUED_INV {
+		queued = append([]InvItem{}, queued[len(queued)-MAX_QUEUED_INV:]...)
+	}
+	inv.queued[peer] = queued
+}
+
+// dequeue takes at most MAX_INV_ITEMS of the announcements for each peer
+func (inv *inventory) dequeue() map[string][]InvItem {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	dequeued := make(map[string][]InvItem, len(inv.queued))
+	for peer, items := range inv.queued {
+		if len(items) > MAX_INV_ITEMS {
+			dequeued[peer] = items[:MAX_INV_ITEMS]
+			inv.queued[peer] = items[MAX_INV_ITEMS:]
+			continue
+		}
+
+		dequeued[peer] = items
+		delete(inv.queued, peer)
+	}
+
+	return dequeued
+}
+
+// request returns the items that were not requested from any peer in the last GETDATA_TIMEOUT, and marks them as
+// requested
+func (inv *inventory) request(items []InvItem, now time.Time) []InvItem {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	for key, requestedAt := range inv.requested {
+		if now.Sub(requestedAt) > GETDATA_TIMEOUT {
+			delete(inv.requested, key)
+		}
+	}
+
+	requested := make([]InvItem, 0, len(items))
+	for _, item := range items {
+		if _, ok := inv.requested[item.key()]; !ok {
+			inv.requested[item.key()] = now
+			requested = append(requested, item)
+		}
+	}
+
+	return requested
+}
+
+// received clears the request of items, another peer announcing them is asked next
+func (inv *inventory) received(items []InvItem) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	for _, item := range items {
+		delete(inv.requested, item.key())
+	}
+}
+
+// startFetch takes one of the MAX_GETDATA_IN_FLIGHT getdata requests, and reports false if they are all taken
+func (inv *inventory) startFetch() bool {
+	select {
+	case inv.fetches <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// endFetch gives back the getdata request taken by startFetch
+func (inv *inventory) endFetch() {
+	<-inv.fetches
+}
+
+// forget drops the relay state of a peer that left
+func (inv *inventory) forget(peer string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	delete(inv.known, peer)
+	delete(inv.queued, peer)
+}
+
+func blockInvItem(block coin.Block) InvItem {
+	return InvItem{Type: INV_BLOCK, Hash: block.Hash}
+}
+
+func txInvItem(tx repository.Transaction) InvItem {
+	return InvItem{Type: INV_TX, Hash: tx.ID}
+}
+
+// MarkKnown records that peer has the block or tx of items, as it sent or announced them
+func (c *Client) MarkKnown(peer string, items ...InvItem) {
+	if peer == "" {
+		return
+	}
+
+	c.inventory.markKnown(peer, items...)
+}
+
+// RelayInventory announces the txs queued for each peer every TX_TRICKLE_INTERVAL. It does not return.
+func (c *Client) RelayInventory() {
+	for range time.Tick(TX_TRICKLE_INTERVAL) {
+		var wg sync.WaitGroup
+		for peer, items := range c.inventory.dequeue() {
+			wg.Add(1)
+			go func(peer string, items []InvItem) {
+				defer wg.Done()
+				c.sendInv(peer, items)
+			}(peer, items)
+		}
+		wg.Wait()
+	}
+}
+
+// sendInv announces items to peer, over its connection if it has one. A peer that cannot be reached is removed from
+// the peer table until it is connected again.
+func (c *Client) sendInv(peer string, items []InvItem) {
+	if conn, ok := c.conns.get(peer); ok {
+		if err := conn.Send(CMD_INV, Inv{Items: items}); err == nil {
+			return
+		}
+	}
+
+	resp, err := c.httpPostWithBackoffFrom(c.peerURL(peer, "/inv"), Inv{Items: items}, c.ThisPeer)
+	if err != nil {
+		utils.ErrorLogger.Println(fmt.Sprintf("error when announcing inventory to peer %s. error: %s", peer, err))
+
+		// the address manager keeps the peer, it is dialed again once it is back
+		c.Addresses.Failed(peer)
+		c.Peers.RemoveHostname(peer)
+		c.inventory.forget(peer)
+		return
+	}
+	defer resp.Body.Close()
+}
+
+// GetDataFromPeer requests the blocks and txs of items from peer, which announced them. Like GetBlockFromPeer it is not
+// retried.
+func (c *Client) GetDataFromPeer(peer string, items []InvItem) (*InvData, error) {
+	if conn, ok := c.conns.get(peer); ok {
+		return requestData(conn, items)
+	}
+
+	resp, err := c.httpPostFrom(c.peerURL(peer, "/getdata"), Inv{Items: items}, c.ThisPeer)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s did not send data. error: %s", peer, readResponseBody(resp.Body))
+	}
+
+	var data InvData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
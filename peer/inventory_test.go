@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testInvItems(count int) []InvItem {
+	items := make([]InvItem, count)
+	for i := range items {
+		items[i] = InvItem{Type: INV_TX, Hash: []byte(fmt.Sprintf("tx%d", i))}
+	}
+
+	return items
+}
+
+func TestInventory(t *testing.T) {
+	t.Run("forgets the oldest known items past the max", func(t *testing.T) {
+		inv := newInventory()
+		items := testInvItems(MAX_KNOWN_INVENTORY + 1)
+		inv.markKnown("node:8081", items...)
+
+		known := inv.known["node:8081"]
+		if len(known.items) != MAX_KNOWN_INVENTORY || len(known.order) != MAX_KNOWN_INVENTORY {
+			t.Fatalf("incorrect known items. Got: %d. Want: %d", len(known.items), MAX_KNOWN_INVENTORY)
+		}
+		if known.items[items[0].key()] || !known.items[items[MAX_KNOWN_INVENTORY].key()] {
+			t.Errorf("expected the oldest item to be forgotten and the newest kept")
+		}
+
+		if unknown := inv.unknown("node:8081", items[MAX_KNOWN_INVENTORY:]); len(unknown) != 0 {
+			t.Errorf("expected the newest item to be known, got: %v", unknown)
+		}
+		if unknown := inv.unknown("node:8081", items[:1]); len(unknown) != 1 {
+			t.Errorf("expected the forgotten item to be unknown, got: %v", unknown)
+		}
+	})
+
+	t.Run("dequeues at most the max items of an inv for each peer", func(t *testing.T) {
+		inv := newInventory()
+		inv.queue("node:8081", testInvItems(MAX_INV_ITEMS+10))
+		inv.queue("node:8082", testInvItems(3))
+
+		dequeued := inv.dequeue()
+		if len(dequeued["node:8081"]) != MAX_INV_ITEMS || len(dequeued["node:8082"]) != 3 {
+			t.Fatalf("incorrect first batch. Got: %d and %d", len(dequeued["node:8081"]), len(dequeued["node:8082"]))
+		}
+
+		dequeued = inv.dequeue()
+		if len(dequeued["node:8081"]) != 10 || len(dequeued) != 1 {
+			t.Fatalf("incorrect second batch. Got: %v", dequeued)
+		}
+
+		if dequeued = inv.dequeue(); len(dequeued) != 0 {
+			t.Errorf("expected the queue to be empty, got: %v", dequeued)
+		}
+	})
+
+	t.Run("drops the oldest queued items past the max", func(t *testing.T) {
+		inv := newInventory()
+		items := testInvItems(MAX_QUEUED_INV + 5)
+		inv.queue("node:8081", items)
+
+		queued := inv.queued["node:8081"]
+		if len(queued) != MAX_QUEUED_INV || queued[0].key() != items[5].key() {
+			t.Errorf("incorrect queue. Got %d items starting with %s", len(queued), queued[0].key())
+		}
+	})
+
+	t.Run("requests an item again after the timeout or once it was received", func(t *testing.T) {
+		inv := newInventory()
+		items := testInvItems(2)
+		now := time.Now()
+
+		if requested := inv.request(items, now); len(requested) != 2 {
+			t.Fatalf("expected both items to be requested, got: %v", requested)
+		}
+		if requested := inv.request(items, now.Add(GETDATA_TIMEOUT)); len(requested) != 0 {
+			t.Fatalf("expected no item to be requested again before the timeout, got: %v", requested)
+		}
+
+		inv.received(items[:1])
+		if requested := inv.request(items, now.Add(GETDATA_TIMEOUT)); len(requested) != 1 || requested[0].key() != items[0].key() {
+			t.Fatalf("expected the received item to be requested again, got: %v", requested)
+		}
+
+		if requested := inv.request(items, now.Add(GETDATA_TIMEOUT+time.Second)); len(requested) != 1 || requested[0].key() != items[1].key() {
+			t.Errorf("expected the timed out item to be requested again, got: %v", requested)
+		}
+	})
+
+	t.Run("bounds the getdata requests in flight", func(t *testing.T) {
+		inv := newInventory()
+		for i := 0; i < MAX_GETDATA_IN_FLIGHT; i++ {
+			if !inv.startFetch() {
+				t.Fatalf("expected fetch %d to start", i)
+			}
+		}
+		if inv.startFetch() {
+			t.Fatalf("expected a fetch past the max not to start")
+		}
+
+		inv.endFetch()
+		if !inv.startFetch() {
+			t.Errorf("expected a fetch to start once one ended")
+		}
+	})
+}
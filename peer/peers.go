@@ -1,10 +1,14 @@
 package peer
 
+import "sync"
+
 //get all Peers when coming online
 // start with peer 8080
 
+// Peers is the peer table of a node, safe for concurrent use
 type Peers struct {
-	Hostnames map[string]string
+	mu        sync.RWMutex
+	hostnames map[string]string
 	ThisHost  string
 }
 
@@ -12,14 +16,44 @@ func NewPeers() *Peers {
 	hostnames := make(map[string]string)
 	// hostnames[seedHost] = seedHost
 	return &Peers{
-		Hostnames: hostnames,
+		hostnames: hostnames,
+	}
+}
+
+// Hostnames returns a copy of the known peers
+func (p *Peers) Hostnames() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	hostnames := make(map[string]string, len(p.hostnames))
+	for key, hostname := range p.hostnames {
+		hostnames[key] = hostname
+	}
+
+	return hostnames
+}
+
+// SetHostnames replaces the known peers with hostnames
+func (p *Peers) SetHostnames(hostnames map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hostnames = make(map[string]string, len(hostnames))
+	for key, hostname := range hostnames {
+		p.hostnames[key] = hostname
 	}
 }
 
 func (p *Peers) AddHostname(hostname string) {
-	p.Hostnames[hostname] = hostname
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hostnames[hostname] = hostname
 }
 
 func (p *Peers) RemoveHostname(hostname string) {
-	delete(p.Hostnames, hostname)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.hostnames, hostname)
 }
@@ -0,0 +1,200 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EndpointClass groups the endpoints that share a rate limit
+type EndpointClass string
+
+const (
+	// CLASS_CONTROL is the endpoints operators call, CLASS_GOSSIP those peers relay blocks, txs and hostnames with, and
+	// CLASS_QUERY those peers and wallets read the chain and the network from
+	CLASS_CONTROL EndpointClass = "control"
+	CLASS_GOSSIP  EndpointClass = "gossip"
+	CLASS_QUERY   EndpointClass = "query"
+
+	// RATE_LIMIT_SWEEP_INTERVAL is how often the buckets of addresses that stopped sending are dropped
+	RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+)
+
+// RateLimit lets an address make Burst requests at once, refilled at Rate requests per second. A Rate of zero or less
+// is no limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// capacity is the tokens a full bucket holds, at least one so a limit lets some requests through
+func (limit RateLimit) capacity() float64 {
+	return math.Max(1, float64(limit.Burst))
+}
+
+// RateLimitConfig is the rate limit of each endpoint class, per remote address
+type RateLimitConfig map[EndpointClass]RateLimit
+
+// DefaultRateLimitConfig is loose enough for a node syncing from its peers, and keeps a single address from flooding
+// the node. The queries answer with the chain or the tx pool, so the query class is the tightest.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		CLASS_CONTROL: {Rate: 10, Burst: 20},
+		CLASS_GOSSIP:  {Rate: 50, Burst: 100},
+		CLASS_QUERY:   {Rate: 5, Burst: 10},
+	}
+}
+
+// RateLimitMetrics counts the requests let through and rejected by class, and the rejected ones by endpoint
+type RateLimitMetrics struct {
+	Allowed            map[EndpointClass]uint64 `json:"allowed"`
+	Rejected           map[EndpointClass]uint64 `json:"rejected"`
+	RejectedByEndpoint map[string]uint64        `json:"rejectedByEndpoint"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	class   EndpointClass
+	address string
+}
+
+// RateLimiter keeps a token bucket per endpoint class and remote address. It is safe for concurrent use.
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    RateLimitConfig
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+	metrics   RateLimitMetrics
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    config,
+		buckets:   make(map[bucketKey]*tokenBucket),
+		lastSweep: time.Now(),
+		metrics: RateLimitMetrics{
+			Allowed:            make(map[EndpointClass]uint64),
+			Rejected:           make(map[EndpointClass]uint64),
+			RejectedByEndpoint: make(map[string]uint64),
+		},
+	}
+}
+
+// Allow takes a token from the bucket of address for class. A rejected request is told how long to wait for a token.
+func (l *RateLimiter) Allow(class EndpointClass, endpoint string, address string) (bool, time.Duration) {
+	// requests are limited by IP, a peer gets a new port on every connection
+	if ip, err := BanAddress(address); err == nil {
+		address = ip
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= RATE_LIMIT_SWEEP_INTERVAL {
+		l.sweep(now)
+	}
+
+	limit, ok := l.config[class]
+	if !ok || limit.Rate <= 0 {
+		l.metrics.Allowed[class]++
+		return true, 0
+	}
+
+	key := bucketKey{class: class, address: address}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.capacity(), last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(limit.capacity(), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		l.metrics.Rejected[class]++
+		l.metrics.RejectedByEndpoint[endpoint]++
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	l.metrics.Allowed[class]++
+	return true, 0
+}
+
+// sweep drops the buckets that refilled, which are the same as no bucket
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		limit := l.config[key.class]
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate >= limit.capacity() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Metrics returns a copy of the counts of allowed and rejected requests
+func (l *RateLimiter) Metrics() RateLimitMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	metrics := RateLimitMetrics{
+		Allowed:            make(map[EndpointClass]uint64),
+		Rejected:           make(map[EndpointClass]uint64),
+		RejectedByEndpoint: make(map[string]uint64),
+	}
+	for class, count := range l.metrics.Allowed {
+		metrics.Allowed[class] = count
+	}
+	for class, count := range l.metrics.Rejected {
+		metrics.Rejected[class] = count
+	}
+	for endpoint, count := range l.metrics.RejectedByEndpoint {
+		metrics.RejectedByEndpoint[endpoint] = count
+	}
+
+	return metrics
+}
+
+// Config returns the rate limits of the limiter
+func (l *RateLimiter) Config() RateLimitConfig {
+	config := make(RateLimitConfig)
+	for class, limit := range l.config {
+		config[class] = limit
+	}
+
+	return config
+}
+
+// Limit serves requests to endpoint while the remote address has tokens left for class, and responds 429 with a
+// Retry-After in seconds otherwise
+func (l *RateLimiter) Limit(class EndpointClass, endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		allowed, retryAfter := l.Allow(class, endpoint, request.RemoteAddr)
+		if allowed {
+			handler(writer, request)
+			return
+		}
+
+		allowOrigin(writer, request)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusTooManyRequests)
+
+		err := json.NewEncoder(writer).Encode(ErrorResponse{
+			Type:    "error",
+			Message: fmt.Sprintf("too many %s requests, retry after %s", class, retryAfter.Round(time.Millisecond)),
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package peer_test
+
+import (
+	"firstcoin/peer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("rejects requests past the burst until the bucket refills", func(t *testing.T) {
+		l := peer.NewRateLimiter(peer.RateLimitConfig{peer.CLASS_GOSSIP: {Rate: 100, Burst: 2}})
+
+		for i := 0; i < 2; i++ {
+			if allowed, _ := l.Allow(peer.CLASS_GOSSIP, "/inv", "10.0.0.1:5000"); !allowed {
+				t.Fatalf("expected request %d of the burst to be allowed", i)
+			}
+		}
+
+		allowed, retryAfter := l.Allow(peer.CLASS_GOSSIP, "/inv", "10.0.0.1:5001")
+		if allowed || retryAfter <= 0 {
+			t.Fatalf("expected the request to be rejected with a wait, got allowed %t and wait %s", allowed, retryAfter)
+		}
+
+		time.Sleep(retryAfter + 5*time.Millisecond)
+		if allowed, _ := l.Allow(peer.CLASS_GOSSIP, "/inv", "10.0.0.1:5002"); !allowed {
+			t.Errorf("expected the request to be allowed once a token refilled")
+		}
+	})
+
+	t.Run("keeps a bucket per address and class", func(t *testing.T) {
+		l := peer.NewRateLimiter(peer.RateLimitConfig{
+			peer.CLASS_GOSSIP: {Rate: 1, Burst: 1},
+			peer.CLASS_QUERY:  {Rate: 1, Burst: 1},
+		})
+
+		l.Allow(peer.CLASS_GOSSIP, "/inv", "10.0.0.1:5000")
+		if allowed, _ := l.Allow(peer.CLASS_GOSSIP, "/inv", "10.0.0.2:5000"); !allowed {
+			t.Errorf("expected another address to have its own bucket")
+		}
+		if allowed, _ := l.Allow(peer.CLASS_QUERY, "/latest-block", "10.0.0.1:5000"); !allowed {
+			t.Errorf("expected another class to have its own bucket")
+		}
+	})
+
+	t.Run("does not limit a class without a rate", func(t *testing.T) {
+		l := peer.NewRateLimiter(peer.RateLimitConfig{peer.CLASS_CONTROL: {Rate: 0, Burst: 1}})
+
+		for i := 0; i < 10; i++ {
+			if allowed, _ := l.Allow(peer.CLASS_CONTROL, "/txpool", "10.0.0.1:5000"); !allowed {
+				t.Fatalf("expected request %d to be allowed", i)
+			}
+		}
+	})
+
+	t.Run("responds 429 with Retry-After and counts the rejection", func(t *testing.T) {
+		l := peer.NewRateLimiter(peer.RateLimitConfig{peer.CLASS_QUERY: {Rate: 0.5, Burst: 1}})
+		handler := l.Limit(peer.CLASS_QUERY, "/hosts", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		codes := make([]int, 0)
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/hosts", nil)
+			request.RemoteAddr = "10.0.0.1:5000"
+			handler(recorder, request)
+
+			codes = append(codes, recorder.Code)
+			if recorder.Code == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") != "2" {
+				t.Errorf("incorrect Retry-After. Got: %q. Want: %q", recorder.Header().Get("Retry-After"), "2")
+			}
+		}
+
+		if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+			t.Errorf("incorrect response codes. Got: %v. Want: [200 429]", codes)
+		}
+
+		metrics := l.Metrics()
+		if metrics.Allowed[peer.CLASS_QUERY] != 1 || metrics.Rejected[peer.CLASS_QUERY] != 1 || metrics.RejectedByEndpoint["/hosts"] != 1 {
+			t.Errorf("incorrect metrics. Got: %+v", metrics)
+		}
+	})
+}
@@ -4,48 +4,147 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
+	"io"
 	"log"
 	"net/http"
 )
 
+const (
+	// MAX_REQUEST_BODY_SIZE caps the bytes read from the body of a request to an endpoint
+	MAX_REQUEST_BODY_SIZE = 1 << 20
+
+	// JSON_SIZE_FACTOR bounds how much larger the JSON of a block is than its serialized size
+	JSON_SIZE_FACTOR = 4
+)
+
 // TODO remove all non-server related stuff to a new package - need refactor
 type Server struct {
 	CoinServerHandler CoinServerHandler
+	RateLimiter       *RateLimiter
+	ControlAuth       *ControlAuth
 }
 
-func NewServer(cs CoinServerHandler) *Server {
+func NewServer(cs CoinServerHandler, l *RateLimiter, a *ControlAuth) *Server {
 	return &Server{
 		CoinServerHandler: cs,
+		RateLimiter:       l,
+		ControlAuth:       a,
 	}
 }
 
-func (s *Server) HandleServer(port string, shouldHandleWeb bool) {
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+// HandleServer serves the peer API on port and the control API on controlAddress, each over TLS if the TLS config of the
+// client secures it. The peer API only has the endpoints peers call, the control API has the web UI and the endpoints
+// operators call, for the role of their token.
+func (s *Server) HandleServer(port string, controlAddress string, shouldHandleWeb bool) {
+	peerMux := http.NewServeMux()
+	controlMux := http.NewServeMux()
+
+	// every endpoint is rate limited per remote address and endpoint class
+	handlePeer := func(class EndpointClass, endpoint string, handler http.HandlerFunc) {
+		peerMux.HandleFunc(endpoint, s.RateLimiter.Limit(class, endpoint, handler))
+	}
+	handleControl := func(role Role, endpoint string, handler ServiceHandler) {
+		controlMux.HandleFunc(endpoint, s.RateLimiter.Limit(CLASS_CONTROL, endpoint, JSONHandler(s.ControlAuth.Authorize(role, handler))))
+	}
+
+	handlePeer(CLASS_QUERY, "/ping", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "pong from, %q", html.EscapeString(r.URL.Path))
 	})
 
+	// banned peers are refused on the endpoints peers call
+	peerEndpoint := s.CoinServerHandler.peerEndpoint
+	handlePeer(CLASS_GOSSIP, "/block", JSONHandlerWithLimit(peerEndpoint(s.CoinServerHandler.mineBlock), JSON_SIZE_FACTOR*int64(s.CoinServerHandler.BlockchainService.Blockchain.Params().MaxBlockSize)))
+	handlePeer(CLASS_QUERY, "/block-chain", JSONHandler(peerEndpoint(s.CoinServerHandler.blockChain)))
+	handlePeer(CLASS_GOSSIP, "/peers", JSONHandler(peerEndpoint(s.CoinServerHandler.peers)))
+	handlePeer(CLASS_GOSSIP, "/notify", JSONHandler(peerEndpoint(s.CoinServerHandler.peers)))
+	handlePeer(CLASS_QUERY, "/latest-block", JSONHandler(peerEndpoint(s.CoinServerHandler.latestBlock)))
+	handlePeer(CLASS_GOSSIP, "/transaction", JSONHandler(peerEndpoint(s.CoinServerHandler.receiveTransaction)))
+	handlePeer(CLASS_GOSSIP, "/inv", JSONHandler(peerEndpoint(s.CoinServerHandler.inv)))
+	handlePeer(CLASS_GOSSIP, "/getdata", JSONHandler(peerEndpoint(s.CoinServerHandler.getData)))
+	handlePeer(CLASS_QUERY, "/txpool", JSONHandler(peerEndpoint(s.CoinServerHandler.getTxPool)))
+	handlePeer(CLASS_QUERY, "/hosts", JSONHandler(peerEndpoint(s.CoinServerHandler.hosts)))
+
 	if shouldHandleWeb {
 		buildHandler := http.FileServer(http.Dir("web/build"))
-		http.Handle("/", buildHandler)
+		controlMux.HandleFunc("/", s.RateLimiter.Limit(CLASS_CONTROL, "/", buildHandler.ServeHTTP))
 	}
+	controlMux.HandleFunc("/login", s.RateLimiter.Limit(CLASS_CONTROL, "/login", s.ControlAuth.login))
+	controlMux.HandleFunc("/logout", s.RateLimiter.Limit(CLASS_CONTROL, "/logout", s.ControlAuth.logout))
 
-	http.HandleFunc("/create-block", JSONHandler(s.CoinServerHandler.createBlock))        // control endpoint
-	http.HandleFunc("/spend-coin", JSONHandler(s.CoinServerHandler.createTransaction))    // control endpoint
-	http.HandleFunc("/spend-coin-relay", JSONHandler(s.CoinServerHandler.spendCoinRelay)) // control endpoint
-	http.HandleFunc("/txpool", JSONHandler(s.CoinServerHandler.getTxPool))                // control endpoint
-	http.HandleFunc("/txset", JSONHandler(s.CoinServerHandler.getTxSet))                  // control endpoint
-	http.HandleFunc("/blockchain", JSONHandler(s.CoinServerHandler.getBlockchain))        // control endpoint
-	http.HandleFunc("/hosts", JSONHandler(s.CoinServerHandler.getHostsRecursive))         // control endpoint
-	http.HandleFunc("/host-details", JSONHandler(s.CoinServerHandler.getHostDetails))     // control endpoint
+	handleControl(ROLE_MINE, "/create-block", s.CoinServerHandler.createBlock)
+	handleControl(ROLE_SPEND, "/spend-coin", s.CoinServerHandler.createTransaction)
+	handleControl(ROLE_SPEND, "/spend-coin-relay", s.CoinServerHandler.spendCoinRelay)
+	handleControl(ROLE_SPEND, "/payment-batch", s.CoinServerHandler.paymentBatch)
+	handleControl(ROLE_SPEND, "/bumpfee", s.CoinServerHandler.bumpFee)
+	handleControl(ROLE_READ, "/txpool", s.CoinServerHandler.getTxPool)
+	handleControl(ROLE_READ, "/txpool-info", s.CoinServerHandler.getTxPoolInfo)
+	handleControl(ROLE_READ, "/txset", s.CoinServerHandler.getTxSet)
+	handleControl(ROLE_READ, "/blockchain", s.CoinServerHandler.getBlockchain)
+	handleControl(ROLE_READ, "/block-chain", s.CoinServerHandler.blockChain)
+	handleControl(ROLE_READ, "/latest-block", s.CoinServerHandler.latestBlock)
+	handleControl(ROLE_READ, "/hosts", s.CoinServerHandler.getHostsRecursive)
+	handleControl(ROLE_READ, "/host-details", s.CoinServerHandler.getHostDetails)
+	handleControl(ROLE_SPEND, "/multisig", s.CoinServerHandler.multisig)
+	handleControl(ROLE_SPEND, "/multisig-spend", s.CoinServerHandler.spendMultisig)
+	handleControl(ROLE_SPEND, "/psbt-sign", s.CoinServerHandler.signPartialTx)
+	handleControl(ROLE_SPEND, "/psbt-submit", s.CoinServerHandler.submitPartialTxs)
+	handleControl(ROLE_SPEND, "/vesting", s.CoinServerHandler.vesting)
+	handleControl(ROLE_SPEND, "/htlc", s.CoinServerHandler.fundHTLC)
+	handleControl(ROLE_SPEND, "/htlc-claim", s.CoinServerHandler.claimHTLC)
+	handleControl(ROLE_SPEND, "/htlc-refund", s.CoinServerHandler.refundHTLC)
+	handleControl(ROLE_SPEND, "/commitment", s.CoinServerHandler.publishCommitment)
+	handleControl(ROLE_READ, "/commitment-proof", s.CoinServerHandler.commitmentProof)
+	handleControl(ROLE_READ, "/connections", s.CoinServerHandler.connections)
+	handleControl(ROLE_READ, "/metrics", s.metrics)
+	handleControl(ROLE_READ, "/addresses", s.CoinServerHandler.addresses)
+	handleControl(ROLE_ADMIN, "/bans", s.CoinServerHandler.bans)
 
-	http.HandleFunc("/block", JSONHandler(s.CoinServerHandler.mineBlock))
-	http.HandleFunc("/block-chain", JSONHandler(s.CoinServerHandler.blockChain))
-	http.HandleFunc("/peers", JSONHandler(s.CoinServerHandler.peers))
-	http.HandleFunc("/notify", JSONHandler(s.CoinServerHandler.peers))
-	http.HandleFunc("/latest-block", JSONHandler(s.CoinServerHandler.latestBlock))
-	http.HandleFunc("/transaction", JSONHandler(s.CoinServerHandler.receiveTransaction))
+	// peers exchange blocks and txs over long-lived connections, the HTTP endpoints stay for peers without one
+	p2pAddress, err := P2PAddress(fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Fatal(s.CoinServerHandler.ListenPeers(p2pAddress))
+	}()
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	tlsConfig := s.CoinServerHandler.Client.TLS
+	go func() {
+		if tlsConfig != nil && tlsConfig.Control {
+			server := &http.Server{Addr: controlAddress, Handler: controlMux, TLSConfig: tlsConfig.ControlConfig()}
+			log.Fatal(server.ListenAndServeTLS("", ""))
+		}
+		log.Fatal(http.ListenAndServe(controlAddress, controlMux))
+	}()
+
+	if tlsConfig != nil && tlsConfig.Peer {
+		server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: peerMux, TLSConfig: tlsConfig.ServerConfig()}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), peerMux))
+}
+
+// Metrics is what a node counts of the requests it serves
+type Metrics struct {
+	RateLimit       RateLimitMetrics `json:"rateLimit"`
+	RateLimitConfig RateLimitConfig  `json:"rateLimitConfig"`
+}
+
+func (s *Server) metrics(r *http.Request) (*HTTPResponse, *HTTPError) {
+	switch r.Method {
+	case "GET":
+		return &HTTPResponse{
+			StatusCode: http.StatusOK,
+			Body: Metrics{
+				RateLimit:       s.RateLimiter.Metrics(),
+				RateLimitConfig: s.RateLimiter.Config(),
+			},
+		}, nil
+	}
+
+	return nil, &HTTPError{
+		Code: http.StatusMethodNotAllowed,
+	}
 }
 
 type ServiceHandler func(*http.Request) (*HTTPResponse, *HTTPError)
@@ -55,15 +154,33 @@ var allowList = map[string]bool{
 	"http://localhost:3000": true,
 }
 
+// allowOrigin lets the web UI on an allowed origin read the response
+func allowOrigin(writer http.ResponseWriter, request *http.Request) {
+	if origin := request.Header.Get("Origin"); allowList[origin] {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
 func JSONHandler(handler ServiceHandler) http.HandlerFunc {
+	return JSONHandlerWithLimit(handler, MAX_REQUEST_BODY_SIZE)
+}
+
+// JSONHandlerWithLimit reads at most maxBodySize bytes of the request body. A handler failing on a larger body responds
+// with 413.
+func JSONHandlerWithLimit(handler ServiceHandler, maxBodySize int64) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if origin := request.Header.Get("Origin"); allowList[origin] {
-			writer.Header().Set("Access-Control-Allow-Origin", origin)
-		}
+		allowOrigin(writer, request)
+
+		body := &limitedBody{ReadCloser: request.Body, remaining: maxBodySize}
+		request.Body = body
 
 		httpResponse, err := handler(request)
 		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 
+		if err != nil && body.exceeded {
+			err = NewHTTPError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", maxBodySize)
+		}
+
 		if err != nil {
 			writer.WriteHeader(err.Code)
 
@@ -86,6 +203,33 @@ func JSONHandler(handler ServiceHandler) http.HandlerFunc {
 	}
 }
 
+// limitedBody fails reads past the remaining bytes and records that the body was too large
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, fmt.Errorf("request body too large")
+	}
+
+	// read one byte past the limit to tell a body of exactly the limit from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		return int(b.remaining), fmt.Errorf("request body too large")
+	}
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
 type HTTPResponse struct {
 	StatusCode int
 	Body       interface{}
@@ -0,0 +1,295 @@
+package peer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"firstcoin/utils"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CERT_VALIDITY is how long the self-signed certificate of a node identity is valid. Peers pin the key, not the
+// certificate, so a certificate issued again for the same key keeps the identity.
+const CERT_VALIDITY = 10 * 365 * 24 * time.Hour
+
+var ErrKeyNotAllowed = errors.New("node key is not allowed")
+
+// NodeIdentity is the key a node proves itself with over TLS, in a self-signed certificate
+type NodeIdentity struct {
+	Certificate tls.Certificate
+	Fingerprint string
+}
+
+// KeyFingerprint is the hex sha256 of the public key of cert, which peers pin and allow-list nodes by
+func KeyFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadOrCreateIdentity reads the node identity at keyPath and certPath, or creates a new key and self-signed certificate
+// there if there is none
+func LoadOrCreateIdentity(keyPath string, certPath string) (*NodeIdentity, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if os.IsNotExist(err) {
+		cert, err = createIdentity(keyPath, certPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	return &NodeIdentity{Certificate: cert, Fingerprint: KeyFingerprint(leaf)}, nil
+}
+
+func createIdentity(keyPath string, certPath string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "firstcoin node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// PinStore keeps the key fingerprint of each peer hostname, pinned the first time the peer is reached over TLS. A peer
+// that later presents another key is refused, until its pin is removed from the file at path. It is safe for concurrent
+// use.
+type PinStore struct {
+	mu   sync.Mutex
+	pins map[string]string
+	path string
+}
+
+func NewPinStore(path string) *PinStore {
+	return &PinStore{
+		pins: make(map[string]string),
+		path: path,
+	}
+}
+
+// Load reads the pins saved at the path of the store. A missing file is no pins.
+func (p *PinStore) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	j, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(j, &p.pins)
+}
+
+// Check pins fingerprint for hostname if it has no pin, and fails if it has another
+func (p *PinStore) Check(hostname string, fingerprint string) error {
+	p.mu.Lock()
+	pinned, ok := p.pins[hostname]
+	if !ok {
+		p.pins[hostname] = fingerprint
+	}
+	p.mu.Unlock()
+
+	if ok && pinned != fingerprint {
+		return fmt.Errorf("peer %s presented key %s, pinned key is %s", hostname, fingerprint, pinned)
+	}
+	if !ok {
+		return p.Save()
+	}
+
+	return nil
+}
+
+// Pins returns a copy of the pins
+func (p *PinStore) Pins() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pins := make(map[string]string, len(p.pins))
+	for hostname, fingerprint := range p.pins {
+		pins[hostname] = fingerprint
+	}
+
+	return pins
+}
+
+// Save writes the pins to the path of the store
+func (p *PinStore) Save() error {
+	return utils.WriteJSONFile(p.path, p.Pins())
+}
+
+// ParseAllowedKeys parses comma separated key fingerprints
+func ParseAllowedKeys(s string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// TLSConfig is how a node secures its peer and control listeners. Peers are verified by the pin of their key, or, with
+// AllowedKeys set, only the nodes with an allowed key may connect either way. An inbound peer is pinned against the
+// hostname it sends in the version handshake, so its key is only checked by VerifyInbound once that is known.
+type TLSConfig struct {
+	Identity    *NodeIdentity
+	Pins        *PinStore
+	AllowedKeys map[string]bool
+	Peer        bool
+	Control     bool
+}
+
+// Mutual reports if peers must present an allowed key
+func (t *TLSConfig) Mutual() bool {
+	return len(t.AllowedKeys) > 0
+}
+
+// verify checks the key of the certificate a peer presented, hostname is empty for an inbound peer checked in the TLS
+// handshake with mutual auth
+func (t *TLSConfig) verify(hostname string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	fingerprint := KeyFingerprint(cert)
+
+	if t.Mutual() {
+		if !t.AllowedKeys[fingerprint] {
+			return fmt.Errorf("%w: %s", ErrKeyNotAllowed, fingerprint)
+		}
+		return nil
+	}
+
+	if hostname == "" {
+		return nil
+	}
+
+	return t.Pins.Check(hostname, fingerprint)
+}
+
+// VerifyInbound checks the key an inbound peer presented against the pin of the hostname it sent in the version
+// handshake. With mutual auth the key was already checked in the TLS handshake.
+func (t *TLSConfig) VerifyInbound(hostname string, state tls.ConnectionState) error {
+	if t.Mutual() {
+		return nil
+	}
+
+	rawCerts := make([][]byte, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+
+	return t.verify(hostname, rawCerts)
+}
+
+// ServerConfig is the TLS config of the peer listeners. With mutual auth peers must present an allowed key, otherwise
+// their key is requested for VerifyInbound.
+func (t *TLSConfig) ServerConfig() *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{t.Identity.Certificate},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequestClientCert,
+	}
+
+	if t.Mutual() {
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return t.verify("", rawCerts)
+		}
+	}
+
+	return config
+}
+
+// ControlConfig is the TLS config of the control listener, operators authenticate with tokens rather than keys
+func (t *TLSConfig) ControlConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.Identity.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientConfig is the TLS config to connect to the node with hostname. Certificates are self-signed, so the key is
+// verified against the pin or the allowed keys instead of a certificate authority.
+func (t *TLSConfig) ClientConfig(hostname string) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{t.Identity.Certificate},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return t.verify(hostname, rawCerts)
+		},
+	}
+}
+
+// HTTPClient is an HTTP client that verifies https peers by ClientConfig
+func (t *TLSConfig) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		dialer := tls.Dialer{Config: t.ClientConfig(address)}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{Transport: transport}
+}
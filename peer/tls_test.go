@@ -0,0 +1,175 @@
+package peer_test
+
+import (
+	"firstcoin/peer"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLS(t *testing.T) {
+	newIdentity := func(t *testing.T) *peer.NodeIdentity {
+		dir := t.TempDir()
+		identity, err := peer.LoadOrCreateIdentity(filepath.Join(dir, "node.key"), filepath.Join(dir, "node.crt"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return identity
+	}
+
+	newTLSConfig := func(t *testing.T, identity *peer.NodeIdentity, allowedKeys ...string) *peer.TLSConfig {
+		return &peer.TLSConfig{
+			Identity:    identity,
+			Pins:        peer.NewPinStore(filepath.Join(t.TempDir(), "pins.json")),
+			AllowedKeys: peer.ParseAllowedKeys(strings.Join(allowedKeys, ",")),
+			Peer:        true,
+		}
+	}
+
+	// serve starts an https server with the server config of node
+	serve := func(t *testing.T, node *peer.TLSConfig) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = node.ServerConfig()
+		server.StartTLS()
+		t.Cleanup(server.Close)
+
+		return server
+	}
+
+	t.Run("loads the identity it created", func(t *testing.T) {
+		dir := t.TempDir()
+		keyPath, certPath := filepath.Join(dir, "node.key"), filepath.Join(dir, "node.crt")
+
+		created, err := peer.LoadOrCreateIdentity(keyPath, certPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		loaded, err := peer.LoadOrCreateIdentity(keyPath, certPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if created.Fingerprint != loaded.Fingerprint || len(created.Fingerprint) != 64 {
+			t.Errorf("expected the same fingerprint, got %s and %s", created.Fingerprint, loaded.Fingerprint)
+		}
+	})
+
+	t.Run("pins the key of a peer on first use", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pins.json")
+		pins := peer.NewPinStore(path)
+
+		if err := pins.Check("node:8081", "aa"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := pins.Check("node:8081", "aa"); err != nil {
+			t.Errorf("unexpected error for the pinned key: %s", err)
+		}
+		if err := pins.Check("node:8081", "bb"); err == nil {
+			t.Errorf("expected an error for another key")
+		}
+
+		loaded := peer.NewPinStore(path)
+		if err := loaded.Load(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if loaded.Pins()["node:8081"] != "aa" {
+			t.Errorf("expected the pin to be saved, got: %v", loaded.Pins())
+		}
+	})
+
+	t.Run("refuses a peer whose key changed", func(t *testing.T) {
+		server := serve(t, newTLSConfig(t, newIdentity(t)))
+		client := newTLSConfig(t, newIdentity(t))
+		hostname := strings.TrimPrefix(server.URL, "https://")
+
+		if err := client.Pins.Check(hostname, strings.Repeat("0", 64)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if _, err := client.HTTPClient().Get(server.URL); err == nil {
+			t.Errorf("expected an error for a key that does not match the pin")
+		}
+	})
+
+	t.Run("connects to a peer and pins its key", func(t *testing.T) {
+		serverIdentity := newIdentity(t)
+		server := serve(t, newTLSConfig(t, serverIdentity))
+		client := newTLSConfig(t, newIdentity(t))
+
+		resp, err := client.HTTPClient().Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+
+		if pinned := client.Pins.Pins()[strings.TrimPrefix(server.URL, "https://")]; pinned != serverIdentity.Fingerprint {
+			t.Errorf("incorrect pin. Got: %s. Want: %s", pinned, serverIdentity.Fingerprint)
+		}
+	})
+
+	t.Run("pins the key of an inbound peer to the hostname it sent", func(t *testing.T) {
+		node := newTLSConfig(t, newIdentity(t))
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := node.VerifyInbound("node:8081", *r.TLS); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = node.ServerConfig()
+		server.StartTLS()
+		t.Cleanup(server.Close)
+
+		inboundIdentity := newIdentity(t)
+		for i := 0; i < 2; i++ {
+			resp, err := newTLSConfig(t, inboundIdentity).HTTPClient().Get(server.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("incorrect status for the pinned key. Got: %d. Want: %d", resp.StatusCode, http.StatusOK)
+			}
+		}
+		if pinned := node.Pins.Pins()["node:8081"]; pinned != inboundIdentity.Fingerprint {
+			t.Errorf("incorrect pin. Got: %s. Want: %s", pinned, inboundIdentity.Fingerprint)
+		}
+
+		resp, err := newTLSConfig(t, newIdentity(t)).HTTPClient().Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected another key for the hostname to be refused, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("only lets allowed keys connect with mutual auth", func(t *testing.T) {
+		serverIdentity, allowedIdentity := newIdentity(t), newIdentity(t)
+		server := serve(t, newTLSConfig(t, serverIdentity, allowedIdentity.Fingerprint))
+
+		allowed := newTLSConfig(t, allowedIdentity, serverIdentity.Fingerprint)
+		resp, err := allowed.HTTPClient().Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error for an allowed key: %s", err)
+		}
+		resp.Body.Close()
+
+		other := newTLSConfig(t, newIdentity(t), serverIdentity.Fingerprint)
+		if _, err := other.HTTPClient().Get(server.URL); err == nil {
+			t.Errorf("expected a key that is not allowed to be refused")
+		}
+
+		// the client refuses a server whose key it does not allow either
+		distrusting := newTLSConfig(t, allowedIdentity, allowedIdentity.Fingerprint)
+		if _, err := distrusting.HTTPClient().Get(server.URL); err == nil {
+			t.Errorf("expected a server with a key that is not allowed to be refused")
+		}
+	})
+}
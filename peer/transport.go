@@ -0,0 +1,419 @@
+package peer
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/utils"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// P2P_PORT_OFFSET is added to the HTTP port of a node for the port of its peer connections
+	P2P_PORT_OFFSET = 1000
+
+	// DIAL_TIMEOUT is how long connecting to a peer may take
+	DIAL_TIMEOUT = 10 * time.Second
+
+	// TARGET_OUTBOUND is how many connections a node dials and keeps to peers, checked every CONNECTION_CHECK_INTERVAL
+	TARGET_OUTBOUND           = 8
+	CONNECTION_CHECK_INTERVAL = 10 * time.Second
+
+	// ADDR_EXCHANGE_INTERVAL is how often the connected peers are asked for the addresses they know
+	ADDR_EXCHANGE_INTERVAL = 10 * time.Minute
+
+	// ADDR_SAVE_INTERVAL is how often the address manager is saved to disk
+	ADDR_SAVE_INTERVAL = time.Minute
+)
+
+// P2PAddress is the address of the peer connections of the node with hostname, its HTTP host and port
+func P2PAddress(hostname string) (string, error) {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %s. error: %s", hostname, err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p+P2P_PORT_OFFSET)), nil
+}
+
+func randomNonce() uint64 {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		utils.PanicError(err)
+	}
+
+	// zero means no ping is outstanding
+	return binary.LittleEndian.Uint64(b) | 1
+}
+
+// localVersion is the version message of this node
+func (c *Client) localVersion() VersionMessage {
+	bestHeight := -1
+	if c.BlockchainService.Blockchain.Len() > 0 {
+		bestHeight = c.BlockchainService.Blockchain.GetLastBlock().Index
+	}
+
+	return VersionMessage{
+		ProtocolVersion: PROTOCOL_VERSION,
+		ChainID:         c.BlockchainService.Blockchain.Params().ID,
+		BestHeight:      bestHeight,
+		Services:        SERVICE_NODE_NETWORK,
+		Hostname:        c.ThisPeer,
+		Nonce:           c.nonce,
+		Timestamp:       time.Now().Unix(),
+	}
+}
+
+// Connections describes the peer connections of the node
+func (c *Client) Connections() []ConnInfo {
+	infos := make([]ConnInfo, 0)
+	for _, conn := range c.conns.all() {
+		infos = append(infos, conn.Info())
+	}
+
+	return infos
+}
+
+// requestOne requests the block or tx of item over conn and unmarshals it into v
+func requestOne(conn *Conn, item InvItem, v interface{}) error {
+	messages, err := conn.request([]InvItem{item})
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 || messages[0].Command == CMD_NOTFOUND {
+		return fmt.Errorf("peer %s does not have %s %x", conn.Version.Hostname, item.Type, item.Hash)
+	}
+
+	return messages[0].Decode(v)
+}
+
+// requestData requests the blocks and txs of items over conn
+func requestData(conn *Conn, items []InvItem) (*InvData, error) {
+	messages, err := conn.request(items)
+
+	data := InvData{
+		Blocks:       make([]coin.Block, 0),
+		Transactions: make([]repository.Transaction, 0),
+	}
+	for _, msg := range messages {
+		switch msg.Command {
+		case CMD_BLOCK:
+			var block coin.Block
+			if err := msg.Decode(&block); err == nil {
+				data.Blocks = append(data.Blocks, block)
+			}
+		case CMD_TX:
+			var tx repository.Transaction
+			if err := msg.Decode(&tx); err == nil {
+				data.Transactions = append(data.Transactions, tx)
+			}
+		}
+	}
+
+	// the blocks and txs that arrived before a timeout are still processed
+	if err != nil && len(messages) == 0 {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// ListenPeers accepts peer connections on address, over TLS if the peer listeners are secured. It does not return
+// unless listening fails.
+func (c *CoinServerHandler) ListenPeers(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if c.Client.TLS != nil && c.Client.TLS.Peer {
+		listener = tls.NewListener(listener, c.Client.TLS.ServerConfig())
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		// a banned peer is dropped before the handshake
+		if c.Bans.IsBanned(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+
+		go c.serveConn(conn, "")
+	}
+}
+
+// ConnectPeer opens a connection to the peer with hostname, unless it has one or the peer is banned. The attempt and its
+// outcome are recorded in the address manager.
+func (c *CoinServerHandler) ConnectPeer(hostname string) error {
+	if _, ok := c.Client.conns.get(hostname); ok {
+		return nil
+	}
+
+	address, err := P2PAddress(hostname)
+	if err != nil {
+		return err
+	}
+
+	c.Client.Addresses.Attempt(hostname)
+	conn, err := net.DialTimeout("tcp", address, DIAL_TIMEOUT)
+	if err != nil {
+		c.Client.Addresses.Failed(hostname)
+		return err
+	}
+
+	if c.Bans.IsBanned(conn.RemoteAddr().String()) {
+		conn.Close()
+		return fmt.Errorf("peer %s at %s is banned", hostname, conn.RemoteAddr())
+	}
+
+	// the key of the peer is checked in the TLS handshake, on the first message of the version handshake
+	if c.Client.TLS != nil && c.Client.TLS.Peer {
+		conn = tls.Client(conn, c.Client.TLS.ClientConfig(hostname))
+	}
+
+	go c.serveConn(conn, hostname)
+	return nil
+}
+
+// MaintainPeerConnections keeps TARGET_OUTBOUND connections to peers picked by the address manager, dialing again the
+// peers that dropped. It asks the connected peers for addresses every ADDR_EXCHANGE_INTERVAL, and saves the address
+// manager every ADDR_SAVE_INTERVAL. Until a peer is connected, messages to it go over HTTP. It does not return.
+func (c *CoinServerHandler) MaintainPeerConnections() {
+	lastExchange := time.Time{}
+	lastSave := time.Now()
+
+	for {
+		// the peers in the table, from the seed or notifying this node, are candidates like any other address
+		for hostname := range c.Peers.Hostnames() {
+			c.Client.Addresses.AddAddresses(c.Client.ThisPeer, hostname)
+		}
+
+		exclude := map[string]bool{c.Client.ThisPeer: true}
+		outbound := 0
+		for _, conn := range c.Client.conns.all() {
+			exclude[conn.Version.Hostname] = true
+			if !conn.Inbound {
+				outbound++
+			}
+		}
+
+		if outbound < TARGET_OUTBOUND {
+			for _, hostname := range c.Client.Addresses.Select(TARGET_OUTBOUND-outbound, exclude) {
+				if err := c.ConnectPeer(hostname); err != nil {
+					utils.ErrorLogger.Printf("could not connect to peer %s. error: %s", hostname, err)
+				}
+			}
+		}
+
+		if time.Since(lastExchange) >= ADDR_EXCHANGE_INTERVAL {
+			for _, conn := range c.Client.conns.all() {
+				conn.Send(CMD_GETADDR, nil)
+			}
+			lastExchange = time.Now()
+		}
+
+		if time.Since(lastSave) >= ADDR_SAVE_INTERVAL {
+			if err := c.Client.Addresses.Save(); err != nil {
+				utils.ErrorLogger.Printf("could not save peer addresses. error: %s", err)
+			}
+			lastSave = time.Now()
+		}
+
+		time.Sleep(CONNECTION_CHECK_INTERVAL)
+	}
+}
+
+// serveConn completes the handshake over conn and serves the peer until the connection fails. dialed is the hostname
+// of the peer for an outbound connection, empty for an inbound one.
+func (c *CoinServerHandler) serveConn(netConn net.Conn, dialed string) {
+	inbound := dialed == ""
+
+	conn, err := newConn(netConn, c.Client.localVersion(), inbound)
+	if err != nil {
+		utils.ErrorLogger.Printf("handshake with %s failed. error: %s", netConn.RemoteAddr(), err)
+		if !inbound {
+			c.Client.Addresses.Failed(dialed)
+		}
+		return
+	}
+	defer conn.Close()
+
+	// an inbound peer is only known by the hostname it sent, which must be the address it connected from
+	if inbound && !resolvesTo(conn.Version.Hostname, conn.RemoteAddr()) {
+		utils.ErrorLogger.Printf("peer at %s sent hostname %s, which does not resolve to it", conn.RemoteAddr(), conn.Version.Hostname)
+		c.misbehaving(conn.RemoteAddr(), SCORE_FAKE_HOSTNAME, fmt.Sprintf("sent hostname %q", conn.Version.Hostname))
+		return
+	}
+
+	// the key of an inbound peer is pinned against the hostname it sent, as an outbound peer is against the dialed one
+	if tlsConn, ok := netConn.(*tls.Conn); ok && inbound {
+		if err := c.Client.TLS.VerifyInbound(conn.Version.Hostname, tlsConn.ConnectionState()); err != nil {
+			utils.ErrorLogger.Printf("peer at %s refused. error: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	// both peers can dial each other at once, the connection that completes first is kept
+	if !c.Client.conns.add(conn) {
+		return
+	}
+	defer c.Client.conns.remove(conn)
+
+	remote := conn.Version.Hostname
+	c.Peers.AddHostname(remote)
+
+	// an inbound peer is only heard of, its hostname is tried once this node dials it
+	if inbound {
+		c.Client.Addresses.AddAddresses(remote, remote)
+	} else {
+		c.Client.Addresses.Good(remote)
+		conn.Send(CMD_GETADDR, nil)
+	}
+	utils.InfoLogger.Printf("connected to peer %s, protocol version %d, best height %d\n", remote, conn.Version.ProtocolVersion, conn.Version.BestHeight)
+
+	// a peer with a longer chain is synced with, as on startup
+	if c.BlockchainService.Blockchain.Len() == 0 || conn.Version.BestHeight > c.BlockchainService.Blockchain.GetLastBlock().Index {
+		go func() {
+			if err := c.Client.QueryPeersForBlockchain(map[string]string{remote: remote}); err != nil {
+				utils.ErrorLogger.Printf("could not sync with peer %s. error: %s", remote, err)
+			}
+		}()
+	}
+
+	go conn.pingLoop(randomNonce)
+
+	err = conn.readLoop(c.allowMessage(conn), c.handleMessage)
+	utils.InfoLogger.Printf("disconnected from peer %s. error: %s\n", remote, err)
+
+	switch {
+	case errors.Is(err, ErrOversizedMessage):
+		c.misbehaving(conn.RemoteAddr(), SCORE_OVERSIZED_MESSAGE, err.Error())
+	case errors.Is(err, ErrBadMagic), errors.Is(err, ErrBadChecksum):
+		c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, err.Error())
+	}
+}
+
+// allowMessage takes a token from the rate limiter for each message of conn, in the class of the HTTP endpoint of the
+// same name. Requested blocks and txs are delivered without one.
+func (c *CoinServerHandler) allowMessage(conn *Conn) func(string) bool {
+	return func(command string) bool {
+		if c.RateLimiter == nil {
+			return true
+		}
+
+		class := CLASS_GOSSIP
+		if command == CMD_PING || command == CMD_GETADDR {
+			class = CLASS_QUERY
+		}
+
+		allowed, _ := c.RateLimiter.Allow(class, command, conn.RemoteAddr())
+		return allowed
+	}
+}
+
+// handleMessage handles the inv, getdata, block and tx messages a peer sends over its connection, like the HTTP
+// endpoints of the same names, and the getaddr and addr messages peers exchange addresses with
+func (c *CoinServerHandler) handleMessage(conn *Conn, msg Message) {
+	peer := conn.Version.Hostname
+
+	switch msg.Command {
+	case CMD_INV:
+		var inv Inv
+		if err := msg.Decode(&inv); err != nil {
+			utils.ErrorLogger.Printf("invalid inv from peer %s. error: %s", peer, err)
+			c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, "invalid inv")
+			return
+		}
+		c.receiveInv(peer, conn.RemoteAddr(), inv.Items)
+
+	case CMD_GETDATA:
+		var inv Inv
+		if err := msg.Decode(&inv); err != nil || len(inv.Items) > MAX_INV_ITEMS {
+			utils.ErrorLogger.Printf("invalid getdata from peer %s", peer)
+			c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, "invalid getdata")
+			return
+		}
+		c.Client.MarkKnown(peer, inv.Items...)
+
+		data := c.findData(inv.Items)
+		for _, block := range data.Blocks {
+			if err := conn.Send(CMD_BLOCK, block); err != nil {
+				return
+			}
+		}
+		for _, tx := range data.Transactions {
+			if err := conn.Send(CMD_TX, tx); err != nil {
+				return
+			}
+		}
+		if len(data.NotFound) > 0 {
+			conn.Send(CMD_NOTFOUND, Inv{Items: data.NotFound})
+		}
+
+	case CMD_BLOCK:
+		var block coin.Block
+		if err := msg.Decode(&block); err != nil {
+			utils.ErrorLogger.Printf("invalid block from peer %s. error: %s", peer, err)
+			c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, "invalid block message")
+			return
+		}
+		if _, err := c.acceptBlock(block, peer, conn.RemoteAddr()); err != nil {
+			utils.ErrorLogger.Printf("block %x from peer %s rejected. error: %s", block.Hash, peer, err)
+		}
+
+	case CMD_TX:
+		var tx repository.Transaction
+		if err := msg.Decode(&tx); err != nil {
+			utils.ErrorLogger.Printf("invalid tx from peer %s. error: %s", peer, err)
+			c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, "invalid tx message")
+			return
+		}
+		if _, err := c.acceptTransaction(tx, peer, conn.RemoteAddr()); err != nil {
+			utils.ErrorLogger.Printf("tx %x from peer %s rejected. error: %s", tx.ID, peer, err)
+		}
+
+	case CMD_GETADDR:
+		conn.Send(CMD_ADDR, AddrMessage{Addresses: c.Client.Addresses.Addresses()})
+
+	case CMD_ADDR:
+		var addr AddrMessage
+		if err := msg.Decode(&addr); err != nil {
+			utils.ErrorLogger.Printf("invalid addr from peer %s. error: %s", peer, err)
+			c.misbehaving(conn.RemoteAddr(), SCORE_MALFORMED_MESSAGE, "invalid addr")
+			return
+		}
+		if len(addr.Addresses) > MAX_ADDR_PER_MESSAGE {
+			addr.Addresses = addr.Addresses[:MAX_ADDR_PER_MESSAGE]
+		}
+
+		hostnames := make([]string, 0, len(addr.Addresses))
+		for _, hostname := range addr.Addresses {
+			if _, err := P2PAddress(hostname); err == nil && hostname != c.Client.ThisPeer {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		c.Client.Addresses.AddAddresses(peer, hostnames...)
+
+	case CMD_NOTFOUND:
+		// the request it answers timed out
+
+	default:
+		utils.InfoLogger.Printf("ignoring unknown %s message from peer %s\n", msg.Command, peer)
+	}
+}
@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"firstcoin/coin"
+	"fmt"
+	"io"
+)
+
+const (
+	// PROTOCOL_VERSION is the version of the peer protocol this node speaks. Peers below MIN_PROTOCOL_VERSION are refused.
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+
+	// MAGIC starts every message, a stream that does not start with it is not a firstcoin peer
+	MAGIC uint32 = 0xf1c0f1c0
+
+	// SERVICE_NODE_NETWORK is the services flag of a node that serves the full chain
+	SERVICE_NODE_NETWORK uint64 = 1 << 0
+
+	// MAX_MESSAGE_PAYLOAD bounds the payload of a message, the largest is the JSON of a block
+	MAX_MESSAGE_PAYLOAD = JSON_SIZE_FACTOR * coin.MAX_BLOCK_SIZE
+
+	COMMAND_SIZE     = 12
+	MSG_HEADER_SIZE  = 4 + COMMAND_SIZE + 4 + 4
+	MSG_CHECKSUM_LEN = 4
+)
+
+const (
+	CMD_VERSION  = "version"
+	CMD_VERACK   = "verack"
+	CMD_PING     = "ping"
+	CMD_PONG     = "pong"
+	CMD_INV      = "inv"
+	CMD_GETDATA  = "getdata"
+	CMD_NOTFOUND = "notfound"
+	CMD_BLOCK    = "block"
+	CMD_TX       = "tx"
+	CMD_GETADDR  = "getaddr"
+	CMD_ADDR     = "addr"
+)
+
+var (
+	ErrBadMagic         = errors.New("message does not start with the network magic")
+	ErrBadChecksum      = errors.New("message checksum does not match its payload")
+	ErrOversizedMessage = errors.New("message payload is larger than the max")
+)
+
+// Message is a framed peer message: the magic, the command null padded to COMMAND_SIZE bytes, the payload length, the
+// first 4 bytes of the double sha256 of the payload, and the JSON payload
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+// Decode unmarshals the payload into v
+func (m Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// VersionMessage opens the handshake, each side sends its own and acknowledges the other's with a verack
+type VersionMessage struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	ChainID         string `json:"chainId"`
+	BestHeight      int    `json:"bestHeight"`
+	Services        uint64 `json:"services"`
+	Hostname        string `json:"hostname"`
+	Nonce           uint64 `json:"nonce"`
+	Timestamp       int64  `json:"timestamp"`
+}
+
+// PingMessage is the payload of a ping, and of the pong answering it with the same nonce
+type PingMessage struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// AddrMessage is the payload of an addr, the hostnames of peers the sender knows
+type AddrMessage struct {
+	Addresses []string `json:"addresses"`
+}
+
+// WriteMessage frames the JSON of payload under command and writes it to w. A nil payload is sent empty.
+func WriteMessage(w io.Writer, command string, payload interface{}) error {
+	if len(command) > COMMAND_SIZE {
+		return fmt.Errorf("command %q is longer than %d bytes", command, COMMAND_SIZE)
+	}
+
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	if len(body) > MAX_MESSAGE_PAYLOAD {
+		return fmt.Errorf("%w: %s payload is %d bytes, max %d", ErrOversizedMessage, command, len(body), MAX_MESSAGE_PAYLOAD)
+	}
+
+	header := make([]byte, MSG_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(header[0:4], MAGIC)
+	copy(header[4:4+COMMAND_SIZE], command)
+	binary.LittleEndian.PutUint32(header[4+COMMAND_SIZE:8+COMMAND_SIZE], uint32(len(body)))
+	copy(header[8+COMMAND_SIZE:], checksum(body))
+
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+// ReadMessage reads the next message from r, checking its magic, size and checksum
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, MSG_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) != MAGIC {
+		return Message{}, ErrBadMagic
+	}
+
+	command := string(bytes.TrimRight(header[4:4+COMMAND_SIZE], "\x00"))
+	length := binary.LittleEndian.Uint32(header[4+COMMAND_SIZE : 8+COMMAND_SIZE])
+	if length > MAX_MESSAGE_PAYLOAD {
+		return Message{}, fmt.Errorf("%w: %s payload is %d bytes, max %d", ErrOversizedMessage, command, length, MAX_MESSAGE_PAYLOAD)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, err
+	}
+
+	if !bytes.Equal(header[8+COMMAND_SIZE:], checksum(payload)) {
+		return Message{}, ErrBadChecksum
+	}
+
+	return Message{Command: command, Payload: payload}, nil
+}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:MSG_CHECKSUM_LEN]
+}
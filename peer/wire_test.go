@@ -0,0 +1,141 @@
+package peer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"firstcoin/peer"
+	"net"
+	"testing"
+)
+
+func TestMessageFraming(t *testing.T) {
+	t.Run("reads back the message written", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := peer.WriteMessage(&buf, peer.CMD_PING, peer.PingMessage{Nonce: 42}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		msg, err := peer.ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var ping peer.PingMessage
+		if err := msg.Decode(&ping); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if msg.Command != peer.CMD_PING || ping.Nonce != 42 {
+			t.Errorf("incorrect message. Got: %s %d. Want: %s %d", msg.Command, ping.Nonce, peer.CMD_PING, 42)
+		}
+	})
+
+	t.Run("rejects a corrupted payload", func(t *testing.T) {
+		var buf bytes.Buffer
+		peer.WriteMessage(&buf, peer.CMD_PING, peer.PingMessage{Nonce: 42})
+		corrupted := buf.Bytes()
+		corrupted[len(corrupted)-2] ^= 1
+
+		if _, err := peer.ReadMessage(bytes.NewReader(corrupted)); !errors.Is(err, peer.ErrBadChecksum) {
+			t.Errorf("expected a bad checksum, got: %v", err)
+		}
+	})
+
+	t.Run("rejects another network's magic", func(t *testing.T) {
+		var buf bytes.Buffer
+		peer.WriteMessage(&buf, peer.CMD_VERACK, nil)
+		wrongMagic := buf.Bytes()
+		binary.LittleEndian.PutUint32(wrongMagic[0:4], peer.MAGIC+1)
+
+		if _, err := peer.ReadMessage(bytes.NewReader(wrongMagic)); !errors.Is(err, peer.ErrBadMagic) {
+			t.Errorf("expected a bad magic, got: %v", err)
+		}
+	})
+
+	t.Run("rejects a payload larger than the max before reading it", func(t *testing.T) {
+		var buf bytes.Buffer
+		peer.WriteMessage(&buf, peer.CMD_BLOCK, nil)
+		oversized := buf.Bytes()
+		binary.LittleEndian.PutUint32(oversized[4+peer.COMMAND_SIZE:8+peer.COMMAND_SIZE], peer.MAX_MESSAGE_PAYLOAD+1)
+
+		if _, err := peer.ReadMessage(bytes.NewReader(oversized)); !errors.Is(err, peer.ErrOversizedMessage) {
+			t.Errorf("expected an error for an oversized payload")
+		}
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	version := func(nonce uint64, protocolVersion int) peer.VersionMessage {
+		return peer.VersionMessage{
+			ProtocolVersion: protocolVersion,
+			ChainID:         "firstcoin-test",
+			BestHeight:      int(nonce),
+			Services:        peer.SERVICE_NODE_NETWORK,
+			Hostname:        "localhost:8080",
+			Nonce:           nonce,
+		}
+	}
+
+	// handshake runs both sides of a handshake over a pipe, returning what each side learned of the other
+	handshake := func(a peer.VersionMessage, b peer.VersionMessage) (peer.VersionMessage, error, peer.VersionMessage, error) {
+		connA, connB := net.Pipe()
+		defer connA.Close()
+		defer connB.Close()
+
+		type result struct {
+			version peer.VersionMessage
+			err     error
+		}
+		done := make(chan result)
+		go func() {
+			remote, err := peer.Handshake(connB, b)
+			if err != nil {
+				connB.Close()
+			}
+			done <- result{remote, err}
+		}()
+
+		remoteOfA, errA := peer.Handshake(connA, a)
+		if errA != nil {
+			connA.Close()
+		}
+		resultB := <-done
+
+		return remoteOfA, errA, resultB.version, resultB.err
+	}
+
+	t.Run("exchanges versions and settles on the lower protocol version", func(t *testing.T) {
+		remoteOfA, errA, remoteOfB, errB := handshake(version(1, peer.PROTOCOL_VERSION), version(2, peer.PROTOCOL_VERSION+1))
+		if errA != nil || errB != nil {
+			t.Fatalf("unexpected errors: %v, %v", errA, errB)
+		}
+
+		if remoteOfA.BestHeight != 2 || remoteOfB.BestHeight != 1 {
+			t.Errorf("expected each side to learn the other's best height")
+		}
+		if remoteOfA.ProtocolVersion != peer.PROTOCOL_VERSION {
+			t.Errorf("incorrect protocol version. Got: %d. Want: %d", remoteOfA.ProtocolVersion, peer.PROTOCOL_VERSION)
+		}
+	})
+
+	t.Run("refuses a peer on another chain", func(t *testing.T) {
+		other := version(2, peer.PROTOCOL_VERSION)
+		other.ChainID = "firstcoin-other"
+
+		if _, errA, _, _ := handshake(version(1, peer.PROTOCOL_VERSION), other); errA == nil {
+			t.Errorf("expected the handshake to fail")
+		}
+	})
+
+	t.Run("refuses a connection to itself", func(t *testing.T) {
+		if _, errA, _, _ := handshake(version(1, peer.PROTOCOL_VERSION), version(1, peer.PROTOCOL_VERSION)); errA == nil {
+			t.Errorf("expected the handshake to fail")
+		}
+	})
+
+	t.Run("refuses a peer below the min protocol version", func(t *testing.T) {
+		if _, errA, _, _ := handshake(version(1, peer.PROTOCOL_VERSION), version(2, peer.MIN_PROTOCOL_VERSION-1)); errA == nil {
+			t.Errorf("expected the handshake to fail")
+		}
+	})
+}
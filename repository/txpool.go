@@ -1,54 +1,144 @@
 package repository
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
 
+// Locktime is the earliest block index, or unix time in seconds if >= 500000000, that the transaction can be mined in.
+// BlockIndex and BlockTimestamp are only set on transactions in the UTxO set and record the block that confirmed them,
+// they are not part of the transaction id.
 type Transaction struct {
-	ID        []byte `json:"txid"`
-	Locktime  int    `json:"locktime"`
-	TxIns     []TxIn `json:"vin"`
-	TxOuts    []TxO  `json:"vout"`
-	Timestamp int    `json:"timestamp"`
+	ID             []byte `json:"txid"`
+	Locktime       int    `json:"locktime"`
+	TxIns          []TxIn `json:"vin"`
+	TxOuts         []TxO  `json:"vout"`
+	Timestamp      int    `json:"timestamp"`
+	BlockIndex     int    `json:"blockIndex,omitempty"`
+	BlockTimestamp int    `json:"blockTimestamp,omitempty"`
 }
 
-var unconfirmedTransactionPool = make(map[TxIDType]Transaction, 0)
-
 func (t Transaction) String() string {
 	return fmt.Sprintf("txId: %s\ntxIns: %+v\ntxOuts: %+v\n", t.ID, t.TxIns, t.TxOuts)
 }
 
-func AddTxToTxPool(tx Transaction) bool {
-	unconfirmedTransactionPool[TxIDType(tx.ID)] = tx
+// TxPool holds the unconfirmed txs of a node, safe for concurrent use. It records when each tx entered the pool, in unix
+// nanoseconds, to order the pool and expire old txs.
+type TxPool struct {
+	mu    sync.RWMutex
+	txs   map[TxIDType]Transaction
+	times map[TxIDType]int
+}
+
+func NewTxPool() *TxPool {
+	return &TxPool{
+		txs:   make(map[TxIDType]Transaction),
+		times: make(map[TxIDType]int),
+	}
+}
+
+func (p *TxPool) Add(tx Transaction) bool {
+	return p.AddAt(tx, int(time.Now().UnixNano()))
+}
+
+// AddAt adds tx as if it entered the tx pool at addedAt, which keeps the place of a tx that is put back. A tx already in
+// the pool keeps its time.
+func (p *TxPool) AddAt(tx Transaction, addedAt int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.times[TxIDType(tx.ID)]; !ok {
+		p.times[TxIDType(tx.ID)] = addedAt
+	}
+	p.txs[TxIDType(tx.ID)] = tx
 
 	return true
 }
 
-func GetTxPool() map[TxIDType]Transaction {
-	return unconfirmedTransactionPool
+// Time returns when the tx with txId entered the tx pool
+func (p *TxPool) Time(txId []byte) (int, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	addedAt, ok := p.times[TxIDType(txId)]
+	return addedAt, ok
+}
+
+// Map returns a copy of the pool keyed by tx id
+func (p *TxPool) Map() map[TxIDType]Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	txPool := make(map[TxIDType]Transaction, len(p.txs))
+	for txID, tx := range p.txs {
+		txPool[txID] = tx
+	}
+
+	return txPool
 }
 
-func GetTxFromTxPool(txId []byte) (Transaction, bool) {
-	tx, ok := unconfirmedTransactionPool[TxIDType(txId)]
+func (p *TxPool) Get(txId []byte) (Transaction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	tx, ok := p.txs[TxIDType(txId)]
 	return tx, ok
 }
 
-func GetTxPoolArray() []Transaction {
-	txPool := make([]Transaction, 0)
+func (p *TxPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.txs)
+}
 
-	for _, tx := range unconfirmedTransactionPool {
+// Array returns the pool txs in the order they entered the pool, ties broken by tx id
+func (p *TxPool) Array() []Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	txPool := make([]Transaction, 0, len(p.txs))
+	for _, tx := range p.txs {
 		txPool = append(txPool, tx)
 	}
 
+	sort.Slice(txPool, func(i, j int) bool {
+		timeI, timeJ := p.times[TxIDType(txPool[i].ID)], p.times[TxIDType(txPool[j].ID)]
+		if timeI != timeJ {
+			return timeI < timeJ
+		}
+		return bytes.Compare(txPool[i].ID, txPool[j].ID) < 0
+	})
+
 	return txPool
 }
 
-func SetTxPool(txPool map[TxIDType]Transaction) {
-	unconfirmedTransactionPool = txPool
+// Set replaces the pool with txPool, all entering it now
+func (p *TxPool) Set(txPool map[TxIDType]Transaction) {
+	now := int(time.Now().UnixNano())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.txs = make(map[TxIDType]Transaction, len(txPool))
+	p.times = make(map[TxIDType]int, len(txPool))
+	for txID, tx := range txPool {
+		p.txs[txID] = tx
+		p.times[txID] = now
+	}
 }
 
-func RemoveTxFromTxPool(txId []byte) {
-	delete(unconfirmedTransactionPool, TxIDType(txId))
+func (p *TxPool) Remove(txId []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.txs, TxIDType(txId))
+	delete(p.times, TxIDType(txId))
 }
 
-func EmptyTxPool() {
-	unconfirmedTransactionPool = make(map[TxIDType]Transaction, 0)
+func (p *TxPool) Empty() {
+	p.Set(nil)
 }
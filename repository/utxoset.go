@@ -2,40 +2,113 @@ package repository
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"reflect"
+	"sync"
 )
 
-var uTxOSet = UTxOSetType(make(map[TxIDType]Transaction))
-
 type TxIDType string
 type UTxOSetType map[TxIDType]Transaction
 type UserWalletType map[TxIDType]Transaction // wallet is basically the subset of UTxOSet that concerns the user
 
-// transcation input refers to the giver of coins. Signature is signed with giver's private key
+// transcation input refers to the giver of coins. Signature is signed with giver's private key. Sequence is a relative
+// timelock on the uTxO being spent, see wallet.CheckSequenceLocks
 type TxIn struct {
 	TxID            []byte `json:"txid"`
 	TxOIndex        int    `json:"vout"`
 	ScriptSignature []byte `json:"scriptSig"`
+	Sequence        int    `json:"sequence"`
 }
 
-// transaction ouput refers to the receiver of coins. Address is receiver's public key
+// transaction ouput refers to the receiver of coins. ScriptPubKey locks the coins to the receiver's address
 type TxO struct {
 	ScriptPubKey []byte `json:"scriptPubKey"`
 	Value        int    `json:"value"`
 }
 
-func GetEntireUTxOSet() UTxOSetType {
-	return uTxOSet
+// IsSpent is true for the empty output that takes the place of a spent or unspendable output in the uTxO set, so that
+// the outputs after it keep their index. A tx can never have an output without a scriptPubKey.
+func (t TxO) IsSpent() bool {
+	return len(t.ScriptPubKey) == 0
+}
+
+// UTxOSet is the uTxO set of a node, safe for concurrent use. Readers work on copies, so that validating and spending
+// against a copy never races with blocks being committed.
+type UTxOSet struct {
+	mu  sync.RWMutex
+	set UTxOSetType
+}
+
+func NewUTxOSet() *UTxOSet {
+	return &UTxOSet{set: make(UTxOSetType)}
+}
+
+// Copy returns a deep copy of the set
+func (u *UTxOSet) Copy() UTxOSetType {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return CopyUTxOSetFrom(u.set)
+}
+
+// Get returns a copy of the tx with txID, which shares nothing with the set
+func (u *UTxOSet) Get(txID []byte) (Transaction, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	tx, ok := u.set[TxIDType(txID)]
+	if !ok {
+		return tx, false
+	}
+
+	tx.TxIns = append([]TxIn{}, tx.TxIns...)
+	tx.TxOuts = append([]TxO{}, tx.TxOuts...)
+	return tx, true
+}
+
+func (u *UTxOSet) Len() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return len(u.set)
+}
+
+func (u *UTxOSet) Add(tx Transaction) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	AddTxSpecifiedToUTxOSet(tx, u.set)
+}
+
+// Update runs update on a copy of the set while holding the write lock and swaps the copy in, so the txs readers got
+// from the set are never changed under them
+func (u *UTxOSet) Update(update func(UTxOSetType)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	set := CopyUTxOSetFrom(u.set)
+	update(set)
+	u.set = set
+}
+
+// Replace swaps the whole set for uTxOSet
+func (u *UTxOSet) Replace(uTxOSet UTxOSetType) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.set = uTxOSet
+}
+
+func (u *UTxOSet) Clear() {
+	u.Replace(make(UTxOSetType))
 }
 
-func GetUserLedger(publicKey []byte) UserWalletType {
+func GetUserLedgerCopy(scriptPubKey []byte, uTxOSet UTxOSetType) UserWalletType {
 	wallet := make(map[TxIDType]Transaction)
 
 	for _, tx := range uTxOSet {
 		for _, txO := range tx.TxOuts {
-			if reflect.DeepEqual(txO.ScriptPubKey, publicKey) {
+			if reflect.DeepEqual(txO.ScriptPubKey, scriptPubKey) {
 				wallet[TxIDType(tx.ID)] = tx
 				break
 			}
@@ -45,10 +118,6 @@ func GetUserLedger(publicKey []byte) UserWalletType {
 	return wallet
 }
 
-func AddTxToUTxOSet(tx Transaction) {
-	AddTxSpecifiedToUTxOSet(tx, uTxOSet)
-}
-
 func AddTxToUTxOSetCopy(tx Transaction, uTxOSetCopy UTxOSetType) {
 	AddTxSpecifiedToUTxOSet(tx, uTxOSetCopy)
 }
@@ -57,35 +126,47 @@ func AddTxSpecifiedToUTxOSet(tx Transaction, uTxOSet UTxOSetType) {
 	uTxOSet[TxIDType(tx.ID)] = tx
 }
 
-func RemoveTxOFromUTxOSet(txID TxIDType, txIn TxIn) {
-	RemoveTxOFromUTxOCopy(txID, txIn, uTxOSet)
-}
-
+// RemoveTxOFromUTxOCopy spends the output txIn refers to. It is replaced by an empty output, so the other outputs of its
+// tx keep their index, and the tx leaves the set once all its outputs are spent.
 func RemoveTxOFromUTxOCopy(txID TxIDType, txIn TxIn, uTxOSet UTxOSetType) {
 	index := txIn.TxOIndex
-	uTxOID := txIn.TxID
-	txOs := uTxOSet[TxIDType(uTxOID)].TxOuts
-
-	remainingTxOs := append(txOs[:index], txOs[index+1:]...)
-	if len(remainingTxOs) == 0 {
-		delete(uTxOSet, TxIDType(uTxOID))
-	} else {
-		tx := uTxOSet[TxIDType(uTxOID)]
-		tx.TxOuts = remainingTxOs
-		uTxOSet[TxIDType(uTxOID)] = tx
+	uTxOID := TxIDType(txIn.TxID)
+	tx, ok := uTxOSet[uTxOID]
+	if !ok || index < 0 || index >= len(tx.TxOuts) {
+		return
+	}
+
+	// the outputs are copied, a tx read from the set may share them
+	tx.TxOuts = append([]TxO{}, tx.TxOuts...)
+	tx.TxOuts[index] = TxO{}
+
+	for _, txO := range tx.TxOuts {
+		if !txO.IsSpent() {
+			uTxOSet[uTxOID] = tx
+			return
+		}
+	}
+	delete(uTxOSet, uTxOID)
+}
+
+// RemoveTxOsFromUTxOCopy spends the outputs all of txIns refer to
+func RemoveTxOsFromUTxOCopy(txID TxIDType, txIns []TxIn, uTxOSet UTxOSetType) {
+	for _, txIn := range txIns {
+		RemoveTxOFromUTxOCopy(txID, txIn, uTxOSet)
 	}
 }
 
-func ClearUTxOSet() {
-	uTxOSet = UTxOSetType(make(map[TxIDType]Transaction))
+// Outpoint names the output txIn spends by the id of its tx and its index
+func (t TxIn) Outpoint() string {
+	return fmt.Sprintf("%x:%d", t.TxID, t.TxOIndex)
 }
 
 func (t TxIn) String() string {
-	return fmt.Sprintf("{\nTxID: %s\nuTxOIndex: %+v\nscriptSig: %+v\n}\n", t.TxID, t.TxOIndex, Base64Encode(t.ScriptSignature))
+	return fmt.Sprintf("{\nTxID: %s\nuTxOIndex: %+v\nscriptSig: %+v\nsequence: %d\n}\n", t.TxID, t.TxOIndex, Base64Encode(t.ScriptSignature), t.Sequence)
 }
 
 func (t TxO) String() string {
-	return fmt.Sprintf("{\nAddress: %s\nAmount: %+v\n}\n", string(t.ScriptPubKey), t.Value)
+	return fmt.Sprintf("{\nScriptPubKey: %x\nAmount: %+v\n}\n", t.ScriptPubKey, t.Value)
 }
 
 func Base64Encode(message []byte) []byte {
@@ -94,13 +175,13 @@ func Base64Encode(message []byte) []byte {
 	return b
 }
 
-func CopyUTxOSet() UTxOSetType {
-	uTxOSetCopy := make(map[TxIDType]Transaction)
+// CopyUTxOSetFrom deep copies the given uTxO set, so that spending from the copy leaves it untouched
+func CopyUTxOSetFrom(uTxOSet UTxOSetType) UTxOSetType {
+	uTxOSetCopy := make(map[TxIDType]Transaction, len(uTxOSet))
 	for txID, tx := range uTxOSet {
-		txCopy := Transaction{}
-		bytes, _ := json.Marshal(tx)
-		json.Unmarshal(bytes, &txCopy)
-		uTxOSetCopy[txID] = txCopy
+		tx.TxIns = append([]TxIn{}, tx.TxIns...)
+		tx.TxOuts = append([]TxO{}, tx.TxOuts...)
+		uTxOSetCopy[txID] = tx
 	}
 
 	return uTxOSetCopy
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/utils"
+	"firstcoin/wallet"
+	"fmt"
+	"time"
+)
+
+// ConnectBlock makes block the new tip of the chain. It is validated on top of the current tip and its txs are applied
+// to a scratch copy of the uTxO set, and the block is saved with its undo data to the chain store of the service. Only
+// once that succeeds is the copy swapped in, the tx pool updated and the block appended to the chain, so on any failure the chain,
+// the uTxO set and the tx pool are left as they were. Blocks mined locally, relayed by peers and downloaded on sync all
+// enter the chain this way.
+func (s *BlockchainService) ConnectBlock(block coin.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connectBlock(block)
+}
+
+func (s *BlockchainService) connectBlock(block coin.Block) error {
+	var tip *coin.Block
+	if s.Blockchain.Len() > 0 {
+		lastBlock := s.Blockchain.GetLastBlock()
+		tip = &lastBlock
+	}
+
+	uTxOSet := s.UTxOSet.Copy()
+	undo, err := applyBlock(tip, block, uTxOSet, s.Blockchain.Params())
+	if err != nil {
+		return err
+	}
+
+	if err := s.saveBlocks([]coin.Block{block}, []blockUndo{undo}); err != nil {
+		return err
+	}
+
+	s.UTxOSet.Replace(uTxOSet)
+	s.addBlockUndo(block, undo)
+	for _, tx := range block.Transactions {
+		s.removeFromTxPool(tx.ID)
+	}
+	s.revalidateTxPool(block.Index + 1)
+	s.Blockchain.AddBlock(block)
+
+	// the parents of orphan txs can arrive in a block as well as on their own
+	s.acceptOrphanTxs(block.Transactions, block.Index+1)
+
+	return nil
+}
+
+// SyncBlockchain switches the node to the chain of blocks if it is valid and has more work than the node's own. Every
+// block is connected as by ConnectBlock, on a scratch uTxO set built up from the genesis block, and the node keeps its
+// chain and uTxO set if any block fails.
+func (s *BlockchainService) SyncBlockchain(blocks []coin.Block) error {
+	if len(blocks) == 0 {
+		return fmt.Errorf("Invalid blockchain: %s", "no blocks")
+	}
+
+	// the blocks are validated before taking the lock, the node keeps running while a long chain is checked
+	uTxOSet, undos, err := applyBlocks(blocks, s.Blockchain.Params())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.replaceBlockchain(blocks, uTxOSet, undos); err != nil {
+		return err
+	}
+	s.connectOrphanBlocks(blocks[len(blocks)-1])
+
+	return nil
+}
+
+func (s *BlockchainService) syncBlockchain(blocks []coin.Block) error {
+	uTxOSet, undos, err := applyBlocks(blocks, s.Blockchain.Params())
+	if err != nil {
+		return err
+	}
+
+	return s.replaceBlockchain(blocks, uTxOSet, undos)
+}
+
+// replaceBlockchain switches to the validated blocks, their uTxO set and undo data if they have more work than the
+// chain and could be saved. The txs of the blocks left behind go back to the tx pool, where they stay if they are still
+// valid.
+func (s *BlockchainService) replaceBlockchain(blocks []coin.Block, uTxOSet repository.UTxOSetType, undos []blockUndo) error {
+	previous := s.Blockchain.GetBlocks()
+	if coin.CumulativeDifficulty(blocks) <= coin.CumulativeDifficulty(previous) {
+		return fmt.Errorf("blockchain does not have more work than the current one")
+	}
+
+	if err := s.saveBlocks(blocks, undos); err != nil {
+		return err
+	}
+
+	s.Blockchain.SetBlockchain(blocks)
+	s.UTxOSet.Replace(uTxOSet)
+	s.blockUndos = make(map[string]blockUndo)
+	for i, block := range blocks {
+		s.addBlockUndo(block, undos[i])
+	}
+
+	disconnected := make([]coin.Block, 0)
+	for _, block := range previous {
+		if _, ok := s.Blockchain.GetBlockByHash(block.Hash); !ok {
+			disconnected = append(disconnected, block)
+		}
+	}
+	s.returnToTxPool(disconnected, blocks[len(blocks)-1].Index+1)
+
+	return nil
+}
+
+// reorganize switches the chain to branch, which forks off it after forkPoint. The blocks after the fork point are
+// disconnected with their undo data and the blocks of branch connected on a scratch copy of the uTxO set, and the branch
+// is saved before the chain is switched to it, so on any failure the node is left as it was. Without undo data for every block to disconnect, the chain up to the fork point is
+// replayed instead.
+func (s *BlockchainService) reorganize(forkPoint coin.Block, branch []coin.Block) error {
+	blocks := s.Blockchain.GetBlocks()
+	kept := blocks[:forkPoint.Index+1]
+	disconnected := blocks[forkPoint.Index+1:]
+	candidate := append(append([]coin.Block{}, kept...), branch...)
+
+	uTxOSet := s.UTxOSet.Copy()
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		undo, ok := s.blockUndos[string(disconnected[i].Hash)]
+		if !ok {
+			return s.syncBlockchain(candidate)
+		}
+		undo.disconnect(uTxOSet)
+	}
+
+	undos := make([]blockUndo, 0, len(branch))
+	tip := forkPoint
+	for _, block := range branch {
+		undo, err := applyBlock(&tip, block, uTxOSet, s.Blockchain.Params())
+		if err != nil {
+			return fmt.Errorf("Invalid branch at block %d. error: %w", block.Index, err)
+		}
+		undos = append(undos, undo)
+		tip = block
+	}
+
+	if err := s.saveBlocks(branch, undos); err != nil {
+		return err
+	}
+
+	s.Blockchain.SetBlockchain(candidate)
+	s.UTxOSet.Replace(uTxOSet)
+	for _, block := range disconnected {
+		delete(s.blockUndos, string(block.Hash))
+	}
+	for i, block := range branch {
+		s.addBlockUndo(block, undos[i])
+	}
+
+	for _, block := range branch {
+		for _, tx := range block.Transactions {
+			s.removeFromTxPool(tx.ID)
+		}
+	}
+	s.returnToTxPool(disconnected, tip.Index+1)
+
+	return nil
+}
+
+// returnToTxPool puts the txs of blocks that left the chain back in the tx pool, through the same admission as relayed
+// txs in the block at nextBlockIndex. The pool txs are taken out while they are admitted, as they can spend the outputs
+// of the txs put back, and are then revalidated on the new tip.
+func (s *BlockchainService) returnToTxPool(blocks []coin.Block, nextBlockIndex int) {
+	txPool := s.TxPool.Array()
+	addedAt := make(map[repository.TxIDType]int, len(txPool))
+	for _, tx := range txPool {
+		addedAt[repository.TxIDType(tx.ID)], _ = s.TxPool.Time(tx.ID)
+		s.removeFromTxPool(tx.ID)
+	}
+
+	for _, block := range blocks {
+		if len(block.Transactions) == 0 {
+			continue
+		}
+
+		// the first tx is the block's coinbase, which is only valid in its block
+		for _, tx := range block.Transactions[1:] {
+			if _, err := s.acceptToTxPool(tx, nextBlockIndex); err != nil {
+				utils.InfoLogger.Printf("Dropped tx %x of a disconnected block: %s", tx.ID, err)
+			}
+		}
+	}
+
+	for _, tx := range wallet.SortTransactionsByDependency(txPool) {
+		s.addToTxPool(tx, addedAt[repository.TxIDType(tx.ID)])
+	}
+	s.revalidateTxPool(nextBlockIndex)
+	s.limitTxPool(int(time.Now().UnixNano()))
+}
+
+// applyBlocks validates blocks under params as a chain from the genesis block and returns its uTxO set and the undo data
+// of each block
+func applyBlocks(blocks []coin.Block, params coin.ChainParams) (repository.UTxOSetType, []blockUndo, error) {
+	uTxOSet := make(repository.UTxOSetType)
+	undos := make([]blockUndo, 0, len(blocks))
+	var tip *coin.Block
+	for i := range blocks {
+		undo, err := applyBlock(tip, blocks[i], uTxOSet, params)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid blockchain at block %d. error: %w", blocks[i].Index, err)
+		}
+		undos = append(undos, undo)
+		tip = &blocks[i]
+	}
+
+	return uTxOSet, undos, nil
+}
+
+// applyBlock validates block under params on top of tip, or as the genesis block if tip is nil, and applies its txs to
+// uTxOSet. It returns the undo data to disconnect the block again.
+func applyBlock(tip *coin.Block, block coin.Block, uTxOSet repository.UTxOSetType, params coin.ChainParams) (blockUndo, error) {
+	// we copy the block to avoid any pointer copying fails, such as slice pointers. Updating the slice of TxOs in UTxOSet,
+	// updated the slice in the blockchain
+	copyBlock, err := CopyBlock(block)
+	if err != nil {
+		return blockUndo{}, err
+	}
+
+	if tip == nil {
+		err = copyBlock.IsGenesisBlock()
+	} else {
+		err = copyBlock.IsValidBlock(*tip, uTxOSet, params)
+	}
+	if err != nil {
+		return blockUndo{}, err
+	}
+
+	undo := newBlockUndo(copyBlock, uTxOSet)
+	for _, tx := range copyBlock.Transactions {
+		wallet.ApplyTransactionCopy(tx, uTxOSet, copyBlock.Index, copyBlock.Timestamp)
+	}
+
+	return undo, nil
+}
+
+// blockUndo is what connecting a block changed in the uTxO set: the entries its txs spent from as they were before the
+// block, and the ids of the txs it added
+type blockUndo struct {
+	index int
+	spent map[repository.TxIDType]repository.Transaction
+	added []repository.TxIDType
+}
+
+// newBlockUndo records the undo data of block before its txs are applied to uTxOSet
+func newBlockUndo(block coin.Block, uTxOSet repository.UTxOSetType) blockUndo {
+	undo := blockUndo{
+		index: block.Index,
+		spent: make(map[repository.TxIDType]repository.Transaction),
+		added: make([]repository.TxIDType, 0, len(block.Transactions)),
+	}
+
+	for _, tx := range block.Transactions {
+		for _, txIn := range tx.TxIns {
+			parentID := repository.TxIDType(txIn.TxID)
+			if _, ok := undo.spent[parentID]; ok {
+				continue
+			}
+			// a tx spending an earlier tx of the block spends nothing that was there before it
+			if parent, ok := uTxOSet[parentID]; ok {
+				undo.spent[parentID] = copyTx(parent)
+			}
+		}
+		undo.added = append(undo.added, repository.TxIDType(tx.ID))
+	}
+
+	return undo
+}
+
+// disconnect undoes the block on uTxOSet, which must be the uTxO set of the chain with the block as its tip
+func (u blockUndo) disconnect(uTxOSet repository.UTxOSetType) {
+	for _, txID := range u.added {
+		delete(uTxOSet, txID)
+	}
+	for txID, tx := range u.spent {
+		uTxOSet[txID] = copyTx(tx)
+	}
+}
+
+// addBlockUndo keeps the undo data of block, and drops that of blocks more than MAX_REORG_DEPTH below it
+func (s *BlockchainService) addBlockUndo(block coin.Block, undo blockUndo) {
+	s.blockUndos[string(block.Hash)] = undo
+
+	for hash, u := range s.blockUndos {
+		if u.index <= block.Index-MAX_REORG_DEPTH {
+			delete(s.blockUndos, hash)
+		}
+	}
+}
+
+// copyTx copies the slices of tx, so that undo data shares nothing with the uTxO set
+func copyTx(tx repository.Transaction) repository.Transaction {
+	tx.TxIns = append([]repository.TxIn{}, tx.TxIns...)
+	tx.TxOuts = append([]repository.TxO{}, tx.TxOuts...)
+
+	return tx
+}
+
+// revalidateTxPool drops the expired pool txs and those that are no longer valid in the block at nextBlockIndex, eg
+// because the chain now spends their outputs
+func (s *BlockchainService) revalidateTxPool(nextBlockIndex int) {
+	s.expireTxPool(int(time.Now().UnixNano()))
+
+	if invalidTxIDs, err := s.validateTxPoolDryRun(nil, nextBlockIndex); err != nil {
+		utils.InfoLogger.Println("Left over Tx pool is invalid after connecting block. Removing invalid txs")
+		for _, invalidTxID := range invalidTxIDs {
+			s.removeFromTxPool(invalidTxID)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"firstcoin/coin"
+	"firstcoin/repository"
+	"firstcoin/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// ErrChainNotSaved is returned when a new tip could not be saved to the chain store. The node failed, not the block.
+var ErrChainNotSaved = errors.New("could not save the chain")
+
+// ChainStore saves the chain of a node to path, so a restarted node carries on from the tip it had. Every block the node
+// connects is appended with its undo data as one line of JSON, and replaces the saved blocks from its index on, so a
+// reorg only appends its branch. A chain from the genesis block is written through a temporary file instead, and a
+// crash in the middle of an append leaves a partial last line that is dropped on load.
+type ChainStore struct {
+	path string
+}
+
+func NewChainStore(path string) *ChainStore {
+	return &ChainStore{path: path}
+}
+
+// chainStoreRecord is how a block is saved, one per line
+type chainStoreRecord struct {
+	Block coin.Block    `json:"block"`
+	Undo  blockUndoJSON `json:"undo"`
+}
+
+// blockUndoJSON is how the undo data of a block is saved. The txs it spent from are saved as a list, keyed by their raw
+// id like the uTxO set.
+type blockUndoJSON struct {
+	Spent []repository.Transaction `json:"spent"`
+	Added [][]byte                 `json:"added"`
+}
+
+func (u blockUndo) toJSON() blockUndoJSON {
+	j := blockUndoJSON{
+		Spent: make([]repository.Transaction, 0, len(u.spent)),
+		Added: make([][]byte, 0, len(u.added)),
+	}
+	for _, tx := range u.spent {
+		j.Spent = append(j.Spent, tx)
+	}
+	sort.Slice(j.Spent, func(i, k int) bool { return bytes.Compare(j.Spent[i].ID, j.Spent[k].ID) < 0 })
+	for _, txID := range u.added {
+		j.Added = append(j.Added, []byte(txID))
+	}
+
+	return j
+}
+
+func (j blockUndoJSON) toUndo(index int) blockUndo {
+	undo := blockUndo{
+		index: index,
+		spent: make(map[repository.TxIDType]repository.Transaction, len(j.Spent)),
+		added: make([]repository.TxIDType, 0, len(j.Added)),
+	}
+	for _, tx := range j.Spent {
+		undo.spent[repository.TxIDType(tx.ID)] = tx
+	}
+	for _, txID := range j.Added {
+		undo.added = append(undo.added, repository.TxIDType(txID))
+	}
+
+	return undo
+}
+
+// Append saves blocks with their undo data, in place of the saved blocks from the index of the first one on
+func (c *ChainStore) Append(blocks []coin.Block, undos []blockUndo) error {
+	var lines bytes.Buffer
+	for i, block := range blocks {
+		j, err := json.Marshal(chainStoreRecord{Block: block, Undo: undos[i].toJSON()})
+		if err != nil {
+			return err
+		}
+		lines.Write(j)
+		lines.WriteByte('\n')
+	}
+
+	if len(blocks) > 0 && blocks[0].Index == 0 {
+		return utils.WriteFile(c.path, lines.Bytes())
+	}
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(lines.Bytes()); err != nil {
+		// a partial write would hide the blocks appended after it
+		f.Truncate(info.Size())
+		return err
+	}
+
+	return f.Sync()
+}
+
+// hasChain reports whether any block was saved to the store
+func (c *ChainStore) hasChain() bool {
+	info, err := os.Stat(c.path)
+	return err == nil && info.Size() > 0
+}
+
+// Load reads the blocks last saved and their undo data. A missing file is no blocks.
+func (c *ChainStore) Load() ([]coin.Block, []blockUndo, error) {
+	j, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blocks := make([]coin.Block, 0)
+	undos := make([]blockUndo, 0)
+	for offset := 0; offset < len(j); {
+		end := bytes.IndexByte(j[offset:], '\n')
+		record := chainStoreRecord{}
+		if end < 0 || json.Unmarshal(j[offset:offset+end], &record) != nil {
+			if end < 0 || offset+end+1 == len(j) {
+				// the last append did not finish, the blocks before it are the saved chain
+				return blocks, undos, os.Truncate(c.path, int64(offset))
+			}
+			return nil, nil, fmt.Errorf("chain store is corrupt after block %d", len(blocks)-1)
+		}
+		offset += end + 1
+
+		index := record.Block.Index
+		if index < 0 || index > len(blocks) {
+			return nil, nil, fmt.Errorf("saved block %d does not follow block %d", index, len(blocks)-1)
+		}
+		blocks = append(blocks[:index], record.Block)
+		undos = append(undos[:index], record.Undo.toUndo(index))
+	}
+
+	return blocks, undos, nil
+}
+
+// SetChainStore makes the service save every block it connects to store before the new tip is exposed. A store without
+// a saved chain starts with the chain the service has, its undo data worked out again from the genesis block, and a
+// saved chain is left for LoadChain.
+func (s *BlockchainService) SetChainStore(store *ChainStore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chainStore = store
+	if s.Blockchain.Len() == 0 || store.hasChain() {
+		return nil
+	}
+
+	blocks := s.Blockchain.GetBlocks()
+	_, undos, err := applyBlocks(blocks, s.Blockchain.Params())
+	if err != nil {
+		return err
+	}
+
+	return s.saveBlocks(blocks, undos)
+}
+
+// LoadChain restores the chain last saved to the chain store of the service. It reports whether there was a saved chain.
+// The uTxO set is not saved: it is built again by connecting the saved blocks from the genesis block, which validates
+// them, and the saved undo data must match what connecting them gives.
+func (s *BlockchainService) LoadChain() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chainStore == nil {
+		return false, nil
+	}
+
+	blocks, savedUndos, err := s.chainStore.Load()
+	if err != nil {
+		return false, err
+	}
+	if len(blocks) == 0 {
+		return false, nil
+	}
+
+	uTxOSet, undos, err := applyBlocks(blocks, s.Blockchain.Params())
+	if err != nil {
+		return false, err
+	}
+	for i := range undos {
+		if !sameBlockUndo(undos[i], savedUndos[i]) {
+			return false, fmt.Errorf("saved undo data of block %d does not match the chain", blocks[i].Index)
+		}
+	}
+
+	s.Blockchain.SetBlockchain(blocks)
+	s.UTxOSet.Replace(uTxOSet)
+	s.blockUndos = make(map[string]blockUndo)
+	for i, block := range blocks {
+		s.addBlockUndo(block, undos[i])
+	}
+	s.syncPendingTxs()
+
+	return true, nil
+}
+
+// sameBlockUndo reports whether a and b restore the same uTxO set entries
+func sameBlockUndo(a blockUndo, b blockUndo) bool {
+	jsonA, errA := json.Marshal(a.toJSON())
+	jsonB, errB := json.Marshal(b.toJSON())
+
+	return errA == nil && errB == nil && a.index == b.index && bytes.Equal(jsonA, jsonB)
+}
+
+// saveBlocks appends blocks and their undo data to the chain store, if the service has one
+func (s *BlockchainService) saveBlocks(blocks []coin.Block, undos []blockUndo) error {
+	if s.chainStore == nil {
+		return nil
+	}
+
+	if err := s.chainStore.Append(blocks, undos); err != nil {
+		return fmt.Errorf("%w. error: %s", ErrChainNotSaved, err)
+	}
+
+	return nil
+}
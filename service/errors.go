@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// InvalidBlockError is returned for a block that breaks the consensus rules, as opposed to one that is already known or
+// whose parent is missing. The peer that sent it is misbehaving.
+type InvalidBlockError struct {
+	Err error
+}
+
+func (e *InvalidBlockError) Error() string {
+	return fmt.Sprintf("invalid block. error: %s", e.Err)
+}
+
+func (e *InvalidBlockError) Unwrap() error {
+	return e.Err
+}
+
+// invalidBlockError is an *InvalidBlockError for a block that failed with err, unless it failed on the node's own side
+func invalidBlockError(err error) error {
+	if errors.Is(err, ErrChainNotSaved) {
+		return err
+	}
+
+	return &InvalidBlockError{Err: err}
+}
+
+// InvalidTxError is returned for a tx that is malformed or whose signatures do not verify against the confirmed outputs
+// it spends, as opposed to one rejected by tx pool policy or missing its inputs. The peer that relayed it is
+// misbehaving.
+type InvalidTxError struct {
+	Err error
+}
+
+func (e *InvalidTxError) Error() string {
+	return fmt.Sprintf("invalid tx. error: %s", e.Err)
+}
+
+func (e *InvalidTxError) Unwrap() error {
+	return e.Err
+}
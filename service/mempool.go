@@ -0,0 +1,465 @@
+package service
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// DEFAULT_TX_POOL_MAX_SIZE is the most bytes of serialized txs the tx pool holds before it evicts the lowest fee rate
+	// packages
+	DEFAULT_TX_POOL_MAX_SIZE = 5000000
+
+	// DEFAULT_TX_POOL_EXPIRY is how long a tx waits in the tx pool to be mined before it is dropped
+	DEFAULT_TX_POOL_EXPIRY = 14 * 24 * time.Hour
+
+	// MAX_TX_POOL_ANCESTORS is the most unconfirmed ancestors a tx in the pool can have
+	MAX_TX_POOL_ANCESTORS = 25
+
+	// MIN_RELAY_FEE_HALF_LIFE is how long it takes the minimum relay fee rate raised by evictions to halve back towards
+	// DEFAULT_FEE_RATE
+	MIN_RELAY_FEE_HALF_LIFE = 12 * time.Hour
+)
+
+// TxPoolConfig bounds the tx pool by the bytes it holds and the time a tx can wait in it
+type TxPoolConfig struct {
+	MaxSize int
+	Expiry  time.Duration
+}
+
+// TxPoolEntry is a pool tx with its fee, its size and the totals of the package it forms with its unconfirmed ancestors,
+// which is what it is mined by, and of the package it forms with its descendants, which is what it is evicted by
+type TxPoolEntry struct {
+	Tx             repository.Transaction `json:"tx"`
+	Fee            int                    `json:"fee"`
+	Size           int                    `json:"size"`
+	AddedAt        int                    `json:"addedAt"`
+	Ancestors      int                    `json:"ancestors"`
+	AncestorFee    int                    `json:"ancestorFee"`
+	AncestorSize   int                    `json:"ancestorSize"`
+	Descendants    int                    `json:"descendants"`
+	DescendantFee  int                    `json:"descendantFee"`
+	DescendantSize int                    `json:"descendantSize"`
+
+	ancestors   map[repository.TxIDType]bool
+	descendants map[repository.TxIDType]bool
+}
+
+// TxPoolInfo describes the state of the tx pool. MinRelayFeeRate is in coins per 1000 bytes.
+type TxPoolInfo struct {
+	Count           int           `json:"count"`
+	Size            int           `json:"size"`
+	MaxSize         int           `json:"maxSize"`
+	Expiry          time.Duration `json:"expiry"`
+	MinRelayFeeRate int           `json:"minRelayFeeRate"`
+	Entries         []TxPoolEntry `json:"entries"`
+}
+
+func (s *BlockchainService) SetTxPoolConfig(config TxPoolConfig) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DEFAULT_TX_POOL_MAX_SIZE
+	}
+	if config.Expiry <= 0 {
+		config.Expiry = DEFAULT_TX_POOL_EXPIRY
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txPoolConfig = config
+}
+
+func (s *BlockchainService) GetTxPoolConfig() TxPoolConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.txPoolConfig
+}
+
+// MinRelayFeeRate is the fee rate a tx must pay to enter the tx pool at now. It halves every MIN_RELAY_FEE_HALF_LIFE
+// since it was last raised, down to DEFAULT_FEE_RATE.
+func (s *BlockchainService) MinRelayFeeRate(now int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.minRelayFeeRateAt(now)
+}
+
+func (s *BlockchainService) minRelayFeeRateAt(now int) int {
+	rate := s.minRelayFeeRate
+	for elapsed := now - s.minRelayFeeRateRaisedAt; elapsed >= int(MIN_RELAY_FEE_HALF_LIFE) && rate > wallet.DEFAULT_FEE_RATE; elapsed -= int(MIN_RELAY_FEE_HALF_LIFE) {
+		rate /= 2
+	}
+
+	if rate < wallet.DEFAULT_FEE_RATE {
+		return wallet.DEFAULT_FEE_RATE
+	}
+	return rate
+}
+
+// ResetMinRelayFeeRate sets the minimum relay fee rate back to DEFAULT_FEE_RATE
+func (s *BlockchainService) ResetMinRelayFeeRate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.minRelayFeeRate = wallet.DEFAULT_FEE_RATE
+	s.minRelayFeeRateRaisedAt = 0
+}
+
+func (s *BlockchainService) raiseMinRelayFeeRate(rate int, now int) {
+	if rate > s.minRelayFeeRateAt(now) {
+		s.minRelayFeeRate = rate
+		s.minRelayFeeRateRaisedAt = now
+	}
+}
+
+// GetTxPoolInfo returns the size and limits of the tx pool, with its txs by descending ancestor fee rate
+func (s *BlockchainService) GetTxPoolInfo() TxPoolInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.poolIndex
+	entries := make([]TxPoolEntry, 0, len(index.entries))
+	for _, entry := range index.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if wallet.HasHigherFeeRate(entries[i].AncestorFee, entries[i].AncestorSize, entries[j].AncestorFee, entries[j].AncestorSize) {
+			return true
+		}
+		if wallet.HasHigherFeeRate(entries[j].AncestorFee, entries[j].AncestorSize, entries[i].AncestorFee, entries[i].AncestorSize) {
+			return false
+		}
+		return entries[i].AddedAt < entries[j].AddedAt
+	})
+
+	return TxPoolInfo{
+		Count:           len(entries),
+		Size:            index.size,
+		MaxSize:         s.txPoolConfig.MaxSize,
+		Expiry:          s.txPoolConfig.Expiry,
+		MinRelayFeeRate: s.minRelayFeeRateAt(int(time.Now().UnixNano())),
+		Entries:         entries,
+	}
+}
+
+// txPoolIndex is an entry for every pool tx that spends outputs of the uTxO set or of other indexed pool txs. The
+// package totals of the entries are updated as txs are added and removed, rather than worked out again from the uTxO set.
+type txPoolIndex struct {
+	entries map[repository.TxIDType]*TxPoolEntry
+	// the indexed txs spending the outputs of each tx
+	spenders map[repository.TxIDType]map[repository.TxIDType]bool
+	size     int
+}
+
+func newTxPoolIndex() *txPoolIndex {
+	return &txPoolIndex{
+		entries:  make(map[repository.TxIDType]*TxPoolEntry),
+		spenders: make(map[repository.TxIDType]map[repository.TxIDType]bool),
+	}
+}
+
+// add indexes tx paying fee, whose indexed parents must already be in the index. The indexed txs spending its outputs, eg
+// when a reorg puts tx back in the pool, become descendants of tx and of its ancestors.
+func (idx *txPoolIndex) add(tx repository.Transaction, fee int, addedAt int) {
+	txID := repository.TxIDType(tx.ID)
+	if _, ok := idx.entries[txID]; ok {
+		return
+	}
+
+	size := wallet.SerializedSize(tx)
+	entry := &TxPoolEntry{
+		Tx:             tx,
+		Fee:            fee,
+		Size:           size,
+		AddedAt:        addedAt,
+		AncestorFee:    fee,
+		AncestorSize:   size,
+		DescendantFee:  fee,
+		DescendantSize: size,
+		ancestors:      make(map[repository.TxIDType]bool),
+		descendants:    make(map[repository.TxIDType]bool),
+	}
+
+	for ancestorID := range poolAncestors(tx, idx.entries, nil) {
+		idx.link(idx.entries[ancestorID], entry)
+	}
+
+	descendants := make(map[repository.TxIDType]bool)
+	for spenderID := range idx.spenders[txID] {
+		descendants[spenderID] = true
+		for descendantID := range idx.entries[spenderID].descendants {
+			descendants[descendantID] = true
+		}
+	}
+	for descendantID := range descendants {
+		descendant := idx.entries[descendantID]
+		idx.link(entry, descendant)
+		for ancestorID := range entry.ancestors {
+			idx.link(idx.entries[ancestorID], descendant)
+		}
+	}
+
+	for _, txIn := range tx.TxIns {
+		parentID := repository.TxIDType(txIn.TxID)
+		if idx.spenders[parentID] == nil {
+			idx.spenders[parentID] = make(map[repository.TxIDType]bool)
+		}
+		idx.spenders[parentID][txID] = true
+	}
+
+	idx.entries[txID] = entry
+	idx.size += size
+}
+
+// link adds ancestor to the ancestors of descendant and descendant to the descendants of ancestor, with their totals
+func (idx *txPoolIndex) link(ancestor *TxPoolEntry, descendant *TxPoolEntry) {
+	ancestorID, descendantID := repository.TxIDType(ancestor.Tx.ID), repository.TxIDType(descendant.Tx.ID)
+	if descendant.ancestors[ancestorID] {
+		return
+	}
+
+	descendant.ancestors[ancestorID] = true
+	descendant.Ancestors++
+	descendant.AncestorFee += ancestor.Fee
+	descendant.AncestorSize += ancestor.Size
+
+	ancestor.descendants[descendantID] = true
+	ancestor.Descendants++
+	ancestor.DescendantFee += descendant.Fee
+	ancestor.DescendantSize += descendant.Size
+}
+
+// remove drops the entry of the tx with txID from the index and from the totals of its ancestors and descendants
+func (idx *txPoolIndex) remove(txID repository.TxIDType) {
+	entry, ok := idx.entries[txID]
+	if !ok {
+		return
+	}
+
+	for ancestorID := range entry.ancestors {
+		if ancestor, ok := idx.entries[ancestorID]; ok {
+			delete(ancestor.descendants, txID)
+			ancestor.Descendants--
+			ancestor.DescendantFee -= entry.Fee
+			ancestor.DescendantSize -= entry.Size
+		}
+	}
+	for descendantID := range entry.descendants {
+		if descendant, ok := idx.entries[descendantID]; ok {
+			delete(descendant.ancestors, txID)
+			descendant.Ancestors--
+			descendant.AncestorFee -= entry.Fee
+			descendant.AncestorSize -= entry.Size
+		}
+	}
+
+	for _, txIn := range entry.Tx.TxIns {
+		parentID := repository.TxIDType(txIn.TxID)
+		delete(idx.spenders[parentID], txID)
+		if len(idx.spenders[parentID]) == 0 {
+			delete(idx.spenders, parentID)
+		}
+	}
+
+	delete(idx.entries, txID)
+	idx.size -= entry.Size
+}
+
+// withDescendants returns the entry of the tx with txID and the entries of its descendants, in dependency order
+func (idx *txPoolIndex) withDescendants(txID repository.TxIDType) []*TxPoolEntry {
+	entry, ok := idx.entries[txID]
+	if !ok {
+		return nil
+	}
+
+	txs := []repository.Transaction{entry.Tx}
+	for descendantID := range entry.descendants {
+		txs = append(txs, idx.entries[descendantID].Tx)
+	}
+
+	pkg := make([]*TxPoolEntry, 0, len(txs))
+	for _, tx := range wallet.SortTransactionsByDependency(txs) {
+		pkg = append(pkg, idx.entries[repository.TxIDType(tx.ID)])
+	}
+
+	return pkg
+}
+
+// fee is the fee of tx spending the outputs of indexed pool txs and of uTxOSet
+func (idx *txPoolIndex) fee(tx repository.Transaction, uTxOSet *repository.UTxOSet) (int, error) {
+	fee := 0
+	for _, txIn := range tx.TxIns {
+		var txOs []repository.TxO
+		if parent, ok := idx.entries[repository.TxIDType(txIn.TxID)]; ok {
+			txOs = wallet.PruneUnspendableTxOs(parent.Tx).TxOuts
+		} else if parent, ok := uTxOSet.Get(txIn.TxID); ok {
+			txOs = parent.TxOuts
+		}
+
+		if txIn.TxOIndex < 0 || txIn.TxOIndex >= len(txOs) || txOs[txIn.TxOIndex].IsSpent() {
+			return 0, fmt.Errorf("tx %x spends outputs that are not in the uTxO set or the tx pool", tx.ID)
+		}
+		fee += txOs[txIn.TxOIndex].Value
+	}
+
+	for _, txO := range tx.TxOuts {
+		fee -= txO.Value
+	}
+
+	return fee, nil
+}
+
+// addToTxPool adds tx to the tx pool and its index as if it entered the pool at addedAt. A tx that is already in the pool
+// or spends outputs that are neither in the uTxO set nor in the pool is not added. Every change of the pool goes through
+// addToTxPool and removeFromTxPool, so the index always matches it.
+func (s *BlockchainService) addToTxPool(tx repository.Transaction, addedAt int) bool {
+	if _, ok := s.poolIndex.entries[repository.TxIDType(tx.ID)]; ok {
+		return false
+	}
+
+	fee, err := s.poolIndex.fee(tx, s.UTxOSet)
+	if err != nil {
+		return false
+	}
+
+	s.TxPool.AddAt(tx, addedAt)
+	s.poolIndex.add(tx, fee, addedAt)
+	return true
+}
+
+// removeFromTxPool removes the tx with txID from the tx pool and its index
+func (s *BlockchainService) removeFromTxPool(txID []byte) {
+	s.TxPool.Remove(txID)
+	s.poolIndex.remove(repository.TxIDType(txID))
+}
+
+// indexTxPool builds the index of the tx pool again from scratch, dropping the pool txs whose inputs cannot be found
+func (s *BlockchainService) indexTxPool() {
+	txPool := s.TxPool.Array()
+	addedAt := make(map[repository.TxIDType]int, len(txPool))
+	for _, tx := range txPool {
+		addedAt[repository.TxIDType(tx.ID)], _ = s.TxPool.Time(tx.ID)
+	}
+
+	s.TxPool.Empty()
+	s.poolIndex = newTxPoolIndex()
+	for _, tx := range wallet.SortTransactionsByDependency(txPool) {
+		s.addToTxPool(tx, addedAt[repository.TxIDType(tx.ID)])
+	}
+}
+
+// SetTxPool replaces the tx pool with the txs of txPool, all entering it now
+func (s *BlockchainService) SetTxPool(txPool map[repository.TxIDType]repository.Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.TxPool.Set(txPool)
+	s.indexTxPool()
+}
+
+// poolAncestors are the ids of the indexed pool txs tx spends from, directly or not, leaving out the excluded ones
+func poolAncestors(tx repository.Transaction, byID map[repository.TxIDType]*TxPoolEntry, exclude map[repository.TxIDType]bool) map[repository.TxIDType]bool {
+	ancestors := make(map[repository.TxIDType]bool)
+
+	for _, txIn := range tx.TxIns {
+		parent, ok := byID[repository.TxIDType(txIn.TxID)]
+		if !ok || exclude[repository.TxIDType(txIn.TxID)] {
+			continue
+		}
+
+		ancestors[repository.TxIDType(txIn.TxID)] = true
+		for ancestorID := range parent.ancestors {
+			ancestors[ancestorID] = true
+		}
+	}
+
+	return ancestors
+}
+
+// checkTxPoolPolicy checks that tx, paying fee, can enter the tx pool with the excluded pool txs replaced: it must fit
+// the max tx size, pay the minimum relay fee and not have too many unconfirmed ancestors
+func (s *BlockchainService) checkTxPoolPolicy(tx repository.Transaction, fee int, exclude map[repository.TxIDType]bool, now int) error {
+	if err := s.Blockchain.Params().CheckTxSize(tx); err != nil {
+		return err
+	}
+
+	if minFee := wallet.TxFee(wallet.SerializedSize(tx), s.minRelayFeeRateAt(now)); fee < minFee {
+		return fmt.Errorf("tx fee %d is less than the minimum relay fee %d", fee, minFee)
+	}
+
+	if ancestors := len(poolAncestors(tx, s.poolIndex.entries, exclude)); ancestors > MAX_TX_POOL_ANCESTORS {
+		return fmt.Errorf("tx has %d unconfirmed ancestors, more than %d", ancestors, MAX_TX_POOL_ANCESTORS)
+	}
+
+	return nil
+}
+
+// expireTxPool drops the txs that entered the tx pool longer than the expiry ago, and the txs spending them
+func (s *BlockchainService) expireTxPool(now int) []repository.Transaction {
+	expired := make([]repository.Transaction, 0)
+	for _, tx := range s.TxPool.Array() {
+		if addedAt, ok := s.TxPool.Time(tx.ID); ok && now-addedAt > int(s.txPoolConfig.Expiry) {
+			expired = append(expired, tx)
+		}
+	}
+
+	if len(expired) == 0 {
+		return expired
+	}
+
+	expired = s.poolTxsWithDescendants(expired)
+	for _, tx := range expired {
+		s.removeFromTxPool(tx.ID)
+	}
+
+	return expired
+}
+
+// limitTxPool evicts packages of a pool tx and its descendants, lowest package fee rate first, until the tx pool fits in
+// its max size. The minimum relay fee rate is raised above the fee rate of every evicted package.
+func (s *BlockchainService) limitTxPool(now int) []repository.Transaction {
+	index := s.poolIndex
+	evicted := make([]repository.Transaction, 0)
+
+	for index.size > s.txPoolConfig.MaxSize {
+		worst := index.worstPackage()
+		if worst == nil {
+			break
+		}
+		fee, size := worst.DescendantFee, worst.DescendantSize
+
+		for _, entry := range index.withDescendants(repository.TxIDType(worst.Tx.ID)) {
+			s.removeFromTxPool(entry.Tx.ID)
+			evicted = append(evicted, entry.Tx)
+		}
+
+		// rounded up so that a package paying the same rate is not accepted again
+		s.raiseMinRelayFeeRate((fee*1000+size-1)/size+wallet.INCREMENTAL_RELAY_FEE_RATE, now)
+	}
+
+	return evicted
+}
+
+// worstPackage is the entry whose package with its descendants pays the lowest fee rate, the one that entered the pool
+// first among equals
+func (idx *txPoolIndex) worstPackage() *TxPoolEntry {
+	var worst *TxPoolEntry
+	for _, entry := range idx.entries {
+		if worst == nil || wallet.HasHigherFeeRate(worst.DescendantFee, worst.DescendantSize, entry.DescendantFee, entry.DescendantSize) {
+			worst = entry
+			continue
+		}
+
+		if !wallet.HasHigherFeeRate(entry.DescendantFee, entry.DescendantSize, worst.DescendantFee, worst.DescendantSize) &&
+			(entry.AddedAt < worst.AddedAt || entry.AddedAt == worst.AddedAt && string(entry.Tx.ID) < string(worst.Tx.ID)) {
+			worst = entry
+		}
+	}
+
+	return worst
+}
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"firstcoin/coin"
+	"fmt"
+	"time"
+)
+
+const (
+	// MAX_ORPHAN_BLOCKS is the most blocks kept while their parent is missing or their branch has less work than the
+	// chain. The oldest are dropped first.
+	MAX_ORPHAN_BLOCKS = 100
+
+	// MAX_ORPHAN_BLOCKS_PER_SOURCE is the most orphans kept from one source, so that a peer cannot crowd the orphans of
+	// others out of the pool. The oldest of the source are dropped first.
+	MAX_ORPHAN_BLOCKS_PER_SOURCE = 25
+
+	// MAX_ORPHAN_DIFFICULTY_DROP is how far below the difficulty level of the tip an orphan can be. A competing branch
+	// may have adjusted its difficulty differently since the fork, a block far below took too little work to keep.
+	MAX_ORPHAN_DIFFICULTY_DROP = 1
+
+	// ORPHAN_BLOCK_EXPIRY is how long a block is kept waiting for its parent
+	ORPHAN_BLOCK_EXPIRY = 20 * time.Minute
+
+	// MAX_REORG_DEPTH is how many blocks back from the tip undo data is kept for. A reorganization disconnecting deeper
+	// blocks replays the chain up to the fork point.
+	MAX_REORG_DEPTH = 100
+)
+
+// ErrKnownBlock is returned for a block that is already in the chain or the orphan pool
+var ErrKnownBlock = errors.New("block is already known")
+
+// MissingParentError is returned for a block that was kept in the orphan pool because its branch does not reach the
+// chain. Missing is the hash of the ancestor to request from the peer that sent it.
+type MissingParentError struct {
+	Missing []byte
+}
+
+func (e *MissingParentError) Error() string {
+	return fmt.Sprintf("block is an orphan, missing ancestor %x", e.Missing)
+}
+
+// orphanBlock is a block of the orphan pool with the time, in unix nanoseconds, it was received and the source it came
+// from
+type orphanBlock struct {
+	block   coin.Block
+	addedAt int
+	source  string
+}
+
+// ProcessBlock connects block if it extends the tip, followed by the orphans that extend it in turn. A block that does
+// not extend the tip is kept in the orphan pool, keyed by the hash of its parent. If that completes a branch from the
+// chain with more work than the chain, the node reorganizes onto it. It returns the blocks that were connected, and a
+// *MissingParentError if the block's branch does not reach the chain yet or an *InvalidBlockError if the block or its
+// branch breaks the consensus rules.
+func (s *BlockchainService) ProcessBlock(block coin.Block) ([]coin.Block, error) {
+	return s.ProcessBlockFrom(block, "")
+}
+
+// ProcessBlockFrom processes block like ProcessBlock, keeping at most MAX_ORPHAN_BLOCKS_PER_SOURCE orphans from source,
+// eg the address of the peer that sent it. Blocks of an empty source are only bounded by MAX_ORPHAN_BLOCKS.
+func (s *BlockchainService) ProcessBlockFrom(block coin.Block, source string) ([]coin.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := int(time.Now().UnixNano())
+	s.expireOrphanBlocks(now)
+
+	if _, ok := s.Blockchain.GetBlockByHash(block.Hash); ok {
+		return nil, ErrKnownBlock
+	}
+	if _, ok := s.orphanBlock(block.Hash); ok {
+		return nil, ErrKnownBlock
+	}
+
+	// the first block of an empty chain is its genesis block
+	if s.Blockchain.Len() == 0 || bytes.Equal(block.PreviousHash, s.Blockchain.GetLastBlock().Hash) {
+		if err := s.connectBlock(block); err != nil {
+			return nil, invalidBlockError(err)
+		}
+
+		return append([]coin.Block{block}, s.connectOrphanBlocks(block)...), nil
+	}
+
+	// only blocks that took work to make are kept
+	if err := block.CheckProofOfWork(); err != nil {
+		return nil, &InvalidBlockError{Err: err}
+	}
+	if minDifficulty := s.minOrphanDifficulty(); block.DifficultyLevel < minDifficulty {
+		return nil, fmt.Errorf("orphan block difficulty level %d is below the minimum of %d", block.DifficultyLevel, minDifficulty)
+	}
+	s.addOrphanBlock(block, source, now)
+
+	branch, missing := s.orphanBranch(block)
+	if missing != nil {
+		return nil, &MissingParentError{Missing: missing}
+	}
+
+	forkPoint, _ := s.Blockchain.GetBlockByHash(branch[0].PreviousHash)
+	disconnected := s.Blockchain.GetBlocks()[forkPoint.Index+1:]
+
+	// a competing branch with no more work than the chain stays in the pool, the first block seen wins
+	if coin.CumulativeDifficulty(branch) <= coin.CumulativeDifficulty(disconnected) {
+		return nil, nil
+	}
+
+	if err := s.reorganize(forkPoint, branch); err != nil {
+		s.removeOrphanBlock(block.Hash)
+		return nil, invalidBlockError(err)
+	}
+
+	for _, connected := range branch {
+		s.removeOrphanBlock(connected.Hash)
+	}
+
+	return append(branch, s.connectOrphanBlocks(block)...), nil
+}
+
+// GetBlock returns the block with hash from the chain or the orphan pool
+func (s *BlockchainService) GetBlock(hash []byte) (coin.Block, bool) {
+	if block, ok := s.Blockchain.GetBlockByHash(hash); ok {
+		return block, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.orphanBlock(hash)
+}
+
+// OrphanBlocks returns the blocks of the orphan pool
+func (s *BlockchainService) OrphanBlocks() []coin.Block {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocks := make([]coin.Block, 0)
+	for _, orphans := range s.orphanBlocks {
+		for _, orphan := range orphans {
+			blocks = append(blocks, orphan.block)
+		}
+	}
+
+	return blocks
+}
+
+// connectOrphanBlocks connects the orphans that extend parent, and then those that extend them, returning the connected
+// blocks. An orphan that fails to connect is dropped.
+func (s *BlockchainService) connectOrphanBlocks(parent coin.Block) []coin.Block {
+	connected := make([]coin.Block, 0)
+
+	for {
+		var next *coin.Block
+		for _, orphan := range s.orphanBlocks[parentKey(parent.Hash)] {
+			s.removeOrphanBlock(orphan.block.Hash)
+			if err := s.connectBlock(orphan.block); err == nil {
+				block := orphan.block
+				next = &block
+				break
+			}
+		}
+
+		if next == nil {
+			return connected
+		}
+
+		connected = append(connected, *next)
+		parent = *next
+	}
+}
+
+// minOrphanDifficulty is the lowest difficulty level of a block kept in the orphan pool
+func (s *BlockchainService) minOrphanDifficulty() int {
+	minDifficulty := coin.MIN_DIFFICULTY_LEVEL
+	if s.Blockchain.Len() > 0 {
+		if tipDifficulty := s.Blockchain.GetLastBlock().DifficultyLevel - MAX_ORPHAN_DIFFICULTY_DROP; tipDifficulty > minDifficulty {
+			minDifficulty = tipDifficulty
+		}
+	}
+
+	return minDifficulty
+}
+
+// orphanBranch walks back from block through the orphan pool. If it reaches the chain it returns the branch from the
+// chain to block, otherwise the hash of the first missing ancestor.
+func (s *BlockchainService) orphanBranch(block coin.Block) ([]coin.Block, []byte) {
+	branch := []coin.Block{block}
+
+	for {
+		if _, ok := s.Blockchain.GetBlockByHash(branch[0].PreviousHash); ok {
+			return branch, nil
+		}
+
+		parent, ok := s.orphanBlock(branch[0].PreviousHash)
+		if !ok {
+			return nil, branch[0].PreviousHash
+		}
+
+		branch = append([]coin.Block{parent}, branch...)
+	}
+}
+
+func (s *BlockchainService) orphanBlock(hash []byte) (coin.Block, bool) {
+	for _, orphans := range s.orphanBlocks {
+		for _, orphan := range orphans {
+			if bytes.Equal(orphan.block.Hash, hash) {
+				return orphan.block, true
+			}
+		}
+	}
+
+	return coin.Block{}, false
+}
+
+// addOrphanBlock keeps block from source in the orphan pool, dropping the oldest orphans of source once it has
+// MAX_ORPHAN_BLOCKS_PER_SOURCE and the oldest of all once the pool holds MAX_ORPHAN_BLOCKS
+func (s *BlockchainService) addOrphanBlock(block coin.Block, source string, now int) {
+	key := parentKey(block.PreviousHash)
+	s.orphanBlocks[key] = append(s.orphanBlocks[key], orphanBlock{block: block, addedAt: now, source: source})
+
+	for source != "" && s.orphanBlockCount(source) > MAX_ORPHAN_BLOCKS_PER_SOURCE {
+		s.removeOrphanBlock(s.oldestOrphanBlock(source).block.Hash)
+	}
+	for s.orphanBlockCount("") > MAX_ORPHAN_BLOCKS {
+		s.removeOrphanBlock(s.oldestOrphanBlock("").block.Hash)
+	}
+}
+
+// oldestOrphanBlock is the orphan received first from source, or of all orphans for an empty source
+func (s *BlockchainService) oldestOrphanBlock(source string) *orphanBlock {
+	var oldest *orphanBlock
+	for _, orphans := range s.orphanBlocks {
+		for i := range orphans {
+			if source != "" && orphans[i].source != source {
+				continue
+			}
+			if oldest == nil || orphans[i].addedAt < oldest.addedAt {
+				oldest = &orphans[i]
+			}
+		}
+	}
+
+	return oldest
+}
+
+func (s *BlockchainService) removeOrphanBlock(hash []byte) {
+	for key, orphans := range s.orphanBlocks {
+		for i, orphan := range orphans {
+			if !bytes.Equal(orphan.block.Hash, hash) {
+				continue
+			}
+
+			orphans = append(orphans[:i:i], orphans[i+1:]...)
+			if len(orphans) == 0 {
+				delete(s.orphanBlocks, key)
+			} else {
+				s.orphanBlocks[key] = orphans
+			}
+			return
+		}
+	}
+}
+
+// expireOrphanBlocks drops the orphans received longer than ORPHAN_BLOCK_EXPIRY ago
+func (s *BlockchainService) expireOrphanBlocks(now int) {
+	for key, orphans := range s.orphanBlocks {
+		kept := make([]orphanBlock, 0, len(orphans))
+		for _, orphan := range orphans {
+			if now-orphan.addedAt <= int(ORPHAN_BLOCK_EXPIRY) {
+				kept = append(kept, orphan)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(s.orphanBlocks, key)
+		} else {
+			s.orphanBlocks[key] = kept
+		}
+	}
+}
+
+// orphanBlockCount is the number of orphans from source, or of all orphans for an empty source
+func (s *BlockchainService) orphanBlockCount(source string) int {
+	count := 0
+	for _, orphans := range s.orphanBlocks {
+		for _, orphan := range orphans {
+			if source == "" || orphan.source == source {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func parentKey(hash []byte) string {
+	return fmt.Sprintf("%x", hash)
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"fmt"
+	"time"
+)
+
+const (
+	// MAX_ORPHAN_TXS is the most txs kept while the txs they spend from are missing. The oldest are dropped first.
+	MAX_ORPHAN_TXS = 100
+
+	// MAX_ORPHAN_TXS_PER_SOURCE is the most orphans kept from one source, so that a peer cannot crowd the orphans of
+	// others out of the pool. The oldest of the source are dropped first.
+	MAX_ORPHAN_TXS_PER_SOURCE = 25
+
+	// ORPHAN_TX_EXPIRY is how long a tx is kept waiting for the txs it spends from
+	ORPHAN_TX_EXPIRY = 20 * time.Minute
+)
+
+// MissingInputsError is returned for a tx that was kept in the orphan tx pool because it spends outputs of txs that are
+// neither in the uTxO set nor in the tx pool. Missing are the ids of those txs, to request from the peer that relayed it.
+type MissingInputsError struct {
+	Missing [][]byte
+}
+
+func (e *MissingInputsError) Error() string {
+	return fmt.Sprintf("tx is an orphan, missing %d parent txs", len(e.Missing))
+}
+
+// orphanTx is a tx of the orphan tx pool with the time, in unix nanoseconds, it was received and the source it came from
+type orphanTx struct {
+	tx      repository.Transaction
+	addedAt int
+	source  string
+}
+
+// ProcessTransaction admits tx to the tx pool like AcceptToTxPool. A tx spending outputs of txs that are neither in the
+// uTxO set nor in the tx pool is kept in the orphan tx pool instead, and a *MissingInputsError names those txs. Once tx
+// enters the pool, the orphans spending it are admitted in turn. It returns the txs that entered the pool, tx first, and
+// the txs that left it.
+func (s *BlockchainService) ProcessTransaction(tx repository.Transaction, nextBlockIndex int) ([]repository.Transaction, []repository.Transaction, error) {
+	return s.ProcessTransactionFrom(tx, nextBlockIndex, "")
+}
+
+// ProcessTransactionFrom processes tx like ProcessTransaction, keeping at most MAX_ORPHAN_TXS_PER_SOURCE orphans from
+// source, eg the address of the peer that sent it. Txs of an empty source are only bounded by MAX_ORPHAN_TXS.
+func (s *BlockchainService) ProcessTransactionFrom(tx repository.Transaction, nextBlockIndex int, source string) ([]repository.Transaction, []repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nextBlockIndex = s.currentNextBlockIndex(nextBlockIndex)
+	s.expireOrphanTxs(int(time.Now().UnixNano()))
+
+	if _, ok := s.orphanTxs[repository.TxIDType(tx.ID)]; ok {
+		return nil, nil, &MissingInputsError{Missing: s.missingInputs(tx)}
+	}
+
+	// an orphan cannot be validated yet, but it must be well formed to be kept
+	if err := s.checkTransaction(tx, nextBlockIndex); err != nil {
+		return nil, nil, err
+	}
+
+	if missing := s.missingInputs(tx); len(missing) > 0 {
+		s.addOrphanTx(tx, source, int(time.Now().UnixNano()))
+		return nil, nil, &MissingInputsError{Missing: missing}
+	}
+
+	evicted, err := s.acceptToTxPool(tx, nextBlockIndex)
+	if err != nil {
+		return nil, evicted, err
+	}
+
+	accepted, orphansEvicted := s.acceptOrphanTxs([]repository.Transaction{tx}, nextBlockIndex)
+
+	return append([]repository.Transaction{tx}, accepted...), append(evicted, orphansEvicted...), nil
+}
+
+// checkTransaction is an *InvalidTxError for a tx that is too large, has no inputs or outputs, an invalid output, an id
+// that is not its hash, or an input failing its script against the confirmed output it spends in the block at
+// nextBlockIndex. Inputs spending unconfirmed or missing outputs are left to the tx pool.
+func (s *BlockchainService) checkTransaction(tx repository.Transaction, nextBlockIndex int) error {
+	if err := s.Blockchain.Params().CheckTxSize(tx); err != nil {
+		return &InvalidTxError{Err: err}
+	}
+
+	if len(tx.TxIns) == 0 || len(tx.TxOuts) == 0 {
+		return &InvalidTxError{Err: fmt.Errorf("tx has %d inputs and %d outputs", len(tx.TxIns), len(tx.TxOuts))}
+	}
+
+	if err := wallet.AreValidTxOuts(tx.TxOuts); err != nil {
+		return &InvalidTxError{Err: err}
+	}
+
+	if !bytes.Equal(wallet.GenerateTransactionID(tx), tx.ID) {
+		return &InvalidTxError{Err: fmt.Errorf("tx id %x is not its hash", tx.ID)}
+	}
+
+	uTxOSet := s.UTxOSet.Copy()
+	for i, txIn := range tx.TxIns {
+		if _, ok := uTxOSet[repository.TxIDType(txIn.TxID)]; !ok {
+			continue
+		}
+
+		if err := wallet.IsValidTxIn(tx, i, uTxOSet, s.Blockchain.Params().ScriptFlags(nextBlockIndex)); err != nil {
+			return &InvalidTxError{Err: err}
+		}
+	}
+
+	return nil
+}
+
+// GetTransaction returns the tx with txID from the tx pool or the orphan tx pool
+func (s *BlockchainService) GetTransaction(txID []byte) (repository.Transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tx, ok := s.TxPool.Get(txID); ok {
+		return tx, true
+	}
+
+	orphan, ok := s.orphanTxs[repository.TxIDType(txID)]
+	return orphan.tx, ok
+}
+
+// OrphanTxs returns the txs of the orphan tx pool
+func (s *BlockchainService) OrphanTxs() []repository.Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txs := make([]repository.Transaction, 0, len(s.orphanTxs))
+	for _, orphan := range s.orphanTxs {
+		txs = append(txs, orphan.tx)
+	}
+
+	return txs
+}
+
+// acceptOrphanTxs admits the orphans spending parents to the tx pool, and then those spending them. Orphans that are
+// still missing inputs stay, those that fail admission are dropped. It returns the txs that entered the pool and those
+// that left it.
+func (s *BlockchainService) acceptOrphanTxs(parents []repository.Transaction, nextBlockIndex int) ([]repository.Transaction, []repository.Transaction) {
+	accepted := make([]repository.Transaction, 0)
+	evicted := make([]repository.Transaction, 0)
+
+	for len(parents) > 0 {
+		parentIDs := make(map[repository.TxIDType]bool, len(parents))
+		for _, parent := range parents {
+			parentIDs[repository.TxIDType(parent.ID)] = true
+		}
+		parents = nil
+
+		for txID, orphan := range s.orphanTxs {
+			if !spendsAny(orphan.tx, parentIDs) || len(s.missingInputs(orphan.tx)) > 0 {
+				continue
+			}
+
+			delete(s.orphanTxs, txID)
+			txEvicted, err := s.acceptToTxPool(orphan.tx, nextBlockIndex)
+			evicted = append(evicted, txEvicted...)
+			if err != nil {
+				continue
+			}
+
+			accepted = append(accepted, orphan.tx)
+			parents = append(parents, orphan.tx)
+		}
+	}
+
+	return accepted, evicted
+}
+
+// missingInputs are the ids of the txs tx spends from that are neither in the uTxO set nor in the tx pool
+func (s *BlockchainService) missingInputs(tx repository.Transaction) [][]byte {
+	missing := make([][]byte, 0)
+	seen := make(map[repository.TxIDType]bool)
+
+	for _, txIn := range tx.TxIns {
+		if seen[repository.TxIDType(txIn.TxID)] {
+			continue
+		}
+		seen[repository.TxIDType(txIn.TxID)] = true
+
+		if _, ok := s.UTxOSet.Get(txIn.TxID); ok {
+			continue
+		}
+		if _, ok := s.TxPool.Get(txIn.TxID); ok {
+			continue
+		}
+
+		missing = append(missing, txIn.TxID)
+	}
+
+	return missing
+}
+
+// addOrphanTx keeps tx from source in the orphan tx pool, dropping the oldest orphans of source once it has
+// MAX_ORPHAN_TXS_PER_SOURCE and the oldest of all once the pool holds MAX_ORPHAN_TXS
+func (s *BlockchainService) addOrphanTx(tx repository.Transaction, source string, now int) {
+	s.orphanTxs[repository.TxIDType(tx.ID)] = orphanTx{tx: tx, addedAt: now, source: source}
+
+	for source != "" && s.orphanTxCount(source) > MAX_ORPHAN_TXS_PER_SOURCE {
+		delete(s.orphanTxs, s.oldestOrphanTx(source))
+	}
+	for len(s.orphanTxs) > MAX_ORPHAN_TXS {
+		delete(s.orphanTxs, s.oldestOrphanTx(""))
+	}
+}
+
+// oldestOrphanTx is the id of the orphan received first from source, or of all orphans for an empty source
+func (s *BlockchainService) oldestOrphanTx(source string) repository.TxIDType {
+	var oldestID repository.TxIDType
+	oldestAt := 0
+	for txID, orphan := range s.orphanTxs {
+		if source != "" && orphan.source != source {
+			continue
+		}
+		if oldestAt == 0 || orphan.addedAt < oldestAt || (orphan.addedAt == oldestAt && txID < oldestID) {
+			oldestID, oldestAt = txID, orphan.addedAt
+		}
+	}
+
+	return oldestID
+}
+
+// orphanTxCount is the number of orphans from source
+func (s *BlockchainService) orphanTxCount(source string) int {
+	count := 0
+	for _, orphan := range s.orphanTxs {
+		if orphan.source == source {
+			count++
+		}
+	}
+
+	return count
+}
+
+// expireOrphanTxs drops the orphans received longer than ORPHAN_TX_EXPIRY ago
+func (s *BlockchainService) expireOrphanTxs(now int) {
+	for txID, orphan := range s.orphanTxs {
+		if now-orphan.addedAt > int(ORPHAN_TX_EXPIRY) {
+			delete(s.orphanTxs, txID)
+		}
+	}
+}
+
+func spendsAny(tx repository.Transaction, txIDs map[repository.TxIDType]bool) bool {
+	for _, txIn := range tx.TxIns {
+		if txIDs[repository.TxIDType(txIn.TxID)] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"fmt"
+	"time"
+)
+
+// AcceptToTxPool validates tx on top of the tx pool and adds it to the pool. The tx must pay the minimum relay fee and
+// have at most MAX_TX_POOL_ANCESTORS unconfirmed ancestors. A tx spending the same outputs as txs in the pool replaces
+// them and their descendants if it follows the replace-by-fee rules:
+//  1. every tx it replaces signals replaceability
+//  2. it only spends unconfirmed outputs that the txs it replaces spent too
+//  3. it pays at least the fees of all the txs it evicts
+//  4. on top of those it pays the incremental relay fee for its own size
+//  5. its fee rate is higher than that of every tx it replaces
+//  6. it evicts no more than MAX_REPLACEMENT_EVICTIONS txs
+//
+// Expired txs are dropped first, and once tx is in the pool the lowest fee rate packages are evicted until the pool fits
+// in its max size. It returns all the txs that left the pool.
+func (s *BlockchainService) AcceptToTxPool(tx repository.Transaction, nextBlockIndex int) ([]repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.acceptToTxPool(tx, s.currentNextBlockIndex(nextBlockIndex))
+}
+
+// currentNextBlockIndex raises nextBlockIndex to the block after the tip. Callers read the tip before taking the lock,
+// so a block connected in between would otherwise leave the tx checked against a block that is already in the chain.
+func (s *BlockchainService) currentNextBlockIndex(nextBlockIndex int) int {
+	if s.Blockchain.Len() > 0 && nextBlockIndex <= s.Blockchain.GetLastBlock().Index {
+		return s.Blockchain.GetLastBlock().Index + 1
+	}
+
+	return nextBlockIndex
+}
+
+func (s *BlockchainService) acceptToTxPool(tx repository.Transaction, nextBlockIndex int) ([]repository.Transaction, error) {
+	now := int(time.Now().UnixNano())
+	evicted := s.expireTxPool(now)
+
+	conflicts := s.conflictingPoolTxs(tx)
+	replaced := s.poolTxsWithDescendants(conflicts)
+	exclude := make(map[repository.TxIDType]bool, len(replaced))
+	for _, replacedTx := range replaced {
+		exclude[repository.TxIDType(replacedTx.ID)] = true
+	}
+
+	fee, err := wallet.FeeForTx(tx, s.txPoolUTxOSet(exclude))
+	if err != nil {
+		return evicted, fmt.Errorf("txPool is invalid. error: %s", err)
+	}
+
+	if len(conflicts) > 0 {
+		if err := s.checkReplacement(tx, fee, conflicts, replaced); err != nil {
+			return evicted, err
+		}
+	}
+
+	if err := s.checkTxPoolPolicy(tx, fee, exclude, now); err != nil {
+		return evicted, err
+	}
+
+	replacedAt := make(map[repository.TxIDType]int, len(replaced))
+	for _, replacedTx := range replaced {
+		replacedAt[repository.TxIDType(replacedTx.ID)], _ = s.TxPool.Time(replacedTx.ID)
+		s.removeFromTxPool(replacedTx.ID)
+	}
+
+	if _, err := s.validateTxPoolDryRun(&tx, nextBlockIndex); err != nil {
+		for _, replacedTx := range wallet.SortTransactionsByDependency(replaced) {
+			s.addToTxPool(replacedTx, replacedAt[repository.TxIDType(replacedTx.ID)])
+		}
+		return evicted, fmt.Errorf("txPool is invalid. error: %s", err)
+	}
+
+	s.addToTxPool(tx, int(time.Now().UnixNano()))
+
+	evicted = append(evicted, replaced...)
+	evicted = append(evicted, s.limitTxPool(now)...)
+
+	if _, ok := s.TxPool.Get(tx.ID); !ok {
+		return evicted, fmt.Errorf("tx pool is full, tx fee rate is too low")
+	}
+
+	return evicted, nil
+}
+
+// conflictingPoolTxs are the pool txs spending an output that tx spends too
+func (s *BlockchainService) conflictingPoolTxs(tx repository.Transaction) []repository.Transaction {
+	spent := make(map[string]bool, len(tx.TxIns))
+	for _, txIn := range tx.TxIns {
+		spent[txIn.Outpoint()] = true
+	}
+
+	conflicts := make([]repository.Transaction, 0)
+	for _, poolTx := range s.TxPool.Array() {
+		for _, txIn := range poolTx.TxIns {
+			if spent[txIn.Outpoint()] {
+				conflicts = append(conflicts, poolTx)
+				break
+			}
+		}
+	}
+
+	return conflicts
+}
+
+func (s *BlockchainService) checkReplacement(tx repository.Transaction, fee int, conflicts []repository.Transaction, replaced []repository.Transaction) error {
+	spentByConflicts := make(map[string]bool)
+	for _, conflict := range conflicts {
+		if !wallet.SignalsReplaceability(conflict) {
+			return fmt.Errorf("tx conflicts with tx %x in the tx pool, which does not signal replaceability", conflict.ID)
+		}
+
+		for _, txIn := range conflict.TxIns {
+			spentByConflicts[txIn.Outpoint()] = true
+		}
+	}
+
+	// another output of a tx the conflicts spend from is a new unconfirmed output all the same
+	for _, txIn := range tx.TxIns {
+		if _, unconfirmed := s.TxPool.Get(txIn.TxID); unconfirmed && !spentByConflicts[txIn.Outpoint()] {
+			return fmt.Errorf("replacement spends a new unconfirmed output %s", txIn.Outpoint())
+		}
+	}
+
+	if len(replaced) > wallet.MAX_REPLACEMENT_EVICTIONS {
+		return fmt.Errorf("replacement would evict %d txs, more than %d", len(replaced), wallet.MAX_REPLACEMENT_EVICTIONS)
+	}
+
+	fees := s.txPoolFees()
+	replacedFees := 0
+	for _, replacedTx := range replaced {
+		replacedFees += fees[repository.TxIDType(replacedTx.ID)]
+	}
+
+	size := wallet.SerializedSize(tx)
+	if minFee := replacedFees + wallet.TxFee(size, wallet.INCREMENTAL_RELAY_FEE_RATE); fee < minFee {
+		return fmt.Errorf("replacement fee %d is less than the %d of the txs it replaces plus the relay fee", fee, minFee)
+	}
+
+	for _, conflict := range conflicts {
+		if !wallet.HasHigherFeeRate(fee, size, fees[repository.TxIDType(conflict.ID)], wallet.SerializedSize(conflict)) {
+			return fmt.Errorf("replacement fee rate is not higher than that of tx %x", conflict.ID)
+		}
+	}
+
+	return nil
+}
+
+// poolTxsWithDescendants returns txs and every pool tx spending their outputs, directly or not
+func (s *BlockchainService) poolTxsWithDescendants(txs []repository.Transaction) []repository.Transaction {
+	index := s.poolIndex
+
+	family := make(map[repository.TxIDType]bool, len(txs))
+	for _, tx := range txs {
+		family[repository.TxIDType(tx.ID)] = true
+	}
+
+	descendants := make([]repository.Transaction, 0)
+	for _, tx := range txs {
+		entry, ok := index.entries[repository.TxIDType(tx.ID)]
+		if !ok {
+			continue
+		}
+
+		for descendantID := range entry.descendants {
+			if !family[descendantID] {
+				family[descendantID] = true
+				descendants = append(descendants, index.entries[descendantID].Tx)
+			}
+		}
+	}
+
+	return append(append([]repository.Transaction{}, txs...), wallet.SortTransactionsByDependency(descendants)...)
+}
+
+// txPoolUTxOSet is the uTxO set with the pool txs applied, leaving out the excluded ones and the txs depending on them
+func (s *BlockchainService) txPoolUTxOSet(exclude map[repository.TxIDType]bool) repository.UTxOSetType {
+	uTxOSet := s.UTxOSet.Copy()
+
+	for _, tx := range wallet.SortTransactionsByDependency(s.TxPool.Array()) {
+		if exclude[repository.TxIDType(tx.ID)] {
+			continue
+		}
+
+		if _, err := wallet.FeeForTx(tx, uTxOSet); err == nil {
+			wallet.ApplyTransactionCopy(tx, uTxOSet, 0, 0)
+		}
+	}
+
+	return uTxOSet
+}
+
+// txPoolFees are the fees of the pool txs
+func (s *BlockchainService) txPoolFees() map[repository.TxIDType]int {
+	index := s.poolIndex
+
+	fees := make(map[repository.TxIDType]int, len(index.entries))
+	for txID, entry := range index.entries {
+		fees[txID] = entry.Fee
+	}
+
+	return fees
+}
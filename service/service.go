@@ -1,37 +1,92 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"firstcoin/coin"
 	"firstcoin/repository"
 	"firstcoin/utils"
 	"firstcoin/wallet"
 	"fmt"
+	"sync"
+	"time"
 )
 
 const (
 	SeedDifficultyLevel = 6
 )
 
+// BlockchainService owns the state of a node: its chain, uTxO set, tx pool and wallet. Each of those is safe for
+// concurrent use on its own, and mu serializes the operations that read or change more than one of them, so that
+// handlers running on their own goroutines see them consistent with each other.
 type BlockchainService struct {
 	Blockchain *coin.Blockchain
 	Wallet     *wallet.Wallet
+	UTxOSet    *repository.UTxOSet
+	TxPool     *repository.TxPool
+
+	mu sync.Mutex
+
+	txPoolConfig TxPoolConfig
+	poolIndex    *txPoolIndex
+	// the minimum relay fee rate is raised above the fee rate of the packages evicted from a full tx pool, so that txs
+	// that would be evicted next are not accepted, and decays from there
+	minRelayFeeRate         int
+	minRelayFeeRateRaisedAt int
+
+	// blocks that do not extend the tip, keyed by the hash of their parent
+	orphanBlocks map[string][]orphanBlock
+	// the undo data of the last MAX_REORG_DEPTH blocks of the chain, keyed by their hash
+	blockUndos map[string]blockUndo
+	// txs spending outputs of txs the node has not seen yet
+	orphanTxs map[repository.TxIDType]orphanTx
+
+	// where every new tip is saved before it is exposed, nil to keep the chain in memory only
+	chainStore *ChainStore
 }
 
-func NewBlockchainService(b *coin.Blockchain, w *wallet.Wallet) BlockchainService {
-	return BlockchainService{
+// NewBlockchainService creates the service of a node running w, sharing the uTxO set and tx pool of w
+func NewBlockchainService(b *coin.Blockchain, w *wallet.Wallet) *BlockchainService {
+	s := &BlockchainService{
 		Blockchain: b,
 		Wallet:     w,
+		UTxOSet:    w.UTxOSet,
+		TxPool:     w.TxPool,
+		txPoolConfig: TxPoolConfig{
+			MaxSize: DEFAULT_TX_POOL_MAX_SIZE,
+			Expiry:  DEFAULT_TX_POOL_EXPIRY,
+		},
+		poolIndex:       newTxPoolIndex(),
+		minRelayFeeRate: wallet.DEFAULT_FEE_RATE,
+		orphanBlocks:    make(map[string][]orphanBlock),
+		blockUndos:      make(map[string]blockUndo),
+		orphanTxs:       make(map[repository.TxIDType]orphanTx),
 	}
+	// the wallet's tx pool can hold txs already
+	s.indexTxPool()
+
+	return s
 }
 
+// CreateNextBlock mines a block on top of the chain with the best paying txs of the tx pool and connects it. The lock is
+// only held while the txs are picked and the block is connected, not during the proof of work, so the block is rejected
+// if another one became the tip in the meantime.
 func (s *BlockchainService) CreateNextBlock() (*coin.Block, *coin.Blockchain, error) {
 	// coinbase transaction is the first transaction included by the miner
 	transactionPool := make([]repository.Transaction, 0)
 
-	totalFees, txsToInclude := wallet.CalculateTotalTxFees(repository.GetTxPoolArray())
+	s.mu.Lock()
+	lastBlock := s.Blockchain.GetLastBlock()
+
+	// the coinbase serializes to the same size whatever the fees it collects
+	coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(s.Wallet.Crypt, 0)
+	params := s.Blockchain.Params()
+	maxTxsSize := params.MaxBlockTxsSize(lastBlock.Hash) - wallet.SerializedSize(coinbaseTransaction)
+
+	totalFees, txsToInclude := wallet.SelectBlockTransactions(s.TxPool.Array(), s.UTxOSet.Copy(), maxTxsSize, params.MaxBlockTxs-1)
+	s.mu.Unlock()
 
-	coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(s.Wallet.Crypt, totalFees)
+	coinbaseTransaction, _ = wallet.CreateCoinbaseTransaction(s.Wallet.Crypt, totalFees)
 	transactionPool = append(transactionPool, coinbaseTransaction)
 	transactionPool = append(transactionPool, txsToInclude...)
 	block, err := s.Blockchain.GenerateNextBlock(&transactionPool)
@@ -40,111 +95,377 @@ func (s *BlockchainService) CreateNextBlock() (*coin.Block, *coin.Blockchain, er
 		return nil, nil, err
 	}
 
-	err = block.IsValidBlock(s.Blockchain.GetLastBlock())
+	err = s.ConnectBlock(block)
 	if err != nil {
 		utils.ErrorLogger.Println(fmt.Sprintf("Error in createNextBlock. err: %s", err))
 		return nil, nil, err
 	}
+	s.SyncPendingTxs()
 
 	return &block, s.Blockchain, err
 }
 
-func (s *BlockchainService) CreateTx(receiverAddress []byte, amount int) (*repository.Transaction, error) {
-	tx, _, err := s.Wallet.CreateTransaction(receiverAddress, amount)
+// CreateTx creates a tx of the wallet paying payments. The uTxOs it spends are reserved for it, so a tx created before it
+// enters the tx pool does not spend them again. A tx that does not make it into the pool must be released with ReleaseTx.
+func (s *BlockchainService) CreateTx(payments []wallet.Payment, options wallet.TxOptions) (*repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+
+	tx, _, err := s.Wallet.CreateTransactionWithOptions(payments, options)
 	if err != nil {
 		return nil, err
 	}
+	s.Wallet.Pending.Reserve(*tx)
 
 	return tx, nil
 }
 
-// Need to validate the entire pool for two reasons:
-// 1. Multiple individual transactions can be valid, while the entire pool is invalid. Eg, same spender spends all his money twice.
-// 2. When a new block is mined, and added to the chain, and uTxOs are updated, current txs might no longer be valid (e.g. the UtxO was used).
+// ReleaseTx gives back the uTxOs reserved for a tx of the wallet that did not make it into the tx pool
+func (s *BlockchainService) ReleaseTx(txID []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-//Note: Say there is a pair of txs that are invalid together, this will register the SECOND tx as the invalid one and keep the first.
-func ValidateTxPoolDryRun(newTx *repository.Transaction) ([][]byte, error) {
-	invalidTxIDs := make([][]byte, 0)
-	var err error
+	s.Wallet.Pending.Release(txID)
+}
 
-	txPoolArray := repository.GetTxPoolArray()
+func (s *BlockchainService) QueuePayments(payments []wallet.Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if newTx != nil {
-		txPoolArray = append(txPoolArray, *newTx)
+	return s.Wallet.PaymentBatch.Add(payments...)
+}
+
+func (s *BlockchainService) QueuedPayments() []wallet.Payment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Wallet.PaymentBatch.Payments()
+}
+
+// FlushPayments creates one tx for all queued payments, reserving its uTxOs like CreateTx. The caller should queue the
+// returned payments again if the tx does not make it into the tx pool.
+func (s *BlockchainService) FlushPayments() (*repository.Transaction, []wallet.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+
+	tx, payments, err := s.Wallet.FlushPaymentBatch(wallet.TxOptions{})
+	if err != nil {
+		return nil, payments, err
 	}
+	s.Wallet.Pending.Reserve(*tx)
 
-	uTxOSetCopy := repository.CopyUTxOSet()
+	return tx, payments, nil
+}
 
-	for _, tx := range txPoolArray {
-		if err = wallet.IsValidTransactionCopy(tx, uTxOSetCopy); err != nil {
-			utils.ErrorLogger.Printf("error when validating txPool: %s\n", err)
-			invalidTxIDs = append(invalidTxIDs, tx.ID)
-			continue
-		}
+// TrackPendingTx records a tx that entered the tx pool as pending in the wallet if it spends the wallet's coins, so that
+// the wallet can spend its change before it is mined
+func (s *BlockchainService) TrackPendingTx(tx repository.Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		for _, txIn := range tx.TxIns {
-			repository.RemoveTxOFromUTxOCopy(repository.TxIDType(tx.ID), txIn, uTxOSetCopy)
-		}
-		repository.AddTxToUTxOSetCopy(tx, uTxOSetCopy)
+	if s.Wallet.PendingTxSpendsWallet(tx, s.UTxOSet.Copy()) {
+		s.Wallet.Pending.Add(tx)
 	}
+	s.Wallet.Pending.Release(tx.ID)
+}
 
-	return invalidTxIDs, err
+// SyncPendingTxs forgets the wallet's pending txs that have been mined or evicted from the tx pool
+func (s *BlockchainService) SyncPendingTxs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+}
+
+func (s *BlockchainService) syncPendingTxs() {
+	s.Wallet.Pending.Sync(s.TxPool.Map())
+}
+
+// BumpFee creates a replacement for the wallet's pending tx with txID paying feeRate
+func (s *BlockchainService) BumpFee(txID []byte, feeRate int) (*repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+
+	return s.Wallet.BumpFeeTransaction(txID, feeRate, nil)
+}
+
+// GetBalances splits the wallet's coins into confirmed, pending and still locked
+func (s *BlockchainService) GetBalances() wallet.Balances {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+
+	return s.Wallet.GetBalances(s.UTxOSet.Copy(), s.Blockchain.GetLastBlock().Index+1, int(time.Now().UnixNano()))
 }
 
-// commit all block txs. Remove txs from current tx pool that exist in the block.
-// Then further validate if the rest of the entire tx pool is valid and remove the txs that are invalid.
-func CommitBlockTransactions(block coin.Block) error {
-	// we copy the block to avoid any pointer copying fails, such as slice pointers. Updating the slice of TxOs in UTxOSet,
-	// updated the slice in the blockchain
-	copyBlock, err := CopyBlock(block)
+func (s *BlockchainService) GetVestingUTxOs() []wallet.VestingUTxO {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Wallet.GetVestingUTxOs()
+}
+
+// ClaimVestingTx spends an unlocked vesting output of this node's wallet, paying this node's own address if receiverAddress is empty.
+// The tx reserves its uTxO like CreateTx.
+func (s *BlockchainService) ClaimVestingTx(txID []byte, txOIndex int, receiverAddress []byte) (*repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(receiverAddress) == 0 {
+		receiverAddress = s.Wallet.Crypt.FirstcoinAddress
+	}
+
+	tx, err := s.Wallet.ClaimVestingTransaction(txID, txOIndex, receiverAddress)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	s.Wallet.Pending.Reserve(*tx)
 
-	if err := wallet.AreValidTransactions(copyBlock.Transactions); err != nil {
-		return err
+	return tx, nil
+}
+
+func (s *BlockchainService) CreateMultisig(m int, publicKeys [][]byte) (wallet.Multisig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Wallet.AddMultisig(m, publicKeys)
+}
+
+// Multisigs returns the multisig addresses the wallet is a cosigner of
+func (s *BlockchainService) Multisigs() []wallet.Multisig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	multisigs := make([]wallet.Multisig, 0, len(s.Wallet.Multisigs))
+	for _, multisig := range s.Wallet.Multisigs {
+		multisigs = append(multisigs, multisig)
 	}
 
-	for _, tx := range copyBlock.Transactions {
-		for _, txIn := range tx.TxIns {
-			repository.RemoveTxOFromUTxOSet(repository.TxIDType(tx.ID), txIn)
-		}
-		repository.AddTxToUTxOSet(tx)
-		repository.RemoveTxFromTxPool(tx.ID)
+	return multisigs
+}
+
+func (s *BlockchainService) CreateMultisigTx(multisigAddress []byte, receiverAddress []byte, amount int, feeRate int) (*wallet.PartiallySignedTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Wallet.CreateMultisigTransaction(multisigAddress, receiverAddress, amount, feeRate)
+}
+
+func (s *BlockchainService) SignPartialTx(pst wallet.PartiallySignedTransaction) (*wallet.PartiallySignedTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Wallet.SignPartiallySignedTransaction(&pst, wallet.SigHashAll); err != nil {
+		return nil, err
+	}
+
+	return &pst, nil
+}
+
+// FundHTLC locks amount to receiverAddress behind secretHash, refundable to this node's wallet from locktime on. The tx
+// reserves its uTxOs like CreateTx.
+func (s *BlockchainService) FundHTLC(secretHash []byte, receiverAddress []byte, locktime int, amount int) (wallet.HTLC, *repository.Transaction, error) {
+	htlc, err := wallet.NewHTLC(secretHash, receiverAddress, s.Wallet.Crypt.FirstcoinAddress, locktime)
+	if err != nil {
+		return wallet.HTLC{}, nil, err
 	}
 
-	if invalidTxIDs, err := ValidateTxPoolDryRun(nil); err != nil {
-		utils.InfoLogger.Println("Left over Tx pool is invalid after committing block. Emptying tx pool")
-		for _, invalidTxID := range invalidTxIDs {
-			repository.RemoveTxFromTxPool(invalidTxID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPendingTxs()
+
+	tx, err := s.Wallet.FundHTLC(htlc, amount, wallet.TxOptions{})
+	if err != nil {
+		return wallet.HTLC{}, nil, err
+	}
+	s.Wallet.Pending.Reserve(*tx)
+
+	return htlc, tx, nil
+}
+
+// ClaimHTLC spends an htlc paid to this node's wallet with its secret, paying this node's own address if receiverAddress is empty.
+// The tx reserves its uTxO like CreateTx.
+func (s *BlockchainService) ClaimHTLC(redeemScript []byte, txID []byte, txOIndex int, secret []byte, receiverAddress []byte) (*repository.Transaction, error) {
+	htlc, err := wallet.ParseHTLC(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(receiverAddress) == 0 {
+		receiverAddress = s.Wallet.Crypt.FirstcoinAddress
+	}
+
+	tx, err := s.Wallet.ClaimHTLCTransaction(htlc, txID, txOIndex, secret, receiverAddress, s.UTxOSet.Copy())
+	if err != nil {
+		return nil, err
+	}
+	s.Wallet.Pending.Reserve(*tx)
+
+	return tx, nil
+}
+
+// RefundHTLC takes back an expired htlc funded by this node's wallet, paying this node's own address if receiverAddress is empty.
+// The tx reserves its uTxO like CreateTx.
+func (s *BlockchainService) RefundHTLC(redeemScript []byte, txID []byte, txOIndex int, receiverAddress []byte) (*repository.Transaction, error) {
+	htlc, err := wallet.ParseHTLC(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(receiverAddress) == 0 {
+		receiverAddress = s.Wallet.Crypt.FirstcoinAddress
+	}
+
+	tx, err := s.Wallet.RefundHTLCTransaction(htlc, txID, txOIndex, receiverAddress, s.UTxOSet.Copy())
+	if err != nil {
+		return nil, err
+	}
+	s.Wallet.Pending.Reserve(*tx)
+
+	return tx, nil
+}
+
+// PublishData anchors data on chain in a data carrier output paid for by this node's wallet. The tx reserves its uTxOs
+// like CreateTx.
+func (s *BlockchainService) PublishData(data []byte) (*repository.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.Wallet.CreateDataCarrierTransaction(data, s.UTxOSet.Copy())
+	if err != nil {
+		return nil, err
+	}
+	s.Wallet.Pending.Reserve(*tx)
+
+	return tx, nil
+}
+
+func (s *BlockchainService) ProveData(data []byte) (coin.InclusionProof, error) {
+	return s.Blockchain.ProveDataCommitment(data)
+}
+
+// FinalizePartialTxs combines the signatures collected by each cosigner and builds the final transaction
+func (s *BlockchainService) FinalizePartialTxs(psts []wallet.PartiallySignedTransaction) (*repository.Transaction, error) {
+	combined, err := wallet.CombinePartiallySignedTransactions(psts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := combined.Finalize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// Need to validate the entire pool for two reasons:
+// 1. Multiple individual transactions can be valid, while the entire pool is invalid. Eg, same spender spends all his money twice.
+// 2. When a new block is mined, and added to the chain, and uTxOs are updated, current txs might no longer be valid (e.g. the UtxO was used).
+
+//Note: Say there is a pair of txs that are invalid together, this will register the SECOND tx as the invalid one and keep the first.
+// Txs are validated as if mined in the block at nextBlockIndex right now, so their locktimes and relative timelocks must
+// already be satisfied. A pool tx counts as confirmed in that block for the pool txs that spend it.
+func (s *BlockchainService) ValidateTxPoolDryRun(newTx *repository.Transaction, nextBlockIndex int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.validateTxPoolDryRun(newTx, nextBlockIndex)
+}
+
+func (s *BlockchainService) validateTxPoolDryRun(newTx *repository.Transaction, nextBlockIndex int) ([][]byte, error) {
+	invalidTxIDs := make([][]byte, 0)
+	var err, newTxErr error
+	now := int(time.Now().UnixNano())
+
+	txPoolArray := s.TxPool.Array()
+
+	if newTx != nil {
+		txPoolArray = append(txPoolArray, *newTx)
+	}
+
+	uTxOSetCopy := s.UTxOSet.Copy()
+	flags := s.Blockchain.Params().ScriptFlags(nextBlockIndex)
+
+	// txs spending unconfirmed outputs are validated after the txs they spend from
+	for _, tx := range wallet.SortTransactionsByDependency(txPoolArray) {
+		txErr := wallet.IsValidTransactionCopy(tx, uTxOSetCopy, flags)
+		if txErr != nil {
+			utils.ErrorLogger.Printf("error when validating txPool: %s\n", txErr)
+		} else {
+			if txErr = wallet.IsFinalTransaction(tx, nextBlockIndex, now); txErr == nil {
+				txErr = wallet.CheckSequenceLocks(tx, uTxOSetCopy, nextBlockIndex, now)
+			}
+			if txErr != nil {
+				utils.ErrorLogger.Printf("error when validating txPool timelocks: %s\n", txErr)
+			}
 		}
+
+		if txErr != nil {
+			invalidTxIDs = append(invalidTxIDs, tx.ID)
+			err = txErr
+			if newTx != nil && bytes.Equal(tx.ID, newTx.ID) {
+				newTxErr = txErr
+			}
+			continue
+		}
+
+		wallet.ApplyTransactionCopy(tx, uTxOSetCopy, nextBlockIndex, now)
+	}
+
+	// when checking a new tx only its own validity matters, the pool is cleaned up when the next block is committed
+	if newTx != nil {
+		return invalidTxIDs, newTxErr
 	}
 
-	return nil
+	return invalidTxIDs, err
 }
 
-func CreateGenesisBlockchain(crypt wallet.Cryptographic, blockchain coin.Blockchain) (coin.Blockchain, repository.Transaction, error) {
+// CreateGenesisBlockchain starts the chain of the service with a genesis block paying crypt
+func (s *BlockchainService) CreateGenesisBlockchain(crypt wallet.Cryptographic) (repository.Transaction, error) {
 	genesisTransactionPool := make([]repository.Transaction, 0)
 
 	// coinbase transaction is the first transaction included by the miner
 	coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(crypt, 0)
 	genesisTransactionPool = append(genesisTransactionPool, coinbaseTransaction)
 
-	repository.AddTxToUTxOSet(coinbaseTransaction)
 	genesisBlock, err := coin.GenesisBlock(SeedDifficultyLevel, genesisTransactionPool)
 	if err != nil {
-		return coin.Blockchain{}, repository.Transaction{}, err
+		return repository.Transaction{}, err
+	}
+
+	if err := s.ConnectBlock(genesisBlock); err != nil {
+		return repository.Transaction{}, err
 	}
-	blockchain.AddBlock(genesisBlock)
 
-	return blockchain, coinbaseTransaction, nil
+	return coinbaseTransaction, nil
 }
 
 func (s *BlockchainService) AddTxToTxPool(tx repository.Transaction) bool {
-	if _, ok := repository.GetTxFromTxPool(tx.ID); ok {
-		return false
-	}
-	return repository.AddTxToTxPool(tx)
+	return s.AddTxToTxPoolAt(tx, int(time.Now().UnixNano()))
+}
+
+// AddTxToTxPoolAt adds tx to the tx pool without any checks, as if it entered the pool at addedAt. A tx spending outputs
+// that are neither in the uTxO set nor in the pool is not added.
+func (s *BlockchainService) AddTxToTxPoolAt(tx repository.Transaction, addedAt int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addToTxPool(tx, addedAt)
 }
 
 func CopyBlock(bl coin.Block) (coin.Block, error) {
@@ -1,11 +1,20 @@
 package service_test
 
 import (
+	"bytes"
+	"errors"
 	"firstcoin/coin"
 	"firstcoin/repository"
 	"firstcoin/service"
 	"firstcoin/wallet"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUpdateUTxOSet(t *testing.T) {
@@ -18,17 +27,18 @@ func TestUpdateUTxOSet(t *testing.T) {
 		receiverCrypt := wallet.NewCryptographic()
 		receiverCrypt.GenerateKeyPair()
 
-		senderWallet := wallet.NewWallet(*senderCrypt)
+		senderWallet := wallet.NewWallet(*senderCrypt, repository.NewUTxOSet(), repository.NewTxPool())
 
 		blocks := make([]coin.Block, 0)
-		blockchain := coin.NewBlockchain(blocks)
-		*blockchain, _, err = service.CreateGenesisBlockchain(*senderCrypt, *blockchain)
+		blockchain := coin.NewBlockchain(blocks, coin.DefaultChainParams())
+		s := service.NewBlockchainService(blockchain, senderWallet)
+		_, err = s.CreateGenesisBlockchain(*senderCrypt)
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(*senderCrypt, 1)
 
-		tx, _, err := senderWallet.CreateTransaction(receiverCrypt.PublicKey, amount)
+		tx, _, err := senderWallet.CreateTransaction(receiverCrypt.FirstcoinAddress, amount)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
@@ -42,12 +52,12 @@ func TestUpdateUTxOSet(t *testing.T) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 
-		err = service.CommitBlockTransactions(block)
+		err = s.ConnectBlock(block)
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
 
-		uTxOSet := repository.GetEntireUTxOSet()
+		uTxOSet := s.UTxOSet.Copy()
 		if len(uTxOSet) != 2 {
 			t.Fatalf("Length of uTxOSet incorrect. Got: %d. Want:%d", len(uTxOSet), 2)
 		}
@@ -65,3 +75,1498 @@ func TestUpdateUTxOSet(t *testing.T) {
 		}
 	})
 }
+
+func TestValidateTxPoolDryRun(t *testing.T) {
+	t.Run("accepts txs spending unconfirmed outputs of the pool", func(t *testing.T) {
+		senderCrypt := wallet.NewCryptographic()
+		senderCrypt.GenerateKeyPair()
+		receiverCrypt := wallet.NewCryptographic()
+		receiverCrypt.GenerateKeyPair()
+
+		s := newTestNode(t, senderCrypt)
+
+		parent, err := s.CreateTx([]wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.ValidateTxPoolDryRun(parent, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		s.AddTxToTxPool(*parent)
+		s.TrackPendingTx(*parent)
+
+		child, err := s.CreateTx([]wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 20}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("expected to spend the unconfirmed change: %s", err)
+		}
+		if _, err := s.ValidateTxPoolDryRun(child, 1); err != nil {
+			t.Fatalf("expected the child of a pool tx to be valid: %s", err)
+		}
+		s.AddTxToTxPool(*child)
+		s.TrackPendingTx(*child)
+
+		if balances := s.GetBalances(); balances.Confirmed != 0 || balances.Pending != child.TxOuts[1].Value {
+			t.Fatalf("incorrect balances: %+v", balances)
+		}
+
+		totalFees, txs := wallet.CalculateTotalTxFees(s.TxPool.Array(), s.UTxOSet.Copy())
+		if len(txs) != 2 || string(txs[0].ID) != string(parent.ID) || totalFees != 2*wallet.TRANSACTION_FEE {
+			t.Fatalf("expected both txs to be mined parent first, got %d txs with %d fees", len(txs), totalFees)
+		}
+
+		blockCoinbase, _ := wallet.CreateCoinbaseTransaction(*senderCrypt, totalFees)
+		if err := wallet.AreValidTransactions(append([]repository.Transaction{blockCoinbase}, txs...), s.UTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected the chained txs to be valid in one block: %s", err)
+		}
+	})
+}
+
+func TestAcceptToTxPool(t *testing.T) {
+	setup := func(t *testing.T) (*service.BlockchainService, *wallet.Cryptographic) {
+		senderCrypt := wallet.NewCryptographic()
+		senderCrypt.GenerateKeyPair()
+		receiverCrypt := wallet.NewCryptographic()
+		receiverCrypt.GenerateKeyPair()
+
+		return newTestNode(t, senderCrypt), receiverCrypt
+	}
+
+	// respend signs a tx spending the same inputs as tx, paying fee more out of its change
+	respend := func(t *testing.T, s *service.BlockchainService, tx repository.Transaction, fee int) repository.Transaction {
+		conflict := repository.Transaction{
+			TxIns:     append([]repository.TxIn{}, tx.TxIns...),
+			TxOuts:    append([]repository.TxO{}, tx.TxOuts...),
+			Timestamp: tx.Timestamp + 1,
+		}
+		conflict.TxOuts[len(conflict.TxOuts)-1].Value -= fee
+		conflict.ID = wallet.GenerateTransactionID(conflict)
+
+		if _, err := s.Wallet.SignTransaction(&conflict, s.UTxOSet.Copy(), wallet.SigHashAll); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return conflict
+	}
+
+	t.Run("replaces a replaceable tx with a higher fee one", func(t *testing.T) {
+		s, receiverCrypt := setup(t)
+
+		original, err := s.CreateTx([]wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{Replaceable: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*original, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		s.TrackPendingTx(*original)
+
+		replacement, err := s.BumpFee(original.ID, 50)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		evicted, err := s.AcceptToTxPool(*replacement, 1)
+		if err != nil {
+			t.Fatalf("expected the replacement to be accepted: %s", err)
+		}
+		if len(evicted) != 1 || string(evicted[0].ID) != string(original.ID) {
+			t.Fatalf("expected the original to be evicted, got %d txs", len(evicted))
+		}
+
+		if _, ok := s.TxPool.Get(original.ID); ok {
+			t.Fatalf("expected the original to leave the tx pool")
+		}
+		if _, ok := s.TxPool.Get(replacement.ID); !ok {
+			t.Fatalf("expected the replacement in the tx pool")
+		}
+	})
+
+	t.Run("rejects replacing a tx that does not signal replaceability", func(t *testing.T) {
+		s, receiverCrypt := setup(t)
+
+		original, err := s.CreateTx([]wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*original, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		doubleSpend := respend(t, s, *original, 50)
+
+		if _, err := s.AcceptToTxPool(doubleSpend, 1); err == nil {
+			t.Fatalf("expected the double spend to be rejected")
+		}
+		if _, ok := s.TxPool.Get(original.ID); !ok {
+			t.Fatalf("expected the original to stay in the tx pool")
+		}
+	})
+
+	t.Run("rejects a replacement that does not pay more", func(t *testing.T) {
+		s, receiverCrypt := setup(t)
+
+		original, err := s.CreateTx([]wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{Replaceable: true, FeeRate: 50})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*original, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// the same fee does not pay for relaying the replacement
+		sameFee := respend(t, s, *original, 0)
+
+		if _, err := s.AcceptToTxPool(sameFee, 1); err == nil {
+			t.Fatalf("expected a replacement with the same fee to be rejected")
+		}
+
+		if _, err := s.AcceptToTxPool(respend(t, s, *original, 1), 1); err != nil {
+			t.Fatalf("expected a replacement paying the relay fee on top to be accepted: %s", err)
+		}
+	})
+
+	t.Run("rejects a replacement spending another unconfirmed output of the tx the original spends from", func(t *testing.T) {
+		s, receiverCrypt := setup(t)
+
+		// the parent pays the sender twice, in a payment and its change
+		parent, err := s.CreateTx([]wallet.Payment{{Address: s.Wallet.Crypt.FirstcoinAddress, Amount: 30}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*parent, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		view := s.UTxOSet.Copy()
+		wallet.ApplyTransactionCopy(*parent, view, 0, 0)
+		spend := func(txIns []repository.TxIn, value int) repository.Transaction {
+			tx := repository.Transaction{
+				TxIns:     txIns,
+				TxOuts:    []repository.TxO{{ScriptPubKey: receiverCrypt.ScriptPubKey, Value: value}},
+				Timestamp: int(time.Now().UnixNano()),
+			}
+			tx.ID = wallet.GenerateTransactionID(tx)
+			if _, err := s.Wallet.SignTransaction(&tx, view, wallet.SigHashAll); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			return tx
+		}
+
+		payment := repository.TxIn{TxID: parent.ID, TxOIndex: 0, Sequence: wallet.SEQUENCE_REPLACEABLE_FLAG}
+		change := repository.TxIn{TxID: parent.ID, TxOIndex: 1, Sequence: wallet.SEQUENCE_REPLACEABLE_FLAG}
+
+		original := spend([]repository.TxIn{payment}, 25)
+		if _, err := s.AcceptToTxPool(original, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// the replacement pays a much higher fee, but the change of the parent was not spent by the original
+		replacement := spend([]repository.TxIn{change, payment}, 10)
+		if _, err := s.AcceptToTxPool(replacement, 1); err == nil || !strings.Contains(err.Error(), "new unconfirmed output") {
+			t.Fatalf("expected the replacement to be rejected for spending a new unconfirmed output, got: %v", err)
+		}
+		if _, ok := s.TxPool.Get(original.ID); !ok {
+			t.Fatalf("expected the original to stay in the tx pool")
+		}
+	})
+
+	t.Run("replaces only the tx spending the same output when a sibling of it is already spent", func(t *testing.T) {
+		s, receiverCrypt := setup(t)
+
+		// the parent pays the sender twice, followed by its change
+		parent, err := s.CreateTx([]wallet.Payment{
+			{Address: s.Wallet.Crypt.FirstcoinAddress, Amount: 20},
+			{Address: s.Wallet.Crypt.FirstcoinAddress, Amount: 20},
+		}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*parent, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, _, err := s.CreateNextBlock(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		spend := func(txIn repository.TxIn, value int) repository.Transaction {
+			tx := repository.Transaction{
+				TxIns:     []repository.TxIn{txIn},
+				TxOuts:    []repository.TxO{{ScriptPubKey: receiverCrypt.ScriptPubKey, Value: value}},
+				Timestamp: int(time.Now().UnixNano()),
+			}
+			tx.ID = wallet.GenerateTransactionID(tx)
+			if _, err := s.Wallet.SignTransaction(&tx, s.UTxOSet.Copy(), wallet.SigHashAll); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			return tx
+		}
+
+		first := repository.TxIn{TxID: parent.ID, TxOIndex: 0}
+		second := repository.TxIn{TxID: parent.ID, TxOIndex: 1}
+		change := repository.TxIn{TxID: parent.ID, TxOIndex: 2, Sequence: wallet.SEQUENCE_REPLACEABLE_FLAG}
+		changeValue := parent.TxOuts[2].Value
+
+		if _, err := s.AcceptToTxPool(spend(first, 15), 2); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, _, err := s.CreateNextBlock(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		sibling := spend(second, 15)
+		if _, err := s.AcceptToTxPool(sibling, 3); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		original := spend(change, changeValue-5)
+		if _, err := s.AcceptToTxPool(original, 3); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		evicted, err := s.AcceptToTxPool(spend(change, changeValue-50), 3)
+		if err != nil {
+			t.Fatalf("expected the replacement to be accepted: %s", err)
+		}
+		if len(evicted) != 1 || string(evicted[0].ID) != string(original.ID) {
+			t.Fatalf("expected only the original to be evicted, got %d txs", len(evicted))
+		}
+		if _, ok := s.TxPool.Get(sibling.ID); !ok {
+			t.Fatalf("expected the tx spending the sibling output to stay in the tx pool")
+		}
+
+		if _, err := s.AcceptToTxPool(spend(second, 10), 3); err == nil {
+			t.Fatalf("expected a double spend of the sibling output to be rejected")
+		}
+	})
+}
+
+func TestTxPoolLimits(t *testing.T) {
+	receiverCrypt := wallet.NewCryptographic()
+	receiverCrypt.GenerateKeyPair()
+	payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+	var s *service.BlockchainService
+	reset := func() {
+		minerCrypt := wallet.NewCryptographic()
+		minerCrypt.GenerateKeyPair()
+		s = newTestNode(t, minerCrypt)
+	}
+
+	t.Run("evicts the lowest fee rate txs when full and raises the minimum relay fee", func(t *testing.T) {
+		reset()
+
+		low, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 10})
+		high, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 50})
+
+		s.SetTxPoolConfig(service.TxPoolConfig{MaxSize: wallet.SerializedSize(*low) + wallet.SerializedSize(*high) - 1})
+
+		if _, err := s.AcceptToTxPool(*low, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		evicted, err := s.AcceptToTxPool(*high, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(evicted) != 1 || string(evicted[0].ID) != string(low.ID) {
+			t.Fatalf("expected the low fee rate tx to be evicted, got %d txs", len(evicted))
+		}
+
+		info := s.GetTxPoolInfo()
+		if info.Count != 1 || info.MinRelayFeeRate <= 10 {
+			t.Fatalf("incorrect tx pool info: %+v", info)
+		}
+
+		if _, err := s.AcceptToTxPool(*low, 1); err == nil {
+			t.Fatalf("expected the evicted tx to be below the minimum relay fee")
+		}
+
+		if rate := s.MinRelayFeeRate(int(time.Now().Add(30 * 24 * time.Hour).UnixNano())); rate != wallet.DEFAULT_FEE_RATE {
+			t.Fatalf("expected the minimum relay fee rate to decay. Got: %d", rate)
+		}
+	})
+
+	t.Run("evicts a tx together with its descendants", func(t *testing.T) {
+		reset()
+
+		accept := func(options wallet.TxOptions) repository.Transaction {
+			tx, err := s.CreateTx(payment, options)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			s.TrackPendingTx(*tx)
+
+			return *tx
+		}
+
+		parent := accept(wallet.TxOptions{FeeRate: 10})
+		child := accept(wallet.TxOptions{FeeRate: 20})
+
+		info := s.GetTxPoolInfo()
+		for _, entry := range info.Entries {
+			if string(entry.Tx.ID) == string(parent.ID) && (entry.Descendants != 1 || entry.DescendantSize != info.Size) {
+				t.Fatalf("incorrect descendants of the parent: %+v", entry)
+			}
+			if string(entry.Tx.ID) == string(child.ID) && (entry.Ancestors != 1 || entry.AncestorSize != info.Size) {
+				t.Fatalf("incorrect ancestors of the child: %+v", entry)
+			}
+		}
+
+		high, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 50})
+		s.SetTxPoolConfig(service.TxPoolConfig{MaxSize: info.Size + wallet.SerializedSize(*high) - 1})
+
+		evicted, err := s.AcceptToTxPool(*high, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(evicted) != 2 || string(evicted[0].ID) != string(parent.ID) || string(evicted[1].ID) != string(child.ID) {
+			t.Fatalf("expected the parent and child to be evicted, got %d txs", len(evicted))
+		}
+		if info := s.GetTxPoolInfo(); info.Count != 1 || info.Size != wallet.SerializedSize(*high) {
+			t.Fatalf("incorrect tx pool info: %+v", info)
+		}
+	})
+
+	t.Run("rejects txs over the max tx size", func(t *testing.T) {
+		reset()
+
+		tx, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{})
+
+		// the node's chain is swapped for the same blocks under a lower max tx size
+		params := coin.DefaultChainParams()
+		params.MaxTxSize = wallet.SerializedSize(*tx) - 1
+		s = service.NewBlockchainService(coin.NewBlockchain(s.Blockchain.GetBlocks(), params), s.Wallet)
+
+		if _, err := s.AcceptToTxPool(*tx, 1); err == nil {
+			t.Fatalf("expected the tx to be rejected")
+		}
+	})
+
+	t.Run("drops expired txs", func(t *testing.T) {
+		reset()
+
+		old, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{})
+		s.AddTxToTxPoolAt(*old, int(time.Now().Add(-service.DEFAULT_TX_POOL_EXPIRY-time.Hour).UnixNano()))
+
+		tx, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{})
+		evicted, err := s.AcceptToTxPool(*tx, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(evicted) != 1 || string(evicted[0].ID) != string(old.ID) {
+			t.Fatalf("expected the old tx to expire, got %d txs", len(evicted))
+		}
+		if txPool := s.TxPool.Array(); len(txPool) != 1 || string(txPool[0].ID) != string(tx.ID) {
+			t.Fatalf("expected only the new tx in the pool")
+		}
+	})
+
+	t.Run("fills block templates by fee rate up to the max size", func(t *testing.T) {
+		reset()
+
+		low, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 10})
+		high, _, _ := newTestSender(s).CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 50})
+		now := int(time.Now().UnixNano())
+		s.AddTxToTxPoolAt(*low, now)
+		s.AddTxToTxPoolAt(*high, now+1)
+
+		if txPool := s.TxPool.Array(); string(txPool[0].ID) != string(low.ID) {
+			t.Fatalf("expected the pool in the order txs entered it")
+		}
+
+		_, txs := wallet.SelectBlockTransactions(s.TxPool.Array(), s.UTxOSet.Copy(), wallet.SerializedSize(*high), 0)
+		if len(txs) != 1 || string(txs[0].ID) != string(high.ID) {
+			t.Fatalf("expected only the high fee rate tx to fit, got %d txs", len(txs))
+		}
+
+		if _, txs := wallet.SelectBlockTransactions(s.TxPool.Array(), s.UTxOSet.Copy(), 0, 0); len(txs) != 2 || string(txs[0].ID) != string(high.ID) {
+			t.Fatalf("expected both txs highest fee rate first, got %d txs", len(txs))
+		}
+	})
+}
+
+func TestConnectBlock(t *testing.T) {
+	receiverCrypt := wallet.NewCryptographic()
+	receiverCrypt.GenerateKeyPair()
+	payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+	newNode := func(t *testing.T) *service.BlockchainService {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		return newTestNode(t, crypt)
+	}
+
+	t.Run("connects mined blocks and removes their txs from the tx pool", func(t *testing.T) {
+		s := newNode(t)
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		block, _, err := s.CreateNextBlock()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if last := s.Blockchain.GetLastBlock(); string(last.Hash) != string(block.Hash) {
+			t.Fatalf("expected the mined block to be the tip")
+		}
+		if _, ok := s.UTxOSet.Get(tx.ID); !ok || s.TxPool.Len() != 0 {
+			t.Fatalf("expected the tx to move from the tx pool to the uTxO set")
+		}
+
+		if err := s.ConnectBlock(*block); err == nil {
+			t.Fatalf("expected the block not to connect twice")
+		}
+	})
+
+	t.Run("mines the spends of two outputs of one tx into the same block", func(t *testing.T) {
+		s := newNode(t)
+		aliceCrypt, bobCrypt := wallet.NewCryptographic(), wallet.NewCryptographic()
+		aliceCrypt.GenerateKeyPair()
+		bobCrypt.GenerateKeyPair()
+		alice := wallet.NewWallet(*aliceCrypt, s.UTxOSet, s.TxPool)
+		bob := wallet.NewWallet(*bobCrypt, s.UTxOSet, s.TxPool)
+
+		tx, err := s.CreateTx([]wallet.Payment{
+			{Address: aliceCrypt.FirstcoinAddress, Amount: 20},
+			{Address: bobCrypt.FirstcoinAddress, Amount: 20},
+		}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, _, err := s.CreateNextBlock(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for _, spender := range []*wallet.Wallet{alice, bob} {
+			spend, _, err := spender.CreateTransaction(receiverCrypt.FirstcoinAddress, 10)
+			if err != nil {
+				t.Fatalf("expected the output of each recipient to be spendable: %s", err)
+			}
+			if _, err := s.AcceptToTxPool(*spend, 2); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		block, _, err := s.CreateNextBlock()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(block.Transactions) != 3 {
+			t.Fatalf("expected both spends in the block, got %d txs", len(block.Transactions))
+		}
+		for _, crypt := range []*wallet.Cryptographic{aliceCrypt, bobCrypt} {
+			if amount := wallet.GetTotalAmount(crypt.ScriptPubKey, s.UTxOSet.Copy()); amount >= 20 {
+				t.Errorf("expected the output of 20 to be spent, the recipient has %d", amount)
+			}
+		}
+	})
+
+	t.Run("leaves the node state untouched when a block fails", func(t *testing.T) {
+		s := newNode(t)
+		other := newNode(t)
+
+		// a block spending coins that only exist on the other node is valid there but not here
+		tx, err := other.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := other.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(s.Wallet.Crypt, 0)
+		transactionPool := []repository.Transaction{coinbaseTransaction, *tx}
+		block, err := s.Blockchain.GenerateNextBlock(&transactionPool)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		pending, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*pending, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		uTxOSet := s.UTxOSet.Copy()
+
+		if err := s.ConnectBlock(block); err == nil {
+			t.Fatalf("expected the block to be rejected")
+		}
+
+		if s.Blockchain.Len() != 1 || len(s.UTxOSet.Copy()) != len(uTxOSet) || s.TxPool.Len() != 1 {
+			t.Fatalf("expected the chain, uTxO set and tx pool to be unchanged")
+		}
+	})
+
+	t.Run("saves every new tip and restarts from the saved chain", func(t *testing.T) {
+		s := newNode(t)
+		path := filepath.Join(t.TempDir(), "chain.json")
+		s.SetChainStore(service.NewChainStore(path))
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, _, err := s.CreateNextBlock(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		restarted := service.NewBlockchainService(coin.NewBlockchain(nil, coin.DefaultChainParams()), wallet.NewWallet(s.Wallet.Crypt, repository.NewUTxOSet(), repository.NewTxPool()))
+		restarted.SetChainStore(service.NewChainStore(path))
+		if loaded, err := restarted.LoadChain(); err != nil || !loaded {
+			t.Fatalf("expected the saved chain to load, got: %v", err)
+		}
+
+		if string(restarted.Blockchain.GetLastBlock().Hash) != string(s.Blockchain.GetLastBlock().Hash) {
+			t.Fatalf("expected the restarted node to carry on from the saved tip")
+		}
+		if !reflect.DeepEqual(restarted.UTxOSet.Copy(), s.UTxOSet.Copy()) {
+			t.Fatalf("expected the restarted node to have the saved uTxO set")
+		}
+
+		if _, _, err := restarted.CreateNextBlock(); err != nil {
+			t.Fatalf("expected the restarted node to mine on its saved chain: %s", err)
+		}
+	})
+
+	t.Run("drops a partly saved last block and refuses a saved chain that does not validate", func(t *testing.T) {
+		s := newNode(t)
+		path := filepath.Join(t.TempDir(), "chain.json")
+		if err := s.SetChainStore(service.NewChainStore(path)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, _, err := s.CreateNextBlock(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		saved, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := ioutil.WriteFile(path, append(append([]byte{}, saved...), []byte(`{"block":{"index":3`)...), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		restart := func() (*service.BlockchainService, error) {
+			restarted := service.NewBlockchainService(coin.NewBlockchain(nil, coin.DefaultChainParams()), wallet.NewWallet(s.Wallet.Crypt, repository.NewUTxOSet(), repository.NewTxPool()))
+			restarted.SetChainStore(service.NewChainStore(path))
+			_, err := restarted.LoadChain()
+			return restarted, err
+		}
+
+		restarted, err := restart()
+		if err != nil {
+			t.Fatalf("expected the saved blocks to load, got: %s", err)
+		}
+		if string(restarted.Blockchain.GetLastBlock().Hash) != string(s.Blockchain.GetLastBlock().Hash) || !reflect.DeepEqual(restarted.UTxOSet.Copy(), s.UTxOSet.Copy()) {
+			t.Fatalf("expected the restarted node to carry on from the last whole block")
+		}
+		if truncated, _ := ioutil.ReadFile(path); !bytes.Equal(truncated, saved) {
+			t.Fatalf("expected the partly saved block to be dropped from the store")
+		}
+
+		// the coinbase of the tip pays more than it can
+		lines := strings.Split(strings.TrimSuffix(string(saved), "\n"), "\n")
+		lines[len(lines)-1] = strings.Replace(lines[len(lines)-1], `"value":`, `"value":9`, 1)
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := restart(); err == nil {
+			t.Fatalf("expected a saved chain that does not validate to be refused")
+		}
+	})
+
+	t.Run("leaves the node state untouched when the chain cannot be saved", func(t *testing.T) {
+		s := newNode(t)
+		s.SetChainStore(service.NewChainStore(filepath.Join(t.TempDir(), "missing", "chain.json")))
+		uTxOSet := s.UTxOSet.Copy()
+
+		if _, _, err := s.CreateNextBlock(); err == nil {
+			t.Fatalf("expected the block to be rejected")
+		}
+
+		if s.Blockchain.Len() != 1 || !reflect.DeepEqual(s.UTxOSet.Copy(), uTxOSet) {
+			t.Fatalf("expected the chain and uTxO set to be unchanged")
+		}
+	})
+
+	t.Run("syncs to a chain with more work", func(t *testing.T) {
+		s := newNode(t)
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, _, err := s.CreateNextBlock(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		peer := newNode(t)
+		if err := peer.SyncBlockchain(s.Blockchain.GetBlocks()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if peer.Blockchain.Len() != 2 || len(peer.UTxOSet.Copy()) != len(s.UTxOSet.Copy()) {
+			t.Fatalf("expected the peer to take the chain and its uTxO set")
+		}
+		if _, ok := peer.UTxOSet.Get(tx.ID); !ok {
+			t.Fatalf("expected the synced uTxO set to hold the mined tx")
+		}
+
+		if err := s.SyncBlockchain(s.Blockchain.GetBlocks()[:1]); err == nil || s.Blockchain.Len() != 2 {
+			t.Fatalf("expected a chain with less work to be rejected")
+		}
+	})
+}
+
+func TestProcessBlock(t *testing.T) {
+	receiverCrypt := wallet.NewCryptographic()
+	receiverCrypt.GenerateKeyPair()
+	payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+	// mine mines n blocks on s
+	mine := func(t *testing.T, s *service.BlockchainService, n int) []coin.Block {
+		blocks := make([]coin.Block, 0, n)
+		for i := 0; i < n; i++ {
+			block, _, err := s.CreateNextBlock()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			blocks = append(blocks, *block)
+		}
+
+		return blocks
+	}
+
+	t.Run("does not blame the block when the chain cannot be saved", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		block := mine(t, s, 1)[0]
+
+		peer := newTestPeer(t, s)
+		peer.SetChainStore(service.NewChainStore(filepath.Join(t.TempDir(), "missing", "chain.json")))
+
+		var invalidBlock *service.InvalidBlockError
+		if _, err := peer.ProcessBlock(block); !errors.Is(err, service.ErrChainNotSaved) || errors.As(err, &invalidBlock) {
+			t.Fatalf("expected the chain not to be saved, got: %v", err)
+		}
+		if peer.Blockchain.Len() != 1 {
+			t.Errorf("expected the block not to be connected")
+		}
+	})
+
+	t.Run("returns an InvalidBlockError for a block that breaks the rules", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		block := mine(t, s, 1)[0]
+
+		peer := newTestPeer(t, s)
+		block.Transactions[0].TxOuts[0].Value++
+
+		var invalidBlock *service.InvalidBlockError
+		if _, err := peer.ProcessBlock(block); !errors.As(err, &invalidBlock) {
+			t.Fatalf("expected an invalid block, got: %v", err)
+		}
+		if peer.Blockchain.Len() != 1 {
+			t.Errorf("expected the block not to be connected")
+		}
+	})
+
+	t.Run("connects blocks that arrive before their parents", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		blocks := mine(t, s, 3)
+
+		peer := newTestPeer(t, s)
+
+		var missingParent *service.MissingParentError
+		if _, err := peer.ProcessBlock(blocks[2]); !errors.As(err, &missingParent) || string(missingParent.Missing) != string(blocks[1].Hash) {
+			t.Fatalf("expected the parent of the block to be missing, got: %v", err)
+		}
+		if _, err := peer.ProcessBlock(blocks[1]); !errors.As(err, &missingParent) || string(missingParent.Missing) != string(blocks[0].Hash) {
+			t.Fatalf("expected the grandparent of the block to be missing, got: %v", err)
+		}
+		if len(peer.OrphanBlocks()) != 2 || peer.Blockchain.Len() != 1 {
+			t.Fatalf("expected the blocks to wait in the orphan pool")
+		}
+
+		connected, err := peer.ProcessBlock(blocks[0])
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(connected) != 3 || len(peer.OrphanBlocks()) != 0 {
+			t.Fatalf("expected the orphans to connect after their parent, got %d blocks", len(connected))
+		}
+		if string(peer.Blockchain.GetLastBlock().Hash) != string(blocks[2].Hash) {
+			t.Fatalf("expected the last block to be the tip")
+		}
+
+		if _, err := peer.ProcessBlock(blocks[1]); !errors.Is(err, service.ErrKnownBlock) {
+			t.Fatalf("expected the block to be known, got: %v", err)
+		}
+	})
+
+	t.Run("reorganizes onto a competing branch with more work", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		competitor := newTestPeer(t, s)
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mine(t, s, 1)
+
+		branch := mine(t, competitor, 2)
+
+		connected, err := s.ProcessBlock(branch[0])
+		if err != nil || len(connected) != 0 {
+			t.Fatalf("expected a branch with the same work to be kept aside, got %d blocks and error: %v", len(connected), err)
+		}
+
+		connected, err = s.ProcessBlock(branch[1])
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(connected) != 2 || string(s.Blockchain.GetLastBlock().Hash) != string(branch[1].Hash) {
+			t.Fatalf("expected the node to switch to the branch, got %d blocks", len(connected))
+		}
+
+		if _, ok := s.TxPool.Get(tx.ID); !ok {
+			t.Fatalf("expected the tx of the disconnected block back in the tx pool")
+		}
+		if !reflect.DeepEqual(s.UTxOSet.Copy(), competitor.UTxOSet.Copy()) {
+			t.Fatalf("expected the uTxO set of the branch after disconnecting the block")
+		}
+	})
+
+	t.Run("saves only the branch of a reorg and restarts on it", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		competitor := newTestPeer(t, s)
+		path := filepath.Join(t.TempDir(), "chain.json")
+		if err := s.SetChainStore(service.NewChainStore(path)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mine(t, s, 1)
+
+		branch := mine(t, competitor, 2)
+		s.ProcessBlock(branch[0])
+		if _, err := s.ProcessBlock(branch[1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if saved, _ := ioutil.ReadFile(path); strings.Count(string(saved), "\n") != 4 {
+			t.Fatalf("expected the genesis block, the disconnected block and the branch to be appended one by one")
+		}
+
+		restarted := newTestPeerOf(t, s, crypt)
+		restarted.SetChainStore(service.NewChainStore(path))
+		if loaded, err := restarted.LoadChain(); err != nil || !loaded {
+			t.Fatalf("expected the saved chain to load, got: %v", err)
+		}
+		if string(restarted.Blockchain.GetLastBlock().Hash) != string(branch[1].Hash) || !reflect.DeepEqual(restarted.UTxOSet.Copy(), s.UTxOSet.Copy()) {
+			t.Fatalf("expected the restarted node on the branch")
+		}
+	})
+
+	t.Run("puts the txs of disconnected blocks back only if the tx pool admits them", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		competitor := newTestPeer(t, s)
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mine(t, s, 1)
+
+		s.SetTxPoolConfig(service.TxPoolConfig{MaxSize: wallet.SerializedSize(*tx) - 1})
+		branch := mine(t, competitor, 2)
+		s.ProcessBlock(branch[0])
+		if _, err := s.ProcessBlock(branch[1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if _, ok := s.TxPool.Get(tx.ID); ok {
+			t.Fatalf("expected the tx not to fit in the tx pool")
+		}
+		if s.MinRelayFeeRate(int(time.Now().UnixNano())) <= wallet.DEFAULT_FEE_RATE {
+			t.Fatalf("expected the eviction to raise the minimum relay fee rate")
+		}
+	})
+
+	t.Run("indexes a tx put back by a reorg as the ancestor of its pool spenders", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		competitor := newTestPeer(t, s)
+
+		parent, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*parent, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mine(t, s, 1)
+
+		receiver := wallet.NewWallet(*receiverCrypt, s.UTxOSet, s.TxPool)
+		child, _, err := receiver.CreateTransactionWithOptions([]wallet.Payment{{Address: crypt.FirstcoinAddress, Amount: 5}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*child, 2); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		branch := mine(t, competitor, 2)
+		s.ProcessBlock(branch[0])
+		if _, err := s.ProcessBlock(branch[1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		entries := make(map[string]service.TxPoolEntry)
+		for _, entry := range s.GetTxPoolInfo().Entries {
+			entries[string(entry.Tx.ID)] = entry
+		}
+		parentEntry, childEntry := entries[string(parent.ID)], entries[string(child.ID)]
+		if len(entries) != 2 || parentEntry.Descendants != 1 || childEntry.Ancestors != 1 {
+			t.Fatalf("expected the parent back in the pool as the ancestor of the child, got %d entries", len(entries))
+		}
+		if childEntry.AncestorFee != parentEntry.Fee+childEntry.Fee || parentEntry.DescendantSize != parentEntry.Size+childEntry.Size {
+			t.Fatalf("expected the package totals of both txs, got %+v and %+v", parentEntry, childEntry)
+		}
+	})
+
+	t.Run("keeps blocks with too little work out of the orphan pool", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+		genesisBlock, err := coin.GenesisBlock(0, []repository.Transaction{coinbaseTransaction})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		s := service.NewBlockchainService(coin.NewBlockchain(nil, coin.DefaultChainParams()), wallet.NewWallet(*crypt, repository.NewUTxOSet(), repository.NewTxPool()))
+		if err := s.ConnectBlock(genesisBlock); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		blocks := mine(t, s, 2)
+
+		peer := newTestPeer(t, s)
+		var missingParent *service.MissingParentError
+		if _, err := peer.ProcessBlock(blocks[1]); err == nil || errors.As(err, &missingParent) {
+			t.Fatalf("expected a block of difficulty level 0 to be refused, got: %v", err)
+		}
+		if len(peer.OrphanBlocks()) != 0 {
+			t.Errorf("expected the block not to be kept")
+		}
+	})
+
+	t.Run("keeps at most MAX_ORPHAN_BLOCKS_PER_SOURCE orphans from a source", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+		blocks := mine(t, s, service.MAX_ORPHAN_BLOCKS_PER_SOURCE+2)
+
+		peer := newTestPeer(t, s)
+		for _, block := range blocks[1:] {
+			peer.ProcessBlockFrom(block, "10.0.0.1")
+		}
+
+		if orphans := len(peer.OrphanBlocks()); orphans != service.MAX_ORPHAN_BLOCKS_PER_SOURCE {
+			t.Fatalf("incorrect orphans. Got: %d. Want: %d", orphans, service.MAX_ORPHAN_BLOCKS_PER_SOURCE)
+		}
+		if _, ok := peer.GetBlock(blocks[1].Hash); ok {
+			t.Errorf("expected the oldest orphan of the source to be dropped")
+		}
+
+		if _, err := peer.ProcessBlockFrom(blocks[1], "10.0.0.2"); err == nil {
+			t.Fatalf("expected the block to be an orphan")
+		}
+		if orphans := len(peer.OrphanBlocks()); orphans != service.MAX_ORPHAN_BLOCKS_PER_SOURCE+1 {
+			t.Errorf("expected another source to keep its orphan, got %d orphans", orphans)
+		}
+	})
+}
+
+func TestProcessTransaction(t *testing.T) {
+	receiverCrypt := wallet.NewCryptographic()
+	receiverCrypt.GenerateKeyPair()
+	payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+	// pay creates a tx of the wallet of s spending its pending change, and puts it in the tx pool of s
+	pay := func(t *testing.T, s *service.BlockchainService) repository.Transaction {
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.AcceptToTxPool(*tx, s.Blockchain.GetLastBlock().Index+1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		s.TrackPendingTx(*tx)
+
+		return *tx
+	}
+
+	newOrigin := func(t *testing.T) *service.BlockchainService {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		return newTestNode(t, crypt)
+	}
+
+	t.Run("admits a tx relayed before its parent once the parent arrives", func(t *testing.T) {
+		origin := newOrigin(t)
+		parent := pay(t, origin)
+		child := pay(t, origin)
+
+		peer := newTestPeer(t, origin)
+
+		var missingInputs *service.MissingInputsError
+		if _, _, err := peer.ProcessTransaction(child, 1); !errors.As(err, &missingInputs) || len(missingInputs.Missing) != 1 || string(missingInputs.Missing[0]) != string(parent.ID) {
+			t.Fatalf("expected the parent to be missing, got: %v", err)
+		}
+		if len(peer.OrphanTxs()) != 1 || peer.TxPool.Len() != 0 {
+			t.Fatalf("expected the child to wait in the orphan tx pool")
+		}
+
+		accepted, _, err := peer.ProcessTransaction(parent, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(accepted) != 2 || string(accepted[1].ID) != string(child.ID) {
+			t.Fatalf("expected the child to follow its parent into the tx pool, got %d txs", len(accepted))
+		}
+		if len(peer.OrphanTxs()) != 0 || peer.TxPool.Len() != 2 {
+			t.Fatalf("expected both txs in the tx pool")
+		}
+	})
+
+	t.Run("admits orphans whose parent arrives in a block", func(t *testing.T) {
+		origin := newOrigin(t)
+		pay(t, origin)
+		block, _, err := origin.CreateNextBlock()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		child := pay(t, origin)
+
+		peer := newTestPeer(t, origin)
+		if _, _, err := peer.ProcessTransaction(child, 1); err == nil {
+			t.Fatalf("expected the child to be an orphan")
+		}
+
+		if _, err := peer.ProcessBlock(*block); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, ok := peer.TxPool.Get(child.ID); !ok || len(peer.OrphanTxs()) != 0 {
+			t.Fatalf("expected the child in the tx pool")
+		}
+	})
+
+	t.Run("returns an InvalidTxError for a tampered or badly signed tx", func(t *testing.T) {
+		origin := newOrigin(t)
+		tx, err := origin.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var invalidTx *service.InvalidTxError
+
+		tampered := *tx
+		tampered.TxOuts = append([]repository.TxO{}, tx.TxOuts...)
+		tampered.TxOuts[0].Value++
+		if _, _, err := origin.ProcessTransaction(tampered, 1); !errors.As(err, &invalidTx) {
+			t.Errorf("expected a tx with an id that is not its hash to be invalid, got: %v", err)
+		}
+
+		// the id matches, but the signature is over the original outputs
+		tampered.ID = wallet.GenerateTransactionID(tampered)
+		if _, _, err := origin.ProcessTransaction(tampered, 1); !errors.As(err, &invalidTx) {
+			t.Errorf("expected a tx with a bad signature to be invalid, got: %v", err)
+		}
+
+		if _, _, err := origin.ProcessTransaction(*tx, 1); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("keeps at most MAX_ORPHAN_TXS orphans", func(t *testing.T) {
+		peer := newOrigin(t)
+
+		for i := 0; i <= service.MAX_ORPHAN_TXS; i++ {
+			orphan := repository.Transaction{
+				TxIns:     []repository.TxIn{{TxID: []byte(fmt.Sprintf("missing-%d", i))}},
+				TxOuts:    []repository.TxO{{Value: 10, ScriptPubKey: receiverCrypt.ScriptPubKey}},
+				Timestamp: i,
+			}
+			orphan.ID = wallet.GenerateTransactionID(orphan)
+
+			if _, _, err := peer.ProcessTransaction(orphan, 1); err == nil {
+				t.Fatalf("expected the tx to be an orphan")
+			}
+		}
+
+		if orphans := len(peer.OrphanTxs()); orphans != service.MAX_ORPHAN_TXS {
+			t.Fatalf("incorrect number of orphans. Got: %d. Want: %d", orphans, service.MAX_ORPHAN_TXS)
+		}
+	})
+
+	t.Run("keeps at most MAX_ORPHAN_TXS_PER_SOURCE orphans from a source", func(t *testing.T) {
+		peer := newOrigin(t)
+
+		newOrphan := func(i int) repository.Transaction {
+			orphan := repository.Transaction{
+				TxIns:     []repository.TxIn{{TxID: []byte(fmt.Sprintf("missing-%d", i))}},
+				TxOuts:    []repository.TxO{{Value: 10, ScriptPubKey: receiverCrypt.ScriptPubKey}},
+				Timestamp: i,
+			}
+			orphan.ID = wallet.GenerateTransactionID(orphan)
+
+			return orphan
+		}
+
+		first := newOrphan(0)
+		if _, _, err := peer.ProcessTransactionFrom(first, 1, "10.0.0.1"); err == nil {
+			t.Fatalf("expected the tx to be an orphan")
+		}
+		for i := 1; i <= service.MAX_ORPHAN_TXS_PER_SOURCE; i++ {
+			peer.ProcessTransactionFrom(newOrphan(i), 1, "10.0.0.1")
+		}
+
+		if orphans := len(peer.OrphanTxs()); orphans != service.MAX_ORPHAN_TXS_PER_SOURCE {
+			t.Fatalf("incorrect number of orphans. Got: %d. Want: %d", orphans, service.MAX_ORPHAN_TXS_PER_SOURCE)
+		}
+		if _, ok := peer.GetTransaction(first.ID); ok {
+			t.Errorf("expected the oldest orphan of the source to be dropped")
+		}
+
+		if _, _, err := peer.ProcessTransactionFrom(first, 1, "10.0.0.2"); err == nil {
+			t.Fatalf("expected the tx to be an orphan")
+		}
+		if orphans := len(peer.OrphanTxs()); orphans != service.MAX_ORPHAN_TXS_PER_SOURCE+1 {
+			t.Errorf("expected another source to keep its orphan, got %d orphans", orphans)
+		}
+	})
+}
+
+func TestConcurrentNodeState(t *testing.T) {
+	t.Run("keeps the node state consistent under concurrent payments, mining and reads", func(t *testing.T) {
+		const senders, paymentsPerSender, blocks = 8, 3, 3
+
+		minerCrypt := wallet.NewCryptographic()
+		minerCrypt.GenerateKeyPair()
+		receiverCrypt := wallet.NewCryptographic()
+		receiverCrypt.GenerateKeyPair()
+		payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+		s := newTestNode(t, minerCrypt)
+		wallets := make([]*wallet.Wallet, senders)
+		for i := range wallets {
+			wallets[i] = newTestSender(s)
+		}
+
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+
+		// every sender pays on top of its own pending txs, like a wallet behind the spend-coin endpoint
+		for _, w := range wallets {
+			wg.Add(1)
+			go func(w *wallet.Wallet) {
+				defer wg.Done()
+
+				for i := 0; i < paymentsPerSender; i++ {
+					tx, _, err := w.CreateTransactionWithOptions(payment, wallet.TxOptions{})
+					if err != nil {
+						t.Errorf("unexpected error: %s", err)
+						return
+					}
+
+					if _, err := s.AcceptToTxPool(*tx, s.Blockchain.GetLastBlock().Index+1); err != nil {
+						t.Errorf("unexpected error: %s", err)
+						return
+					}
+					w.Pending.Add(*tx)
+				}
+			}(w)
+		}
+
+		// the node's own wallet pays through the service
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < paymentsPerSender; i++ {
+				tx, err := s.CreateTx(payment, wallet.TxOptions{})
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+
+				if _, err := s.AcceptToTxPool(*tx, s.Blockchain.GetLastBlock().Index+1); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				s.TrackPendingTx(*tx)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < blocks; i++ {
+				if _, _, err := s.CreateNextBlock(); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}()
+
+		var readers sync.WaitGroup
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					s.GetTxPoolInfo()
+					s.GetBalances()
+					s.Blockchain.GetBlocks()
+					s.TxPool.Map()
+				}
+			}
+		}()
+
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		if s.Blockchain.Len() != blocks+1 {
+			t.Fatalf("incorrect chain length. Got: %d. Want: %d", s.Blockchain.Len(), blocks+1)
+		}
+
+		if _, err := s.ValidateTxPoolDryRun(nil, s.Blockchain.GetLastBlock().Index+1); err != nil {
+			t.Fatalf("expected the tx pool to stay valid: %s", err)
+		}
+
+		// fees move coins from the senders to the miner, so the coins in the set are exactly the coinbases
+		total := 0
+		for _, tx := range s.UTxOSet.Copy() {
+			for _, txO := range tx.TxOuts {
+				total += txO.Value
+			}
+		}
+		if want := (1 + senders + blocks) * wallet.COINBASE_TRANSACTION_AMOUNT; total != want {
+			t.Fatalf("incorrect total value of the uTxO set. Got: %d. Want: %d", total, want)
+		}
+	})
+
+	receiverCrypt := wallet.NewCryptographic()
+	receiverCrypt.GenerateKeyPair()
+	payment := []wallet.Payment{{Address: receiverCrypt.FirstcoinAddress, Amount: 10}}
+
+	t.Run("reserves the uTxOs of a created tx until it enters the tx pool or is released", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+
+		tx, err := s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := s.CreateTx(payment, wallet.TxOptions{}); err == nil {
+			t.Fatalf("expected the only uTxO of the wallet to be reserved")
+		}
+
+		s.ReleaseTx(tx.ID)
+		tx, err = s.CreateTx(payment, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("expected the released uTxO to be spent: %s", err)
+		}
+
+		if _, err := s.AcceptToTxPool(*tx, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		s.TrackPendingTx(*tx)
+		if _, err := s.CreateTx(payment, wallet.TxOptions{}); err != nil {
+			t.Fatalf("expected the change of the pending tx to be spent: %s", err)
+		}
+	})
+
+	t.Run("does not spend a uTxO twice with payments created at once", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+		s := newTestNode(t, crypt)
+
+		// the payments are all created before any enters the tx pool, as by handlers running at once
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		created := make([]repository.Transaction, 0)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// a payment finding the uTxOs reserved by another one fails to fund itself
+				if tx, err := s.CreateTx(payment, wallet.TxOptions{}); err == nil {
+					mu.Lock()
+					created = append(created, *tx)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(created) == 0 {
+			t.Fatalf("expected a payment to be created")
+		}
+		for _, tx := range created {
+			if _, err := s.AcceptToTxPool(tx, 1); err != nil {
+				t.Fatalf("expected every payment to spend uTxOs of its own: %s", err)
+			}
+			s.TrackPendingTx(tx)
+		}
+	})
+}
+
+func TestHTLC(t *testing.T) {
+	// mine accepts txs into the tx pool of miner, mines them and connects the block to the peers
+	mine := func(t *testing.T, miner *service.BlockchainService, peers []*service.BlockchainService, txs ...repository.Transaction) (*coin.Block, error) {
+		for _, tx := range txs {
+			if _, err := miner.AcceptToTxPool(tx, miner.Blockchain.GetLastBlock().Index+1); err != nil {
+				return nil, err
+			}
+		}
+
+		block, _, err := miner.CreateNextBlock()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, peer := range peers {
+			if err := peer.ConnectBlock(*block); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		return block, nil
+	}
+
+	t.Run("atomic swap between two networks", func(t *testing.T) {
+		aliceCrypt := wallet.NewCryptographic()
+		aliceCrypt.GenerateKeyPair()
+		bobCrypt := wallet.NewCryptographic()
+		bobCrypt.GenerateKeyPair()
+
+		// alice mines network A and bob network B, each with a node of the other on it
+		aliceOnA := newTestNode(t, aliceCrypt)
+		bobOnA := newTestPeerOf(t, aliceOnA, bobCrypt)
+		bobOnB := newTestNode(t, bobCrypt)
+		aliceOnB := newTestPeerOf(t, bobOnB, aliceCrypt)
+
+		// alice initiates: she locks 30 coins to bob on network A behind a secret only she knows
+		secret, secretHash, _ := wallet.NewHTLCSecret()
+		aliceContract, aliceFunding, err := aliceOnA.FundHTLC(secretHash, bobCrypt.FirstcoinAddress, 48, 30)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := mine(t, aliceOnA, []*service.BlockchainService{bobOnA}, *aliceFunding); err != nil {
+			t.Fatalf("alice funding rejected: %s", err)
+		}
+
+		// bob audits alice's contract before locking his side to the same secret hash with a shorter timeout
+		audited, err := wallet.ParseHTLC(aliceContract.RedeemScript())
+		if err != nil || !bytes.Equal(aliceFunding.TxOuts[0].ScriptPubKey, audited.ScriptPubKey()) {
+			t.Fatalf("alice's funding does not pay to the audited contract: %v", err)
+		}
+		if !bytes.Equal(audited.ReceiverHash, wallet.ConvertPublicKeyToHash160(bobCrypt.PublicKey)) {
+			t.Fatalf("alice's contract does not pay bob")
+		}
+
+		bobContract, bobFunding, err := bobOnB.FundHTLC(audited.SecretHash, aliceCrypt.FirstcoinAddress, 24, 40)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := mine(t, bobOnB, []*service.BlockchainService{aliceOnB}, *bobFunding); err != nil {
+			t.Fatalf("bob funding rejected: %s", err)
+		}
+
+		// bob cannot take his coins back before his timeout
+		bobRefund, err := bobOnB.RefundHTLC(bobContract.RedeemScript(), bobFunding.ID, 0, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := bobOnB.AcceptToTxPool(*bobRefund, bobOnB.Blockchain.GetLastBlock().Index+1); err == nil {
+			t.Fatalf("expected bob's refund to be rejected before the htlc expires")
+		}
+
+		// alice claims bob's coins on network B, revealing the secret
+		aliceClaim, err := aliceOnB.ClaimHTLC(bobContract.RedeemScript(), bobFunding.ID, 0, secret, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		claimBlock, err := mine(t, bobOnB, []*service.BlockchainService{aliceOnB}, *aliceClaim)
+		if err != nil {
+			t.Fatalf("alice claim rejected: %s", err)
+		}
+
+		// bob learns the secret from alice's claim in his own chain and uses it on network A
+		learned, err := wallet.ExtractHTLCSecret(claimBlock.Transactions[1], bobContract)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		bobClaim, err := bobOnA.ClaimHTLC(aliceContract.RedeemScript(), aliceFunding.ID, 0, learned, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := mine(t, aliceOnA, []*service.BlockchainService{bobOnA}, *bobClaim); err != nil {
+			t.Fatalf("bob claim rejected: %s", err)
+		}
+
+		if balance := bobOnA.GetBalances().Confirmed; balance != 30-wallet.TRANSACTION_FEE {
+			t.Fatalf("incorrect bob balance on network A. Got: %d. Want: %d", balance, 30-wallet.TRANSACTION_FEE)
+		}
+
+		if balance := aliceOnB.GetBalances().Confirmed; balance != 40-wallet.TRANSACTION_FEE {
+			t.Fatalf("incorrect alice balance on network B. Got: %d. Want: %d", balance, 40-wallet.TRANSACTION_FEE)
+		}
+	})
+
+	t.Run("refund after expiry", func(t *testing.T) {
+		aliceCrypt := wallet.NewCryptographic()
+		aliceCrypt.GenerateKeyPair()
+		bobCrypt := wallet.NewCryptographic()
+		bobCrypt.GenerateKeyPair()
+
+		alice := newTestNode(t, aliceCrypt)
+		bob := newTestPeerOf(t, alice, bobCrypt)
+		peers := []*service.BlockchainService{bob}
+
+		secret, secretHash, _ := wallet.NewHTLCSecret()
+		contract, funding, err := alice.FundHTLC(secretHash, bobCrypt.FirstcoinAddress, 10, 30)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := mine(t, alice, peers, *funding); err != nil {
+			t.Fatalf("funding rejected: %s", err)
+		}
+
+		if _, err := bob.ClaimHTLC(contract.RedeemScript(), funding.ID, 0, []byte("wrong secret"), nil); err == nil {
+			t.Fatalf("expected error for the wrong secret")
+		}
+
+		if _, err := bob.RefundHTLC(contract.RedeemScript(), funding.ID, 0, nil); err == nil {
+			t.Fatalf("expected error: bob is not the refund address")
+		}
+
+		// the claim path does not check the locktime, so an honest receiver can still claim with the secret
+		if _, err := bob.ClaimHTLC(contract.RedeemScript(), funding.ID, 0, secret, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		refund, err := alice.RefundHTLC(contract.RedeemScript(), funding.ID, 0, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if _, err := mine(t, alice, peers, *refund); err == nil {
+			t.Fatalf("expected refund to be rejected before block 10")
+		}
+
+		for alice.Blockchain.GetLastBlock().Index+1 < 10 {
+			mine(t, alice, peers)
+		}
+		if _, err := mine(t, alice, peers, *refund); err != nil {
+			t.Fatalf("expected refund at block 10 to be accepted: %s", err)
+		}
+
+		if _, ok := bob.UTxOSet.Get(refund.ID); !ok {
+			t.Fatalf("expected the refund to be confirmed on the network")
+		}
+	})
+}
+
+func newTestNode(t *testing.T, crypt *wallet.Cryptographic) *service.BlockchainService {
+	coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+
+	genesisBlock, err := coin.GenesisBlock(1, []repository.Transaction{coinbaseTransaction})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s := service.NewBlockchainService(coin.NewBlockchain(nil, coin.DefaultChainParams()), wallet.NewWallet(*crypt, repository.NewUTxOSet(), repository.NewTxPool()))
+	if err := s.ConnectBlock(genesisBlock); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return s
+}
+
+// newTestPeer starts a node with an empty wallet on the genesis block of s
+func newTestPeer(t *testing.T, s *service.BlockchainService) *service.BlockchainService {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	return newTestPeerOf(t, s, crypt)
+}
+
+// newTestPeerOf starts a node with the wallet of crypt on the genesis block of s
+func newTestPeerOf(t *testing.T, s *service.BlockchainService, crypt *wallet.Cryptographic) *service.BlockchainService {
+	peer := service.NewBlockchainService(coin.NewBlockchain(nil, coin.DefaultChainParams()), wallet.NewWallet(*crypt, repository.NewUTxOSet(), repository.NewTxPool()))
+	if err := peer.ConnectBlock(s.Blockchain.GetBlocks()[0]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return peer
+}
+
+// newTestSender funds a new wallet on the node of s with a confirmed coinbase
+func newTestSender(s *service.BlockchainService) *wallet.Wallet {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	coinbaseTransaction, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+	s.UTxOSet.Add(coinbaseTransaction)
+
+	return wallet.NewWallet(*crypt, s.UTxOSet, s.TxPool)
+}
@@ -1,7 +1,43 @@
 package utils
 
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
 func PanicError(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
+
+// WriteJSONFile writes the JSON of v to path through a temporary file, so a crash leaves the last write
+func WriteJSONFile(path string, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(path, j)
+}
+
+// WriteFile writes data to path through a temporary file, so a crash leaves the last write
+func WriteFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,62 @@
+package wallet
+
+import (
+	"firstcoin/repository"
+	"fmt"
+)
+
+// PaymentBatch queues payments so that they can be sent together in a single transaction, which spends the wallet's
+// uTxOs once, pays one tx fee and leaves one change output instead of one per payment.
+type PaymentBatch struct {
+	payments []Payment
+}
+
+// Add queues a payment. The address and amount are checked now so that one bad payment does not fail the whole flush.
+func (b *PaymentBatch) Add(payments ...Payment) error {
+	for _, payment := range payments {
+		if _, err := ScriptPubKeyFromAddress(payment.Address); err != nil {
+			return err
+		}
+
+		if payment.Amount <= 0 {
+			return fmt.Errorf("invalid payment to %s: amount must be > 0", payment.Address)
+		}
+	}
+
+	b.payments = append(b.payments, payments...)
+	return nil
+}
+
+// Payments returns a copy of the queued payments
+func (b *PaymentBatch) Payments() []Payment {
+	return append([]Payment{}, b.payments...)
+}
+
+func (b *PaymentBatch) Len() int {
+	return len(b.payments)
+}
+
+// take empties the queue and returns what was in it
+func (b *PaymentBatch) take() []Payment {
+	payments := b.payments
+	b.payments = nil
+	return payments
+}
+
+// FlushPaymentBatch sends every queued payment in one transaction and empties the queue. If the transaction cannot be
+// created the payments stay queued.
+func (w *Wallet) FlushPaymentBatch(options TxOptions) (*repository.Transaction, []Payment, error) {
+	if w.PaymentBatch.Len() == 0 {
+		return nil, nil, fmt.Errorf("no queued payments to flush")
+	}
+
+	payments := w.PaymentBatch.take()
+
+	tx, _, err := w.CreateTransactionWithOptions(payments, options)
+	if err != nil {
+		w.PaymentBatch.payments = append(payments, w.PaymentBatch.payments...)
+		return nil, nil, err
+	}
+
+	return tx, payments, nil
+}
@@ -0,0 +1,110 @@
+package wallet_test
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestCreatePaymentTransaction(test *testing.T) {
+	test.Run("pays every receiver with one change output", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+		a, b, c := newTestWallet(), newTestWallet(), newTestWallet()
+
+		tx, _, err := sender.CreatePaymentTransaction([]wallet.Payment{
+			{Address: a.Crypt.FirstcoinAddress, Amount: 10},
+			{Address: b.Crypt.FirstcoinAddress, Amount: 20},
+			{Address: c.Crypt.FirstcoinAddress, Amount: 30},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(*tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected valid tx: %+v", err)
+		}
+
+		expected := []repository.TxO{
+			{ScriptPubKey: a.Crypt.ScriptPubKey, Value: 10},
+			{ScriptPubKey: b.Crypt.ScriptPubKey, Value: 20},
+			{ScriptPubKey: c.Crypt.ScriptPubKey, Value: 30},
+			{ScriptPubKey: sender.Crypt.ScriptPubKey, Value: wallet.COINBASE_TRANSACTION_AMOUNT - 60 - wallet.TRANSACTION_FEE},
+		}
+		if len(tx.TxOuts) != len(expected) {
+			t.Fatalf("incorrect number of txOuts. Got: %d. Want: %d", len(tx.TxOuts), len(expected))
+		}
+		for index, txO := range expected {
+			if string(tx.TxOuts[index].ScriptPubKey) != string(txO.ScriptPubKey) || tx.TxOuts[index].Value != txO.Value {
+				t.Fatalf("incorrect txO %d\nGot:%+v\nWant:%+v", index, tx.TxOuts[index], txO)
+			}
+		}
+	})
+
+	test.Run("invalid payments are rejected", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+		receiver := newTestWallet()
+
+		if _, _, err := sender.CreatePaymentTransaction(nil); err == nil {
+			t.Fatalf("expected error for no payments")
+		}
+
+		if _, _, err := sender.CreatePaymentTransaction([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 0}}); err == nil {
+			t.Fatalf("expected error for a zero amount")
+		}
+
+		if _, _, err := sender.CreatePaymentTransaction([]wallet.Payment{
+			{Address: receiver.Crypt.FirstcoinAddress, Amount: 60},
+			{Address: receiver.Crypt.FirstcoinAddress, Amount: 40},
+		}); err == nil {
+			t.Fatalf("expected error: payments and fee exceed the balance")
+		}
+	})
+}
+
+func TestPaymentBatch(test *testing.T) {
+	test.Run("queued payments are flushed in one tx", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+		a, b := newTestWallet(), newTestWallet()
+
+		if err := sender.PaymentBatch.Add(wallet.Payment{Address: a.Crypt.FirstcoinAddress, Amount: 5}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		sender.PaymentBatch.Add(wallet.Payment{Address: b.Crypt.FirstcoinAddress, Amount: 7})
+
+		if err := sender.PaymentBatch.Add(wallet.Payment{Address: []byte("not an address"), Amount: 1}); err == nil {
+			t.Fatalf("expected error for an invalid address")
+		}
+
+		tx, payments, err := sender.FlushPaymentBatch(wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(payments) != 2 || len(tx.TxOuts) != 3 {
+			t.Fatalf("expected 2 payments and change in one tx, got %d payments and %d txOuts", len(payments), len(tx.TxOuts))
+		}
+
+		if sender.PaymentBatch.Len() != 0 {
+			t.Fatalf("expected an empty queue after flush")
+		}
+
+		if _, _, err := sender.FlushPaymentBatch(wallet.TxOptions{}); err == nil {
+			t.Fatalf("expected error flushing an empty queue")
+		}
+	})
+
+	test.Run("payments stay queued if the flush fails", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+		receiver := newTestWallet()
+
+		sender.PaymentBatch.Add(wallet.Payment{Address: receiver.Crypt.FirstcoinAddress, Amount: wallet.COINBASE_TRANSACTION_AMOUNT})
+
+		if _, _, err := sender.FlushPaymentBatch(wallet.TxOptions{}); err == nil {
+			t.Fatalf("expected error: amount leaves nothing for the tx fee")
+		}
+
+		if sender.PaymentBatch.Len() != 1 {
+			t.Fatalf("expected the payment to stay queued")
+		}
+	})
+}
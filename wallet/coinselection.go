@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// DEFAULT_FEE_RATE is the fee rate in coins per 1000 bytes of serialized transaction used when none is given. Whatever
+// the rate, a transaction pays at least TRANSACTION_FEE.
+const DEFAULT_FEE_RATE = 1
+
+const DEFAULT_BRANCH_AND_BOUND_TRIES = 100000
+
+// SpendableUTxO is an output the wallet can fund a transaction with
+type SpendableUTxO struct {
+	TxID     []byte
+	TxOIndex int
+	Value    int
+}
+
+// CoinSelectionTarget is what the selected uTxOs must pay for: Amount to the receivers plus the fee of a transaction
+// of BaseSize bytes without any inputs or change, InputSize bytes per input and ChangeSize bytes for a change output.
+type CoinSelectionTarget struct {
+	Amount     int
+	FeeRate    int
+	BaseSize   int
+	InputSize  int
+	ChangeSize int
+}
+
+// TxFee is the fee of a transaction of size bytes at feeRate coins per 1000 bytes, rounded up
+func TxFee(size int, feeRate int) int {
+	fee := (size*feeRate + 999) / 1000
+	if fee < TRANSACTION_FEE {
+		return TRANSACTION_FEE
+	}
+
+	return fee
+}
+
+// Fee is the fee of the transaction when it spends inputs uTxOs, with or without a change output
+func (t CoinSelectionTarget) Fee(inputs int, withChange bool) int {
+	size := t.BaseSize + inputs*t.InputSize
+	if withChange {
+		size += t.ChangeSize
+	}
+
+	return TxFee(size, t.FeeRate)
+}
+
+// DustThreshold is the smallest change worth creating. Below it more than a third of the change would go to the fee of
+// spending it later, so it is left to the fee instead.
+func (t CoinSelectionTarget) DustThreshold() int {
+	return 3 * ((t.InputSize*t.FeeRate + 999) / 1000)
+}
+
+// CostOfChange is what a change output costs: its own bytes now and the input spending it later
+func (t CoinSelectionTarget) CostOfChange() int {
+	return (t.ChangeSize*t.FeeRate+999)/1000 + (t.InputSize*t.FeeRate+999)/1000
+}
+
+// Change is what goes back to the wallet when spending total. It is 0 when the leftover would be dust, in which case
+// the leftover is added to the fee.
+func (t CoinSelectionTarget) Change(total int, inputs int) int {
+	change := total - t.Amount - t.Fee(inputs, true)
+	if change < t.DustThreshold() || change <= 0 {
+		return 0
+	}
+
+	return change
+}
+
+// covers is true when total pays the amount and the fee of a transaction with that many inputs and no change
+func (t CoinSelectionTarget) covers(total int, inputs int) bool {
+	return total >= t.Amount+t.Fee(inputs, false)
+}
+
+// CoinSelectionStrategy picks which of the uTxOs fund a transaction. Given the same uTxOs a strategy must always make
+// the same selection.
+type CoinSelectionStrategy interface {
+	SelectCoins(uTxOs []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error)
+}
+
+// LargestFirst spends the largest uTxOs first, keeping the number of inputs and so the fee low
+type LargestFirst struct{}
+
+// SmallestFirst spends the smallest uTxOs first, consolidating the wallet at the cost of a higher fee
+type SmallestFirst struct{}
+
+// BranchAndBound searches for a set of uTxOs that pays the target closely enough that no change is needed, ie. the
+// excess is no more than the cost of the change. It gives up after MaxTries steps of the search and falls back to
+// LargestFirst.
+type BranchAndBound struct {
+	MaxTries int
+}
+
+// Privacy avoids linking the wallet's uTxOs together: it spends the single smallest uTxO covering the target, and only
+// when there is none combines as few uTxOs as it can.
+type Privacy struct{}
+
+// CoinSelectionStrategies are the strategies by the name they are chosen with over the api
+func CoinSelectionStrategies() map[string]CoinSelectionStrategy {
+	return map[string]CoinSelectionStrategy{
+		"largest-first":    LargestFirst{},
+		"smallest-first":   SmallestFirst{},
+		"branch-and-bound": BranchAndBound{MaxTries: DEFAULT_BRANCH_AND_BOUND_TRIES},
+		"privacy":          Privacy{},
+	}
+}
+
+// DefaultCoinSelection is the strategy of a new wallet
+func DefaultCoinSelection() CoinSelectionStrategy {
+	return BranchAndBound{MaxTries: DEFAULT_BRANCH_AND_BOUND_TRIES}
+}
+
+// CoinSelectionStrategyByName returns the named strategy, or nil for an empty name, which leaves it to the wallet
+func CoinSelectionStrategyByName(name string) (CoinSelectionStrategy, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	strategy, ok := CoinSelectionStrategies()[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown coin selection strategy %q", name)
+	}
+
+	return strategy, nil
+}
+
+func (LargestFirst) SelectCoins(uTxOs []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error) {
+	sorted := sortUTxOs(uTxOs)
+	reverseUTxOs(sorted)
+
+	return accumulateUTxOs(sorted, target)
+}
+
+func (SmallestFirst) SelectCoins(uTxOs []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error) {
+	return accumulateUTxOs(sortUTxOs(uTxOs), target)
+}
+
+func (s BranchAndBound) SelectCoins(uTxOs []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error) {
+	sorted := sortUTxOs(uTxOs)
+	reverseUTxOs(sorted)
+
+	// remaining[i] is the value of sorted[i:], to prune branches that can no longer reach the target
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Value
+	}
+
+	var best []int
+	bestExcess := 0
+	tries := 0
+	selected := make([]int, 0)
+
+	var search func(index int, total int)
+	search = func(index int, total int) {
+		if tries >= s.MaxTries {
+			return
+		}
+		tries++
+
+		if target.covers(total, len(selected)) {
+			excess := total - target.Amount - target.Fee(len(selected), false)
+			if excess <= target.CostOfChange() && (best == nil || excess < bestExcess) {
+				best = append([]int{}, selected...)
+				bestExcess = excess
+			}
+			// adding more uTxOs only adds to the excess
+			return
+		}
+
+		if index == len(sorted) || total+remaining[index] < target.Amount+target.Fee(len(selected)+1, false) {
+			return
+		}
+
+		selected = append(selected, index)
+		search(index+1, total+sorted[index].Value)
+		selected = selected[:len(selected)-1]
+
+		search(index+1, total)
+	}
+	search(0, 0)
+
+	if best == nil {
+		return LargestFirst{}.SelectCoins(uTxOs, target)
+	}
+
+	selection := make([]SpendableUTxO, 0, len(best))
+	for _, index := range best {
+		selection = append(selection, sorted[index])
+	}
+
+	return selection, nil
+}
+
+func (Privacy) SelectCoins(uTxOs []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error) {
+	for _, uTxO := range sortUTxOs(uTxOs) {
+		if target.covers(uTxO.Value, 1) {
+			return []SpendableUTxO{uTxO}, nil
+		}
+	}
+
+	return LargestFirst{}.SelectCoins(uTxOs, target)
+}
+
+func accumulateUTxOs(sorted []SpendableUTxO, target CoinSelectionTarget) ([]SpendableUTxO, error) {
+	selection := make([]SpendableUTxO, 0)
+	total := 0
+
+	for _, uTxO := range sorted {
+		selection = append(selection, uTxO)
+		total += uTxO.Value
+
+		if target.covers(total, len(selection)) {
+			return selection, nil
+		}
+	}
+
+	if total < target.Amount {
+		return nil, fmt.Errorf("insufficient funds or no available uTxOs")
+	}
+
+	return nil, fmt.Errorf("insufficient funds to include the tx fee of %s", coins(target.Fee(len(selection), false)))
+}
+
+// sortUTxOs orders a copy of uTxOs by value, then tx id and index, so that strategies do not depend on map order
+func sortUTxOs(uTxOs []SpendableUTxO) []SpendableUTxO {
+	sorted := append([]SpendableUTxO{}, uTxOs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Value != sorted[j].Value {
+			return sorted[i].Value < sorted[j].Value
+		}
+		if c := bytes.Compare(sorted[i].TxID, sorted[j].TxID); c != 0 {
+			return c < 0
+		}
+		return sorted[i].TxOIndex < sorted[j].TxOIndex
+	})
+
+	return sorted
+}
+
+func coins(amount int) string {
+	if amount == 1 {
+		return "1 coin"
+	}
+
+	return fmt.Sprintf("%d coins", amount)
+}
+
+func reverseUTxOs(uTxOs []SpendableUTxO) {
+	for i, j := 0, len(uTxOs)-1; i < j; i, j = i+1, j-1 {
+		uTxOs[i], uTxOs[j] = uTxOs[j], uTxOs[i]
+	}
+}
@@ -0,0 +1,240 @@
+package wallet_test
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"reflect"
+	"testing"
+)
+
+// one coin per byte with a single byte per input and change output, so that fees are easy to follow: a transaction with
+// n inputs costs 1+n without change and 2+n with change
+var testTarget = wallet.CoinSelectionTarget{
+	FeeRate:    1000,
+	BaseSize:   1,
+	InputSize:  1,
+	ChangeSize: 1,
+}
+
+func testUTxOs() []wallet.SpendableUTxO {
+	return []wallet.SpendableUTxO{
+		{TxID: []byte("d"), TxOIndex: 0, Value: 8},
+		{TxID: []byte("a"), TxOIndex: 1, Value: 1},
+		{TxID: []byte("f"), TxOIndex: 0, Value: 15},
+		{TxID: []byte("c"), TxOIndex: 2, Value: 5},
+		{TxID: []byte("e"), TxOIndex: 0, Value: 20},
+		{TxID: []byte("b"), TxOIndex: 0, Value: 3},
+	}
+}
+
+func selectedTxIDs(selection []wallet.SpendableUTxO) string {
+	txIDs := ""
+	for _, uTxO := range selection {
+		txIDs += string(uTxO.TxID)
+	}
+
+	return txIDs
+}
+
+func TestCoinSelection(test *testing.T) {
+	target := testTarget
+	target.Amount = 10
+
+	strategies := []struct {
+		name     string
+		strategy wallet.CoinSelectionStrategy
+		want     string
+	}{
+		{"largest-first", wallet.LargestFirst{}, "e"},
+		{"smallest-first", wallet.SmallestFirst{}, "abcd"},
+		{"branch-and-bound", wallet.BranchAndBound{MaxTries: 1000}, "dc"},
+		{"privacy", wallet.Privacy{}, "f"},
+	}
+
+	for _, s := range strategies {
+		test.Run(s.name, func(t *testing.T) {
+			selection, err := s.strategy.SelectCoins(testUTxOs(), target)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if got := selectedTxIDs(selection); got != s.want {
+				t.Fatalf("incorrect selection. Got: %s. Want: %s", got, s.want)
+			}
+
+			named, err := wallet.CoinSelectionStrategyByName(s.name)
+			if err != nil || reflect.TypeOf(named) != reflect.TypeOf(s.strategy) {
+				t.Fatalf("strategy %s not found by name: %+v", s.name, err)
+			}
+		})
+	}
+
+	test.Run("selection does not depend on the order of the uTxOs", func(t *testing.T) {
+		uTxOs := testUTxOs()
+		reversed := make([]wallet.SpendableUTxO, 0, len(uTxOs))
+		for i := len(uTxOs) - 1; i >= 0; i-- {
+			reversed = append(reversed, uTxOs[i])
+		}
+
+		for _, s := range strategies {
+			first, _ := s.strategy.SelectCoins(uTxOs, target)
+			second, _ := s.strategy.SelectCoins(reversed, target)
+			if !reflect.DeepEqual(first, second) {
+				t.Fatalf("%s selection changed with the order of the uTxOs\nGot:%+v\nWant:%+v", s.name, second, first)
+			}
+		}
+	})
+
+	test.Run("ties are broken by tx id", func(t *testing.T) {
+		uTxOs := []wallet.SpendableUTxO{
+			{TxID: []byte("y"), Value: 20},
+			{TxID: []byte("x"), Value: 20},
+		}
+
+		selection, _ := wallet.LargestFirst{}.SelectCoins(uTxOs, target)
+		if got := selectedTxIDs(selection); got != "y" {
+			t.Fatalf("incorrect selection. Got: %s. Want: y", got)
+		}
+
+		selection, _ = wallet.SmallestFirst{}.SelectCoins(uTxOs, target)
+		if got := selectedTxIDs(selection); got != "x" {
+			t.Fatalf("incorrect selection. Got: %s. Want: x", got)
+		}
+	})
+
+	test.Run("branch and bound falls back to largest first", func(t *testing.T) {
+		// neither uTxO pays the 12 coins with no more than 2 coins of excess
+		uTxOs := []wallet.SpendableUTxO{
+			{TxID: []byte("f"), Value: 15},
+			{TxID: []byte("e"), Value: 20},
+		}
+
+		selection, err := wallet.BranchAndBound{MaxTries: 1000}.SelectCoins(uTxOs, target)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if got := selectedTxIDs(selection); got != "e" {
+			t.Fatalf("incorrect selection. Got: %s. Want: e", got)
+		}
+	})
+
+	test.Run("insufficient funds", func(t *testing.T) {
+		tooMuch := target
+		tooMuch.Amount = 100
+		if _, err := (wallet.LargestFirst{}).SelectCoins(testUTxOs(), tooMuch); err == nil || err.Error() != "insufficient funds or no available uTxOs" {
+			t.Fatalf("expected insufficient funds, got: %+v", err)
+		}
+
+		// 52 coins cover the amount but not the fee of 7 for spending all six uTxOs
+		noFee := target
+		noFee.Amount = 51
+		if _, err := (wallet.LargestFirst{}).SelectCoins(testUTxOs(), noFee); err == nil || err.Error() != "insufficient funds to include the tx fee of 7 coins" {
+			t.Fatalf("expected insufficient funds for the fee, got: %+v", err)
+		}
+	})
+
+	test.Run("unknown strategy", func(t *testing.T) {
+		if _, err := wallet.CoinSelectionStrategyByName("random"); err == nil {
+			t.Fatalf("expected error for an unknown strategy")
+		}
+	})
+}
+
+func TestCoinSelectionFees(test *testing.T) {
+	test.Run("fee is the serialized size times the fee rate", func(t *testing.T) {
+		if fee := wallet.TxFee(2500, 1); fee != 3 {
+			t.Fatalf("incorrect fee. Got: %d. Want: 3", fee)
+		}
+
+		if fee := wallet.TxFee(10, 1); fee != wallet.TRANSACTION_FEE {
+			t.Fatalf("expected the minimum fee. Got: %d. Want: %d", fee, wallet.TRANSACTION_FEE)
+		}
+
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		tx, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{
+			UTxOSet: network.uTxOSet,
+			FeeRate: 100,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		totalInput, totalOutput := wallet.CalculateFeeForTx(*tx, network.uTxOSet)
+		fee := totalInput - totalOutput
+		actual := wallet.TxFee(wallet.SerializedSize(*tx), 100)
+		if fee < actual || fee > actual+1 {
+			t.Fatalf("incorrect fee for %d bytes. Got: %d. Want: %d", wallet.SerializedSize(*tx), fee, actual)
+		}
+
+		if err := network.mine(*tx); err != nil {
+			t.Fatalf("tx rejected: %+v", err)
+		}
+	})
+
+	test.Run("dust change is left to the fee", func(t *testing.T) {
+		target := testTarget
+		target.Amount = 10
+
+		if change := target.Change(20, 1); change != 7 {
+			t.Fatalf("incorrect change. Got: %d. Want: 7", change)
+		}
+
+		if change := target.Change(15, 1); change != 0 {
+			t.Fatalf("expected dust change of 2 to be dropped. Got: %d", change)
+		}
+
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		tx, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: wallet.COINBASE_TRANSACTION_AMOUNT - 2}}, wallet.TxOptions{
+			UTxOSet: network.uTxOSet,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(tx.TxOuts) != 1 {
+			t.Fatalf("expected no change output, got: %+v", tx.TxOuts)
+		}
+	})
+
+	test.Run("spends several outputs of the same tx", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		tx, _, _ := sender.CreateTransactionWithOptions([]wallet.Payment{
+			{Address: receiver.Crypt.FirstcoinAddress, Amount: 5},
+			{Address: receiver.Crypt.FirstcoinAddress, Amount: 6},
+		}, wallet.TxOptions{UTxOSet: network.uTxOSet})
+		if err := network.mine(*tx); err != nil {
+			t.Fatalf("tx rejected: %+v", err)
+		}
+
+		spend, _, err := receiver.CreateTransactionWithOptions([]wallet.Payment{{Address: sender.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{
+			UTxOSet:       network.uTxOSet,
+			CoinSelection: wallet.SmallestFirst{},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(spend.TxIns) != 2 || spend.TxIns[0].TxOIndex != 0 || spend.TxIns[1].TxOIndex != 1 {
+			t.Fatalf("expected both outputs spent in index order, got: %+v", spend.TxIns)
+		}
+
+		if err := network.mine(*spend); err != nil {
+			t.Fatalf("tx rejected: %+v", err)
+		}
+
+		if balance := network.balance(receiver); balance != 0 {
+			t.Fatalf("incorrect receiver balance. Got: %d. Want: 0", balance)
+		}
+
+		if len(repository.GetUserLedgerCopy(receiver.Crypt.ScriptPubKey, network.uTxOSet)) != 0 {
+			t.Fatalf("expected the receiver's outputs to be spent")
+		}
+	})
+}
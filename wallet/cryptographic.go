@@ -10,28 +10,35 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
-	"reflect"
-	"strings"
 
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
-type SigHash string
 type Base58CheckVersionPrefix byte
 
 const (
-	sigHashAll SigHash = "ALL"
-
 	bitcoinAddressVersionPrefix Base58CheckVersionPrefix = 0
+	scriptHashVersionPrefix     Base58CheckVersionPrefix = 5
+)
+
+// SignatureVersion is the first byte of every signature and names the digest that was signed. Signatures made before
+// versioning are bare DER, which always starts with the ASN.1 sequence tag 0x30, so they can still be told apart.
+type SignatureVersion byte
+
+const (
+	SignatureVersionLegacyMD5 SignatureVersion = 0x30
+	SignatureVersionSHA256    SignatureVersion = 0x01
 )
 
+// PublicKey is the 33 byte compressed public key. ScriptPubKey is the P2PKH script that locks coins to FirstcoinAddress.
 type Cryptographic struct {
 	PublicKey        []byte
 	PrivateKey       []byte
 	PrivateKeyObject *ecdsa.PrivateKey
 	PublicKeyObject  *ecdsa.PublicKey
 	FirstcoinAddress []byte
+	ScriptPubKey     []byte
 }
 
 func NewCryptographic() *Cryptographic {
@@ -67,93 +74,61 @@ func (c *Cryptographic) GenerateKeyPair() error {
 	c.PrivateKey = pemEncodedPrivKey
 
 	// public key
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publickey)
-	if err != nil {
-		return err
-	}
-
-	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	}
-
-	pemEncodedPubKey := pem.EncodeToMemory(publicKeyBlock)
-	c.PublicKey = pemEncodedPubKey
+	c.PublicKey = elliptic.MarshalCompressed(curve, publickey.X, publickey.Y)
 
-	hash160 := ConvertPublicKeyToHash160(pemEncodedPubKey)
+	hash160 := ConvertPublicKeyToHash160(c.PublicKey)
 
-	c.FirstcoinAddress = []byte(base58.CheckEncode(hash160, 0))
+	c.FirstcoinAddress = []byte(base58.CheckEncode(hash160, byte(bitcoinAddressVersionPrefix)))
+	c.ScriptPubKey = NewP2PKHLockingScript(hash160).Encode()
 
 	return nil
 }
 
+// GenerateSignature signs the double SHA-256 of message. The returned signature is prefixed with its SignatureVersion.
 func (c *Cryptographic) GenerateSignature(message []byte) []byte {
-	msgHashSum := hashMessage(message)
+	msgHashSum, err := MessageDigest(SignatureVersionSHA256, message)
+	if err != nil {
+		panic(err)
+	}
 
 	signature, err := ecdsa.SignASN1(rand.Reader, c.PrivateKeyObject, msgHashSum)
 	if err != nil {
 		panic(err)
 	}
 
-	return signature
+	return append([]byte{byte(SignatureVersionSHA256)}, signature...)
 }
 
-func splitScriptSig(scriptSig []byte) ([]byte, []byte, error) {
-	split := strings.Split(string(scriptSig), fmt.Sprintf("[%s]", sigHashAll))
-	if len(split) != 2 {
-		return nil, nil, fmt.Errorf("invalid format of scriptSig")
+// VerifyMessageSignature checks a versioned signature of message against a compressed public key. Legacy md5
+// signatures only verify with SCRIPT_VERIFY_LEGACY_SIGNATURES.
+func VerifyMessageSignature(publicKey []byte, message []byte, signature []byte, flags ScriptFlags) error {
+	if err := validateCompressedPublicKey(publicKey); err != nil {
+		return fmt.Errorf("error verifying signature: %s", err)
 	}
 
-	return []byte(split[0]), []byte(split[1]), nil
-}
-
-func verifyPublicKeyIsAddress(address, publicKey []byte) error {
-	hash160PublicKey := ConvertPublicKeyToHash160(publicKey)
-
-	result, version, err := base58.CheckDecode(string(address))
-	if err != nil {
-		return err
-	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), publicKey)
+	pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 
-	if version != byte(bitcoinAddressVersionPrefix) {
-		return fmt.Errorf("Unsupported base58 check version prefix %d", version)
+	if len(signature) == 0 {
+		return fmt.Errorf("invalid signature: empty")
 	}
 
-	if !reflect.DeepEqual(result, hash160PublicKey) {
-		return fmt.Errorf("sigScript does not unlock scriptPubKey")
+	version := SignatureVersion(signature[0])
+	derSignature := signature[1:]
+	if version == SignatureVersionLegacyMD5 {
+		if flags&SCRIPT_VERIFY_LEGACY_SIGNATURES == 0 {
+			return fmt.Errorf("invalid signature: legacy md5 signatures are no longer accepted")
+		}
+		// legacy signatures have no version byte, the 0x30 is part of the DER encoding
+		derSignature = signature
 	}
 
-	return nil
-}
-
-func VerifySignature(scriptSig []byte, address []byte, message []byte) error {
-	signature, publicKey, err := splitScriptSig(scriptSig)
+	msgHashSum, err := MessageDigest(version, message)
 	if err != nil {
 		return err
 	}
 
-	if err := verifyPublicKeyIsAddress(address, publicKey); err != nil {
-		return err
-	}
-
-	pemBlock, _ := pem.Decode(publicKey)
-	if pemBlock == nil {
-		return fmt.Errorf("error verifying signature: could not find pemBlock for public key")
-	}
-
-	genericPublicKey, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
-	if err != nil {
-		return fmt.Errorf("error verifying signature: could not parse public key %+v", err)
-	}
-
-	pubKey, ok := genericPublicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("could not cast pubKey to ecdsa pubKey")
-	}
-
-	msgHashSum := hashMessage(message)
-
-	verify := ecdsa.VerifyASN1(pubKey, msgHashSum, []byte(signature))
+	verify := ecdsa.VerifyASN1(pubKey, msgHashSum, derSignature)
 	if !verify {
 		return fmt.Errorf("invalid signature")
 	}
@@ -161,14 +136,19 @@ func VerifySignature(scriptSig []byte, address []byte, message []byte) error {
 	return nil
 }
 
-func hashMessage(msg []byte) []byte {
-	msgHash := md5.New()
-	_, err := msgHash.Write(msg)
-	if err != nil {
-		panic(err)
+// MessageDigest is the hash that gets signed for a signature of the given version.
+func MessageDigest(version SignatureVersion, msg []byte) ([]byte, error) {
+	switch version {
+	case SignatureVersionSHA256:
+		first := sha256.Sum256(msg)
+		second := sha256.Sum256(first[:])
+		return second[:], nil
+	case SignatureVersionLegacyMD5:
+		msgHash := md5.Sum(msg)
+		return msgHash[:], nil
 	}
 
-	return msgHash.Sum(nil)
+	return nil, fmt.Errorf("unsupported signature version %d", version)
 }
 
 func ConvertPublicKeyToHash160(pubKey []byte) []byte {
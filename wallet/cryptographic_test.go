@@ -1,6 +1,8 @@
 package wallet_test
 
 import (
+	"encoding/hex"
+	"firstcoin/repository"
 	"firstcoin/wallet"
 	"testing"
 )
@@ -9,12 +11,84 @@ func TestVerify(t *testing.T) {
 	crypt := wallet.NewCryptographic()
 	crypt.GenerateKeyPair()
 
-	w := wallet.NewWallet(*crypt)
-	message := []byte{12, 23}
+	w := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
+	prevTxO := repository.TxO{
+		ScriptPubKey: crypt.ScriptPubKey,
+		Value:        10,
+	}
+	tx := repository.Transaction{
+		TxIns:  []repository.TxIn{{TxID: []byte{12, 23}, TxOIndex: 0}},
+		TxOuts: []repository.TxO{{ScriptPubKey: crypt.ScriptPubKey, Value: 9}},
+	}
 
-	scriptSig := w.GenerateTxSigScript(message)
+	if err := w.SignTxIn(&tx, 0, prevTxO, wallet.SigHashAll); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
 
-	if err := wallet.VerifySignature(scriptSig, crypt.FirstcoinAddress, message); err != nil {
+	if err := wallet.VerifyScript(tx.TxIns[0].ScriptSignature, tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err != nil {
 		t.Fatalf("signature not confirmed: %+v", err)
 	}
+
+	prevTxO.Value = 11
+	if err := wallet.VerifyScript(tx.TxIns[0].ScriptSignature, tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+		t.Fatalf("expected signature to commit to the spent output value")
+	}
+}
+
+const vectorPublicKey = "027a6055fa6cf642f9f34b43e4010c92c68e6577437fbd9b3fb356ca0c8648b7ab"
+
+func TestMessageDigest(t *testing.T) {
+	vectors := []struct {
+		version wallet.SignatureVersion
+		message string
+		digest  string
+	}{
+		{wallet.SignatureVersionSHA256, "abc", "4f8b42c22dd3729b519ba6f68d2da7cc5b2d606d05daed5ad5128cc03e6c6358"},
+		{wallet.SignatureVersionSHA256, "", "5df6e0e2761359d30a8275058e299fcc0381534545f55cf43e41983f5d4c9456"},
+		{wallet.SignatureVersionLegacyMD5, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+	}
+
+	for _, v := range vectors {
+		digest, err := wallet.MessageDigest(v.version, []byte(v.message))
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if hex.EncodeToString(digest) != v.digest {
+			t.Fatalf("incorrect digest for %q\nGot:%x\nWant:%s", v.message, digest, v.digest)
+		}
+	}
+
+	if _, err := wallet.MessageDigest(wallet.SignatureVersion(0x02), []byte("abc")); err == nil {
+		t.Fatalf("expected error for unknown signature version")
+	}
+}
+
+func TestVerifyMessageSignatureVectors(t *testing.T) {
+	message := []byte("firstcoin")
+	publicKey, _ := hex.DecodeString(vectorPublicKey)
+	sha256Signature, _ := hex.DecodeString("01304402205933e822183e6abe6edca010e5c1a7bf401249916e96e81fcb79ba3f3fa0f9af02200e3a7105877de28b4f56a9d847c2b564bca564bcd694299c5d6641b92bd41e16")
+	md5Signature, _ := hex.DecodeString("3045022024231da6282481939ff090d14c8f852417a098e94c6499a15b6643fcd493bd13022100c4009d5816c31334dc9fa849d5aacae61847eb352eceac7c18066f6adc295707")
+
+	legacy := wallet.SCRIPT_VERIFY_LEGACY_SIGNATURES
+
+	if err := wallet.VerifyMessageSignature(publicKey, message, sha256Signature, legacy); err != nil {
+		t.Fatalf("sha256 signature not confirmed: %+v", err)
+	}
+
+	if err := wallet.VerifyMessageSignature(publicKey, []byte("firstcoim"), sha256Signature, legacy); err == nil {
+		t.Fatalf("expected error for altered message")
+	}
+
+	if err := wallet.VerifyMessageSignature(publicKey, message, md5Signature, legacy); err != nil {
+		t.Fatalf("legacy md5 signature not confirmed: %+v", err)
+	}
+
+	if err := wallet.VerifyMessageSignature(publicKey, message, md5Signature, wallet.SCRIPT_VERIFY_NONE); err == nil {
+		t.Fatalf("expected legacy md5 signature to be rejected")
+	}
+
+	if err := wallet.VerifyMessageSignature(publicKey, message, sha256Signature, wallet.SCRIPT_VERIFY_NONE); err != nil {
+		t.Fatalf("sha256 signature not confirmed: %+v", err)
+	}
 }
@@ -0,0 +1,98 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"firstcoin/repository"
+	"fmt"
+	"time"
+)
+
+// DataCarrierPayload returns the data anchored by a data carrier scriptPubKey
+func DataCarrierPayload(scriptPubKey []byte) ([]byte, bool) {
+	lockingScript, err := ParseLockingScript(scriptPubKey)
+	if err != nil || lockingScript.Type != ScriptTypeNullData {
+		return nil, false
+	}
+
+	return lockingScript.Data, true
+}
+
+// PruneUnspendableTxOs returns tx with its unspendable outputs replaced by empty ones, which is what is stored in the
+// uTxO set. The other outputs keep their index, and the tx is left out of the set if it has none.
+func PruneUnspendableTxOs(tx repository.Transaction) repository.Transaction {
+	txOuts := make([]repository.TxO, 0, len(tx.TxOuts))
+
+	for _, txOut := range tx.TxOuts {
+		lockingScript, err := ParseLockingScript(txOut.ScriptPubKey)
+		if err == nil && lockingScript.IsUnspendable() {
+			txOut = repository.TxO{}
+		}
+		txOuts = append(txOuts, txOut)
+	}
+
+	tx.TxOuts = txOuts
+	return tx
+}
+
+// hasUnspentTxOs is true when tx has an output that can still be spent
+func hasUnspentTxOs(tx repository.Transaction) bool {
+	for _, txOut := range tx.TxOuts {
+		if !txOut.IsSpent() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CommitmentHash is the commitment published for a document: its sha256 hash
+func CommitmentHash(document []byte) []byte {
+	hash := sha256.Sum256(document)
+	return hash[:]
+}
+
+// CreateDataCarrierTransaction anchors data on chain. The tx only spends enough of the wallet's coins to pay the tx fee,
+// sending the change back to the wallet, and carries the data in its last output.
+func (w *Wallet) CreateDataCarrierTransaction(data []byte, uTxOSet repository.UTxOSetType) (*repository.Transaction, error) {
+	if len(data) == 0 || len(data) > MAX_DATA_CARRIER_SIZE {
+		return nil, fmt.Errorf("data carrier must hold between 1 and %d bytes, got %d", MAX_DATA_CARRIER_SIZE, len(data))
+	}
+
+	txIDIndexPairs, totalAmount, err := w.findUTxOs(w.Crypt.ScriptPubKey, 0, uTxOSet)
+	if err != nil {
+		return nil, err
+	}
+
+	txIns := make([]repository.TxIn, 0)
+	for _, txIDIndexPair := range txIDIndexPairs {
+		txIns = append(txIns, repository.TxIn{
+			TxID:     txIDIndexPair.TxID,
+			TxOIndex: txIDIndexPair.TxOIndex,
+		})
+	}
+
+	txOuts := make([]repository.TxO, 0)
+	if change := totalAmount - TRANSACTION_FEE; change > 0 {
+		txOuts = append(txOuts, repository.TxO{
+			ScriptPubKey: w.Crypt.ScriptPubKey,
+			Value:        change,
+		})
+	}
+	txOuts = append(txOuts, repository.TxO{
+		ScriptPubKey: NewDataCarrierLockingScript(data).Encode(),
+		Value:        0,
+	})
+
+	tx := repository.Transaction{
+		TxIns:     txIns,
+		TxOuts:    txOuts,
+		Timestamp: int(time.Now().UnixNano()),
+	}
+	tx.ID = GenerateTransactionID(tx)
+
+	if _, err := w.SignTransaction(&tx, uTxOSet, SigHashAll); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
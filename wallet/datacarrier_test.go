@@ -0,0 +1,118 @@
+package wallet_test
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestDataCarrier(test *testing.T) {
+	test.Run("script round trips and is unspendable", func(t *testing.T) {
+		scriptPubKey := wallet.NewDataCarrierLockingScript([]byte("hello")).Encode()
+
+		lockingScript, err := wallet.ParseLockingScript(scriptPubKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !lockingScript.IsUnspendable() || !bytes.Equal(lockingScript.Data, []byte("hello")) {
+			t.Fatalf("expected unspendable data carrier, got %+v", lockingScript)
+		}
+
+		if _, err := wallet.AddressFromScriptPubKey(scriptPubKey); err == nil {
+			t.Fatalf("expected error: data carriers have no address")
+		}
+
+		tooLong := wallet.NewDataCarrierLockingScript(make([]byte, wallet.MAX_DATA_CARRIER_SIZE+1)).Encode()
+		if _, err := wallet.ParseLockingScript(tooLong); err == nil {
+			t.Fatalf("expected error for data over %d bytes", wallet.MAX_DATA_CARRIER_SIZE)
+		}
+	})
+
+	test.Run("data carrier outputs must hold no coins and be alone", func(t *testing.T) {
+		dataTxO := repository.TxO{ScriptPubKey: wallet.NewDataCarrierLockingScript([]byte{1}).Encode()}
+
+		if err := wallet.AreValidTxOuts([]repository.TxO{dataTxO}); err != nil {
+			t.Fatalf("expected zero value data carrier to be valid: %+v", err)
+		}
+
+		if err := wallet.AreValidTxOuts([]repository.TxO{dataTxO, dataTxO}); err == nil {
+			t.Fatalf("expected error for two data carriers")
+		}
+
+		dataTxO.Value = 1
+		if err := wallet.AreValidTxOuts([]repository.TxO{dataTxO}); err == nil {
+			t.Fatalf("expected error for coins sent to a data carrier")
+		}
+	})
+
+	test.Run("publish a document commitment", func(t *testing.T) {
+		publisher, _ := newFundedWallet()
+		commitment := wallet.CommitmentHash([]byte("my document"))
+
+		tx, err := publisher.CreateDataCarrierTransaction(commitment, testUTxOSet.Copy())
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(*tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected valid tx: %+v", err)
+		}
+
+		if len(tx.TxOuts) != 2 || tx.TxOuts[0].Value != wallet.COINBASE_TRANSACTION_AMOUNT-wallet.TRANSACTION_FEE {
+			t.Fatalf("expected the change to go back to the publisher, got %+v", tx.TxOuts)
+		}
+
+		data, ok := wallet.DataCarrierPayload(tx.TxOuts[1].ScriptPubKey)
+		if !ok || !bytes.Equal(data, commitment) {
+			t.Fatalf("expected the commitment in the last output")
+		}
+
+		pruned := wallet.PruneUnspendableTxOs(*tx)
+		if len(pruned.TxOuts) != 2 || pruned.TxOuts[0].Value != tx.TxOuts[0].Value || !pruned.TxOuts[1].IsSpent() || !bytes.Equal(pruned.ID, tx.ID) {
+			t.Fatalf("expected only the change output to be spendable in the uTxO set, got %+v", pruned.TxOuts)
+		}
+	})
+
+	test.Run("outputs after a data carrier keep their index", func(t *testing.T) {
+		owner, receiver := newTestWallet(), newTestWallet()
+		tx := repository.Transaction{
+			TxIns: []repository.TxIn{{TxID: []byte{1}, TxOIndex: 0}},
+			TxOuts: []repository.TxO{
+				{ScriptPubKey: wallet.NewDataCarrierLockingScript([]byte{1}).Encode()},
+				{ScriptPubKey: owner.Crypt.ScriptPubKey, Value: 10},
+			},
+		}
+		tx.ID = wallet.GenerateTransactionID(tx)
+
+		uTxOSet := make(repository.UTxOSetType)
+		wallet.ApplyTransactionCopy(tx, uTxOSet, 1, 0)
+
+		spend := repository.Transaction{
+			TxIns:  []repository.TxIn{{TxID: tx.ID, TxOIndex: 1}},
+			TxOuts: []repository.TxO{{ScriptPubKey: receiver.Crypt.ScriptPubKey, Value: 9}},
+		}
+		spend.ID = wallet.GenerateTransactionID(spend)
+		if _, err := owner.SignTransaction(&spend, uTxOSet, wallet.SigHashAll); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(spend, uTxOSet, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected the output at index 1 to be spendable: %+v", err)
+		}
+	})
+
+	test.Run("data carrier cannot be spent", func(t *testing.T) {
+		owner := newTestWallet()
+		prevTxO := repository.TxO{ScriptPubKey: wallet.NewDataCarrierLockingScript([]byte{1}).Encode()}
+		tx := repository.Transaction{
+			TxIns:  []repository.TxIn{{TxID: []byte{1}, TxOIndex: 0}},
+			TxOuts: []repository.TxO{{ScriptPubKey: owner.Crypt.ScriptPubKey, Value: 1}},
+		}
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddInt(1).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error spending a data carrier")
+		}
+	})
+}
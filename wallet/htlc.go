@@ -0,0 +1,236 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"firstcoin/repository"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+const htlcSecretLength = 32
+
+// HTLC is a hash time-locked contract. The receiver can spend the output by revealing the preimage of SecretHash, and once
+// Locktime is reached the funder can take it back with a refund. The contract is paid to as a P2SH address of:
+//
+//	OP_IF
+//		OP_SHA256 <secret hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <receiver hash>
+//	OP_ELSE
+//		<locktime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund hash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+type HTLC struct {
+	SecretHash   []byte `json:"secretHash"`
+	ReceiverHash []byte `json:"receiverHash"`
+	RefundHash   []byte `json:"refundHash"`
+	Locktime     int    `json:"locktime"`
+}
+
+// NewHTLCSecret returns a random secret and its sha256 hash to lock an HTLC with
+func NewHTLCSecret() ([]byte, []byte, error) {
+	secret := make([]byte, htlcSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+
+	secretHash := sha256.Sum256(secret)
+	return secret, secretHash[:], nil
+}
+
+// NewHTLC locks coins to receiverAddress behind secretHash, refundable to refundAddress from locktime on. Both addresses
+// must be pay-to-public-key-hash addresses.
+func NewHTLC(secretHash []byte, receiverAddress []byte, refundAddress []byte, locktime int) (HTLC, error) {
+	if len(secretHash) != sha256.Size {
+		return HTLC{}, fmt.Errorf("invalid htlc: secret hash must be %d bytes, got %d", sha256.Size, len(secretHash))
+	}
+
+	if locktime <= 0 {
+		return HTLC{}, fmt.Errorf("invalid htlc: locktime must be > 0")
+	}
+
+	receiverHash, err := publicKeyHashFromAddress(receiverAddress)
+	if err != nil {
+		return HTLC{}, fmt.Errorf("invalid htlc receiver: %s", err)
+	}
+
+	refundHash, err := publicKeyHashFromAddress(refundAddress)
+	if err != nil {
+		return HTLC{}, fmt.Errorf("invalid htlc refund: %s", err)
+	}
+
+	return HTLC{
+		SecretHash:   secretHash,
+		ReceiverHash: receiverHash,
+		RefundHash:   refundHash,
+		Locktime:     locktime,
+	}, nil
+}
+
+func publicKeyHashFromAddress(address []byte) ([]byte, error) {
+	scriptPubKey, err := ScriptPubKeyFromAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	lockingScript, _ := ParseLockingScript(scriptPubKey)
+	if lockingScript.Type != ScriptTypeP2PKH {
+		return nil, fmt.Errorf("address %s is not a public key hash address", address)
+	}
+
+	return lockingScript.Hash, nil
+}
+
+func (h HTLC) RedeemScript() []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SHA256).AddData(h.SecretHash).AddOp(OP_EQUALVERIFY).AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.ReceiverHash).
+		AddOp(OP_ELSE).
+		AddInt(int64(h.Locktime)).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.RefundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+func (h HTLC) ScriptPubKey() []byte {
+	return NewP2SHLockingScript(h.RedeemScript()).Encode()
+}
+
+func (h HTLC) Address() []byte {
+	return []byte(base58.CheckEncode(ConvertPublicKeyToHash160(h.RedeemScript()), byte(scriptHashVersionPrefix)))
+}
+
+// ParseHTLC recovers the contract terms from a redeem script, so that the counterparty of a swap can audit the contract
+// it is paid through before acting on it.
+func ParseHTLC(redeemScript []byte) (HTLC, error) {
+	ops, err := parseScript(redeemScript)
+	if err != nil {
+		return HTLC{}, fmt.Errorf("invalid htlc: %s", err)
+	}
+
+	if len(ops) != 17 {
+		return HTLC{}, fmt.Errorf("invalid htlc: unexpected script length")
+	}
+
+	locktime, err := decodeScriptNumber(ops[8].data)
+	if ops[8].opcode >= OP_1 && ops[8].opcode <= OP_16 {
+		locktime, err = int64(ops[8].opcode-OP_1+1), nil
+	}
+	if err != nil {
+		return HTLC{}, fmt.Errorf("invalid htlc locktime: %s", err)
+	}
+
+	htlc := HTLC{
+		SecretHash:   ops[2].data,
+		ReceiverHash: ops[6].data,
+		RefundHash:   ops[13].data,
+		Locktime:     int(locktime),
+	}
+
+	// the terms are only valid if they rebuild exactly the same script
+	if len(htlc.SecretHash) != sha256.Size || len(htlc.ReceiverHash) != hash160Length || len(htlc.RefundHash) != hash160Length ||
+		htlc.Locktime <= 0 || !bytes.Equal(htlc.RedeemScript(), redeemScript) {
+		return HTLC{}, fmt.Errorf("invalid htlc: script does not match the htlc template")
+	}
+
+	return htlc, nil
+}
+
+// ExtractHTLCSecret finds the claim of the htlc in tx and returns the secret it revealed. In an atomic swap this is how
+// the initiator's counterparty learns the secret it needs to claim its own side of the swap.
+func ExtractHTLCSecret(tx repository.Transaction, htlc HTLC) ([]byte, error) {
+	redeemScript := htlc.RedeemScript()
+
+	for _, txIn := range tx.TxIns {
+		ops, err := parseScript(txIn.ScriptSignature)
+		if err != nil || len(ops) != 5 || !bytes.Equal(ops[4].data, redeemScript) {
+			continue
+		}
+
+		secretHash := sha256.Sum256(ops[2].data)
+		if bytes.Equal(secretHash[:], htlc.SecretHash) {
+			return ops[2].data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("tx does not claim the htlc")
+}
+
+// FundHTLC pays amount into the htlc. The contract output is the first output of the returned transaction.
+func (w *Wallet) FundHTLC(htlc HTLC, amount int, options TxOptions) (*repository.Transaction, error) {
+	tx, _, err := w.CreateTransactionWithOptions([]Payment{{Address: htlc.Address(), Amount: amount}}, options)
+	return tx, err
+}
+
+// ClaimHTLCTransaction spends the htlc output at txID:txOIndex to receiverAddress by revealing the secret. Only the
+// htlc's receiver can sign the claim.
+func (w *Wallet) ClaimHTLCTransaction(htlc HTLC, txID []byte, txOIndex int, secret []byte, receiverAddress []byte, uTxOSet repository.UTxOSetType) (*repository.Transaction, error) {
+	secretHash := sha256.Sum256(secret)
+	if !bytes.Equal(secretHash[:], htlc.SecretHash) {
+		return nil, fmt.Errorf("secret does not match the htlc secret hash")
+	}
+
+	if !bytes.Equal(htlc.ReceiverHash, ConvertPublicKeyToHash160(w.Crypt.PublicKey)) {
+		return nil, fmt.Errorf("wallet is not the receiver of the htlc")
+	}
+
+	return w.spendHTLC(htlc, txID, txOIndex, receiverAddress, 0, uTxOSet, func(b *ScriptBuilder) {
+		b.AddData(secret).AddInt(1)
+	})
+}
+
+// RefundHTLCTransaction returns the htlc output at txID:txOIndex to receiverAddress. The transaction's locktime is the
+// htlc locktime, so it is only accepted once the htlc has expired.
+func (w *Wallet) RefundHTLCTransaction(htlc HTLC, txID []byte, txOIndex int, receiverAddress []byte, uTxOSet repository.UTxOSetType) (*repository.Transaction, error) {
+	if !bytes.Equal(htlc.RefundHash, ConvertPublicKeyToHash160(w.Crypt.PublicKey)) {
+		return nil, fmt.Errorf("wallet is not the refund address of the htlc")
+	}
+
+	return w.spendHTLC(htlc, txID, txOIndex, receiverAddress, htlc.Locktime, uTxOSet, func(b *ScriptBuilder) {
+		b.AddOp(OP_0)
+	})
+}
+
+// spendHTLC builds the scriptSig <signature> <public key> <branch selector pushes> <redeem script>
+func (w *Wallet) spendHTLC(htlc HTLC, txID []byte, txOIndex int, receiverAddress []byte, locktime int, uTxOSet repository.UTxOSetType, branch func(*ScriptBuilder)) (*repository.Transaction, error) {
+	txIn := repository.TxIn{TxID: txID, TxOIndex: txOIndex}
+
+	prevTxO, err := getUTxOFromTxIn(txIn, uTxOSet)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(prevTxO.ScriptPubKey, htlc.ScriptPubKey()) {
+		return nil, fmt.Errorf("output is not locked to the htlc")
+	}
+
+	if prevTxO.Value <= TRANSACTION_FEE {
+		return nil, fmt.Errorf("htlc output of %d does not cover the tx fee", prevTxO.Value)
+	}
+
+	receiverScriptPubKey, err := ScriptPubKeyFromAddress(receiverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := repository.Transaction{
+		TxIns:     []repository.TxIn{txIn},
+		TxOuts:    []repository.TxO{{ScriptPubKey: receiverScriptPubKey, Value: prevTxO.Value - TRANSACTION_FEE}},
+		Locktime:  locktime,
+		Timestamp: int(time.Now().UnixNano()),
+	}
+	tx.ID = GenerateTransactionID(tx)
+
+	signature, err := w.ScriptSignatureForTxIn(tx, 0, *prevTxO, SigHashAll)
+	if err != nil {
+		return nil, err
+	}
+
+	scriptSig := NewScriptBuilder().AddData(signature).AddData(w.Crypt.PublicKey)
+	branch(scriptSig)
+	tx.TxIns[0].ScriptSignature = scriptSig.AddData(htlc.RedeemScript()).Script()
+
+	return &tx, nil
+}
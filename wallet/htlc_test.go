@@ -0,0 +1,32 @@
+package wallet_test
+
+import (
+	"bytes"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestHTLC(test *testing.T) {
+	test.Run("redeem script round trips", func(t *testing.T) {
+		receiver, refund := newTestWallet(), newTestWallet()
+		_, secretHash, _ := wallet.NewHTLCSecret()
+
+		htlc, err := wallet.NewHTLC(secretHash, receiver.Crypt.FirstcoinAddress, refund.Crypt.FirstcoinAddress, 1000)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		parsed, err := wallet.ParseHTLC(htlc.RedeemScript())
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !bytes.Equal(parsed.RedeemScript(), htlc.RedeemScript()) || parsed.Locktime != 1000 {
+			t.Fatalf("parsed htlc does not match\nGot:%+v\nWant:%+v", parsed, htlc)
+		}
+
+		if _, err := wallet.ParseHTLC(wallet.NewScriptBuilder().AddInt(1).Script()); err == nil {
+			t.Fatalf("expected error for a non-htlc script")
+		}
+	})
+}
@@ -0,0 +1,603 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"firstcoin/repository"
+	"fmt"
+)
+
+// opcodes share their byte values with bitcoin script so scripts can be read with the usual tooling
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c
+	OP_PUSHDATA2           byte = 0x4d
+	OP_1                   byte = 0x51
+	OP_16                  byte = 0x60
+	OP_IF                  byte = 0x63
+	OP_NOTIF               byte = 0x64
+	OP_ELSE                byte = 0x67
+	OP_ENDIF               byte = 0x68
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_HASH160             byte = 0xa9
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+// ScriptFlags are the rules scripts are verified with that change with the block they are in, set by the chain params
+type ScriptFlags uint32
+
+const (
+	SCRIPT_VERIFY_NONE ScriptFlags = 0
+	// SCRIPT_VERIFY_LEGACY_SIGNATURES lets md5 signatures verify while the network migrates to SignatureVersionSHA256
+	SCRIPT_VERIFY_LEGACY_SIGNATURES ScriptFlags = 1 << 0
+)
+
+const (
+	maxScriptSize         = 10000
+	maxScriptElementSize  = 520
+	maxStackSize          = 1000
+	maxOpsPerScript       = 201
+	maxPubKeysPerMultisig = 20
+)
+
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func (o scriptOp) isPush() bool {
+	return o.opcode <= OP_PUSHDATA2 || (o.opcode >= OP_1 && o.opcode <= OP_16)
+}
+
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("script of %d bytes exceeds max size %d", len(script), maxScriptSize)
+	}
+
+	ops := make([]scriptOp, 0)
+	for len(script) > 0 {
+		opcode := script[0]
+		script = script[1:]
+
+		length := 0
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			length = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if len(script) < 1 {
+				return nil, fmt.Errorf("OP_PUSHDATA1 missing length")
+			}
+			length = int(script[0])
+			script = script[1:]
+		case opcode == OP_PUSHDATA2:
+			if len(script) < 2 {
+				return nil, fmt.Errorf("OP_PUSHDATA2 missing length")
+			}
+			length = int(script[0]) | int(script[1])<<8
+			script = script[2:]
+		}
+
+		if len(script) < length {
+			return nil, fmt.Errorf("push of %d bytes but only %d remain", length, len(script))
+		}
+
+		ops = append(ops, scriptOp{opcode: opcode, data: script[:length]})
+		script = script[length:]
+	}
+
+	return ops, nil
+}
+
+type scriptEngine struct {
+	tx         repository.Transaction
+	inputIndex int
+	prevTxO    repository.TxO
+	flags      ScriptFlags
+	stack      [][]byte
+	condStack  []bool
+	opCount    int
+}
+
+// VerifyScript runs the unlocking scriptSig followed by the locking script of prevTxO for the input at inputIndex of tx.
+// The input is valid if both run without error and leave a true value on top of the stack.
+func VerifyScript(scriptSig []byte, tx repository.Transaction, inputIndex int, prevTxO repository.TxO, flags ScriptFlags) error {
+	lockingScript, err := ParseLockingScript(prevTxO.ScriptPubKey)
+	if err != nil {
+		return err
+	}
+
+	unlockingOps, err := parseScript(scriptSig)
+	if err != nil {
+		return fmt.Errorf("invalid scriptSig: %s", err)
+	}
+
+	for _, op := range unlockingOps {
+		if !op.isPush() {
+			return fmt.Errorf("invalid scriptSig: only data pushes are allowed")
+		}
+	}
+
+	engine := &scriptEngine{
+		tx:         tx,
+		inputIndex: inputIndex,
+		prevTxO:    prevTxO,
+		flags:      flags,
+		stack:      make([][]byte, 0),
+	}
+
+	if err := engine.execute(unlockingOps); err != nil {
+		return fmt.Errorf("scriptSig failed: %s", err)
+	}
+
+	// the pushes of the scriptSig are kept aside for P2SH, where they are the inputs of the redeem script
+	scriptSigStack := append([][]byte{}, engine.stack...)
+
+	lockingOps, err := parseScript(lockingScript.Script())
+	if err != nil {
+		return fmt.Errorf("invalid scriptPubKey: %s", err)
+	}
+
+	if err := engine.execute(lockingOps); err != nil {
+		return fmt.Errorf("scriptPubKey failed: %s", err)
+	}
+
+	if len(engine.stack) == 0 || !castToBool(engine.stack[len(engine.stack)-1]) {
+		return fmt.Errorf("sigScript does not unlock scriptPubKey")
+	}
+
+	if lockingScript.Type != ScriptTypeP2SH {
+		return nil
+	}
+
+	// the hash matched, so the last push is the redeem script
+	redeemScript := scriptSigStack[len(scriptSigStack)-1]
+	engine.stack = scriptSigStack[:len(scriptSigStack)-1]
+
+	redeemOps, err := parseScript(redeemScript)
+	if err != nil {
+		return fmt.Errorf("invalid redeem script: %s", err)
+	}
+
+	if err := engine.execute(redeemOps); err != nil {
+		return fmt.Errorf("redeem script failed: %s", err)
+	}
+
+	if len(engine.stack) == 0 || !castToBool(engine.stack[len(engine.stack)-1]) {
+		return fmt.Errorf("sigScript does not unlock redeem script")
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) execute(ops []scriptOp) error {
+	e.condStack = e.condStack[:0]
+	e.opCount = 0
+
+	for _, op := range ops {
+		if len(op.data) > maxScriptElementSize {
+			return fmt.Errorf("push of %d bytes exceeds max element size", len(op.data))
+		}
+
+		if !op.isPush() {
+			e.opCount++
+			if e.opCount > maxOpsPerScript {
+				return fmt.Errorf("script exceeds %d operations", maxOpsPerScript)
+			}
+		}
+
+		if err := e.step(op); err != nil {
+			return err
+		}
+
+		if len(e.stack) > maxStackSize {
+			return fmt.Errorf("stack exceeds %d elements", maxStackSize)
+		}
+	}
+
+	if len(e.condStack) != 0 {
+		return fmt.Errorf("unbalanced conditional")
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) executing() bool {
+	for _, cond := range e.condStack {
+		if !cond {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *scriptEngine) step(op scriptOp) error {
+	// flow control is always evaluated so that nested IF/ENDIF pairs in skipped branches stay balanced
+	switch op.opcode {
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if e.executing() {
+			top, err := e.pop()
+			if err != nil {
+				return err
+			}
+			cond = castToBool(top)
+			if op.opcode == OP_NOTIF {
+				cond = !cond
+			}
+		}
+		e.condStack = append(e.condStack, cond)
+		return nil
+	case OP_ELSE:
+		if len(e.condStack) == 0 {
+			return fmt.Errorf("OP_ELSE without OP_IF")
+		}
+		e.condStack[len(e.condStack)-1] = !e.condStack[len(e.condStack)-1]
+		return nil
+	case OP_ENDIF:
+		if len(e.condStack) == 0 {
+			return fmt.Errorf("OP_ENDIF without OP_IF")
+		}
+		e.condStack = e.condStack[:len(e.condStack)-1]
+		return nil
+	}
+
+	if !e.executing() {
+		return nil
+	}
+
+	switch {
+	case op.opcode <= OP_PUSHDATA2:
+		e.push(op.data)
+		return nil
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		e.push(encodeScriptNumber(int64(op.opcode - OP_1 + 1)))
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_VERIFY:
+		return e.verify()
+	case OP_RETURN:
+		return fmt.Errorf("OP_RETURN")
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		e.push(top)
+		return nil
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.pushBool(bytes.Equal(a, b))
+		if op.opcode == OP_EQUALVERIFY {
+			return e.verify()
+		}
+		return nil
+	case OP_SHA256:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		e.push(hash[:])
+		return nil
+	case OP_HASH160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(ConvertPublicKeyToHash160(top))
+		return nil
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		publicKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.pushBool(e.checkSig(signature, publicKey))
+		if op.opcode == OP_CHECKSIGVERIFY {
+			return e.verify()
+		}
+		return nil
+	case OP_CHECKMULTISIG:
+		return e.checkMultisig()
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLocktimeVerify()
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequenceVerify()
+	}
+
+	return fmt.Errorf("unknown opcode 0x%02x", op.opcode)
+}
+
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+func (e *scriptEngine) pushBool(b bool) {
+	if b {
+		e.push([]byte{1})
+		return
+	}
+	e.push([]byte{})
+}
+
+func (e *scriptEngine) peek() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("stack underflow")
+	}
+
+	return e.stack[len(e.stack)-1], nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	top, err := e.peek()
+	if err != nil {
+		return nil, err
+	}
+	e.stack = e.stack[:len(e.stack)-1]
+
+	return top, nil
+}
+
+func (e *scriptEngine) popNumber() (int64, error) {
+	top, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeScriptNumber(top)
+}
+
+func (e *scriptEngine) verify() error {
+	top, err := e.pop()
+	if err != nil {
+		return err
+	}
+
+	if !castToBool(top) {
+		return fmt.Errorf("verify failed")
+	}
+
+	return nil
+}
+
+// a signature stack element is the versioned signature followed by the sighash byte
+func (e *scriptEngine) checkSig(signature []byte, publicKey []byte) bool {
+	if len(signature) < 2 {
+		return false
+	}
+
+	hashType := SigHashType(signature[len(signature)-1])
+	sigHash, err := SignatureHash(e.tx, e.inputIndex, e.prevTxO, hashType)
+	if err != nil {
+		return false
+	}
+
+	return VerifyMessageSignature(publicKey, sigHash, signature[:len(signature)-1], e.flags) == nil
+}
+
+// stack: <dummy> <sig 1> ... <sig m> <m> <pubkey 1> ... <pubkey n> <n>. Signatures must be in the same order as the public
+// keys they belong to. The dummy element must be empty, as in bitcoin's NULLDUMMY rule.
+func (e *scriptEngine) checkMultisig() error {
+	n, err := e.popNumber()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > maxPubKeysPerMultisig {
+		return fmt.Errorf("invalid multisig public key count %d", n)
+	}
+
+	// as in bitcoin, every public key counts as an operation
+	e.opCount += int(n)
+	if e.opCount > maxOpsPerScript {
+		return fmt.Errorf("script exceeds %d operations", maxOpsPerScript)
+	}
+
+	publicKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if publicKeys[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	m, err := e.popNumber()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return fmt.Errorf("invalid multisig signature count %d of %d", m, n)
+	}
+
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	dummy, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if len(dummy) != 0 {
+		return fmt.Errorf("multisig dummy element must be empty")
+	}
+
+	keyIndex := 0
+	for _, signature := range signatures {
+		for keyIndex < len(publicKeys) && !e.checkSig(signature, publicKeys[keyIndex]) {
+			keyIndex++
+		}
+
+		if keyIndex == len(publicKeys) {
+			e.pushBool(false)
+			return nil
+		}
+		keyIndex++
+	}
+
+	e.pushBool(true)
+	return nil
+}
+
+// the top of the stack is the earliest locktime at which the output can be spent. The transaction's own locktime must be
+// of the same kind (height or time) and at least as late, and the input must not be final, which would let the tx be
+// mined before its locktime. The element is left on the stack.
+func (e *scriptEngine) checkLocktimeVerify() error {
+	top, err := e.peek()
+	if err != nil {
+		return err
+	}
+
+	locktime, err := decodeScriptNumber(top)
+	if err != nil {
+		return err
+	}
+
+	if locktime < 0 {
+		return fmt.Errorf("negative locktime")
+	}
+
+	txLocktime := int64(e.tx.Locktime)
+	if (locktime < LOCKTIME_THRESHOLD) != (txLocktime < LOCKTIME_THRESHOLD) {
+		return fmt.Errorf("locktime kind mismatch")
+	}
+
+	if locktime > txLocktime {
+		return fmt.Errorf("locktime requirement not satisfied")
+	}
+
+	if e.tx.TxIns[e.inputIndex].Sequence == SEQUENCE_FINAL {
+		return fmt.Errorf("input sequence is final, the locktime is not enforced")
+	}
+
+	return nil
+}
+
+// the top of the stack is the relative timelock the output must have matured for. The spending input's sequence must have
+// the lock enabled, be of the same kind (blocks or time) and be at least as long. The element is left on the stack.
+func (e *scriptEngine) checkSequenceVerify() error {
+	top, err := e.peek()
+	if err != nil {
+		return err
+	}
+
+	sequence, err := decodeScriptNumber(top)
+	if err != nil {
+		return err
+	}
+
+	if sequence < 0 {
+		return fmt.Errorf("negative sequence")
+	}
+
+	if sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return nil
+	}
+
+	txSequence := int64(e.tx.TxIns[e.inputIndex].Sequence)
+	if txSequence < 0 || txSequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return fmt.Errorf("relative locktime disabled on input")
+	}
+
+	if (sequence&SEQUENCE_LOCKTIME_TYPE_FLAG != 0) != (txSequence&SEQUENCE_LOCKTIME_TYPE_FLAG != 0) {
+		return fmt.Errorf("sequence kind mismatch")
+	}
+
+	if sequence&SEQUENCE_LOCKTIME_MASK > txSequence&SEQUENCE_LOCKTIME_MASK {
+		return fmt.Errorf("sequence requirement not satisfied")
+	}
+
+	return nil
+}
+
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// negative zero is false
+			if i == len(data)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// script numbers are little endian with the sign in the high bit of the last byte, as in bitcoin
+func encodeScriptNumber(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	result := make([]byte, 0)
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+func decodeScriptNumber(data []byte) (int64, error) {
+	if len(data) > 5 {
+		return 0, fmt.Errorf("script number of %d bytes is too long", len(data))
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+
+	return result, nil
+}
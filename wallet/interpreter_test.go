@@ -0,0 +1,217 @@
+package wallet_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUTxOSet and testTxPool are the state of the node the test wallets share
+var (
+	testUTxOSet = repository.NewUTxOSet()
+	testTxPool  = repository.NewTxPool()
+)
+
+func newTestWallet() *wallet.Wallet {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	return wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
+}
+
+// testNetwork is the uTxO set and chain height the wallet tests mine on, with blocks that apply the same transaction and
+// timelock validation as a node
+type testNetwork struct {
+	uTxOSet    repository.UTxOSetType
+	blockIndex int
+}
+
+func newTestNetwork(wallets ...*wallet.Wallet) *testNetwork {
+	n := &testNetwork{uTxOSet: make(repository.UTxOSetType)}
+
+	for _, w := range wallets {
+		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(w.Crypt, 0)
+		repository.AddTxToUTxOSetCopy(coinbaseTx, n.uTxOSet)
+	}
+
+	return n
+}
+
+func (n *testNetwork) mine(txs ...repository.Transaction) error {
+	blockIndex := n.blockIndex + 1
+	now := int(time.Now().UnixNano())
+
+	for _, tx := range txs {
+		if err := wallet.IsValidTransactionCopy(tx, n.uTxOSet, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			return err
+		}
+
+		if err := wallet.IsFinalTransaction(tx, blockIndex, now); err != nil {
+			return err
+		}
+
+		if err := wallet.CheckSequenceLocks(tx, n.uTxOSet, blockIndex, now); err != nil {
+			return err
+		}
+
+		repository.RemoveTxOsFromUTxOCopy(repository.TxIDType(tx.ID), tx.TxIns, n.uTxOSet)
+		tx.BlockIndex = blockIndex
+		tx.BlockTimestamp = now
+		repository.AddTxToUTxOSetCopy(tx, n.uTxOSet)
+	}
+
+	n.blockIndex = blockIndex
+	return nil
+}
+
+func (n *testNetwork) mineEmptyBlocks(count int) {
+	n.blockIndex += count
+}
+
+func (n *testNetwork) balance(w *wallet.Wallet) int {
+	total := 0
+	for _, tx := range repository.GetUserLedgerCopy(w.Crypt.ScriptPubKey, n.uTxOSet) {
+		for _, txO := range tx.TxOuts {
+			if bytes.Equal(txO.ScriptPubKey, w.Crypt.ScriptPubKey) {
+				total += txO.Value
+			}
+		}
+	}
+
+	return total
+}
+
+func scriptSpend(lockingScript []byte, locktime int) (repository.Transaction, repository.TxO) {
+	prevTxO := repository.TxO{
+		ScriptPubKey: wallet.NewScriptLockingScript(lockingScript).Encode(),
+		Value:        10,
+	}
+
+	tx := repository.Transaction{
+		TxIns:    []repository.TxIn{{TxID: []byte{1}, TxOIndex: 0}},
+		TxOuts:   []repository.TxO{{ScriptPubKey: []byte{2}, Value: 9}},
+		Locktime: locktime,
+	}
+
+	return tx, prevTxO
+}
+
+func TestVerifyScript(test *testing.T) {
+	test.Run("hash lock", func(t *testing.T) {
+		preimage := []byte("secret")
+		hash := sha256.Sum256(preimage)
+		tx, prevTxO := scriptSpend(wallet.NewScriptBuilder().AddOp(wallet.OP_SHA256).AddData(hash[:]).AddOp(wallet.OP_EQUAL).Script(), 0)
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(preimage).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected preimage to unlock: %+v", err)
+		}
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData([]byte("guess")).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for wrong preimage")
+		}
+	})
+
+	test.Run("2-of-3 multisig", func(t *testing.T) {
+		a, b, c := newTestWallet(), newTestWallet(), newTestWallet()
+		tx, prevTxO := scriptSpend(wallet.NewScriptBuilder().
+			AddInt(2).AddData(a.Crypt.PublicKey).AddData(b.Crypt.PublicKey).AddData(c.Crypt.PublicKey).AddInt(3).
+			AddOp(wallet.OP_CHECKMULTISIG).Script(), 0)
+
+		sigA, _ := a.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+		sigC, _ := c.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddOp(wallet.OP_0).AddData(sigA).AddData(sigC).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected 2 signatures to unlock: %+v", err)
+		}
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddOp(wallet.OP_0).AddData(sigC).AddData(sigA).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for signatures out of key order")
+		}
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddOp(wallet.OP_0).AddData(sigA).AddData(sigA).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for the same signature used twice")
+		}
+	})
+
+	test.Run("multisig public keys count towards the operations limit", func(t *testing.T) {
+		// 10 multisigs of 20 keys are 20 operations, and 220 once their keys are counted
+		builder := wallet.NewScriptBuilder()
+		for i := 0; i < 10; i++ {
+			builder.AddOp(wallet.OP_0).AddInt(0)
+			for key := 0; key < 20; key++ {
+				builder.AddData([]byte{byte(key)})
+			}
+			builder.AddInt(20).AddOp(wallet.OP_CHECKMULTISIG).AddOp(wallet.OP_DROP)
+		}
+		tx, prevTxO := scriptSpend(builder.AddInt(1).Script(), 0)
+
+		if err := wallet.VerifyScript(nil, tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil || !strings.Contains(err.Error(), "operations") {
+			t.Fatalf("expected the operations limit to be exceeded, got: %v", err)
+		}
+	})
+
+	test.Run("IF/ELSE escrow", func(t *testing.T) {
+		buyer, seller := newTestWallet(), newTestWallet()
+		tx, prevTxO := scriptSpend(wallet.NewScriptBuilder().
+			AddOp(wallet.OP_IF).AddData(buyer.Crypt.PublicKey).
+			AddOp(wallet.OP_ELSE).AddData(seller.Crypt.PublicKey).
+			AddOp(wallet.OP_ENDIF).AddOp(wallet.OP_CHECKSIG).Script(), 0)
+
+		sellerSig, _ := seller.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(sellerSig).AddOp(wallet.OP_0).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected seller to unlock the ELSE branch: %+v", err)
+		}
+
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(sellerSig).AddInt(1).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for seller signature in the buyer branch")
+		}
+	})
+
+	test.Run("CHECKLOCKTIMEVERIFY", func(t *testing.T) {
+		owner := newTestWallet()
+		lockingScript := wallet.NewScriptBuilder().AddInt(100).AddOp(wallet.OP_CHECKLOCKTIMEVERIFY).AddOp(wallet.OP_DROP).
+			AddData(owner.Crypt.PublicKey).AddOp(wallet.OP_CHECKSIG).Script()
+
+		for locktime, valid := range map[int]bool{99: false, 100: true, wallet.LOCKTIME_THRESHOLD: false} {
+			tx, prevTxO := scriptSpend(lockingScript, locktime)
+			sig, _ := owner.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+
+			err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(sig).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE)
+			if valid && err != nil {
+				t.Fatalf("locktime %d: expected valid: %+v", locktime, err)
+			}
+			if !valid && err == nil {
+				t.Fatalf("locktime %d: expected error", locktime)
+			}
+		}
+
+		// a final input would let the tx be mined before its locktime
+		tx, prevTxO := scriptSpend(lockingScript, 100)
+		tx.TxIns[0].Sequence = wallet.SEQUENCE_FINAL
+		sig, _ := owner.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+		if err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(sig).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for an input with a final sequence")
+		}
+	})
+
+	test.Run("scriptSig must be push only", func(t *testing.T) {
+		tx, prevTxO := scriptSpend(wallet.NewScriptBuilder().AddInt(1).Script(), 0)
+
+		if err := wallet.VerifyScript([]byte{wallet.OP_DUP}, tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for non-push scriptSig")
+		}
+	})
+
+	test.Run("unbalanced conditional", func(t *testing.T) {
+		tx, prevTxO := scriptSpend(wallet.NewScriptBuilder().AddInt(1).AddOp(wallet.OP_IF).AddInt(1).Script(), 0)
+
+		if err := wallet.VerifyScript(nil, tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error for OP_IF without OP_ENDIF")
+		}
+	})
+}
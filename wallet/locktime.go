@@ -0,0 +1,251 @@
+package wallet
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"fmt"
+	"time"
+)
+
+const (
+	// locktimes below this are block heights, at or above it they are unix timestamps in seconds
+	LOCKTIME_THRESHOLD = 500000000
+
+	// relative timelocks follow BIP68: setting SEQUENCE_LOCKTIME_DISABLE_FLAG turns the lock off, otherwise the low 16
+	// bits are the number of blocks, or of 512 second units if SEQUENCE_LOCKTIME_TYPE_FLAG is set, that the spent output
+	// must have been confirmed for
+	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    = 1 << 22
+	SEQUENCE_LOCKTIME_MASK         = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY  = 512
+
+	// SEQUENCE_FINAL on an input opts it out of the locktime of its tx, a tx whose inputs all have it is final whatever its
+	// locktime. It has SEQUENCE_LOCKTIME_DISABLE_FLAG set, so it has no relative timelock either.
+	SEQUENCE_FINAL = 0xffffffff
+)
+
+// IsFinalTransaction reports whether tx may be included in the block at blockIndex with blockTimestamp (in nanoseconds).
+// A zero locktime is always final, and so is a tx whose inputs all have SEQUENCE_FINAL.
+func IsFinalTransaction(tx repository.Transaction, blockIndex int, blockTimestamp int) error {
+	if tx.Locktime < 0 {
+		return fmt.Errorf("invalid locktime %d", tx.Locktime)
+	}
+
+	if err := checkLocktime(tx.Locktime, blockIndex, blockTimestamp); err != nil && !hasFinalTxIns(tx) {
+		return err
+	}
+
+	return nil
+}
+
+// checkLocktime reports whether locktime has passed in the block at blockIndex with blockTimestamp (in nanoseconds)
+func checkLocktime(locktime int, blockIndex int, blockTimestamp int) error {
+	if locktime == 0 {
+		return nil
+	}
+
+	if locktime < LOCKTIME_THRESHOLD {
+		if blockIndex < locktime {
+			return fmt.Errorf("transaction is locked until block %d", locktime)
+		}
+		return nil
+	}
+
+	if blockTimestamp/int(time.Second) < locktime {
+		return fmt.Errorf("transaction is locked until %s", time.Unix(int64(locktime), 0).UTC())
+	}
+
+	return nil
+}
+
+func hasFinalTxIns(tx repository.Transaction) bool {
+	for _, txIn := range tx.TxIns {
+		if txIn.Sequence != SEQUENCE_FINAL {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckSequenceLocks enforces the relative timelock of every input of tx against the block the spent output was confirmed
+// in, as recorded on the transaction in uTxOSet.
+func CheckSequenceLocks(tx repository.Transaction, uTxOSet repository.UTxOSetType, blockIndex int, blockTimestamp int) error {
+	for index, txIn := range tx.TxIns {
+		if txIn.Sequence < 0 || txIn.Sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			continue
+		}
+
+		spentTx, ok := uTxOSet[repository.TxIDType(txIn.TxID)]
+		if !ok {
+			return fmt.Errorf("txIn %d: no tx in set for txID", index)
+		}
+
+		lock := txIn.Sequence & SEQUENCE_LOCKTIME_MASK
+		if txIn.Sequence&SEQUENCE_LOCKTIME_TYPE_FLAG != 0 {
+			unlocksAt := spentTx.BlockTimestamp + lock*SEQUENCE_LOCKTIME_GRANULARITY*int(time.Second)
+			if blockTimestamp < unlocksAt {
+				return fmt.Errorf("txIn %d is locked until %s", index, time.Unix(0, int64(unlocksAt)).UTC())
+			}
+			continue
+		}
+
+		if blockIndex < spentTx.BlockIndex+lock {
+			return fmt.Errorf("txIn %d is locked until block %d", index, spentTx.BlockIndex+lock)
+		}
+	}
+
+	return nil
+}
+
+// AreTransactionsFinal checks the absolute and relative timelocks of every transaction to be included in a block, skipping
+// the coinbase transaction.
+func AreTransactionsFinal(txs []repository.Transaction, uTxOSet repository.UTxOSetType, blockIndex int, blockTimestamp int) error {
+	// a tx spending the output of an earlier tx in the block sees it as confirmed in this block
+	uTxOSet = repository.CopyUTxOSetFrom(uTxOSet)
+
+	for index, tx := range txs {
+		if index == 0 {
+			continue
+		}
+
+		if err := IsFinalTransaction(tx, blockIndex, blockTimestamp); err != nil {
+			return err
+		}
+
+		if err := CheckSequenceLocks(tx, uTxOSet, blockIndex, blockTimestamp); err != nil {
+			return err
+		}
+
+		if hasUTxOsForTxIns(tx, uTxOSet) {
+			ApplyTransactionCopy(tx, uTxOSet, blockIndex, blockTimestamp)
+		}
+	}
+
+	return nil
+}
+
+// NewVestingLockingScript pays to a P2PKH address that can only spend the output from lockUntil on:
+// <lockUntil> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG
+func NewVestingLockingScript(lockUntil int, address []byte) (LockingScript, error) {
+	if lockUntil <= 0 {
+		return LockingScript{}, fmt.Errorf("invalid vesting locktime %d", lockUntil)
+	}
+
+	scriptPubKey, err := ScriptPubKeyFromAddress(address)
+	if err != nil {
+		return LockingScript{}, err
+	}
+
+	lockingScript, _ := ParseLockingScript(scriptPubKey)
+	if lockingScript.Type != ScriptTypeP2PKH {
+		return LockingScript{}, fmt.Errorf("vesting outputs can only pay to a public key hash address")
+	}
+
+	return NewScriptLockingScript(vestingScript(lockUntil, lockingScript.Hash)), nil
+}
+
+func vestingScript(lockUntil int, hash160 []byte) []byte {
+	return NewScriptBuilder().AddInt(int64(lockUntil)).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(hash160).AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// parseVestingScript returns the locktime and public key hash of a vesting scriptPubKey
+func parseVestingScript(scriptPubKey []byte) (int, []byte, bool) {
+	lockingScript, err := ParseLockingScript(scriptPubKey)
+	if err != nil || lockingScript.Type != ScriptTypeScript {
+		return 0, nil, false
+	}
+
+	ops, err := parseScript(lockingScript.Raw)
+	if err != nil || len(ops) != 8 || !ops[0].isPush() || len(ops[5].data) != hash160Length {
+		return 0, nil, false
+	}
+
+	lockUntil, err := decodeScriptNumber(ops[0].data)
+	if ops[0].opcode >= OP_1 && ops[0].opcode <= OP_16 {
+		lockUntil, err = int64(ops[0].opcode-OP_1+1), nil
+	}
+	if err != nil || lockUntil <= 0 {
+		return 0, nil, false
+	}
+
+	if !bytes.Equal(vestingScript(int(lockUntil), ops[5].data), lockingScript.Raw) {
+		return 0, nil, false
+	}
+
+	return int(lockUntil), ops[5].data, true
+}
+
+// VestingUTxO is an output paid to this wallet through a vesting script
+type VestingUTxO struct {
+	TxID      []byte `json:"txid"`
+	TxOIndex  int    `json:"vout"`
+	Value     int    `json:"value"`
+	LockUntil int    `json:"lockUntil"`
+}
+
+// GetVestingUTxOs lists the vesting outputs in the uTxO set that this wallet can claim once they unlock
+func (w *Wallet) GetVestingUTxOs() []VestingUTxO {
+	hash160 := ConvertPublicKeyToHash160(w.Crypt.PublicKey)
+	vesting := make([]VestingUTxO, 0)
+
+	for _, tx := range w.UTxOSet.Copy() {
+		for index, txO := range tx.TxOuts {
+			lockUntil, hash, ok := parseVestingScript(txO.ScriptPubKey)
+			if !ok || !bytes.Equal(hash, hash160) {
+				continue
+			}
+
+			vesting = append(vesting, VestingUTxO{
+				TxID:      tx.ID,
+				TxOIndex:  index,
+				Value:     txO.Value,
+				LockUntil: lockUntil,
+			})
+		}
+	}
+
+	return vesting
+}
+
+// ClaimVestingTransaction spends a vesting output of this wallet to receiverAddress, less the tx fee. The transaction's
+// locktime is set to the vesting locktime, so it is only accepted once that block height or time is reached.
+func (w *Wallet) ClaimVestingTransaction(txID []byte, txOIndex int, receiverAddress []byte) (*repository.Transaction, error) {
+	txIn := repository.TxIn{TxID: txID, TxOIndex: txOIndex}
+
+	prevTxO, err := getUTxOFromTxIn(txIn, w.UTxOSet.Copy())
+	if err != nil {
+		return nil, err
+	}
+
+	lockUntil, hash, ok := parseVestingScript(prevTxO.ScriptPubKey)
+	if !ok || !bytes.Equal(hash, ConvertPublicKeyToHash160(w.Crypt.PublicKey)) {
+		return nil, fmt.Errorf("output is not a vesting output of this wallet")
+	}
+
+	if prevTxO.Value <= TRANSACTION_FEE {
+		return nil, fmt.Errorf("vesting output of %d does not cover the tx fee", prevTxO.Value)
+	}
+
+	receiverScriptPubKey, err := ScriptPubKeyFromAddress(receiverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := repository.Transaction{
+		TxIns:     []repository.TxIn{txIn},
+		TxOuts:    []repository.TxO{{ScriptPubKey: receiverScriptPubKey, Value: prevTxO.Value - TRANSACTION_FEE}},
+		Locktime:  lockUntil,
+		Timestamp: int(time.Now().UnixNano()),
+	}
+	tx.ID = GenerateTransactionID(tx)
+
+	signature, err := w.ScriptSignatureForTxIn(tx, 0, *prevTxO, SigHashAll)
+	if err != nil {
+		return nil, err
+	}
+	tx.TxIns[0].ScriptSignature = NewScriptBuilder().AddData(signature).AddData(w.Crypt.PublicKey).Script()
+
+	return &tx, nil
+}
@@ -0,0 +1,177 @@
+package wallet_test
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsFinalTransaction(test *testing.T) {
+	lockTime := int(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC).Unix())
+	before := int(time.Date(2029, time.December, 31, 0, 0, 0, 0, time.UTC).UnixNano())
+	after := int(time.Date(2030, time.January, 2, 0, 0, 0, 0, time.UTC).UnixNano())
+
+	cases := []struct {
+		name           string
+		locktime       int
+		blockIndex     int
+		blockTimestamp int
+		final          bool
+	}{
+		{"zero locktime", 0, 1, before, true},
+		{"before block height", 10, 9, after, false},
+		{"at block height", 10, 10, before, true},
+		{"before time", lockTime, 1000, before, false},
+		{"after time", lockTime, 1, after, true},
+	}
+
+	for _, c := range cases {
+		test.Run(c.name, func(t *testing.T) {
+			err := wallet.IsFinalTransaction(repository.Transaction{Locktime: c.locktime, TxIns: []repository.TxIn{{}}}, c.blockIndex, c.blockTimestamp)
+			if c.final && err != nil {
+				t.Fatalf("expected final: %+v", err)
+			}
+			if !c.final && err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+
+	test.Run("inputs with a final sequence", func(t *testing.T) {
+		tx := repository.Transaction{Locktime: 10, TxIns: []repository.TxIn{{Sequence: wallet.SEQUENCE_FINAL}, {Sequence: wallet.SEQUENCE_FINAL}}}
+		if err := wallet.IsFinalTransaction(tx, 9, before); err != nil {
+			t.Fatalf("expected final: %+v", err)
+		}
+
+		tx.TxIns[1].Sequence = 0
+		if err := wallet.IsFinalTransaction(tx, 9, before); err == nil {
+			t.Fatalf("expected error with an input that is not final")
+		}
+	})
+}
+
+func TestCheckSequenceLocks(test *testing.T) {
+	confirmedAt := int(time.Date(2021, time.August, 13, 0, 0, 0, 0, time.UTC).UnixNano())
+	uTxOSet := repository.UTxOSetType{
+		"confirmed": {ID: []byte("confirmed"), BlockIndex: 5, BlockTimestamp: confirmedAt},
+	}
+	spend := func(sequence int) repository.Transaction {
+		return repository.Transaction{TxIns: []repository.TxIn{{TxID: []byte("confirmed"), Sequence: sequence}}}
+	}
+
+	test.Run("block based", func(t *testing.T) {
+		if err := wallet.CheckSequenceLocks(spend(3), uTxOSet, 7, confirmedAt); err == nil {
+			t.Fatalf("expected error: only 2 blocks since confirmation")
+		}
+
+		if err := wallet.CheckSequenceLocks(spend(3), uTxOSet, 8, confirmedAt); err != nil {
+			t.Fatalf("expected unlocked: %+v", err)
+		}
+	})
+
+	test.Run("time based", func(t *testing.T) {
+		sequence := wallet.SEQUENCE_LOCKTIME_TYPE_FLAG | 2
+		unlocksAt := confirmedAt + 2*wallet.SEQUENCE_LOCKTIME_GRANULARITY*int(time.Second)
+
+		if err := wallet.CheckSequenceLocks(spend(sequence), uTxOSet, 100, unlocksAt-1); err == nil {
+			t.Fatalf("expected error before 1024 seconds")
+		}
+
+		if err := wallet.CheckSequenceLocks(spend(sequence), uTxOSet, 6, unlocksAt); err != nil {
+			t.Fatalf("expected unlocked: %+v", err)
+		}
+	})
+
+	test.Run("disabled", func(t *testing.T) {
+		if err := wallet.CheckSequenceLocks(spend(wallet.SEQUENCE_LOCKTIME_DISABLE_FLAG|100), uTxOSet, 5, confirmedAt); err != nil {
+			t.Fatalf("expected disabled lock to pass: %+v", err)
+		}
+	})
+}
+
+func TestCheckSequenceVerify(t *testing.T) {
+	owner := newTestWallet()
+	lockingScript := wallet.NewScriptBuilder().AddInt(10).AddOp(wallet.OP_CHECKSEQUENCEVERIFY).AddOp(wallet.OP_DROP).
+		AddData(owner.Crypt.PublicKey).AddOp(wallet.OP_CHECKSIG).Script()
+
+	for sequence, valid := range map[int]bool{
+		9:                                       false,
+		10:                                      true,
+		wallet.SEQUENCE_LOCKTIME_TYPE_FLAG | 10: false,
+		wallet.SEQUENCE_LOCKTIME_DISABLE_FLAG | 10: false,
+	} {
+		tx, prevTxO := scriptSpend(lockingScript, 0)
+		tx.TxIns[0].Sequence = sequence
+		sig, _ := owner.ScriptSignatureForTxIn(tx, 0, prevTxO, wallet.SigHashAll)
+
+		err := wallet.VerifyScript(wallet.NewScriptBuilder().AddData(sig).Script(), tx, 0, prevTxO, wallet.SCRIPT_VERIFY_NONE)
+		if valid && err != nil {
+			t.Fatalf("sequence %d: expected valid: %+v", sequence, err)
+		}
+		if !valid && err == nil {
+			t.Fatalf("sequence %d: expected error", sequence)
+		}
+	}
+}
+
+func TestTransactionIDCommitsToSequence(t *testing.T) {
+	tx := repository.Transaction{TxIns: []repository.TxIn{{TxID: []byte{1}}}}
+	id := wallet.GenerateTransactionID(tx)
+
+	tx.TxIns[0].Sequence = 1
+	if reflect.DeepEqual(id, wallet.GenerateTransactionID(tx)) {
+		t.Fatalf("expected a different tx id for a different sequence")
+	}
+}
+
+func TestVesting(t *testing.T) {
+	sender, _ := newFundedWallet()
+	receiver := newTestWallet()
+	lockUntil := 50
+
+	vestingTx, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 20}}, wallet.TxOptions{LockUntil: lockUntil})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if err := wallet.IsValidTransactionCopy(*vestingTx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+		t.Fatalf("expected valid vesting tx: %+v", err)
+	}
+	testUTxOSet.Add(*vestingTx)
+
+	vesting := receiver.GetVestingUTxOs()
+	if len(vesting) != 1 || vesting[0].Value != 20 || vesting[0].LockUntil != lockUntil {
+		t.Fatalf("expected one vesting output of 20 until %d, got %+v", lockUntil, vesting)
+	}
+
+	if _, err := sender.ClaimVestingTransaction(vestingTx.ID, 0, sender.Crypt.FirstcoinAddress); err == nil {
+		t.Fatalf("expected error: sender cannot claim the receiver's vesting output")
+	}
+
+	claimTx, err := receiver.ClaimVestingTransaction(vesting[0].TxID, vesting[0].TxOIndex, receiver.Crypt.FirstcoinAddress)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if err := wallet.IsValidTransactionCopy(*claimTx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+		t.Fatalf("expected valid claim tx: %+v", err)
+	}
+
+	now := int(time.Now().UnixNano())
+	if err := wallet.IsFinalTransaction(*claimTx, lockUntil-1, now); err == nil {
+		t.Fatalf("expected claim tx to be locked before block %d", lockUntil)
+	}
+
+	if err := wallet.IsFinalTransaction(*claimTx, lockUntil, now); err != nil {
+		t.Fatalf("expected claim tx to be final at block %d: %+v", lockUntil, err)
+	}
+
+	// spending early with a lower locktime fails the script's CHECKLOCKTIMEVERIFY
+	claimTx.Locktime = lockUntil - 1
+	claimTx.ID = wallet.GenerateTransactionID(*claimTx)
+	if err := wallet.IsValidTransactionCopy(*claimTx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err == nil {
+		t.Fatalf("expected error for a locktime before the vesting locktime")
+	}
+}
@@ -0,0 +1,384 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"firstcoin/repository"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// 15 compressed keys keep the redeem script within the 520 byte push limit
+const maxMultisigKeys = 15
+
+// Multisig is an M-of-N pay-to-script-hash address. Coins sent to Address can only be spent with signatures from M of
+// the N PublicKeys. The keys are kept sorted so every cosigner derives the same address whatever order they list them in.
+type Multisig struct {
+	M            int      `json:"m"`
+	PublicKeys   [][]byte `json:"publicKeys"`
+	RedeemScript []byte   `json:"redeemScript"`
+	Address      []byte   `json:"address"`
+}
+
+func NewMultisig(m int, publicKeys [][]byte) (Multisig, error) {
+	if len(publicKeys) == 0 || len(publicKeys) > maxMultisigKeys {
+		return Multisig{}, fmt.Errorf("multisig needs between 1 and %d public keys, got %d", maxMultisigKeys, len(publicKeys))
+	}
+
+	if m < 1 || m > len(publicKeys) {
+		return Multisig{}, fmt.Errorf("multisig needs between 1 and %d signatures, got %d", len(publicKeys), m)
+	}
+
+	sortedKeys := make([][]byte, len(publicKeys))
+	copy(sortedKeys, publicKeys)
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		return bytes.Compare(sortedKeys[i], sortedKeys[j]) < 0
+	})
+
+	for i, publicKey := range sortedKeys {
+		if err := validateCompressedPublicKey(publicKey); err != nil {
+			return Multisig{}, fmt.Errorf("invalid multisig public key: %s", err)
+		}
+
+		if i > 0 && bytes.Equal(sortedKeys[i-1], publicKey) {
+			return Multisig{}, fmt.Errorf("duplicate multisig public key %x", publicKey)
+		}
+	}
+
+	builder := NewScriptBuilder().AddInt(int64(m))
+	for _, publicKey := range sortedKeys {
+		builder.AddData(publicKey)
+	}
+	redeemScript := builder.AddInt(int64(len(sortedKeys))).AddOp(OP_CHECKMULTISIG).Script()
+
+	lockingScript := NewP2SHLockingScript(redeemScript)
+
+	return Multisig{
+		M:            m,
+		PublicKeys:   sortedKeys,
+		RedeemScript: redeemScript,
+		Address:      []byte(base58.CheckEncode(lockingScript.Hash, byte(scriptHashVersionPrefix))),
+	}, nil
+}
+
+func (m Multisig) ScriptPubKey() []byte {
+	return NewP2SHLockingScript(m.RedeemScript).Encode()
+}
+
+// parseMultisigRedeemScript reads back the M and public keys of a redeem script made by NewMultisig
+func parseMultisigRedeemScript(redeemScript []byte) (Multisig, error) {
+	ops, err := parseScript(redeemScript)
+	if err != nil {
+		return Multisig{}, err
+	}
+
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return Multisig{}, fmt.Errorf("redeem script is not a multisig script")
+	}
+
+	publicKeys := make([][]byte, 0)
+	for _, op := range ops[1 : len(ops)-2] {
+		publicKeys = append(publicKeys, op.data)
+	}
+
+	m := int(ops[0].opcode) - int(OP_1) + 1
+	n := int(ops[len(ops)-2].opcode) - int(OP_1) + 1
+	if n != len(publicKeys) {
+		return Multisig{}, fmt.Errorf("redeem script is not a multisig script")
+	}
+
+	multisig, err := NewMultisig(m, publicKeys)
+	if err != nil {
+		return Multisig{}, err
+	}
+
+	if !bytes.Equal(multisig.RedeemScript, redeemScript) {
+		return Multisig{}, fmt.Errorf("redeem script is not a standard multisig script")
+	}
+
+	return multisig, nil
+}
+
+// PartiallySignedInput carries what a cosigner needs to sign one input without access to the UTxO set: the output being
+// spent, its redeem script if it is a multisig output, and the signatures collected so far keyed by hex public key.
+type PartiallySignedInput struct {
+	PrevTxO      repository.TxO    `json:"prevTxO"`
+	RedeemScript []byte            `json:"redeemScript,omitempty"`
+	Signatures   map[string][]byte `json:"signatures,omitempty"`
+}
+
+// PartiallySignedTransaction is passed between cosigners until every multisig input has enough signatures, at which
+// point Finalize turns it in to a transaction that can be broadcast.
+type PartiallySignedTransaction struct {
+	Tx     repository.Transaction `json:"tx"`
+	Inputs []PartiallySignedInput `json:"inputs"`
+}
+
+func NewPartiallySignedTransaction(tx repository.Transaction, uTxOSet repository.UTxOSetType) (*PartiallySignedTransaction, error) {
+	inputs := make([]PartiallySignedInput, 0)
+
+	for _, txIn := range tx.TxIns {
+		uTxO, err := getUTxOFromTxIn(txIn, uTxOSet)
+		if err != nil {
+			return nil, err
+		}
+
+		inputs = append(inputs, PartiallySignedInput{
+			PrevTxO:    *uTxO,
+			Signatures: make(map[string][]byte),
+		})
+	}
+
+	return &PartiallySignedTransaction{
+		Tx:     tx,
+		Inputs: inputs,
+	}, nil
+}
+
+// AddMultisig starts tracking an M-of-N address. The wallet can sign for it if its own public key is one of the N.
+func (w *Wallet) AddMultisig(m int, publicKeys [][]byte) (Multisig, error) {
+	multisig, err := NewMultisig(m, publicKeys)
+	if err != nil {
+		return Multisig{}, err
+	}
+
+	w.Multisigs[string(multisig.Address)] = multisig
+
+	return multisig, nil
+}
+
+// CreateMultisigTransaction pays amount from a tracked multisig address to receiverAddress at feeRate coins per 1000
+// bytes, or DEFAULT_FEE_RATE for 0, sending change back to the multisig address, and adds this wallet's signatures. The
+// result still needs signatures from the other cosigners.
+func (w *Wallet) CreateMultisigTransaction(multisigAddress []byte, receiverAddress []byte, amount int, feeRate int) (*PartiallySignedTransaction, error) {
+	multisig, ok := w.Multisigs[string(multisigAddress)]
+	if !ok {
+		return nil, fmt.Errorf("wallet is not tracking multisig address %s", multisigAddress)
+	}
+
+	if feeRate == 0 {
+		feeRate = DEFAULT_FEE_RATE
+	}
+	if feeRate < 0 {
+		return nil, fmt.Errorf("fee rate must be >= 0")
+	}
+
+	receiverScriptPubKey, err := ScriptPubKeyFromAddress(receiverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	txOuts := []repository.TxO{{ScriptPubKey: receiverScriptPubKey, Value: amount}}
+	target := newCoinSelectionTarget(txOuts, feeRate, multisig.ScriptPubKey())
+	target.InputSize = estimatedMultisigInputSize(multisig)
+
+	uTxOSet := w.UTxOSet.Copy()
+	selection, err := LargestFirst{}.SelectCoins(spendableUTxOs(multisig.ScriptPubKey(), uTxOSet, w.spentOutpoints()), target)
+	if err != nil {
+		return nil, err
+	}
+
+	totalAmount := 0
+	txIns := make([]repository.TxIn, 0, len(selection))
+	for _, txIDIndexPair := range orderTxIns(selection) {
+		txIns = append(txIns, repository.TxIn{
+			TxOIndex: txIDIndexPair.TxOIndex,
+			TxID:     txIDIndexPair.TxID,
+		})
+	}
+	for _, uTxO := range selection {
+		totalAmount += uTxO.Value
+	}
+
+	if change := target.Change(totalAmount, len(txIns)); change > 0 {
+		txOuts = append(txOuts, repository.TxO{
+			ScriptPubKey: multisig.ScriptPubKey(),
+			Value:        change,
+		})
+	}
+
+	transaction := repository.Transaction{
+		TxIns:     txIns,
+		TxOuts:    txOuts,
+		Timestamp: int(time.Now().UnixNano()),
+	}
+	transaction.ID = GenerateTransactionID(transaction)
+
+	pst, err := NewPartiallySignedTransaction(transaction, uTxOSet)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.SignPartiallySignedTransaction(pst, SigHashAll); err != nil {
+		return nil, err
+	}
+
+	return pst, nil
+}
+
+// SignPartiallySignedTransaction adds this wallet's signature to every input it can sign: P2PKH inputs it owns are signed
+// in place, multisig inputs it is a cosigner of get a signature added to the input's collected signatures.
+func (w *Wallet) SignPartiallySignedTransaction(pst *PartiallySignedTransaction, hashType SigHashType) (int, error) {
+	if len(pst.Inputs) != len(pst.Tx.TxIns) {
+		return 0, fmt.Errorf("partially signed tx has %d inputs but tx has %d", len(pst.Inputs), len(pst.Tx.TxIns))
+	}
+
+	signed := 0
+	for index := range pst.Inputs {
+		input := &pst.Inputs[index]
+
+		lockingScript, err := ParseLockingScript(input.PrevTxO.ScriptPubKey)
+		if err != nil {
+			return signed, err
+		}
+
+		switch lockingScript.Type {
+		case ScriptTypeP2PKH:
+			if !uTxOBelongsToSpender(input.PrevTxO, w.Crypt.ScriptPubKey) {
+				continue
+			}
+
+			if err := w.SignTxIn(&pst.Tx, index, input.PrevTxO, hashType); err != nil {
+				return signed, err
+			}
+			signed++
+		case ScriptTypeP2SH:
+			multisig, err := w.multisigForInput(*input, lockingScript)
+			if err != nil {
+				return signed, err
+			}
+
+			if !multisig.hasPublicKey(w.Crypt.PublicKey) {
+				continue
+			}
+
+			signature, err := w.ScriptSignatureForTxIn(pst.Tx, index, input.PrevTxO, hashType)
+			if err != nil {
+				return signed, err
+			}
+
+			if input.Signatures == nil {
+				input.Signatures = make(map[string][]byte)
+			}
+			input.RedeemScript = multisig.RedeemScript
+			input.Signatures[hex.EncodeToString(w.Crypt.PublicKey)] = signature
+			signed++
+		}
+	}
+
+	return signed, nil
+}
+
+// the redeem script comes with the input if another cosigner attached it, otherwise from the multisigs the wallet tracks
+func (w *Wallet) multisigForInput(input PartiallySignedInput, lockingScript LockingScript) (Multisig, error) {
+	redeemScript := input.RedeemScript
+	if len(redeemScript) == 0 {
+		for _, multisig := range w.Multisigs {
+			if bytes.Equal(multisig.ScriptPubKey(), input.PrevTxO.ScriptPubKey) {
+				redeemScript = multisig.RedeemScript
+			}
+		}
+	}
+
+	if !bytes.Equal(ConvertPublicKeyToHash160(redeemScript), lockingScript.Hash) {
+		return Multisig{}, fmt.Errorf("no redeem script matching the input's script hash")
+	}
+
+	return parseMultisigRedeemScript(redeemScript)
+}
+
+func (m Multisig) hasPublicKey(publicKey []byte) bool {
+	for _, key := range m.PublicKeys {
+		if bytes.Equal(key, publicKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CombinePartiallySignedTransactions merges the signatures that different cosigners added to copies of the same
+// partially signed transaction.
+func CombinePartiallySignedTransactions(psts ...PartiallySignedTransaction) (*PartiallySignedTransaction, error) {
+	if len(psts) == 0 {
+		return nil, fmt.Errorf("nothing to combine")
+	}
+
+	combined := PartiallySignedTransaction{
+		Tx:     psts[0].Tx,
+		Inputs: make([]PartiallySignedInput, len(psts[0].Inputs)),
+	}
+	combined.Tx.TxIns = append([]repository.TxIn{}, psts[0].Tx.TxIns...)
+
+	for _, pst := range psts {
+		if !reflect.DeepEqual(pst.Tx.ID, combined.Tx.ID) || len(pst.Inputs) != len(combined.Inputs) {
+			return nil, fmt.Errorf("cannot combine partially signed txs of different transactions")
+		}
+
+		for index, input := range pst.Inputs {
+			combinedInput := &combined.Inputs[index]
+			combinedInput.PrevTxO = input.PrevTxO
+
+			if len(input.RedeemScript) > 0 {
+				combinedInput.RedeemScript = input.RedeemScript
+			}
+
+			if combinedInput.Signatures == nil {
+				combinedInput.Signatures = make(map[string][]byte)
+			}
+			for publicKey, signature := range input.Signatures {
+				combinedInput.Signatures[publicKey] = signature
+			}
+
+			if len(pst.Tx.TxIns[index].ScriptSignature) > 0 {
+				combined.Tx.TxIns[index].ScriptSignature = pst.Tx.TxIns[index].ScriptSignature
+			}
+		}
+	}
+
+	return &combined, nil
+}
+
+// Finalize builds the scriptSig of every multisig input from its collected signatures, in public key order:
+// OP_0 <sig 1> ... <sig m> <redeem script>
+func (p *PartiallySignedTransaction) Finalize() (repository.Transaction, error) {
+	tx := p.Tx
+	tx.TxIns = append([]repository.TxIn{}, p.Tx.TxIns...)
+
+	for index, input := range p.Inputs {
+		if len(input.RedeemScript) == 0 {
+			if len(tx.TxIns[index].ScriptSignature) == 0 {
+				return repository.Transaction{}, fmt.Errorf("input %d is not signed", index)
+			}
+			continue
+		}
+
+		multisig, err := parseMultisigRedeemScript(input.RedeemScript)
+		if err != nil {
+			return repository.Transaction{}, fmt.Errorf("input %d: %s", index, err)
+		}
+
+		builder := NewScriptBuilder().AddOp(OP_0)
+		signatures := 0
+		for _, publicKey := range multisig.PublicKeys {
+			signature, ok := input.Signatures[hex.EncodeToString(publicKey)]
+			if !ok || signatures == multisig.M {
+				continue
+			}
+			builder.AddData(signature)
+			signatures++
+		}
+
+		if signatures < multisig.M {
+			return repository.Transaction{}, fmt.Errorf("input %d has %d of the %d signatures required", index, signatures, multisig.M)
+		}
+
+		tx.TxIns[index].ScriptSignature = builder.AddData(input.RedeemScript).Script()
+	}
+
+	return tx, nil
+}
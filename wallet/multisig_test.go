@@ -0,0 +1,147 @@
+package wallet_test
+
+import (
+	"encoding/json"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestMultisig(test *testing.T) {
+	test.Run("address does not depend on key order", func(t *testing.T) {
+		a, b, c := newTestWallet(), newTestWallet(), newTestWallet()
+
+		first, err := wallet.NewMultisig(2, [][]byte{a.Crypt.PublicKey, b.Crypt.PublicKey, c.Crypt.PublicKey})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		second, _ := wallet.NewMultisig(2, [][]byte{c.Crypt.PublicKey, a.Crypt.PublicKey, b.Crypt.PublicKey})
+
+		if string(first.Address) != string(second.Address) {
+			t.Fatalf("expected the same address\nGot:%s\nWant:%s", second.Address, first.Address)
+		}
+
+		scriptPubKey, err := wallet.ScriptPubKeyFromAddress(first.Address)
+		if err != nil || string(scriptPubKey) != string(first.ScriptPubKey()) {
+			t.Fatalf("address does not decode to the multisig scriptPubKey: %+v", err)
+		}
+	})
+
+	test.Run("invalid multisigs are rejected", func(t *testing.T) {
+		a, b := newTestWallet(), newTestWallet()
+
+		if _, err := wallet.NewMultisig(3, [][]byte{a.Crypt.PublicKey, b.Crypt.PublicKey}); err == nil {
+			t.Fatalf("expected error for m > n")
+		}
+
+		if _, err := wallet.NewMultisig(1, [][]byte{a.Crypt.PublicKey, a.Crypt.PublicKey}); err == nil {
+			t.Fatalf("expected error for duplicate key")
+		}
+	})
+
+	test.Run("2-of-3 spend signed by two cosigners", func(t *testing.T) {
+		funder, _ := newFundedWallet()
+		a, b, c := newTestWallet(), newTestWallet(), newTestWallet()
+		receiver := newTestWallet()
+
+		publicKeys := [][]byte{a.Crypt.PublicKey, b.Crypt.PublicKey, c.Crypt.PublicKey}
+		multisig, _ := a.AddMultisig(2, publicKeys)
+		b.AddMultisig(2, publicKeys)
+
+		fundingTx, _, err := funder.CreateTransaction(multisig.Address, 50)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		testUTxOSet.Add(*fundingTx)
+
+		if balance := wallet.GetTotalAmount(multisig.ScriptPubKey(), testUTxOSet.Copy()); balance != 50 {
+			t.Fatalf("incorrect multisig balance. Got: %d. Want: %d", balance, 50)
+		}
+
+		pst, err := a.CreateMultisigTransaction(multisig.Address, receiver.Crypt.FirstcoinAddress, 20, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if _, err := pst.Finalize(); err == nil {
+			t.Fatalf("expected error: only one of two signatures")
+		}
+
+		// the partially signed tx travels to the second cosigner as json
+		j, _ := json.Marshal(pst)
+		cosignerCopy := wallet.PartiallySignedTransaction{}
+		json.Unmarshal(j, &cosignerCopy)
+
+		signed, err := b.SignPartiallySignedTransaction(&cosignerCopy, wallet.SigHashAll)
+		if err != nil || signed != 1 {
+			t.Fatalf("expected cosigner to sign 1 input. signed: %d, err: %+v", signed, err)
+		}
+
+		combined, err := wallet.CombinePartiallySignedTransactions(*pst, cosignerCopy)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		tx, err := combined.Finalize()
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected valid tx: %+v", err)
+		}
+
+		if string(tx.TxOuts[1].ScriptPubKey) != string(multisig.ScriptPubKey()) {
+			t.Fatalf("expected change to go back to the multisig address")
+		}
+	})
+
+	test.Run("pays the fee rate of the signed spend", func(t *testing.T) {
+		funder, _ := newFundedWallet()
+		a, b, receiver := newTestWallet(), newTestWallet(), newTestWallet()
+		multisig, _ := a.AddMultisig(1, [][]byte{a.Crypt.PublicKey, b.Crypt.PublicKey})
+
+		fundingTx, _, err := funder.CreateTransaction(multisig.Address, 50)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		testUTxOSet.Add(*fundingTx)
+
+		const feeRate = 20
+		pst, err := a.CreateMultisigTransaction(multisig.Address, receiver.Crypt.FirstcoinAddress, 20, feeRate)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		tx, err := pst.Finalize()
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		fee, err := wallet.FeeForTx(tx, testUTxOSet.Copy())
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if want := wallet.TxFee(wallet.SerializedSize(tx), feeRate); fee < want || want <= wallet.TRANSACTION_FEE {
+			t.Errorf("incorrect fee. Got: %d. Want at least: %d", fee, want)
+		}
+	})
+
+	test.Run("non-cosigner cannot sign", func(t *testing.T) {
+		a, b, outsider := newTestWallet(), newTestWallet(), newTestWallet()
+		multisig, _ := a.AddMultisig(1, [][]byte{a.Crypt.PublicKey, b.Crypt.PublicKey})
+
+		prevTxO := repository.TxO{ScriptPubKey: multisig.ScriptPubKey(), Value: 10}
+		pst := wallet.PartiallySignedTransaction{
+			Tx: repository.Transaction{
+				TxIns:  []repository.TxIn{{TxID: []byte{1}, TxOIndex: 0}},
+				TxOuts: []repository.TxO{{ScriptPubKey: outsider.Crypt.ScriptPubKey, Value: 9}},
+			},
+			Inputs: []wallet.PartiallySignedInput{{PrevTxO: prevTxO, RedeemScript: multisig.RedeemScript}},
+		}
+
+		signed, err := outsider.SignPartiallySignedTransaction(&pst, wallet.SigHashAll)
+		if err != nil || signed != 0 {
+			t.Fatalf("expected outsider to sign nothing. signed: %d, err: %+v", signed, err)
+		}
+	})
+}
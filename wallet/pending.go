@@ -0,0 +1,213 @@
+package wallet
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"time"
+)
+
+// RESERVATION_TIMEOUT is how long the outputs a new tx of the wallet spends stay reserved for it to enter the txPool
+const RESERVATION_TIMEOUT = time.Minute
+
+// PendingTransactions are the wallet's own transactions that are waiting to be mined. The wallet spends on top of them:
+// the outputs they spend are not offered again, and their change can fund the next payment before it is confirmed.
+// The txs the wallet created that are not in the txPool yet are reserved: the outputs they spend are not offered again
+// either, until they are added, released or RESERVATION_TIMEOUT passes. The index of the change output of each tx is
+// recorded when the wallet builds it, so a fee bump knows which output it may take the fee out of.
+type PendingTransactions struct {
+	txs      []repository.Transaction
+	reserved map[repository.TxIDType]reservedTx
+	change   map[repository.TxIDType]int
+}
+
+type reservedTx struct {
+	tx         repository.Transaction
+	reservedAt time.Time
+}
+
+// Balances splits the wallet's coins by what it can do with them. Confirmed coins are in the uTxO set and not spent by a
+// pending tx, Pending coins are the wallet's unconfirmed change and Locked coins are vesting outputs that cannot be
+// claimed yet.
+type Balances struct {
+	Confirmed int `json:"confirmed"`
+	Pending   int `json:"pending"`
+	Locked    int `json:"locked"`
+}
+
+// Add records a tx of the wallet once it is in the txPool. The txs must be added in the order they spend each other.
+func (p *PendingTransactions) Add(tx repository.Transaction) {
+	delete(p.reserved, repository.TxIDType(tx.ID))
+
+	for _, pending := range p.txs {
+		if bytes.Equal(pending.ID, tx.ID) {
+			return
+		}
+	}
+
+	p.txs = append(p.txs, tx)
+}
+
+// Reserve keeps the outputs tx spends from being offered to another tx while tx is on its way to the txPool
+func (p *PendingTransactions) Reserve(tx repository.Transaction) {
+	if p.reserved == nil {
+		p.reserved = make(map[repository.TxIDType]reservedTx)
+	}
+
+	p.reserved[repository.TxIDType(tx.ID)] = reservedTx{tx: tx, reservedAt: time.Now()}
+}
+
+// Release gives back the outputs reserved for the tx with txID, which did not make it into the txPool
+func (p *PendingTransactions) Release(txID []byte) {
+	delete(p.reserved, repository.TxIDType(txID))
+	if _, pending := p.get(txID); !pending {
+		delete(p.change, repository.TxIDType(txID))
+	}
+}
+
+// recordChange records that the output at index of the tx with txID is the wallet's change
+func (p *PendingTransactions) recordChange(txID []byte, index int) {
+	if p.change == nil {
+		p.change = make(map[repository.TxIDType]int)
+	}
+
+	p.change[repository.TxIDType(txID)] = index
+}
+
+// changeIndex is the index of the change output of the tx with txID, if the wallet built it with one
+func (p *PendingTransactions) changeIndex(txID []byte) (int, bool) {
+	index, ok := p.change[repository.TxIDType(txID)]
+	return index, ok
+}
+
+// reservedTxs are the reserved txs that did not time out
+func (p *PendingTransactions) reservedTxs() []repository.Transaction {
+	txs := make([]repository.Transaction, 0, len(p.reserved))
+	for txID, reserved := range p.reserved {
+		if time.Since(reserved.reservedAt) >= RESERVATION_TIMEOUT {
+			delete(p.reserved, txID)
+			continue
+		}
+		txs = append(txs, reserved.tx)
+	}
+
+	return txs
+}
+
+// Transactions returns a copy of the pending txs, in the order they were added
+func (p *PendingTransactions) Transactions() []repository.Transaction {
+	return append([]repository.Transaction{}, p.txs...)
+}
+
+func (p *PendingTransactions) Len() int {
+	return len(p.txs)
+}
+
+// Sync drops the txs that left the txPool, either mined into a block or evicted as invalid
+func (p *PendingTransactions) Sync(txPool map[repository.TxIDType]repository.Transaction) {
+	txs := make([]repository.Transaction, 0, len(p.txs))
+	for _, tx := range p.txs {
+		if _, ok := txPool[repository.TxIDType(tx.ID)]; ok {
+			txs = append(txs, tx)
+		} else {
+			delete(p.change, repository.TxIDType(tx.ID))
+		}
+	}
+
+	p.txs = txs
+}
+
+func (p *PendingTransactions) get(txID []byte) (repository.Transaction, bool) {
+	for _, tx := range p.txs {
+		if bytes.Equal(tx.ID, txID) {
+			return tx, true
+		}
+	}
+
+	return repository.Transaction{}, false
+}
+
+// withDescendants returns tx and the pending txs spending its outputs, directly or not, in the order they were added
+func (p *PendingTransactions) withDescendants(tx repository.Transaction) []repository.Transaction {
+	family := map[repository.TxIDType]bool{repository.TxIDType(tx.ID): true}
+	txs := []repository.Transaction{tx}
+
+	for _, pending := range p.txs {
+		for _, txIn := range pending.TxIns {
+			if family[repository.TxIDType(txIn.TxID)] && !family[repository.TxIDType(pending.ID)] {
+				family[repository.TxIDType(pending.ID)] = true
+				txs = append(txs, pending)
+				break
+			}
+		}
+	}
+
+	return txs
+}
+
+// PendingUTxOSet is uTxOSet as the wallet sees it: a copy with the wallet's pending txs applied as if they were mined.
+// Pending txs that no longer fit the set, because they were mined or conflict with it, are skipped.
+func (w *Wallet) PendingUTxOSet(uTxOSet repository.UTxOSetType) repository.UTxOSetType {
+	if w.Pending.Len() == 0 {
+		return uTxOSet
+	}
+
+	return w.pendingUTxOSet(uTxOSet, nil)
+}
+
+// pendingUTxOSet applies the pending txs to a copy of uTxOSet, leaving out the excluded ones
+func (w *Wallet) pendingUTxOSet(uTxOSet repository.UTxOSetType, exclude map[repository.TxIDType]bool) repository.UTxOSetType {
+	view := repository.CopyUTxOSetFrom(uTxOSet)
+	for _, tx := range w.Pending.txs {
+		if _, ok := view[repository.TxIDType(tx.ID)]; ok || exclude[repository.TxIDType(tx.ID)] || !hasUTxOsForTxIns(tx, view) {
+			continue
+		}
+
+		ApplyTransactionCopy(tx, view, 0, 0)
+	}
+
+	return view
+}
+
+// PendingTxSpendsWallet is true when tx spends an output of this wallet, as seen with its pending txs applied
+func (w *Wallet) PendingTxSpendsWallet(tx repository.Transaction, uTxOSet repository.UTxOSetType) bool {
+	view := w.PendingUTxOSet(uTxOSet)
+
+	for _, txIn := range tx.TxIns {
+		uTxO, err := getUTxOFromTxIn(txIn, view)
+		if err == nil && uTxOBelongsToSpender(*uTxO, w.Crypt.ScriptPubKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetBalances splits the wallet's coins in uTxOSet into confirmed, pending and locked, with the timelocks of the vesting
+// outputs checked against the block at blockIndex and blockTimestamp
+func (w *Wallet) GetBalances(uTxOSet repository.UTxOSetType, blockIndex int, blockTimestamp int) Balances {
+	balances := Balances{}
+	hash160 := ConvertPublicKeyToHash160(w.Crypt.PublicKey)
+
+	for _, tx := range w.PendingUTxOSet(uTxOSet) {
+		_, confirmed := uTxOSet[repository.TxIDType(tx.ID)]
+
+		for _, txO := range tx.TxOuts {
+			if uTxOBelongsToSpender(txO, w.Crypt.ScriptPubKey) {
+				if confirmed {
+					balances.Confirmed += txO.Value
+				} else {
+					balances.Pending += txO.Value
+				}
+				continue
+			}
+
+			lockUntil, hash, ok := parseVestingScript(txO.ScriptPubKey)
+			if confirmed && ok && bytes.Equal(hash, hash160) &&
+				checkLocktime(lockUntil, blockIndex, blockTimestamp) != nil {
+				balances.Locked += txO.Value
+			}
+		}
+	}
+
+	return balances
+}
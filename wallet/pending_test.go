@@ -0,0 +1,93 @@
+package wallet_test
+
+import (
+	"bytes"
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestPendingTransactions(test *testing.T) {
+	test.Run("chains payments off unconfirmed change", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		first, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{UTxOSet: network.uTxOSet})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		sender.Pending.Add(*first)
+
+		balances := sender.GetBalances(network.uTxOSet, network.blockIndex+1, 0)
+		if balances.Confirmed != 0 || balances.Pending != first.TxOuts[1].Value {
+			t.Fatalf("incorrect balances with a pending tx: %+v", balances)
+		}
+
+		second, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 20}}, wallet.TxOptions{UTxOSet: network.uTxOSet})
+		if err != nil {
+			t.Fatalf("expected to spend the unconfirmed change: %+v", err)
+		}
+
+		if len(second.TxIns) != 1 || !bytes.Equal(second.TxIns[0].TxID, first.ID) || second.TxIns[0].TxOIndex != 1 {
+			t.Fatalf("expected the change of the first tx to be spent, got: %+v", second.TxIns)
+		}
+		sender.Pending.Add(*second)
+
+		// the next payment goes on top of the second tx's change
+		if _, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 5}}, wallet.TxOptions{UTxOSet: network.uTxOSet}); err != nil {
+			t.Fatalf("expected to spend the change of the second tx: %+v", err)
+		}
+
+		if err := network.mine(*first, *second); err != nil {
+			t.Fatalf("chained txs rejected: %+v", err)
+		}
+
+		if balance := network.balance(receiver); balance != 30 {
+			t.Fatalf("incorrect receiver balance. Got: %d. Want: 30", balance)
+		}
+
+		sender.Pending.Sync(map[repository.TxIDType]repository.Transaction{})
+		balances = sender.GetBalances(network.uTxOSet, network.blockIndex+1, 0)
+		if sender.Pending.Len() != 0 || balances.Pending != 0 || balances.Confirmed != network.balance(sender) {
+			t.Fatalf("incorrect balances once mined: %+v", balances)
+		}
+	})
+
+	test.Run("vesting outputs count as locked", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		tx, _, _ := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{
+			UTxOSet:   network.uTxOSet,
+			LockUntil: 5,
+		})
+		if err := network.mine(*tx); err != nil {
+			t.Fatalf("tx rejected: %+v", err)
+		}
+
+		if balances := receiver.GetBalances(network.uTxOSet, 2, 0); balances.Locked != 10 || balances.Confirmed != 0 {
+			t.Fatalf("incorrect balances before the vesting locktime: %+v", balances)
+		}
+
+		if balances := receiver.GetBalances(network.uTxOSet, 5, 0); balances.Locked != 0 {
+			t.Fatalf("incorrect balances at the vesting locktime: %+v", balances)
+		}
+	})
+
+	test.Run("sorts txs after the txs they spend", func(t *testing.T) {
+		parent := repository.Transaction{ID: []byte("parent")}
+		child := repository.Transaction{ID: []byte("child"), TxIns: []repository.TxIn{{TxID: []byte("parent")}}}
+		grandchild := repository.Transaction{ID: []byte("grandchild"), TxIns: []repository.TxIn{{TxID: []byte("child")}}}
+		other := repository.Transaction{ID: []byte("other"), TxIns: []repository.TxIn{{TxID: []byte("confirmed")}}}
+
+		sorted := wallet.SortTransactionsByDependency([]repository.Transaction{grandchild, other, child, parent})
+
+		ids := ""
+		for _, tx := range sorted {
+			ids += string(tx.ID) + " "
+		}
+		if ids != "other parent child grandchild " {
+			t.Fatalf("incorrect order. Got: %s", ids)
+		}
+	})
+}
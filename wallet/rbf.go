@@ -0,0 +1,176 @@
+package wallet
+
+import (
+	"firstcoin/repository"
+	"fmt"
+	"time"
+)
+
+const (
+	// SEQUENCE_REPLACEABLE_FLAG set on the sequence of any input opts the transaction into replace-by-fee: until it is
+	// mined it can be replaced in the tx pool by a transaction spending the same outputs with a higher fee.
+	SEQUENCE_REPLACEABLE_FLAG = 1 << 30
+
+	// INCREMENTAL_RELAY_FEE_RATE in coins per 1000 bytes is what a replacement pays on top of the fees of the txs it
+	// replaces, for the bandwidth of relaying it
+	INCREMENTAL_RELAY_FEE_RATE = DEFAULT_FEE_RATE
+
+	// MAX_REPLACEMENT_EVICTIONS is the most txs a replacement can evict from the tx pool, counting the descendants of the
+	// txs it replaces
+	MAX_REPLACEMENT_EVICTIONS = 100
+)
+
+// SignalsReplaceability is true when tx opted into replace-by-fee
+func SignalsReplaceability(tx repository.Transaction) bool {
+	for _, txIn := range tx.TxIns {
+		if txIn.Sequence >= 0 && txIn.Sequence&SEQUENCE_REPLACEABLE_FLAG != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FeeForTx is what tx pays in fees, the value of the outputs it spends in uTxOSet less the value of its outputs
+func FeeForTx(tx repository.Transaction, uTxOSet repository.UTxOSetType) (int, error) {
+	if !hasUTxOsForTxIns(tx, uTxOSet) {
+		return 0, fmt.Errorf("tx %x spends outputs that are not in the uTxO set", tx.ID)
+	}
+
+	totalInput, totalOutput := CalculateFeeForTx(tx, uTxOSet)
+	return totalInput - totalOutput, nil
+}
+
+// HasHigherFeeRate is true when feeA/sizeA > feeB/sizeB
+func HasHigherFeeRate(feeA int, sizeA int, feeB int, sizeB int) bool {
+	return feeA*sizeB > feeB*sizeA
+}
+
+// BumpFeeTransaction replaces the pending tx with txID by one paying the same receivers at feeRate. The higher fee comes
+// out of the change, and if the change does not cover it confirmed uTxOs are added. The replacement pays at least the
+// fees of the tx and its pending descendants plus the incremental relay fee, and a higher fee rate than the tx, so that
+// the tx pool accepts it in place of the tx.
+func (w *Wallet) BumpFeeTransaction(txID []byte, feeRate int, uTxOSet repository.UTxOSetType) (*repository.Transaction, error) {
+	if uTxOSet == nil {
+		uTxOSet = w.UTxOSet.Copy()
+	}
+
+	original, ok := w.Pending.get(txID)
+	if !ok {
+		return nil, fmt.Errorf("tx %x is not a pending tx of this wallet", txID)
+	}
+
+	if !SignalsReplaceability(original) {
+		return nil, fmt.Errorf("tx %x does not signal replaceability", txID)
+	}
+
+	replaced := w.Pending.withDescendants(original)
+	exclude := make(map[repository.TxIDType]bool, len(replaced))
+	for _, tx := range replaced {
+		exclude[repository.TxIDType(tx.ID)] = true
+	}
+
+	// the outputs as they were before the tx and its descendants spent them
+	view := w.pendingUTxOSet(uTxOSet, exclude)
+
+	replacedFees := 0
+	replacedView := repository.CopyUTxOSetFrom(view)
+	for _, tx := range replaced {
+		fee, err := FeeForTx(tx, replacedView)
+		if err != nil {
+			return nil, err
+		}
+		replacedFees += fee
+		ApplyTransactionCopy(tx, replacedView, 0, 0)
+	}
+	originalFee, _ := FeeForTx(original, view)
+
+	// only the output recorded as change when the tx was built goes back to the wallet, any other output paying the
+	// wallet is a payment like the rest
+	txOuts := make([]repository.TxO, 0, len(original.TxOuts))
+	changeIndex, hasChange := w.Pending.changeIndex(original.ID)
+	for i, txO := range original.TxOuts {
+		if !hasChange || i != changeIndex {
+			txOuts = append(txOuts, txO)
+		}
+	}
+
+	if feeRate <= 0 {
+		feeRate = DEFAULT_FEE_RATE
+	}
+	target := newCoinSelectionTarget(txOuts, feeRate, w.Crypt.ScriptPubKey)
+
+	txIns := make([]repository.TxIn, 0, len(original.TxIns))
+	totalAmount := 0
+	for _, txIn := range original.TxIns {
+		uTxO, err := getUTxOFromTxIn(txIn, view)
+		if err != nil {
+			return nil, err
+		}
+		totalAmount += uTxO.Value
+		txIns = append(txIns, repository.TxIn{TxID: txIn.TxID, TxOIndex: txIn.TxOIndex, Sequence: txIn.Sequence})
+	}
+
+	// more inputs can only come from confirmed uTxOs, a replacement cannot depend on other unconfirmed txs
+	candidates := sortUTxOs(spendableUTxOs(w.Crypt.ScriptPubKey, uTxOSet, w.spentOutpoints()))
+	reverseUTxOs(candidates)
+
+	added := make([]SpendableUTxO, 0)
+	fee := 0
+	for {
+		inputs := len(txIns) + len(added)
+		size := target.BaseSize + inputs*target.InputSize + target.ChangeSize
+		fee = target.Fee(inputs, true)
+		if minFee := replacedFees + TxFee(size, INCREMENTAL_RELAY_FEE_RATE); fee < minFee {
+			fee = minFee
+		}
+		// the fee rate must beat the original's, rounding up
+		for !HasHigherFeeRate(fee, size, originalFee, SerializedSize(original)) {
+			fee++
+		}
+
+		if totalAmount >= target.Amount+fee {
+			break
+		}
+
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("insufficient funds to bump the fee of tx %x to %d", txID, fee)
+		}
+
+		added = append(added, candidates[0])
+		totalAmount += candidates[0].Value
+		candidates = candidates[1:]
+	}
+
+	for _, txIDIndexPair := range orderTxIns(added) {
+		txIns = append(txIns, repository.TxIn{TxID: txIDIndexPair.TxID, TxOIndex: txIDIndexPair.TxOIndex, Sequence: original.TxIns[0].Sequence})
+	}
+
+	// the leftover goes back as change unless it is dust
+	changeIndex = -1
+	if change := totalAmount - target.Amount - fee; change >= target.DustThreshold() && change > 0 {
+		changeIndex = len(txOuts)
+		txOuts = append(txOuts, repository.TxO{
+			ScriptPubKey: w.Crypt.ScriptPubKey,
+			Value:        change,
+		})
+	}
+
+	tx := repository.Transaction{
+		TxIns:     txIns,
+		TxOuts:    txOuts,
+		Locktime:  original.Locktime,
+		Timestamp: int(time.Now().UnixNano()),
+	}
+	tx.ID = GenerateTransactionID(tx)
+
+	if _, err := w.SignTransaction(&tx, view, SigHashAll); err != nil {
+		return nil, err
+	}
+
+	if changeIndex >= 0 {
+		w.Pending.recordChange(tx.ID, changeIndex)
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,163 @@
+package wallet_test
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestReplaceByFee(test *testing.T) {
+	test.Run("bumps the fee of a replaceable pending tx", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		original, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{
+			UTxOSet:     network.uTxOSet,
+			Replaceable: true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if !wallet.SignalsReplaceability(*original) {
+			t.Fatalf("expected the tx to signal replaceability")
+		}
+		sender.Pending.Add(*original)
+
+		replacement, err := sender.BumpFeeTransaction(original.ID, 50, network.uTxOSet)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		originalFee, _ := wallet.FeeForTx(*original, network.uTxOSet)
+		replacementFee, _ := wallet.FeeForTx(*replacement, network.uTxOSet)
+		if !wallet.HasHigherFeeRate(replacementFee, wallet.SerializedSize(*replacement), originalFee, wallet.SerializedSize(*original)) {
+			t.Fatalf("expected a higher fee rate. Got fee %d. Original fee %d", replacementFee, originalFee)
+		}
+
+		if replacement.TxOuts[0].Value != 10 || string(replacement.TxIns[0].TxID) != string(original.TxIns[0].TxID) {
+			t.Fatalf("expected the replacement to pay the receiver from the same input: %+v", replacement)
+		}
+
+		if err := network.mine(*replacement); err != nil {
+			t.Fatalf("replacement rejected: %+v", err)
+		}
+		if balance := network.balance(receiver); balance != 10 {
+			t.Fatalf("incorrect receiver balance. Got: %d. Want: 10", balance)
+		}
+	})
+
+	test.Run("keeps a payment to the wallet that is not its change", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(sender.Crypt, 0)
+		repository.AddTxToUTxOSetCopy(coinbaseTx, network.uTxOSet)
+
+		// the payment to the wallet's own address takes what the change would, so the tx has no change
+		options := wallet.TxOptions{UTxOSet: network.uTxOSet, Replaceable: true, CoinSelection: wallet.LargestFirst{}}
+		probe, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}, {Address: sender.Crypt.FirstcoinAddress, Amount: 1}}, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		probeFee, _ := wallet.FeeForTx(*probe, network.uTxOSet)
+		selfPayment := wallet.COINBASE_TRANSACTION_AMOUNT - 10 - probeFee
+
+		original, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}, {Address: sender.Crypt.FirstcoinAddress, Amount: selfPayment}}, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if len(original.TxOuts) != 2 || len(original.TxIns) != 1 {
+			t.Fatalf("expected a tx with one input and no change, got: %+v", original)
+		}
+		sender.Pending.Add(*original)
+
+		replacement, err := sender.BumpFeeTransaction(original.ID, 50, network.uTxOSet)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(replacement.TxOuts) < 2 || replacement.TxOuts[0].Value != 10 || replacement.TxOuts[1].Value != selfPayment {
+			t.Fatalf("expected the replacement to keep both payments, got: %+v", replacement.TxOuts)
+		}
+	})
+
+	test.Run("does not bump a tx that is not replaceable", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		network := newTestNetwork(sender)
+
+		original, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{UTxOSet: network.uTxOSet})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		sender.Pending.Add(*original)
+
+		if _, err := sender.BumpFeeTransaction(original.ID, 50, network.uTxOSet); err == nil {
+			t.Fatalf("expected an error bumping a tx that does not signal replaceability")
+		}
+	})
+
+	test.Run("mines a low fee parent for its high fee child", func(t *testing.T) {
+		sender, receiver := newTestWallet(), newTestWallet()
+		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(sender.Crypt, 0)
+		testUTxOSet.Add(coinbaseTx)
+
+		parent, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		sender.Pending.Add(*parent)
+
+		child, _, err := sender.CreateTransactionWithOptions([]wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}, wallet.TxOptions{FeeRate: 50})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		// the parent alone pays less than the child, so the child's package goes first
+		totalFees, txs := wallet.CalculateTotalTxFees([]repository.Transaction{*child, *parent}, testUTxOSet.Copy())
+		if len(txs) != 2 || string(txs[0].ID) != string(parent.ID) || string(txs[1].ID) != string(child.ID) {
+			t.Fatalf("expected the parent to be mined before the child, got %d txs", len(txs))
+		}
+
+		parentFee, _ := wallet.FeeForTx(*parent, testUTxOSet.Copy())
+		childFee, _ := wallet.FeeForTx(*child, sender.PendingUTxOSet(testUTxOSet.Copy()))
+		if totalFees != parentFee+childFee {
+			t.Fatalf("incorrect total fees. Got: %d. Want: %d", totalFees, parentFee+childFee)
+		}
+	})
+}
+
+func TestSelectBlockTransactions(test *testing.T) {
+	test.Run("ranks a package again by its own fee rate once its ancestors are picked", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+		other, _ := newFundedWallet()
+		receiver := newTestWallet()
+		payment := []wallet.Payment{{Address: receiver.Crypt.FirstcoinAddress, Amount: 10}}
+
+		chain := make([]repository.Transaction, 0)
+		for _, feeRate := range []int{wallet.DEFAULT_FEE_RATE, 100, 20} {
+			tx, _, err := sender.CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: feeRate})
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			sender.Pending.Add(*tx)
+			chain = append(chain, *tx)
+		}
+		parent, child, grandchild := chain[0], chain[1], chain[2]
+
+		// the grandchild's package with its parents pays more than the other tx, but on its own it pays less
+		unrelated, _, err := other.CreateTransactionWithOptions(payment, wallet.TxOptions{FeeRate: 30})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		_, txs := wallet.SelectBlockTransactions([]repository.Transaction{grandchild, *unrelated, child, parent}, testUTxOSet.Copy(), 0, 0)
+		want := []repository.Transaction{parent, child, *unrelated, grandchild}
+		if len(txs) != len(want) {
+			t.Fatalf("expected %d txs, got %d", len(want), len(txs))
+		}
+		for i := range want {
+			if string(txs[i].ID) != string(want[i].ID) {
+				t.Fatalf("unexpected tx at %d, want the parent, the child, the unrelated tx and then the grandchild", i)
+			}
+		}
+	})
+}
@@ -0,0 +1,352 @@
+package wallet
+
+import (
+	"crypto/elliptic"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// ScriptType is the first byte of a scriptPubKey and names the locking template the rest of the script follows.
+type ScriptType byte
+
+const (
+	ScriptTypeP2PKH    ScriptType = 0x01
+	ScriptTypeScript   ScriptType = 0x02
+	ScriptTypeP2SH     ScriptType = 0x03
+	ScriptTypeNullData ScriptType = 0x04
+
+	compressedPublicKeyLength = 33
+	hash160Length             = 20
+
+	// data pushes follow the bitcoin convention: lengths up to 75 are a single length byte, longer data is prefixed
+	// with OP_PUSHDATA1 and a one byte length or OP_PUSHDATA2 and a two byte little endian length
+	maxDirectPushLength = 75
+
+	// the most data a data carrier output can hold, enough for a hash and some metadata
+	MAX_DATA_CARRIER_SIZE = 80
+)
+
+// LockingScript is the decoded form of a scriptPubKey. Standard templates are stored compactly as [script type][push(hash)]
+// and expanded to their full script when evaluated, anything else is stored as [ScriptTypeScript][raw script]. Data carrier
+// outputs are stored as [ScriptTypeNullData][push(data)].
+type LockingScript struct {
+	Type ScriptType
+	Hash []byte
+	Raw  []byte
+	Data []byte
+}
+
+// UnlockingScript is the decoded form of a P2PKH scriptSig: [push(signature || sighash)][push(compressed public key)]
+type UnlockingScript struct {
+	Signature []byte
+	SigHash   SigHashType
+	PublicKey []byte
+}
+
+func NewP2PKHLockingScript(hash160 []byte) LockingScript {
+	return LockingScript{
+		Type: ScriptTypeP2PKH,
+		Hash: hash160,
+	}
+}
+
+// NewP2SHLockingScript locks coins to the hash of a redeem script. The spender reveals the redeem script as the last push
+// of the scriptSig, and it is run against the rest of the scriptSig's pushes.
+func NewP2SHLockingScript(redeemScript []byte) LockingScript {
+	return LockingScript{
+		Type: ScriptTypeP2SH,
+		Hash: ConvertPublicKeyToHash160(redeemScript),
+	}
+}
+
+// NewScriptLockingScript locks coins to an arbitrary script, such as one put together with a ScriptBuilder.
+func NewScriptLockingScript(script []byte) LockingScript {
+	return LockingScript{
+		Type: ScriptTypeScript,
+		Raw:  script,
+	}
+}
+
+// NewDataCarrierLockingScript anchors up to MAX_DATA_CARRIER_SIZE bytes of data on chain in a provably unspendable output
+func NewDataCarrierLockingScript(data []byte) LockingScript {
+	return LockingScript{
+		Type: ScriptTypeNullData,
+		Data: data,
+	}
+}
+
+func (l LockingScript) Encode() []byte {
+	switch l.Type {
+	case ScriptTypeScript:
+		return append([]byte{byte(l.Type)}, l.Raw...)
+	case ScriptTypeNullData:
+		return appendPush([]byte{byte(l.Type)}, l.Data)
+	}
+
+	return appendPush([]byte{byte(l.Type)}, l.Hash)
+}
+
+// Script is the script the interpreter runs for this locking script. P2PKH expands to
+// OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG, P2SH to OP_HASH160 <hash> OP_EQUAL and null data to OP_RETURN <data>.
+func (l LockingScript) Script() []byte {
+	switch l.Type {
+	case ScriptTypeNullData:
+		return NewScriptBuilder().AddOp(OP_RETURN).AddData(l.Data).Script()
+	case ScriptTypeP2PKH:
+		return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(l.Hash).AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+	case ScriptTypeP2SH:
+		return NewScriptBuilder().AddOp(OP_HASH160).AddData(l.Hash).AddOp(OP_EQUAL).Script()
+	}
+
+	return l.Raw
+}
+
+// IsUnspendable reports whether no scriptSig can ever satisfy the script, which is the case for data carrier outputs and
+// for any raw script starting with OP_RETURN. Unspendable outputs are never added to the uTxO set.
+func (l LockingScript) IsUnspendable() bool {
+	return l.Type == ScriptTypeNullData || (l.Type == ScriptTypeScript && len(l.Raw) > 0 && l.Raw[0] == OP_RETURN)
+}
+
+func ParseLockingScript(script []byte) (LockingScript, error) {
+	if len(script) == 0 {
+		return LockingScript{}, fmt.Errorf("invalid scriptPubKey: empty")
+	}
+
+	scriptType := ScriptType(script[0])
+	switch scriptType {
+	case ScriptTypeP2PKH, ScriptTypeP2SH:
+	case ScriptTypeScript:
+		if _, err := parseScript(script[1:]); err != nil {
+			return LockingScript{}, fmt.Errorf("invalid scriptPubKey: %s", err)
+		}
+		return NewScriptLockingScript(script[1:]), nil
+	case ScriptTypeNullData:
+		return parseDataCarrierScript(script[1:])
+	default:
+		return LockingScript{}, fmt.Errorf("invalid scriptPubKey: unknown script type %d", scriptType)
+	}
+
+	hash, rest, err := readPush(script[1:])
+	if err != nil {
+		return LockingScript{}, fmt.Errorf("invalid scriptPubKey: %s", err)
+	}
+
+	if len(rest) != 0 {
+		return LockingScript{}, fmt.Errorf("invalid scriptPubKey: %d trailing bytes", len(rest))
+	}
+
+	if len(hash) != hash160Length {
+		return LockingScript{}, fmt.Errorf("invalid scriptPubKey: hash must be %d bytes, got %d", hash160Length, len(hash))
+	}
+
+	return LockingScript{Type: scriptType, Hash: hash}, nil
+}
+
+func parseDataCarrierScript(script []byte) (LockingScript, error) {
+	data, rest, err := readPush(script)
+	if err != nil {
+		return LockingScript{}, fmt.Errorf("invalid data carrier scriptPubKey: %s", err)
+	}
+
+	if len(rest) != 0 {
+		return LockingScript{}, fmt.Errorf("invalid data carrier scriptPubKey: %d trailing bytes", len(rest))
+	}
+
+	if len(data) > MAX_DATA_CARRIER_SIZE {
+		return LockingScript{}, fmt.Errorf("invalid data carrier scriptPubKey: %d bytes of data exceeds max %d", len(data), MAX_DATA_CARRIER_SIZE)
+	}
+
+	return NewDataCarrierLockingScript(data), nil
+}
+
+func (u UnlockingScript) Encode() []byte {
+	signature := append(append([]byte{}, u.Signature...), byte(u.SigHash))
+
+	script := appendPush(nil, signature)
+	return appendPush(script, u.PublicKey)
+}
+
+func ParseUnlockingScript(script []byte) (UnlockingScript, error) {
+	signature, rest, err := readPush(script)
+	if err != nil {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig signature: %s", err)
+	}
+
+	publicKey, rest, err := readPush(rest)
+	if err != nil {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig public key: %s", err)
+	}
+
+	if len(rest) != 0 {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig: %d trailing bytes", len(rest))
+	}
+
+	// at least the signature version byte, one byte of signature and the sighash byte
+	if len(signature) < 3 {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig: signature too short")
+	}
+
+	sigHash := SigHashType(signature[len(signature)-1])
+	if !sigHash.IsValid() {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig: unknown sighash type %d", sigHash)
+	}
+
+	if err := validateCompressedPublicKey(publicKey); err != nil {
+		return UnlockingScript{}, fmt.Errorf("invalid scriptSig: %s", err)
+	}
+
+	return UnlockingScript{
+		Signature: signature[:len(signature)-1],
+		SigHash:   sigHash,
+		PublicKey: publicKey,
+	}, nil
+}
+
+func validateCompressedPublicKey(publicKey []byte) error {
+	if len(publicKey) != compressedPublicKeyLength {
+		return fmt.Errorf("public key must be %d bytes, got %d", compressedPublicKeyLength, len(publicKey))
+	}
+
+	x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), publicKey)
+	if x == nil {
+		return fmt.Errorf("public key is not a compressed point on the curve")
+	}
+
+	return nil
+}
+
+func appendPush(script []byte, data []byte) []byte {
+	switch {
+	case len(data) == 0:
+		return append(script, OP_0)
+	case len(data) <= maxDirectPushLength:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2, byte(len(data)), byte(len(data)>>8))
+	}
+
+	return append(script, data...)
+}
+
+// readPush reads a single non-empty, minimally encoded data push
+func readPush(script []byte) ([]byte, []byte, error) {
+	if len(script) == 0 {
+		return nil, nil, fmt.Errorf("missing push")
+	}
+
+	length := int(script[0])
+	script = script[1:]
+
+	switch {
+	case length == int(OP_PUSHDATA1):
+		if len(script) == 0 {
+			return nil, nil, fmt.Errorf("missing push length")
+		}
+		length = int(script[0])
+		script = script[1:]
+
+		if length <= maxDirectPushLength {
+			return nil, nil, fmt.Errorf("non-minimal push of %d bytes", length)
+		}
+	case length == int(OP_PUSHDATA2):
+		if len(script) < 2 {
+			return nil, nil, fmt.Errorf("missing push length")
+		}
+		length = int(script[0]) | int(script[1])<<8
+		script = script[2:]
+
+		if length <= 0xff {
+			return nil, nil, fmt.Errorf("non-minimal push of %d bytes", length)
+		}
+	case length > maxDirectPushLength:
+		return nil, nil, fmt.Errorf("unknown push opcode %d", length)
+	}
+
+	if length == 0 {
+		return nil, nil, fmt.Errorf("empty push")
+	}
+
+	if len(script) < length {
+		return nil, nil, fmt.Errorf("push of %d bytes but only %d remain", length, len(script))
+	}
+
+	return script[:length], script[length:], nil
+}
+
+var addressVersionPrefixes = map[ScriptType]Base58CheckVersionPrefix{
+	ScriptTypeP2PKH: bitcoinAddressVersionPrefix,
+	ScriptTypeP2SH:  scriptHashVersionPrefix,
+}
+
+// ScriptPubKeyFromAddress converts a base58 check encoded firstcoin address to the script that locks coins to it. The
+// version prefix tells a pay-to-public-key-hash address from a pay-to-script-hash one.
+func ScriptPubKeyFromAddress(address []byte) ([]byte, error) {
+	hash, version, err := base58.CheckDecode(string(address))
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %s", address, err)
+	}
+
+	if len(hash) != hash160Length {
+		return nil, fmt.Errorf("invalid address %s: hash must be %d bytes", address, hash160Length)
+	}
+
+	for scriptType, prefix := range addressVersionPrefixes {
+		if version == byte(prefix) {
+			return LockingScript{Type: scriptType, Hash: hash}.Encode(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported base58 check version prefix %d", version)
+}
+
+func AddressFromScriptPubKey(scriptPubKey []byte) ([]byte, error) {
+	lockingScript, err := ParseLockingScript(scriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, ok := addressVersionPrefixes[lockingScript.Type]
+	if !ok {
+		return nil, fmt.Errorf("script type %d has no address", lockingScript.Type)
+	}
+
+	return []byte(base58.CheckEncode(lockingScript.Hash, byte(prefix))), nil
+}
+
+// ScriptBuilder assembles locking scripts for the interpreter, eg. a 2-of-2 multisig:
+// NewScriptBuilder().AddInt(2).AddData(key1).AddData(key2).AddInt(2).AddOp(OP_CHECKMULTISIG).Script()
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{
+		script: make([]byte, 0),
+	}
+}
+
+func (b *ScriptBuilder) AddOp(opcode byte) *ScriptBuilder {
+	b.script = append(b.script, opcode)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	b.script = appendPush(b.script, data)
+	return b
+}
+
+// AddInt pushes a script number, using the single byte OP_1 to OP_16 opcodes where possible
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n >= 1 && n <= 16 {
+		return b.AddOp(OP_1 + byte(n-1))
+	}
+
+	return b.AddData(encodeScriptNumber(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
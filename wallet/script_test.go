@@ -0,0 +1,102 @@
+package wallet_test
+
+import (
+	"bytes"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func TestParseUnlockingScript(test *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	// the signature deliberately contains the bytes of the old "[ALL]" separator
+	unlockingScript := wallet.UnlockingScript{
+		Signature: append([]byte{byte(wallet.SignatureVersionSHA256)}, []byte("0[ALL]0")...),
+		SigHash:   wallet.SigHashAll,
+		PublicKey: crypt.PublicKey,
+	}
+	encoded := unlockingScript.Encode()
+
+	test.Run("round trip", func(t *testing.T) {
+		parsed, err := wallet.ParseUnlockingScript(encoded)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !bytes.Equal(parsed.Signature, unlockingScript.Signature) || parsed.SigHash != wallet.SigHashAll || !bytes.Equal(parsed.PublicKey, crypt.PublicKey) {
+			t.Fatalf("incorrect unlocking script\nGot:%+v\nWant:%+v", parsed, unlockingScript)
+		}
+	})
+
+	test.Run("malformed scripts are rejected", func(t *testing.T) {
+		badSigHash := unlockingScript
+		badSigHash.SigHash = wallet.SigHashType(0x04)
+
+		shortPublicKey := unlockingScript
+		shortPublicKey.PublicKey = crypt.PublicKey[:32]
+
+		notOnCurve := unlockingScript
+		notOnCurve.PublicKey = append([]byte{0x05}, crypt.PublicKey[1:]...)
+
+		malformed := map[string][]byte{
+			"empty":              {},
+			"trailing bytes":     append(append([]byte{}, encoded...), 0x01),
+			"truncated":          encoded[:len(encoded)-1],
+			"bad sighash":        badSigHash.Encode(),
+			"short public key":   shortPublicKey.Encode(),
+			"public key not ec":  notOnCurve.Encode(),
+			"unknown push":       append([]byte{0x50}, encoded...),
+			"non-minimal push":   append([]byte{0x4c, 0x01, 0x01}, encoded...),
+			"missing public key": encoded[:len(unlockingScript.Signature)+2],
+		}
+
+		for name, script := range malformed {
+			if _, err := wallet.ParseUnlockingScript(script); err == nil {
+				t.Fatalf("%s: expected error", name)
+			}
+		}
+	})
+}
+
+func TestParseLockingScript(test *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	test.Run("address round trip", func(t *testing.T) {
+		scriptPubKey, err := wallet.ScriptPubKeyFromAddress(crypt.FirstcoinAddress)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !bytes.Equal(scriptPubKey, crypt.ScriptPubKey) {
+			t.Fatalf("incorrect scriptPubKey\nGot:%x\nWant:%x", scriptPubKey, crypt.ScriptPubKey)
+		}
+
+		address, err := wallet.AddressFromScriptPubKey(scriptPubKey)
+		if err != nil || !bytes.Equal(address, crypt.FirstcoinAddress) {
+			t.Fatalf("incorrect address\nGot:%s\nWant:%s", address, crypt.FirstcoinAddress)
+		}
+	})
+
+	test.Run("malformed scripts are rejected", func(t *testing.T) {
+		malformed := map[string][]byte{
+			"empty":          {},
+			"unknown type":   append([]byte{0x7f}, crypt.ScriptPubKey[1:]...),
+			"short hash":     wallet.NewP2PKHLockingScript(make([]byte, 19)).Encode(),
+			"trailing bytes": append(append([]byte{}, crypt.ScriptPubKey...), 0x01),
+		}
+
+		for name, script := range malformed {
+			if _, err := wallet.ParseLockingScript(script); err == nil {
+				t.Fatalf("%s: expected error", name)
+			}
+		}
+	})
+
+	test.Run("malformed addresses are rejected", func(t *testing.T) {
+		if _, err := wallet.ScriptPubKeyFromAddress(crypt.PublicKey); err == nil {
+			t.Fatalf("expected error for public key used as address")
+		}
+	})
+}
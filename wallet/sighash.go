@@ -0,0 +1,150 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"firstcoin/repository"
+	"fmt"
+)
+
+// SigHashType decides which parts of a transaction an input signature commits to. It mirrors the bitcoin sighash flags:
+// the low bits pick which outputs are signed and SigHashAnyoneCanPay restricts the signed inputs to the signing input only.
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashOutputMask SigHashType = 0x1f
+)
+
+var sigHashNames = map[SigHashType]string{
+	SigHashAll:    "ALL",
+	SigHashNone:   "NONE",
+	SigHashSingle: "SINGLE",
+}
+
+func (s SigHashType) outputMode() SigHashType {
+	return s & sigHashOutputMask
+}
+
+func (s SigHashType) anyoneCanPay() bool {
+	return s&SigHashAnyoneCanPay != 0
+}
+
+func (s SigHashType) IsValid() bool {
+	if s&^(sigHashOutputMask|SigHashAnyoneCanPay) != 0 {
+		return false
+	}
+
+	_, ok := sigHashNames[s.outputMode()]
+	return ok
+}
+
+func (s SigHashType) String() string {
+	name, ok := sigHashNames[s.outputMode()]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%d)", byte(s))
+	}
+
+	if s.anyoneCanPay() {
+		return name + "|ANYONECANPAY"
+	}
+
+	return name
+}
+
+// SignatureHash is the digest signed by the input at inputIndex. It always commits to that input's outpoint and sequence
+// together with the value and script of the output it spends, plus the transaction timestamp and locktime. Which of the
+// other inputs and outputs are covered is decided by hashType.
+func SignatureHash(tx repository.Transaction, inputIndex int, prevTxO repository.TxO, hashType SigHashType) ([]byte, error) {
+	if inputIndex < 0 || inputIndex >= len(tx.TxIns) {
+		return nil, fmt.Errorf("sighash: input index %d out of range", inputIndex)
+	}
+
+	if !hashType.IsValid() {
+		return nil, fmt.Errorf("sighash: invalid sighash type %d", hashType)
+	}
+
+	if hashType.outputMode() == SigHashSingle && inputIndex >= len(tx.TxOuts) {
+		return nil, fmt.Errorf("sighash: SINGLE requires an output at index %d", inputIndex)
+	}
+
+	preimage := new(bytes.Buffer)
+	writeSigHashInt(preimage, tx.Timestamp)
+	writeSigHashInt(preimage, tx.Locktime)
+
+	if hashType.anyoneCanPay() {
+		writeSigHashInt(preimage, 1)
+		writeSigHashTxIn(preimage, tx.TxIns[inputIndex], &prevTxO)
+	} else {
+		writeSigHashInt(preimage, len(tx.TxIns))
+		for index, txIn := range tx.TxIns {
+			if index == inputIndex {
+				writeSigHashTxIn(preimage, txIn, &prevTxO)
+				continue
+			}
+
+			// as in bitcoin, NONE and SINGLE leave the other inputs free to update their sequence
+			if hashType.outputMode() != SigHashAll {
+				txIn.Sequence = 0
+			}
+			writeSigHashTxIn(preimage, txIn, nil)
+		}
+	}
+
+	switch hashType.outputMode() {
+	case SigHashAll:
+		writeSigHashInt(preimage, len(tx.TxOuts))
+		for _, txOut := range tx.TxOuts {
+			writeSigHashTxO(preimage, txOut)
+		}
+	case SigHashNone:
+		writeSigHashInt(preimage, 0)
+	case SigHashSingle:
+		writeSigHashInt(preimage, inputIndex)
+		writeSigHashTxO(preimage, tx.TxOuts[inputIndex])
+	}
+
+	writeSigHashInt(preimage, int(hashType))
+
+	first := sha256.Sum256(preimage.Bytes())
+	second := sha256.Sum256(first[:])
+
+	return second[:], nil
+}
+
+// the spent output is only written for the input being signed, the other inputs are represented by their outpoints and
+// sequence
+func writeSigHashTxIn(buf *bytes.Buffer, txIn repository.TxIn, prevTxO *repository.TxO) {
+	writeSigHashBytes(buf, txIn.TxID)
+	writeSigHashInt(buf, txIn.TxOIndex)
+	writeSigHashInt(buf, txIn.Sequence)
+
+	if prevTxO == nil {
+		writeSigHashBytes(buf, nil)
+		return
+	}
+
+	writeSigHashBytes(buf, prevTxO.ScriptPubKey)
+	writeSigHashInt(buf, prevTxO.Value)
+}
+
+func writeSigHashTxO(buf *bytes.Buffer, txO repository.TxO) {
+	writeSigHashBytes(buf, txO.ScriptPubKey)
+	writeSigHashInt(buf, txO.Value)
+}
+
+func writeSigHashBytes(buf *bytes.Buffer, b []byte) {
+	writeSigHashInt(buf, len(b))
+	buf.Write(b)
+}
+
+func writeSigHashInt(buf *bytes.Buffer, i int) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	buf.Write(b)
+}
@@ -0,0 +1,128 @@
+package wallet_test
+
+import (
+	"firstcoin/repository"
+	"firstcoin/wallet"
+	"testing"
+)
+
+func newFundedWallet() (*wallet.Wallet, repository.Transaction) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+	testUTxOSet.Add(coinbaseTx)
+
+	return wallet.NewWallet(*crypt, testUTxOSet, testTxPool), coinbaseTx
+}
+
+func TestSignTransaction(test *testing.T) {
+	test.Run("inputs from different owners combined in one tx", func(t *testing.T) {
+		alice, aliceCoinbase := newFundedWallet()
+		bob, bobCoinbase := newFundedWallet()
+
+		receiver := wallet.NewCryptographic()
+		receiver.GenerateKeyPair()
+
+		tx := repository.Transaction{
+			TxIns: []repository.TxIn{
+				{TxID: aliceCoinbase.ID, TxOIndex: 0},
+				{TxID: bobCoinbase.ID, TxOIndex: 0},
+			},
+			TxOuts: []repository.TxO{
+				{ScriptPubKey: receiver.ScriptPubKey, Value: 2*wallet.COINBASE_TRANSACTION_AMOUNT - wallet.TRANSACTION_FEE},
+			},
+		}
+		tx.ID = wallet.GenerateTransactionID(tx)
+
+		signed, err := alice.SignTransaction(&tx, testUTxOSet.Copy(), wallet.SigHashAll)
+		if err != nil || signed != 1 {
+			t.Fatalf("expected alice to sign 1 input. signed: %d, err: %+v", signed, err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected error: bob has not signed yet")
+		}
+
+		signed, err = bob.SignTransaction(&tx, testUTxOSet.Copy(), wallet.SigHashAll)
+		if err != nil || signed != 1 {
+			t.Fatalf("expected bob to sign 1 input. signed: %d, err: %+v", signed, err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected valid tx: %+v", err)
+		}
+	})
+
+	test.Run("SIGHASH_ALL signature is invalidated by a changed output", func(t *testing.T) {
+		sender, _ := newFundedWallet()
+
+		receiver := wallet.NewCryptographic()
+		receiver.GenerateKeyPair()
+
+		tx, _, err := sender.CreateTransaction(receiver.FirstcoinAddress, 5)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		tx.TxOuts[0].Value = 6
+		tx.ID = wallet.GenerateTransactionID(*tx)
+
+		if err := wallet.IsValidTransactionCopy(*tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Fatalf("expected signature verification error")
+		}
+	})
+
+	test.Run("SIGHASH_SINGLE|ANYONECANPAY lets other owners add inputs and outputs", func(t *testing.T) {
+		alice, aliceCoinbase := newFundedWallet()
+		bob, bobCoinbase := newFundedWallet()
+
+		tx := repository.Transaction{
+			TxIns: []repository.TxIn{
+				{TxID: aliceCoinbase.ID, TxOIndex: 0},
+			},
+			TxOuts: []repository.TxO{
+				{ScriptPubKey: alice.Crypt.ScriptPubKey, Value: wallet.COINBASE_TRANSACTION_AMOUNT - wallet.TRANSACTION_FEE},
+			},
+		}
+
+		if _, err := alice.SignTransaction(&tx, testUTxOSet.Copy(), wallet.SigHashSingle|wallet.SigHashAnyoneCanPay); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		tx.TxIns = append(tx.TxIns, repository.TxIn{TxID: bobCoinbase.ID, TxOIndex: 0})
+		tx.TxOuts = append(tx.TxOuts, repository.TxO{ScriptPubKey: bob.Crypt.ScriptPubKey, Value: wallet.COINBASE_TRANSACTION_AMOUNT})
+		tx.ID = wallet.GenerateTransactionID(tx)
+
+		if _, err := bob.SignTransaction(&tx, testUTxOSet.Copy(), wallet.SigHashAll); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if err := wallet.IsValidTransactionCopy(tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("expected valid tx: %+v", err)
+		}
+	})
+}
+
+func TestSignatureHash(t *testing.T) {
+	tx := repository.Transaction{
+		TxIns:  []repository.TxIn{{TxID: []byte{1}, TxOIndex: 0}, {TxID: []byte{2}, TxOIndex: 0}},
+		TxOuts: []repository.TxO{{ScriptPubKey: []byte{3}, Value: 1}},
+	}
+	prevTxO := repository.TxO{ScriptPubKey: []byte{4}, Value: 2}
+
+	if _, err := wallet.SignatureHash(tx, 1, prevTxO, wallet.SigHashSingle); err == nil {
+		t.Fatalf("expected error: SINGLE without matching output")
+	}
+
+	if _, err := wallet.SignatureHash(tx, 0, prevTxO, wallet.SigHashType(0x04)); err == nil {
+		t.Fatalf("expected error: unknown sighash type")
+	}
+
+	all, _ := wallet.SignatureHash(tx, 0, prevTxO, wallet.SigHashAll)
+	tx.Locktime = 10
+	allWithLocktime, _ := wallet.SignatureHash(tx, 0, prevTxO, wallet.SigHashAll)
+	if string(all) == string(allWithLocktime) {
+		t.Fatalf("expected sighash to commit to locktime")
+	}
+}
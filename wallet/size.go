@@ -0,0 +1,100 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"firstcoin/repository"
+)
+
+const (
+	// a P2PKH scriptSig at its largest: push(version || DER signature of up to 72 bytes || sighash) push(public key)
+	estimatedP2PKHScriptSigSize = 1 + 1 + 72 + 1 + 1 + compressedPublicKeyLength
+)
+
+// SerializeTransaction is the canonical binary encoding of a transaction that fees and size limits are measured on.
+// Counts, lengths, indexes and sequences are 4 bytes and amounts and times 8 bytes, all big endian. The tx id is left out
+// as it is derived from the rest.
+func SerializeTransaction(tx repository.Transaction) []byte {
+	buf := new(bytes.Buffer)
+
+	writeUint64(buf, tx.Timestamp)
+	writeUint64(buf, tx.Locktime)
+
+	writeUint32(buf, len(tx.TxIns))
+	for _, txIn := range tx.TxIns {
+		serializeTxIn(buf, txIn)
+	}
+
+	writeUint32(buf, len(tx.TxOuts))
+	for _, txO := range tx.TxOuts {
+		serializeTxO(buf, txO)
+	}
+
+	return buf.Bytes()
+}
+
+// SerializedSize is the size in bytes of the serialized transaction
+func SerializedSize(tx repository.Transaction) int {
+	return len(SerializeTransaction(tx))
+}
+
+func serializeTxIn(buf *bytes.Buffer, txIn repository.TxIn) {
+	writeUint32(buf, len(txIn.TxID))
+	buf.Write(txIn.TxID)
+	writeUint32(buf, txIn.TxOIndex)
+	writeUint32(buf, txIn.Sequence)
+	writeUint32(buf, len(txIn.ScriptSignature))
+	buf.Write(txIn.ScriptSignature)
+}
+
+func serializeTxO(buf *bytes.Buffer, txO repository.TxO) {
+	writeUint64(buf, txO.Value)
+	writeUint32(buf, len(txO.ScriptPubKey))
+	buf.Write(txO.ScriptPubKey)
+}
+
+// the size of a signed P2PKH input spending an output of a tx with a sha256 tx id
+func estimatedP2PKHInputSize() int {
+	buf := new(bytes.Buffer)
+	serializeTxIn(buf, repository.TxIn{
+		TxID:            make([]byte, 32),
+		ScriptSignature: make([]byte, estimatedP2PKHScriptSigSize),
+	})
+
+	return buf.Len()
+}
+
+// the size of an input spending an output of multisig, signed by M of its keys
+func estimatedMultisigInputSize(multisig Multisig) int {
+	builder := NewScriptBuilder().AddOp(OP_0)
+	for i := 0; i < multisig.M; i++ {
+		builder.AddData(make([]byte, 1+72+1))
+	}
+
+	buf := new(bytes.Buffer)
+	serializeTxIn(buf, repository.TxIn{
+		TxID:            make([]byte, 32),
+		ScriptSignature: builder.AddData(multisig.RedeemScript).Script(),
+	})
+
+	return buf.Len()
+}
+
+func txOSize(txO repository.TxO) int {
+	buf := new(bytes.Buffer)
+	serializeTxO(buf, txO)
+
+	return buf.Len()
+}
+
+func writeUint32(buf *bytes.Buffer, i int) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(i))
+	buf.Write(b)
+}
+
+func writeUint64(buf *bytes.Buffer, i int) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	buf.Write(b)
+}
@@ -1,11 +1,15 @@
 package wallet
 
 import (
+	"bytes"
+	"container/heap"
 	"crypto/sha256"
 	"firstcoin/repository"
 	"firstcoin/utils"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -13,41 +17,123 @@ import (
 const COINBASE_TRANSACTION_AMOUNT = 100
 const TRANSACTION_FEE = 1
 
+// Wallet spends from the uTxO set of the node it runs on and keeps clear of the outputs its tx pool spends. The wallet
+// itself is not safe for concurrent use.
 type Wallet struct {
-	Crypt Cryptographic
+	Crypt         Cryptographic
+	Multisigs     map[string]Multisig   // multisig addresses this wallet is a cosigner of, keyed by address
+	PaymentBatch  PaymentBatch          // payments queued to be sent together by FlushPaymentBatch
+	Pending       PendingTransactions   // this wallet's txs that are not mined yet
+	UTxOSet       *repository.UTxOSet   // the node's uTxO set
+	TxPool        *repository.TxPool    // the node's tx pool
+	CoinSelection CoinSelectionStrategy // the strategy of the payments that do not choose one
 }
 
-func NewWallet(c Cryptographic) *Wallet {
+func NewWallet(c Cryptographic, uTxOSet *repository.UTxOSet, txPool *repository.TxPool) *Wallet {
 	return &Wallet{
-		Crypt: c,
+		Crypt:         c,
+		Multisigs:     make(map[string]Multisig),
+		UTxOSet:       uTxOSet,
+		TxPool:        txPool,
+		CoinSelection: DefaultCoinSelection(),
 	}
 }
 
+// TxOptions adds timelocks to a payment. Locktime is the transaction's absolute locktime and Sequence is set on every input
+// as a relative timelock. LockUntil, if set, pays each receiver through a vesting output that it can only claim from that
+// block height or unix time on, see NewVestingLockingScript. UTxOSet is the set the payment is funded from and defaults to
+// the node's uTxO set, seen with the wallet's pending txs applied. FeeRate is in coins per 1000 bytes and defaults to DEFAULT_FEE_RATE, and CoinSelection picks the
+// uTxOs funding the payment, defaulting to the wallet's CoinSelection. Replaceable opts the transaction into replace-by-fee.
+type TxOptions struct {
+	Locktime      int
+	Sequence      int
+	LockUntil     int
+	UTxOSet       repository.UTxOSetType
+	FeeRate       int
+	CoinSelection CoinSelectionStrategy
+	Replaceable   bool
+}
+
+// Payment is a single receiver of a transaction
+type Payment struct {
+	Address []byte `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
 func (w *Wallet) CreateTransaction(receiverAddress []byte, amount int) (*repository.Transaction, int, error) {
-	txIns := make([]repository.TxIn, 0)
-	txOuts := make([]repository.TxO, 0)
+	return w.CreateTransactionWithOptions([]Payment{{Address: receiverAddress, Amount: amount}}, TxOptions{})
+}
 
-	txIDIndexPairs, _, err := w.FindUTxOs(amount)
+// CreatePaymentTransaction pays every receiver in payments in a single transaction, with one change output and one tx fee
+func (w *Wallet) CreatePaymentTransaction(payments []Payment) (*repository.Transaction, int, error) {
+	return w.CreateTransactionWithOptions(payments, TxOptions{})
+}
+
+func (w *Wallet) CreateTransactionWithOptions(payments []Payment, options TxOptions) (*repository.Transaction, int, error) {
+	uTxOSet := options.UTxOSet
+	if uTxOSet == nil {
+		uTxOSet = w.UTxOSet.Copy()
+	}
+
+	feeRate := options.FeeRate
+	if feeRate == 0 {
+		feeRate = DEFAULT_FEE_RATE
+	}
+	if feeRate < 0 {
+		return nil, 0, fmt.Errorf("fee rate must be >= 0")
+	}
+
+	sequence := options.Sequence
+	if options.Replaceable {
+		sequence |= SEQUENCE_REPLACEABLE_FLAG
+	}
+
+	coinSelection := options.CoinSelection
+	if coinSelection == nil {
+		coinSelection = w.CoinSelection
+	}
+
+	// the payments come first, in order, followed by the change
+	txOuts, err := receiverTxOs(payments, options.LockUntil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the change of the wallet's pending txs can be spent before they are mined
+	uTxOSet = w.PendingUTxOSet(uTxOSet)
+
+	target := newCoinSelectionTarget(txOuts, feeRate, w.Crypt.ScriptPubKey)
+	selection, err := coinSelection.SelectCoins(spendableUTxOs(w.Crypt.ScriptPubKey, uTxOSet, w.spentOutpoints()), target)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	for _, txIDIndexPair := range txIDIndexPairs {
-		txIn := repository.TxIn{
+	totalAmount := 0
+	txIns := make([]repository.TxIn, 0, len(selection))
+	for _, txIDIndexPair := range orderTxIns(selection) {
+		txIns = append(txIns, repository.TxIn{
 			TxOIndex: txIDIndexPair.TxOIndex,
 			TxID:     txIDIndexPair.TxID,
-		}
-		txIns = append(txIns, txIn)
+			Sequence: sequence,
+		})
+	}
+	for _, uTxO := range selection {
+		totalAmount += uTxO.Value
 	}
 
-	txOs, _ := w.GetTxOs(amount, receiverAddress, txIns)
-	for _, txO := range txOs {
-		txOuts = append(txOuts, txO)
+	changeIndex := -1
+	if change := target.Change(totalAmount, len(txIns)); change > 0 {
+		changeIndex = len(txOuts)
+		txOuts = append(txOuts, repository.TxO{
+			ScriptPubKey: w.Crypt.ScriptPubKey,
+			Value:        change,
+		})
 	}
 
 	transaction := repository.Transaction{
-		TxIns:  txIns,
-		TxOuts: txOuts,
+		TxIns:    txIns,
+		TxOuts:   txOuts,
+		Locktime: options.Locktime,
 	}
 
 	now := int(time.Now().UnixNano())
@@ -57,25 +143,120 @@ func (w *Wallet) CreateTransaction(receiverAddress []byte, amount int) (*reposit
 	txID := GenerateTransactionID(transaction)
 	transaction.ID = txID
 
-	// tx input signature is the tx id signed by the spender of coins
-	sigScript := w.GenerateTxSigScript(txID)
+	// each tx input carries its own signature over the whole transaction and the output it spends
+	if _, err := w.SignTransaction(&transaction, uTxOSet, SigHashAll); err != nil {
+		return nil, 0, err
+	}
 
-	// sign all txIns from same sender.
-	for i := 0; i < len(transaction.TxIns); i++ {
-		transaction.TxIns[i].ScriptSignature = sigScript
+	if changeIndex >= 0 {
+		w.Pending.recordChange(transaction.ID, changeIndex)
 	}
 
 	return &transaction, now, nil
 }
 
-func (w *Wallet) GenerateTxSigScript(txID []byte) []byte {
-	signature := w.Crypt.GenerateSignature(txID)
-	publicKey := w.Crypt.PublicKey
+// receiverTxOs pays each receiver, through a vesting output if lockUntil is set
+func receiverTxOs(payments []Payment, lockUntil int) ([]repository.TxO, error) {
+	if _, err := totalPaymentAmount(payments); err != nil {
+		return nil, err
+	}
+
+	txOs := make([]repository.TxO, 0, len(payments)+1)
+	for _, payment := range payments {
+		receiverScriptPubKey, err := ScriptPubKeyFromAddress(payment.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		if lockUntil != 0 {
+			vestingScript, err := NewVestingLockingScript(lockUntil, payment.Address)
+			if err != nil {
+				return nil, err
+			}
+			receiverScriptPubKey = vestingScript.Encode()
+		}
+
+		txOs = append(txOs, repository.TxO{
+			ScriptPubKey: receiverScriptPubKey,
+			Value:        payment.Amount,
+		})
+	}
+
+	return txOs, nil
+}
+
+// newCoinSelectionTarget sizes a transaction paying txOs from P2PKH inputs, with change going to changeScriptPubKey
+func newCoinSelectionTarget(txOs []repository.TxO, feeRate int, changeScriptPubKey []byte) CoinSelectionTarget {
+	amount := 0
+	for _, txO := range txOs {
+		amount += txO.Value
+	}
+
+	return CoinSelectionTarget{
+		Amount:     amount,
+		FeeRate:    feeRate,
+		BaseSize:   SerializedSize(repository.Transaction{TxOuts: txOs}),
+		InputSize:  estimatedP2PKHInputSize(),
+		ChangeSize: txOSize(repository.TxO{ScriptPubKey: changeScriptPubKey}),
+	}
+}
+
+// SignTransaction signs every input of tx that spends an output belonging to this wallet and returns how many were signed.
+// Inputs owned by someone else are left untouched so that a transaction funded by several owners can be passed around
+// and signed by each of them in turn.
+func (w *Wallet) SignTransaction(tx *repository.Transaction, uTxOSet repository.UTxOSetType, hashType SigHashType) (int, error) {
+	signed := 0
+
+	for index, txIn := range tx.TxIns {
+		uTxO, err := getUTxOFromTxIn(txIn, uTxOSet)
+		if err != nil {
+			return signed, err
+		}
+
+		if !uTxOBelongsToSpender(*uTxO, w.Crypt.ScriptPubKey) {
+			continue
+		}
+
+		if err := w.SignTxIn(tx, index, *uTxO, hashType); err != nil {
+			return signed, err
+		}
+		signed++
+	}
+
+	return signed, nil
+}
+
+// SignTxIn sets the P2PKH unlocking script of the input at inputIndex, which spends prevTxO.
+func (w *Wallet) SignTxIn(tx *repository.Transaction, inputIndex int, prevTxO repository.TxO, hashType SigHashType) error {
+	sigHash, err := SignatureHash(*tx, inputIndex, prevTxO, hashType)
+	if err != nil {
+		return err
+	}
 
-	sigScript := append(signature, []byte(fmt.Sprintf("[%s]", sigHashAll))...)
-	sigScript = append(sigScript, publicKey...)
+	tx.TxIns[inputIndex].ScriptSignature = w.GenerateTxSigScript(sigHash, hashType)
 
-	return sigScript
+	return nil
+}
+
+// ScriptSignatureForTxIn returns the signature stack element (signature followed by the sighash byte) that OP_CHECKSIG
+// expects for the input at inputIndex. It is used to build unlocking scripts for non-P2PKH outputs.
+func (w *Wallet) ScriptSignatureForTxIn(tx repository.Transaction, inputIndex int, prevTxO repository.TxO, hashType SigHashType) ([]byte, error) {
+	sigHash, err := SignatureHash(tx, inputIndex, prevTxO, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(w.Crypt.GenerateSignature(sigHash), byte(hashType)), nil
+}
+
+func (w *Wallet) GenerateTxSigScript(sigHash []byte, hashType SigHashType) []byte {
+	unlockingScript := UnlockingScript{
+		Signature: w.Crypt.GenerateSignature(sigHash),
+		SigHash:   hashType,
+		PublicKey: w.Crypt.PublicKey,
+	}
+
+	return unlockingScript.Encode()
 }
 
 func CreateCoinbaseTransaction(crypt Cryptographic, txFees int) (repository.Transaction, int) {
@@ -85,7 +266,7 @@ func CreateCoinbaseTransaction(crypt Cryptographic, txFees int) (repository.Tran
 
 	txOut := repository.TxO{
 		Value:        COINBASE_TRANSACTION_AMOUNT + txFees,
-		ScriptPubKey: crypt.FirstcoinAddress,
+		ScriptPubKey: crypt.ScriptPubKey,
 	}
 	txOuts = append(txOuts, txOut)
 
@@ -104,21 +285,21 @@ func CreateCoinbaseTransaction(crypt Cryptographic, txFees int) (repository.Tran
 	return transaction, now
 }
 
-// This is a SHA of all txIns (excluding signature - that gets added later) and txOuts
+// This is a SHA of all txIns (excluding signature - that gets added later) with their sequence, txOuts, timestamp and locktime
 func GenerateTransactionID(transaction repository.Transaction) []byte {
 	msgHash := sha256.New()
 	concatTxIn := ""
 	concatTxOut := ""
 
 	for _, txIn := range transaction.TxIns {
-		concatTxIn += string(txIn.TxID) + strconv.Itoa(txIn.TxOIndex)
+		concatTxIn += string(txIn.TxID) + strconv.Itoa(txIn.TxOIndex) + strconv.Itoa(txIn.Sequence)
 	}
 
 	for _, txOut := range transaction.TxOuts {
 		concatTxOut += string(txOut.ScriptPubKey) + strconv.Itoa(txOut.Value)
 	}
 
-	_, err := msgHash.Write([]byte(fmt.Sprintf("%s%s%d", concatTxIn, concatTxOut, transaction.Timestamp)))
+	_, err := msgHash.Write([]byte(fmt.Sprintf("%s%s%d%d", concatTxIn, concatTxOut, transaction.Timestamp, transaction.Locktime)))
 	utils.PanicError(err)
 
 	return msgHash.Sum(nil)
@@ -129,7 +310,9 @@ type prettyTxO struct {
 	Amount  int
 }
 
-func AreValidTransactions(txs []repository.Transaction) error {
+// AreValidTransactions validates the txs of a block spending from uTxOSet, which is left untouched, with the script flags
+// of the block
+func AreValidTransactions(txs []repository.Transaction, uTxOSet repository.UTxOSetType, flags ScriptFlags) error {
 	if len(txs) == 0 {
 		return fmt.Errorf("Invalid transactions. Cant have empty transactions")
 	}
@@ -137,29 +320,89 @@ func AreValidTransactions(txs []repository.Transaction) error {
 	// first transaction in the list is always the coinbase transaction
 	coinbaseTransaction := txs[0]
 
-	if err := IsValidCoinbaseTransaction(coinbaseTransaction, txs[1:]); err != nil {
+	if err := IsValidCoinbaseTransaction(coinbaseTransaction, txs[1:], uTxOSet); err != nil {
 		return err
 	}
 
+	// a tx can spend the outputs of the txs before it in the block
+	uTxOSet = repository.CopyUTxOSetFrom(uTxOSet)
 	for _, transaction := range txs[1:] {
-		if err := IsValidTransaction(transaction); err != nil {
+		if err := IsValidTransactionCopy(transaction, uTxOSet, flags); err != nil {
 			return err
 		}
+		ApplyTransactionCopy(transaction, uTxOSet, 0, 0)
 	}
 
 	return nil
 }
 
-func IsValidTransaction(tx repository.Transaction) error {
-	return IsValidTransactionCopy(tx, repository.GetEntireUTxOSet())
+// ApplyTransactionCopy spends the outputs tx's inputs refer to and adds tx's spendable outputs to uTxOSet, as confirmed
+// in the block at blockIndex. tx must already be valid against uTxOSet.
+func ApplyTransactionCopy(tx repository.Transaction, uTxOSet repository.UTxOSetType, blockIndex int, blockTimestamp int) {
+	repository.RemoveTxOsFromUTxOCopy(repository.TxIDType(tx.ID), tx.TxIns, uTxOSet)
+
+	// record where the tx was confirmed for the relative timelocks of its spenders
+	tx.BlockIndex = blockIndex
+	tx.BlockTimestamp = blockTimestamp
+	// data carrier outputs can never be spent so they are kept out of the uTxO set
+	if uTxO := PruneUnspendableTxOs(tx); hasUnspentTxOs(uTxO) {
+		repository.AddTxToUTxOSetCopy(uTxO, uTxOSet)
+	}
+}
+
+// SortTransactionsByDependency orders txs so that every tx comes after the txs in the list whose outputs it spends.
+// Otherwise the txs keep their order.
+func SortTransactionsByDependency(txs []repository.Transaction) []repository.Transaction {
+	inList := make(map[repository.TxIDType]bool, len(txs))
+	for _, tx := range txs {
+		inList[repository.TxIDType(tx.ID)] = true
+	}
+
+	sorted := make([]repository.Transaction, 0, len(txs))
+	added := make(map[repository.TxIDType]bool, len(txs))
+	remaining := txs
+
+	for len(remaining) > 0 {
+		next := make([]repository.Transaction, 0, len(remaining))
+
+		for _, tx := range remaining {
+			ready := true
+			for _, txIn := range tx.TxIns {
+				parentID := repository.TxIDType(txIn.TxID)
+				if inList[parentID] && !added[parentID] && parentID != repository.TxIDType(tx.ID) {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				sorted = append(sorted, tx)
+				added[repository.TxIDType(tx.ID)] = true
+			} else {
+				next = append(next, tx)
+			}
+		}
+
+		// what is left spends itself in a cycle, which no valid txs can do
+		if len(next) == len(remaining) {
+			return append(sorted, next...)
+		}
+		remaining = next
+	}
+
+	return sorted
 }
 
-func IsValidTransactionCopy(tx repository.Transaction, uTxOSet repository.UTxOSetType) error {
+func IsValidTransactionCopy(tx repository.Transaction, uTxOSet repository.UTxOSetType, flags ScriptFlags) error {
 	if len(tx.TxIns) < 1 {
 		return fmt.Errorf("Invalid transaction: txIns length must be greater than 0")
 	}
 
-	if err := AreValidTxIns(tx, uTxOSet); err != nil {
+	if err := checkDuplicateTxIns(tx.TxIns); err != nil {
+		return fmt.Errorf("Invalid transaction: %s", err)
+	}
+
+	if err := AreValidTxIns(tx, uTxOSet, flags); err != nil {
 		return fmt.Errorf("invalid txIn %+v", err)
 	}
 
@@ -183,23 +426,202 @@ func IsValidTransactionCopy(tx repository.Transaction, uTxOSet repository.UTxOSe
 	return nil
 }
 
-func CalculateTotalTxFees(txPool []repository.Transaction) (int, []repository.Transaction) {
-	totalFees := 0
-	uTxOSet := repository.GetEntireUTxOSet()
+// checkDuplicateTxIns fails if two of txIns spend the same output
+func checkDuplicateTxIns(txIns []repository.TxIn) error {
+	spent := make(map[string]bool, len(txIns))
+	for _, txIn := range txIns {
+		outpoint := txIn.Outpoint()
+		if spent[outpoint] {
+			return fmt.Errorf("uTxO %s is spent more than once", outpoint)
+		}
+		spent[outpoint] = true
+	}
+
+	return nil
+}
+
+// CalculateTotalTxFees returns the txs of txPool that can be mined in the next block and the total of their fees, with
+// no limit on their size or count
+func CalculateTotalTxFees(txPool []repository.Transaction, uTxOSet repository.UTxOSetType) (int, []repository.Transaction) {
+	return SelectBlockTransactions(txPool, uTxOSet, 0, 0)
+}
+
+// SelectBlockTransactions greedily fills a block template of at most maxSize bytes and maxCount txs from txPool, spending
+// from uTxOSet, and returns them with the total of their fees. Txs are picked as packages with their unconfirmed ancestors, highest package fee rate
+// first, so that a child paying a high fee gets its low fee parents mined (child pays for parent). A package that does
+// not fit is passed over for smaller ones. A package must pay TRANSACTION_FEE per tx. Each tx comes after the txs it
+// spends from. A maxSize or maxCount of 0 or less does not limit the size or count.
+//
+// The package totals are worked out once and only updated for the descendants of the txs picked, which leave their
+// packages.
+func SelectBlockTransactions(txPool []repository.Transaction, uTxOSet repository.UTxOSetType, maxSize int, maxCount int) (int, []repository.Transaction) {
+	candidates := newMiningCandidates(txPool, uTxOSet)
+	queue := make(miningQueue, 0, len(candidates))
+	for _, candidate := range candidates {
+		heap.Push(&queue, candidate.queued())
+	}
+
+	totalFees, totalSize := 0, 0
 	txPoolToInclude := make([]repository.Transaction, 0)
 
-	for _, tx := range txPool {
-		totalInput, totalOutput := CalculateFeeForTx(tx, uTxOSet)
+	for queue.Len() > 0 {
+		next := heap.Pop(&queue).(miningQueueItem)
+		candidate := next.candidate
+		// a candidate is queued again whenever its package changes, only its latest package counts
+		if candidate.included || next.version != candidate.version {
+			continue
+		}
 
-		if totalInput-totalOutput >= TRANSACTION_FEE {
-			txPoolToInclude = append(txPoolToInclude, tx)
-			totalFees += totalInput - totalOutput
+		// a package that does not fit now is queued again if its ancestors are picked and it gets smaller
+		if candidate.pkgFee < TRANSACTION_FEE*candidate.pkgCount || (maxSize > 0 && totalSize+candidate.pkgSize > maxSize) ||
+			(maxCount > 0 && len(txPoolToInclude)+candidate.pkgCount > maxCount) {
+			continue
+		}
+
+		for _, c := range candidate.pkg() {
+			c.included = true
+			txPoolToInclude = append(txPoolToInclude, c.tx)
+			totalFees += c.fee
+			totalSize += c.size
+
+			for _, descendant := range c.descendants {
+				if descendant.included {
+					continue
+				}
+				descendant.pkgFee -= c.fee
+				descendant.pkgSize -= c.size
+				descendant.pkgCount--
+				descendant.version++
+				heap.Push(&queue, descendant.queued())
+			}
 		}
 	}
 
 	return totalFees, txPoolToInclude
 }
 
+// miningCandidate is a pool tx with its fee and size, its pool ancestors and descendants, and the totals of the package it
+// forms with its ancestors that are not picked yet
+type miningCandidate struct {
+	tx          repository.Transaction
+	fee         int
+	size        int
+	order       int
+	ancestors   []*miningCandidate
+	descendants []*miningCandidate
+
+	pkgFee   int
+	pkgSize  int
+	pkgCount int
+	included bool
+	version  int
+}
+
+// newMiningCandidates returns the txs of txPool that spend outputs of uTxOSet or of other txs in txPool, in dependency
+// order
+func newMiningCandidates(txPool []repository.Transaction, uTxOSet repository.UTxOSetType) []*miningCandidate {
+	uTxOSet = repository.CopyUTxOSetFrom(uTxOSet)
+	byID := make(map[repository.TxIDType]*miningCandidate, len(txPool))
+	candidates := make([]*miningCandidate, 0, len(txPool))
+
+	for _, tx := range SortTransactionsByDependency(txPool) {
+		fee, err := FeeForTx(tx, uTxOSet)
+		if err != nil {
+			continue
+		}
+
+		candidate := &miningCandidate{tx: tx, fee: fee, size: SerializedSize(tx), order: len(candidates)}
+		ancestors := make(map[*miningCandidate]bool)
+		for _, txIn := range tx.TxIns {
+			parent, ok := byID[repository.TxIDType(txIn.TxID)]
+			if !ok {
+				continue
+			}
+
+			ancestors[parent] = true
+			for _, ancestor := range parent.ancestors {
+				ancestors[ancestor] = true
+			}
+		}
+
+		candidate.pkgFee, candidate.pkgSize, candidate.pkgCount = candidate.fee, candidate.size, 1
+		for ancestor := range ancestors {
+			candidate.ancestors = append(candidate.ancestors, ancestor)
+			ancestor.descendants = append(ancestor.descendants, candidate)
+			candidate.pkgFee += ancestor.fee
+			candidate.pkgSize += ancestor.size
+			candidate.pkgCount++
+		}
+
+		byID[repository.TxIDType(tx.ID)] = candidate
+		candidates = append(candidates, candidate)
+		ApplyTransactionCopy(tx, uTxOSet, 0, 0)
+	}
+
+	return candidates
+}
+
+// pkg returns the candidate and its ancestors that are not picked yet, ancestors first
+func (c *miningCandidate) pkg() []*miningCandidate {
+	pkg := make([]*miningCandidate, 0, c.pkgCount)
+	for _, ancestor := range c.ancestors {
+		if !ancestor.included {
+			pkg = append(pkg, ancestor)
+		}
+	}
+
+	sort.Slice(pkg, func(i, j int) bool { return pkg[i].order < pkg[j].order })
+	return append(pkg, c)
+}
+
+func (c *miningCandidate) queued() miningQueueItem {
+	return miningQueueItem{candidate: c, fee: c.pkgFee, size: c.pkgSize, version: c.version}
+}
+
+// miningQueueItem is a candidate with its package totals at the time it was queued
+type miningQueueItem struct {
+	candidate *miningCandidate
+	fee       int
+	size      int
+	version   int
+}
+
+// miningQueue is a heap of candidates, highest package fee rate first and the first in dependency order among equals
+type miningQueue []miningQueueItem
+
+func (q miningQueue) Len() int { return len(q) }
+
+func (q miningQueue) Less(i, j int) bool {
+	if HasHigherFeeRate(q[i].fee, q[i].size, q[j].fee, q[j].size) {
+		return true
+	}
+	if HasHigherFeeRate(q[j].fee, q[j].size, q[i].fee, q[i].size) {
+		return false
+	}
+	return q[i].candidate.order < q[j].candidate.order
+}
+
+func (q miningQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *miningQueue) Push(item interface{}) { *q = append(*q, item.(miningQueueItem)) }
+
+func (q *miningQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func hasUTxOsForTxIns(tx repository.Transaction, uTxOSet repository.UTxOSetType) bool {
+	for _, txIn := range tx.TxIns {
+		if _, err := getUTxOFromTxIn(txIn, uTxOSet); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 func CalculateFeeForTx(tx repository.Transaction, uTxOSet repository.UTxOSetType) (int, int) {
 	totalInput := 0
 	totalOutput := 0
@@ -217,13 +639,45 @@ func CalculateFeeForTx(tx repository.Transaction, uTxOSet repository.UTxOSetType
 	return totalInput, totalOutput
 }
 
-func IsValidCoinbaseTransaction(tx repository.Transaction, otherTxs []repository.Transaction) error {
+// BlockTxFees is the total of the fees of the txs of a block, spending from uTxOSet in the order of the block
+func BlockTxFees(txs []repository.Transaction, uTxOSet repository.UTxOSetType) (int, error) {
+	uTxOSet = repository.CopyUTxOSetFrom(uTxOSet)
+
+	totalFees := 0
+	for _, tx := range txs {
+		if err := checkDuplicateTxIns(tx.TxIns); err != nil {
+			return 0, err
+		}
+
+		fee, err := FeeForTx(tx, uTxOSet)
+		if err != nil {
+			return 0, err
+		}
+		if fee < 0 {
+			return 0, fmt.Errorf("tx %x spends more than its inputs", tx.ID)
+		}
+		if totalFees, err = addAmount(totalFees, fee); err != nil {
+			return 0, err
+		}
+
+		ApplyTransactionCopy(tx, uTxOSet, 0, 0)
+	}
+
+	return totalFees, nil
+}
+
+// IsValidCoinbaseTransaction checks that the coinbase tx collects the fees of the other txs of its block, which spend
+// from uTxOSet
+func IsValidCoinbaseTransaction(tx repository.Transaction, otherTxs []repository.Transaction, uTxOSet repository.UTxOSetType) error {
 	if len(tx.TxOuts) != 1 {
 		return fmt.Errorf("Invalid coinbase transaction txOuts length > 0")
 	}
 
 	fees := tx.TxOuts[0].Value - COINBASE_TRANSACTION_AMOUNT
-	totalFees, _ := CalculateTotalTxFees(otherTxs)
+	totalFees, err := BlockTxFees(otherTxs, uTxOSet)
+	if err != nil {
+		return fmt.Errorf("Invalid coinbase transaction. error: %s", err)
+	}
 
 	if fees != totalFees {
 		return fmt.Errorf("Invalid coinbase transaction. Fees are incorrect")
@@ -237,13 +691,13 @@ func IsValidCoinbaseTransaction(tx repository.Transaction, otherTxs []repository
 	return nil
 }
 
-func VerifyTransactionAmount(tx repository.Transaction) error {
-	return VerifyTransactionAmountCopy(tx, repository.GetEntireUTxOSet())
-}
-
+// VerifyTransactionAmountCopy checks that the outputs of tx do not spend more than the uTxOs its inputs refer to
 func VerifyTransactionAmountCopy(tx repository.Transaction, uTxOSet repository.UTxOSetType) error {
-	totalAmountFromUTxOs := 0
+	if err := checkDuplicateTxIns(tx.TxIns); err != nil {
+		return err
+	}
 
+	totalAmountFromUTxOs := 0
 	for _, txIn := range tx.TxIns {
 		spenderUTxO, err := getUTxOFromTxIn(txIn, uTxOSet)
 		if err != nil {
@@ -253,31 +707,40 @@ func VerifyTransactionAmountCopy(tx repository.Transaction, uTxOSet repository.U
 		if err := IsValidTxOutStructure(*spenderUTxO); err != nil {
 			return err
 		}
-		totalAmountFromUTxOs += spenderUTxO.Value
+		if totalAmountFromUTxOs, err = addAmount(totalAmountFromUTxOs, spenderUTxO.Value); err != nil {
+			return err
+		}
 	}
 
-	if tx.TxOuts[0].Value > totalAmountFromUTxOs {
-		return fmt.Errorf("unspent transaction output does not have enough coin")
+	totalAmountToTxOs := 0
+	for _, txO := range tx.TxOuts {
+		var err error
+		if totalAmountToTxOs, err = addAmount(totalAmountToTxOs, txO.Value); err != nil {
+			return err
+		}
+	}
+
+	if totalAmountToTxOs > totalAmountFromUTxOs {
+		return fmt.Errorf("unspent transaction outputs do not have enough coin: outputs spend %d of %d", totalAmountToTxOs, totalAmountFromUTxOs)
 	}
 
 	return nil
 }
 
-func IsValidTxIn(txIn repository.TxIn, uTxOSet repository.UTxOSetType, txID []byte) error {
-	spenderTx, ok := uTxOSet[repository.TxIDType(txIn.TxID)]
-	if !ok {
-		return fmt.Errorf("Invalid txIn - no tx for in set for txID in txIn")
+// addAmount adds value to total, failing for a negative value or a total that would overflow
+func addAmount(total int, value int) (int, error) {
+	if value < 0 {
+		return total, fmt.Errorf("amount %d is negative", value)
 	}
-
-	if txIn.TxOIndex >= len(spenderTx.TxOuts) {
-		return fmt.Errorf("Invalid txIn - referenced txO index does not exist")
+	if value > math.MaxInt64-total {
+		return total, fmt.Errorf("amount %d overflows the total of %d", value, total)
 	}
 
-	uTxO := spenderTx.TxOuts[txIn.TxOIndex]
-	if err := VerifySignature(txIn.ScriptSignature, uTxO.ScriptPubKey, txID); err != nil {
-		return fmt.Errorf("Invalid transaction - signature verification failed: %+v", err.Error())
+	return total + value, nil
+}
 
-	}
+func IsValidTxIn(tx repository.Transaction, inputIndex int, uTxOSet repository.UTxOSetType, flags ScriptFlags) error {
+	txIn := tx.TxIns[inputIndex]
 
 	if len(txIn.TxID) == 0 {
 		return fmt.Errorf("txIn UTxO TxID cannot be empty")
@@ -287,6 +750,15 @@ func IsValidTxIn(txIn repository.TxIn, uTxOSet repository.UTxOSetType, txID []by
 		return fmt.Errorf("txIn Signature cannot be empty")
 	}
 
+	uTxO, err := getUTxOFromTxIn(txIn, uTxOSet)
+	if err != nil {
+		return err
+	}
+
+	if err := VerifyScript(txIn.ScriptSignature, tx, inputIndex, *uTxO, flags); err != nil {
+		return fmt.Errorf("Invalid transaction - script verification failed: %+v", err.Error())
+	}
+
 	return nil
 }
 
@@ -296,16 +768,20 @@ func getUTxOFromTxIn(txIn repository.TxIn, uTxOSet repository.UTxOSetType) (*rep
 		return nil, fmt.Errorf("Invalid txIn - no tx for in set for txID in txIn")
 	}
 
-	if txIn.TxOIndex >= len(spenderTx.TxOuts) {
+	if txIn.TxOIndex < 0 || txIn.TxOIndex >= len(spenderTx.TxOuts) {
 		return nil, fmt.Errorf("Invalid txIn - referenced txO index does not exist")
 	}
 
+	if spenderTx.TxOuts[txIn.TxOIndex].IsSpent() {
+		return nil, fmt.Errorf("Invalid txIn - referenced txO is spent")
+	}
+
 	return &spenderTx.TxOuts[txIn.TxOIndex], nil
 }
 
-func AreValidTxIns(tx repository.Transaction, uTxOSet repository.UTxOSetType) error {
-	for index, txIn := range tx.TxIns {
-		if err := IsValidTxIn(txIn, uTxOSet, tx.ID); err != nil {
+func AreValidTxIns(tx repository.Transaction, uTxOSet repository.UTxOSetType, flags ScriptFlags) error {
+	for index := range tx.TxIns {
+		if err := IsValidTxIn(tx, index, uTxOSet, flags); err != nil {
 			return fmt.Errorf("error in txIn number %d. error: %+v", index, err)
 		}
 	}
@@ -315,7 +791,20 @@ func AreValidTxIns(tx repository.Transaction, uTxOSet repository.UTxOSetType) er
 
 func IsValidTxOutStructure(txOut repository.TxO) error {
 	if len(txOut.ScriptPubKey) == 0 {
-		return fmt.Errorf("invalid txOut: address must be valid public key")
+		return fmt.Errorf("invalid txOut: scriptPubKey cannot be empty")
+	}
+
+	lockingScript, err := ParseLockingScript(txOut.ScriptPubKey)
+	if err != nil {
+		return fmt.Errorf("invalid txOut: %s", err)
+	}
+
+	// coins sent to an unspendable output would be burnt, so data carriers must not hold any
+	if lockingScript.IsUnspendable() {
+		if txOut.Value != 0 {
+			return fmt.Errorf("invalid txOut: unspendable output must have a 0 amount")
+		}
+		return nil
 	}
 
 	if txOut.Value <= 0 {
@@ -326,10 +815,20 @@ func IsValidTxOutStructure(txOut repository.TxO) error {
 }
 
 func AreValidTxOuts(txOuts []repository.TxO) error {
+	dataCarriers := 0
+
 	for index, txOut := range txOuts {
 		if err := IsValidTxOutStructure(txOut); err != nil {
 			return fmt.Errorf("invalid txOut number %d. error: %+v", index, err)
 		}
+
+		if _, ok := DataCarrierPayload(txOut.ScriptPubKey); ok {
+			dataCarriers++
+		}
+	}
+
+	if dataCarriers > 1 {
+		return fmt.Errorf("invalid txOuts: only one data carrier output allowed per tx, got %d", dataCarriers)
 	}
 
 	return nil
@@ -340,113 +839,117 @@ type TxIDIndexPair struct {
 	TxOIndex int
 }
 
-// finding the senders UTxOs that can service the Tx amount - currently the strategy is simply to take the first set of uTxOs
-// that is not already included in the txPool. If the tx is in the txPool, we will alter the txOs and the index will not be correct for
-// the next txIn - TODO: think of something smarter
+// FindUTxOs finds the wallet's uTxOs to pay amount and the minimum tx fee with, largest first
 func (w *Wallet) FindUTxOs(amount int) ([]TxIDIndexPair, int, error) {
-	spenderLedger := repository.GetUserLedger(w.Crypt.FirstcoinAddress)
-	uTxOs := make([]TxIDIndexPair, 0)
-
-	totalAmount := 0
-
-	for _, tx := range spenderLedger {
-		for index, uTxO := range tx.TxOuts {
-			if totalAmount < amount+TRANSACTION_FEE && !isUTxOInTxPool(tx.ID) && uTxOBelongsToSpender(uTxO, w.Crypt.FirstcoinAddress) {
-				uTxOs = append(uTxOs, TxIDIndexPair{
-					TxID:     tx.ID,
-					TxOIndex: index,
-				})
-				totalAmount += uTxO.Value
-				break
+	return w.findUTxOs(w.Crypt.ScriptPubKey, amount, w.PendingUTxOSet(w.UTxOSet.Copy()))
+}
 
-			}
+// findUTxOs selects, largest first, the uTxOs locked to scriptPubKey that pay amount and a flat fee of TRANSACTION_FEE
+func (w *Wallet) findUTxOs(scriptPubKey []byte, amount int, uTxOSet repository.UTxOSetType) ([]TxIDIndexPair, int, error) {
+	uTxOs := spendableUTxOs(scriptPubKey, uTxOSet, w.spentOutpoints())
 
-			if totalAmount >= amount+TRANSACTION_FEE {
-				return uTxOs, totalAmount, nil
-			}
+	selection, err := LargestFirst{}.SelectCoins(uTxOs, CoinSelectionTarget{Amount: amount})
+	if err != nil {
+		totalAmount := 0
+		for _, uTxO := range uTxOs {
+			totalAmount += uTxO.Value
 		}
+		return nil, totalAmount, err
 	}
 
-	if totalAmount < amount {
-		return nil, totalAmount, fmt.Errorf("insufficient funds or no available uTxOs")
-	}
-
-	if totalAmount < amount+TRANSACTION_FEE {
-		return nil, totalAmount, fmt.Errorf("insufficient funds to include the tx fee of 1 coin")
+	totalAmount := 0
+	for _, uTxO := range selection {
+		totalAmount += uTxO.Value
 	}
 
-	return uTxOs, totalAmount, nil
-}
-
-func uTxOBelongsToSpender(uTxO repository.TxO, spenderPublicKey []byte) bool {
-	return reflect.DeepEqual(uTxO.ScriptPubKey, spenderPublicKey)
+	return orderTxIns(selection), totalAmount, nil
 }
 
-// can only send to one receiver, and can get change. Bitcoin protocol allows for multiple receivers and senders in one tx. Potential TODO.
-func (w *Wallet) GetTxOs(amount int, receiverAddress []byte, txIns []repository.TxIn) ([]repository.TxO, error) {
-	txOs := make([]repository.TxO, 0)
+// spendableUTxOs lists the uTxOs locked to scriptPubKey, leaving out the outpoints in spent that the txPool or a pending
+// tx spends
+func spendableUTxOs(scriptPubKey []byte, uTxOSet repository.UTxOSetType, spent map[string]bool) []SpendableUTxO {
+	uTxOs := make([]SpendableUTxO, 0)
 
-	valid, totalAmount := w.validateTxInsCanServiceAmount(txIns, amount)
-	if !valid {
-		return nil, fmt.Errorf("uTxOs cannot service amount. uTxO total: %d. amount: %d", totalAmount, amount)
-	}
+	for _, tx := range repository.GetUserLedgerCopy(scriptPubKey, uTxOSet) {
+		for index, uTxO := range tx.TxOuts {
+			if spent[repository.TxIn{TxID: tx.ID, TxOIndex: index}.Outpoint()] {
+				continue
+			}
 
-	txO := repository.TxO{
-		ScriptPubKey: receiverAddress,
-		Value:        amount,
+			if uTxOBelongsToSpender(uTxO, scriptPubKey) {
+				uTxOs = append(uTxOs, SpendableUTxO{
+					TxID:     tx.ID,
+					TxOIndex: index,
+					Value:    uTxO.Value,
+				})
+			}
+		}
 	}
 
-	txOs = append(txOs, txO)
+	return uTxOs
+}
 
-	change := 0
-	// deduct the difference between the total amount and the amount required, and add that as a repository.TxO to go back to the spender (as change)
-	if totalAmount > amount+TRANSACTION_FEE {
-		change = totalAmount - (amount + TRANSACTION_FEE)
-		changeTxO := repository.TxO{
-			ScriptPubKey: w.Crypt.FirstcoinAddress,
-			Value:        change,
+// orderTxIns orders the selected uTxOs by tx id and index, so that the inputs of a tx do not depend on map order
+func orderTxIns(selection []SpendableUTxO) []TxIDIndexPair {
+	ordered := append([]SpendableUTxO{}, selection...)
+	sort.Slice(ordered, func(i, j int) bool {
+		if c := bytes.Compare(ordered[i].TxID, ordered[j].TxID); c != 0 {
+			return c < 0
 		}
+		return ordered[i].TxOIndex < ordered[j].TxOIndex
+	})
 
-		txOs = append(txOs, changeTxO)
+	txIDIndexPairs := make([]TxIDIndexPair, 0, len(ordered))
+	for _, uTxO := range ordered {
+		txIDIndexPairs = append(txIDIndexPairs, TxIDIndexPair{TxID: uTxO.TxID, TxOIndex: uTxO.TxOIndex})
 	}
 
-	return txOs, nil
+	return txIDIndexPairs
 }
 
-func (w *Wallet) validateTxInsCanServiceAmount(txIns []repository.TxIn, amount int) (bool, int) {
-	totalAmount := 0
+func uTxOBelongsToSpender(uTxO repository.TxO, spenderScriptPubKey []byte) bool {
+	return reflect.DeepEqual(uTxO.ScriptPubKey, spenderScriptPubKey)
+}
 
-	for _, txIn := range txIns {
-		spenderTxs := repository.GetUserLedger(w.Crypt.FirstcoinAddress)
-		tx := spenderTxs[repository.TxIDType(txIn.TxID)]
-		totalAmount += tx.TxOuts[txIn.TxOIndex].Value
+func totalPaymentAmount(payments []Payment) (int, error) {
+	if len(payments) == 0 {
+		return 0, fmt.Errorf("a transaction needs at least one payment")
 	}
 
-	return totalAmount >= amount+TRANSACTION_FEE, totalAmount
+	amount := 0
+	for _, payment := range payments {
+		if payment.Amount <= 0 {
+			return 0, fmt.Errorf("invalid payment to %s: amount must be > 0", payment.Address)
+		}
+		amount += payment.Amount
+	}
+
+	return amount, nil
 }
 
-func isUTxOInTxPool(txID []byte) bool {
-	txPool := repository.GetTxPool()
+// spentOutpoints are the outputs that the tx pool or the wallet's pending and reserved txs spend
+func (w *Wallet) spentOutpoints() map[string]bool {
+	spent := make(map[string]bool)
 
-	for _, tx := range txPool {
+	txs := append(w.TxPool.Array(), w.Pending.txs...)
+	for _, tx := range append(txs, w.Pending.reservedTxs()...) {
 		for _, txIn := range tx.TxIns {
-			if reflect.DeepEqual(txIn.TxID, txID) {
-				return true
-			}
+			spent[txIn.Outpoint()] = true
 		}
 	}
 
-	return false
+	return spent
 }
 
-func GetTotalAmount(publicKey []byte) int {
-	userLedger := repository.GetUserLedger(publicKey)
+// GetTotalAmount is the value of the outputs locked to scriptPubKey in uTxOSet
+func GetTotalAmount(scriptPubKey []byte, uTxOSet repository.UTxOSetType) int {
+	userLedger := repository.GetUserLedgerCopy(scriptPubKey, uTxOSet)
 
 	totalAmount := 0
 
 	for _, tx := range userLedger {
 		for _, uTxO := range tx.TxOuts {
-			if reflect.DeepEqual(uTxO.ScriptPubKey, publicKey) {
+			if reflect.DeepEqual(uTxO.ScriptPubKey, scriptPubKey) {
 				totalAmount += uTxO.Value
 			}
 		}
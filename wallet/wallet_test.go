@@ -3,6 +3,7 @@ package wallet_test
 import (
 	"firstcoin/repository"
 	"firstcoin/wallet"
+	"math"
 	"reflect"
 	"sort"
 	"testing"
@@ -20,7 +21,7 @@ func TestCreateCoinbaseTransaction(t *testing.T) {
 
 		txOut := repository.TxO{
 			Value:        wallet.COINBASE_TRANSACTION_AMOUNT,
-			ScriptPubKey: crypt.FirstcoinAddress,
+			ScriptPubKey: crypt.ScriptPubKey,
 		}
 		txOuts = append(txOuts, txOut)
 
@@ -34,7 +35,7 @@ func TestCreateCoinbaseTransaction(t *testing.T) {
 		txID := wallet.GenerateTransactionID(expectedTx)
 		expectedTx.ID = txID
 
-		if err := wallet.IsValidCoinbaseTransaction(coinbaseTx, []repository.Transaction{}); err != nil {
+		if err := wallet.IsValidCoinbaseTransaction(coinbaseTx, []repository.Transaction{}, testUTxOSet.Copy()); err != nil {
 			t.Fatalf("coinbase Tx not valid %s", err.Error())
 		}
 
@@ -46,6 +47,23 @@ func TestCreateCoinbaseTransaction(t *testing.T) {
 			t.Fatalf("coinbase Tx TxOuts not equal to expected Tx TxOuts")
 		}
 	})
+
+	t.Run("invalidate coinbase tx - fees of a block tx spending unknown outputs", func(t *testing.T) {
+		crypt := wallet.NewCryptographic()
+		crypt.GenerateKeyPair()
+
+		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
+
+		tx := repository.Transaction{
+			TxIns:  []repository.TxIn{{TxID: []byte("unknown"), TxOIndex: 0}},
+			TxOuts: []repository.TxO{{ScriptPubKey: crypt.ScriptPubKey, Value: 1}},
+		}
+		tx.ID = wallet.GenerateTransactionID(tx)
+
+		if err := wallet.IsValidCoinbaseTransaction(coinbaseTx, []repository.Transaction{tx}, testUTxOSet.Copy()); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
 }
 
 func TestCreateTransaction(t *testing.T) {
@@ -59,7 +77,7 @@ func TestCreateTransaction(t *testing.T) {
 		amount := 8
 
 		coinbaseTx, now := wallet.CreateCoinbaseTransaction(*senderCrypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		txIns := make([]repository.TxIn, 0)
 		txOuts := make([]repository.TxO, 0)
@@ -73,11 +91,11 @@ func TestCreateTransaction(t *testing.T) {
 		txIns = append(txIns, txIn)
 
 		txOutReceiver := repository.TxO{
-			ScriptPubKey: receiverCrypt.FirstcoinAddress,
+			ScriptPubKey: receiverCrypt.ScriptPubKey,
 			Value:        amount,
 		}
 		txOutSenderChange := repository.TxO{
-			ScriptPubKey: senderCrypt.FirstcoinAddress,
+			ScriptPubKey: senderCrypt.ScriptPubKey,
 			Value:        wallet.COINBASE_TRANSACTION_AMOUNT - amount,
 		}
 		txOuts = append(txOuts, txOutReceiver)
@@ -89,7 +107,7 @@ func TestCreateTransaction(t *testing.T) {
 			TxOuts: txOuts,
 		}
 
-		senderWallet := wallet.NewWallet(*senderCrypt)
+		senderWallet := wallet.NewWallet(*senderCrypt, testUTxOSet, testTxPool)
 
 		tx, now, _ := senderWallet.CreateTransaction(receiverCrypt.FirstcoinAddress, amount)
 
@@ -99,9 +117,9 @@ func TestCreateTransaction(t *testing.T) {
 
 		expectedSenderTx.ID = expectedTxID
 
-		txIns[0].ScriptSignature = senderWallet.GenerateTxSigScript(expectedTxID)
+		txIns[0].ScriptSignature = senderWallet.GenerateTxSigScript(expectedTxID, wallet.SigHashAll)
 
-		if err := wallet.IsValidTransaction(*tx); err != nil {
+		if err := wallet.IsValidTransactionCopy(*tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err != nil {
 			t.Fatalf("Test failed: %+v", err)
 		}
 
@@ -132,7 +150,7 @@ func TestCreateTransaction(t *testing.T) {
 		amount := wallet.COINBASE_TRANSACTION_AMOUNT + 1
 
 		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*senderCrypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		txIns := make([]repository.TxIn, 0)
 		txOuts := make([]repository.TxO, 0)
@@ -146,17 +164,17 @@ func TestCreateTransaction(t *testing.T) {
 		txIns = append(txIns, txIn)
 
 		txOutReceiver := repository.TxO{
-			ScriptPubKey: receiverCrypt.FirstcoinAddress,
+			ScriptPubKey: receiverCrypt.ScriptPubKey,
 			Value:        amount,
 		}
 		txOutSenderChange := repository.TxO{
-			ScriptPubKey: senderCrypt.FirstcoinAddress,
+			ScriptPubKey: senderCrypt.ScriptPubKey,
 			Value:        wallet.COINBASE_TRANSACTION_AMOUNT - amount,
 		}
 		txOuts = append(txOuts, txOutReceiver)
 		txOuts = append(txOuts, txOutSenderChange)
 
-		senderWallet := wallet.NewWallet(*senderCrypt)
+		senderWallet := wallet.NewWallet(*senderCrypt, testUTxOSet, testTxPool)
 
 		_, _, err := senderWallet.CreateTransaction(receiverCrypt.FirstcoinAddress, amount)
 		if err == nil {
@@ -174,7 +192,7 @@ func TestCreateTransaction(t *testing.T) {
 		amount := 8
 
 		coinbaseTx, now := wallet.CreateCoinbaseTransaction(*senderCrypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		txIns := make([]repository.TxIn, 0)
 		txOuts := make([]repository.TxO, 0)
@@ -188,11 +206,11 @@ func TestCreateTransaction(t *testing.T) {
 		txIns = append(txIns, txIn)
 
 		txOutReceiver := repository.TxO{
-			ScriptPubKey: receiverCrypt.FirstcoinAddress,
+			ScriptPubKey: receiverCrypt.ScriptPubKey,
 			Value:        amount,
 		}
 		txOutSenderChange := repository.TxO{
-			ScriptPubKey: senderCrypt.FirstcoinAddress,
+			ScriptPubKey: senderCrypt.ScriptPubKey,
 			Value:        wallet.COINBASE_TRANSACTION_AMOUNT - amount,
 		}
 		txOuts = append(txOuts, txOutReceiver)
@@ -204,8 +222,8 @@ func TestCreateTransaction(t *testing.T) {
 			TxOuts: txOuts,
 		}
 
-		senderWallet := wallet.NewWallet(*senderCrypt)
-		receiverWallet := wallet.NewWallet(*receiverCrypt)
+		senderWallet := wallet.NewWallet(*senderCrypt, testUTxOSet, testTxPool)
+		receiverWallet := wallet.NewWallet(*receiverCrypt, testUTxOSet, testTxPool)
 
 		tx, now, _ := senderWallet.CreateTransaction(receiverCrypt.FirstcoinAddress, amount)
 
@@ -216,10 +234,10 @@ func TestCreateTransaction(t *testing.T) {
 		expectedSenderTx.ID = expectedTxID
 
 		// changing signature to that of the reciever (anyone other than sender)
-		txIns[0].ScriptSignature = receiverWallet.GenerateTxSigScript(expectedTxID)
+		txIns[0].ScriptSignature = receiverWallet.GenerateTxSigScript(expectedTxID, wallet.SigHashAll)
 		tx.TxIns = txIns
 
-		if err := wallet.IsValidTransaction(*tx); err == nil {
+		if err := wallet.IsValidTransactionCopy(*tx, testUTxOSet.Copy(), wallet.SCRIPT_VERIFY_NONE); err == nil {
 			t.Fatalf("Test failed: expected error")
 		}
 	})
@@ -229,22 +247,22 @@ func TestFindUTxOs(test *testing.T) {
 	test.Run("UTxOs can service the amount and fee", func(t *testing.T) {
 		crypt := wallet.NewCryptographic()
 		crypt.GenerateKeyPair()
-		senderWallet := wallet.NewWallet(*crypt)
+		senderWallet := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
 
 		crypt2 := wallet.NewCryptographic()
 		crypt2.GenerateKeyPair()
-		senderReceiverWallet := wallet.NewWallet(*crypt2)
+		senderReceiverWallet := wallet.NewWallet(*crypt2, testUTxOSet, testTxPool)
 
 		crypt3 := wallet.NewCryptographic()
 		crypt3.GenerateKeyPair()
 
 		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		tx, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 5)
 		tx2, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 6)
-		repository.AddTxToUTxOSet(*tx)
-		repository.AddTxToUTxOSet(*tx2)
+		testUTxOSet.Add(*tx)
+		testUTxOSet.Add(*tx2)
 
 		uTxOs, _, err := senderReceiverWallet.FindUTxOs(10)
 		if err != nil {
@@ -278,19 +296,19 @@ func TestFindUTxOs(test *testing.T) {
 	test.Run("UTxOs cannot service the amount - insufficient funds", func(t *testing.T) {
 		crypt := wallet.NewCryptographic()
 		crypt.GenerateKeyPair()
-		senderWallet := wallet.NewWallet(*crypt)
+		senderWallet := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
 
 		crypt2 := wallet.NewCryptographic()
 		crypt2.GenerateKeyPair()
-		senderReceiverWallet := wallet.NewWallet(*crypt2)
+		senderReceiverWallet := wallet.NewWallet(*crypt2, testUTxOSet, testTxPool)
 
 		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		tx, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 5)
 		tx2, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 5)
-		repository.AddTxToUTxOSet(*tx)
-		repository.AddTxToUTxOSet(*tx2)
+		testUTxOSet.Add(*tx)
+		testUTxOSet.Add(*tx2)
 
 		_, _, err := senderReceiverWallet.FindUTxOs(11)
 		if err == nil || (err != nil && err.Error() != "insufficient funds or no available uTxOs") {
@@ -301,19 +319,19 @@ func TestFindUTxOs(test *testing.T) {
 	test.Run("UTxOs cannot service the amount - not enough for service fee", func(t *testing.T) {
 		crypt := wallet.NewCryptographic()
 		crypt.GenerateKeyPair()
-		senderWallet := wallet.NewWallet(*crypt)
+		senderWallet := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
 
 		crypt2 := wallet.NewCryptographic()
 		crypt2.GenerateKeyPair()
-		senderReceiverWallet := wallet.NewWallet(*crypt2)
+		senderReceiverWallet := wallet.NewWallet(*crypt2, testUTxOSet, testTxPool)
 
 		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		tx, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 5)
 		tx2, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 5)
-		repository.AddTxToUTxOSet(*tx)
-		repository.AddTxToUTxOSet(*tx2)
+		testUTxOSet.Add(*tx)
+		testUTxOSet.Add(*tx2)
 
 		_, _, err := senderReceiverWallet.FindUTxOs(10)
 		if err == nil || (err != nil && err.Error() != "insufficient funds to include the tx fee of 1 coin") {
@@ -331,13 +349,13 @@ func TestGetTxOs(test *testing.T) {
 
 		crypt := wallet.NewCryptographic()
 		crypt.GenerateKeyPair()
-		senderWallet := wallet.NewWallet(*crypt)
+		senderWallet := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
 
 		crypt2 := wallet.NewCryptographic()
 		crypt2.GenerateKeyPair()
 
 		coinbaseTx, _ := wallet.CreateCoinbaseTransaction(*crypt, 0)
-		repository.AddTxToUTxOSet(coinbaseTx)
+		testUTxOSet.Add(coinbaseTx)
 
 		tx, _, _ := senderWallet.CreateTransaction(crypt2.FirstcoinAddress, 6)
 
@@ -348,12 +366,12 @@ func TestGetTxOs(test *testing.T) {
 		})
 
 		expectedTxO1 := repository.TxO{
-			ScriptPubKey: crypt.FirstcoinAddress,
+			ScriptPubKey: crypt.ScriptPubKey,
 			Value:        wallet.COINBASE_TRANSACTION_AMOUNT - amount - wallet.TRANSACTION_FEE,
 		}
 
 		expectedTxO2 := repository.TxO{
-			ScriptPubKey: crypt2.FirstcoinAddress,
+			ScriptPubKey: crypt2.ScriptPubKey,
 			Value:        amount,
 		}
 
@@ -366,3 +384,129 @@ func TestGetTxOs(test *testing.T) {
 		}
 	})
 }
+
+func TestApplyTransactionCopy(t *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+	w := wallet.NewWallet(*crypt, testUTxOSet, testTxPool)
+
+	parent := repository.Transaction{
+		TxOuts: []repository.TxO{
+			{ScriptPubKey: crypt.ScriptPubKey, Value: 10},
+			{ScriptPubKey: crypt.ScriptPubKey, Value: 20},
+			{ScriptPubKey: crypt.ScriptPubKey, Value: 30},
+		},
+	}
+	parent.ID = wallet.GenerateTransactionID(parent)
+
+	// spend returns a signed tx spending the outputs of parent at indexes, valid against a set holding parent
+	spend := func(t *testing.T, indexes ...int) (repository.Transaction, repository.UTxOSetType) {
+		uTxOSet := make(repository.UTxOSetType)
+		repository.AddTxToUTxOSetCopy(parent, uTxOSet)
+
+		tx := repository.Transaction{TxOuts: []repository.TxO{{ScriptPubKey: crypt.ScriptPubKey, Value: 25}}}
+		for _, index := range indexes {
+			tx.TxIns = append(tx.TxIns, repository.TxIn{TxID: parent.ID, TxOIndex: index})
+		}
+		tx.ID = wallet.GenerateTransactionID(tx)
+
+		if _, err := w.SignTransaction(&tx, uTxOSet, wallet.SigHashAll); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return tx, uTxOSet
+	}
+
+	t.Run("spends several outputs of one parent whatever the order of the inputs", func(t *testing.T) {
+		for _, indexes := range [][]int{{0, 1}, {1, 0}} {
+			tx, uTxOSet := spend(t, indexes...)
+
+			if err := wallet.IsValidTransactionCopy(tx, uTxOSet, wallet.SCRIPT_VERIFY_NONE); err != nil {
+				t.Fatalf("unexpected error for inputs %v: %s", indexes, err)
+			}
+			wallet.ApplyTransactionCopy(tx, uTxOSet, 1, 0)
+
+			remaining := uTxOSet[repository.TxIDType(parent.ID)].TxOuts
+			if len(remaining) != 3 || !remaining[0].IsSpent() || !remaining[1].IsSpent() || remaining[2].Value != 30 {
+				t.Errorf("incorrect outputs left of the parent for inputs %v. Got: %v. Want the output of 30 at index 2", indexes, remaining)
+			}
+		}
+	})
+
+	t.Run("keeps the index of the outputs left after a sibling is spent", func(t *testing.T) {
+		first, uTxOSet := spend(t, 0)
+		second, _ := spend(t, 2)
+
+		wallet.ApplyTransactionCopy(first, uTxOSet, 1, 0)
+		if err := wallet.IsValidTransactionCopy(second, uTxOSet, wallet.SCRIPT_VERIFY_NONE); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := wallet.IsValidTransactionCopy(first, uTxOSet, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Errorf("expected an error for an output that is already spent")
+		}
+
+		wallet.ApplyTransactionCopy(second, uTxOSet, 1, 0)
+		remaining := uTxOSet[repository.TxIDType(parent.ID)].TxOuts
+		if len(remaining) != 3 || remaining[1].Value != 20 {
+			t.Errorf("incorrect outputs left of the parent. Got: %v. Want the output of 20 at index 1", remaining)
+		}
+	})
+
+	t.Run("invalidates a tx spending the same output twice", func(t *testing.T) {
+		tx, uTxOSet := spend(t, 1, 1)
+
+		if err := wallet.IsValidTransactionCopy(tx, uTxOSet, wallet.SCRIPT_VERIFY_NONE); err == nil {
+			t.Errorf("expected an error for a duplicate input")
+		}
+	})
+}
+
+func TestVerifyTransactionAmountCopy(t *testing.T) {
+	crypt := wallet.NewCryptographic()
+	crypt.GenerateKeyPair()
+
+	parent := repository.Transaction{
+		TxOuts: []repository.TxO{
+			{ScriptPubKey: crypt.ScriptPubKey, Value: 10},
+			{ScriptPubKey: crypt.ScriptPubKey, Value: 20},
+		},
+	}
+	parent.ID = wallet.GenerateTransactionID(parent)
+
+	uTxOSet := make(repository.UTxOSetType)
+	repository.AddTxToUTxOSetCopy(parent, uTxOSet)
+
+	// spend returns a tx spending the outputs of parent at indexes to outputs of values
+	spend := func(indexes []int, values ...int) repository.Transaction {
+		tx := repository.Transaction{}
+		for _, index := range indexes {
+			tx.TxIns = append(tx.TxIns, repository.TxIn{TxID: parent.ID, TxOIndex: index})
+		}
+		for _, value := range values {
+			tx.TxOuts = append(tx.TxOuts, repository.TxO{ScriptPubKey: crypt.ScriptPubKey, Value: value})
+		}
+
+		return tx
+	}
+
+	t.Run("validates outputs spending up to the inputs", func(t *testing.T) {
+		if err := wallet.VerifyTransactionAmountCopy(spend([]int{0, 1}, 15, 14), uTxOSet); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("invalidates bad amounts", func(t *testing.T) {
+		tests := map[string]repository.Transaction{
+			"the outputs together spend more than the inputs": spend([]int{1}, 10, 11),
+			"an output is negative":                           spend([]int{0, 1}, 40, -15),
+			"the outputs overflow":                            spend([]int{0, 1}, math.MaxInt64, math.MaxInt64, 2),
+			"an output is spent twice":                        spend([]int{1, 1}, 40),
+		}
+
+		for name, tx := range tests {
+			if err := wallet.VerifyTransactionAmountCopy(tx, uTxOSet); err == nil {
+				t.Errorf("expected an error when %s", name)
+			}
+		}
+	})
+}